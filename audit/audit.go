@@ -0,0 +1,206 @@
+package audit
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// Events recorded by the hub.
+const (
+	EventSignal = "signal"
+	EventRelay  = "relay"
+	EventJoin   = "join"
+	EventKick   = "kick"
+)
+
+// Record is one audit entry. It says who did what to whom, not what was
+// sent: PayloadSHA256 is only set when the hub is asked to hash payloads.
+type Record struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Namespace     string    `json:"namespace,omitempty"`
+	From          string    `json:"from"`
+	To            string    `json:"to,omitempty"`
+	PayloadSHA256 string    `json:"payload_sha256,omitempty"`
+}
+
+// Sink receives audit records. Record is called on the hub's hot path, so it
+// must not block; a sink that can't keep up should drop.
+type Sink interface {
+	Record(r Record)
+	Close() error
+}
+
+// DefaultMaxBytes is the size a FileSink's file may grow to before it is
+// rotated, and DefaultBuffer how many records may wait to be written.
+const (
+	DefaultMaxBytes = 100 << 20
+	DefaultBuffer   = 4096
+)
+
+var ErrClosed = errors.New("audit: sink closed")
+
+// FileSink writes records as JSON lines to a file from its own goroutine.
+// Once the file reaches maxBytes it is renamed to path + ".1", replacing
+// the previous one, and a new file started, so at most twice maxBytes is
+// kept. Records arriving while the buffer is full are dropped and counted.
+type FileSink struct {
+	path     string
+	maxBytes int64
+	records  chan Record
+	stop     chan struct{}
+	done     chan struct{}
+	dropped  atomic.Int64
+	once     sync.Once
+
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// NewFile opens (appending to) path and starts writing records to it.
+// maxBytes and buffer default to DefaultMaxBytes and DefaultBuffer when <= 0.
+func NewFile(path string, maxBytes int64, buffer int) (*FileSink, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+	s := &FileSink{
+		path:     path,
+		maxBytes: maxBytes,
+		records:  make(chan Record, buffer),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.w = bufio.NewWriter(f)
+	s.size = info.Size()
+	return nil
+}
+
+// Record queues r without waiting, dropping it if the buffer is full or the
+// sink closed.
+func (s *FileSink) Record(r Record) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	select {
+	case s.records <- r:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Dropped returns how many records were lost to a full buffer.
+func (s *FileSink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+func (s *FileSink) run() {
+	defer close(s.done)
+	for {
+		select {
+		case r := <-s.records:
+			s.write(r)
+			continue
+		default:
+		}
+		// idle, get what's buffered onto disk before waiting
+		s.flush()
+		select {
+		case r := <-s.records:
+			s.write(r)
+		case <-s.stop:
+			for len(s.records) > 0 {
+				s.write(<-s.records)
+			}
+			s.flush()
+			if s.file != nil {
+				s.file.Close()
+			}
+			return
+		}
+	}
+}
+
+func (s *FileSink) write(r Record) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	if s.size > 0 && s.size+int64(len(data)) > s.maxBytes {
+		s.rotate()
+	}
+	n, err := s.w.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		log.Printf("audit: write %s: %v", s.path, err)
+	}
+}
+
+func (s *FileSink) flush() {
+	if err := s.w.Flush(); err != nil {
+		log.Printf("audit: write %s: %v", s.path, err)
+	}
+}
+
+func (s *FileSink) rotate() {
+	s.flush()
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		log.Printf("audit: rotate %s: %v", s.path, err)
+	}
+	if err := s.open(); err != nil {
+		// records are lost until the next rotation retries
+		log.Printf("audit: reopen %s: %v", s.path, err)
+		s.file = nil
+		s.w = bufio.NewWriter(io.Discard)
+		s.size = 0
+	}
+}
+
+// Close writes out the records already queued and closes the file. Records
+// after Close are dropped.
+func (s *FileSink) Close() error {
+	err := ErrClosed
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = nil
+	})
+	return err
+}
@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestFileSinkWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	s.Record(Record{Time: time.Now(), Event: EventSignal, Namespace: "lobby", From: "fp1", To: "fp2"})
+	s.Record(Record{Time: time.Now(), Event: EventKick, Namespace: "room", From: "fp1", To: "fp3"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := s.Close(); err != ErrClosed {
+		t.Errorf("expected ErrClosed on second close, got %v", err)
+	}
+	s.Record(Record{Event: EventJoin, From: "late"})
+
+	lines := readLines(t, path)
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	var r Record
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if r.Event != EventKick || r.To != "fp3" || r.Namespace != "room" {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFile(path, 300, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Record(Record{Time: time.Now(), Event: EventJoin, Namespace: "lobby", From: "fp1"})
+	}
+	s.Close()
+
+	for _, p := range []string{path, path + ".1"} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("stat %s: %v", p, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("%s is %d bytes, over the 300 limit", p, info.Size())
+		}
+	}
+	if n := len(readLines(t, path)); n == 0 || n == 10 {
+		t.Errorf("expected the current file to hold some of the records, got %d", n)
+	}
+}
+
+func TestFileSinkDropsWhenFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFile(path, 0, 1)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		s.Record(Record{Event: EventRelay, From: "fp1", To: "fp2"})
+	}
+	s.Close()
+	written := len(readLines(t, path))
+	if dropped := s.Dropped(); dropped == 0 || int(dropped)+written != 1000 {
+		t.Errorf("expected written + dropped = 1000 with some dropped, got %d + %d", written, dropped)
+	}
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// DefaultAsyncBuffer is how many messages each AsyncLocalBroker subscriber
+// may have waiting before publishes to it fail.
+const DefaultAsyncBuffer = 1024
+
+var ErrSubscriberFull = errors.New("broker: subscriber buffer full")
+
+// AsyncLocalBroker is an in-process broker that, like Redis, delivers on the
+// subscriber's goroutine rather than the publisher's. Each subscription
+// gets its own buffer and goroutine, so messages on a channel reach it in
+// publish order and a slow handler only holds up itself.
+type AsyncLocalBroker struct {
+	subscribers map[string][]*asyncSub
+	buffer      int
+	mu          sync.RWMutex
+}
+
+type asyncSub struct {
+	msgs chan []byte
+	stop chan struct{}
+	once sync.Once
+}
+
+func (s *asyncSub) close() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+// NewAsyncLocal returns an AsyncLocalBroker whose subscribers buffer up to
+// buffer messages, DefaultAsyncBuffer if buffer <= 0.
+func NewAsyncLocal(buffer int) *AsyncLocalBroker {
+	if buffer <= 0 {
+		buffer = DefaultAsyncBuffer
+	}
+	return &AsyncLocalBroker{
+		subscribers: make(map[string][]*asyncSub),
+		buffer:      buffer,
+	}
+}
+
+// Publish queues a copy of data for every subscriber of channel without
+// waiting for delivery. A subscriber whose buffer is full misses it, and
+// ErrSubscriberFull is returned.
+func (b *AsyncLocalBroker) Publish(_ context.Context, channel string, data []byte) error {
+	msg := append([]byte(nil), data...)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var err error
+	for _, sub := range b.subscribers[channel] {
+		select {
+		case sub.msgs <- msg:
+		default:
+			err = ErrSubscriberFull
+		}
+	}
+	return err
+}
+
+// Subscribe starts delivering channel to handler until the channel is
+// unsubscribed, the broker closed or ctx cancelled.
+func (b *AsyncLocalBroker) Subscribe(ctx context.Context, channel string, handler MessageHandler) error {
+	sub := &asyncSub{
+		msgs: make(chan []byte, b.buffer),
+		stop: make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.subscribers[channel] = append(b.subscribers[channel], sub)
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case data := <-sub.msgs:
+				deliver(handler, channel, data)
+			case <-sub.stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *AsyncLocalBroker) Unsubscribe(_ context.Context, channel string) error {
+	b.mu.Lock()
+	subs := b.subscribers[channel]
+	delete(b.subscribers, channel)
+	b.mu.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+	return nil
+}
+
+func (b *AsyncLocalBroker) Close() error {
+	b.mu.Lock()
+	all := b.subscribers
+	b.subscribers = make(map[string][]*asyncSub)
+	b.mu.Unlock()
+	for _, subs := range all {
+		for _, sub := range subs {
+			sub.close()
+		}
+	}
+	return nil
+}
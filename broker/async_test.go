@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAsyncLocalDoesNotBlockPublisher(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(_ string, _ []byte) { <-release }
+
+	// the sync broker runs the handler on the publisher
+	direct := NewLocal()
+	defer direct.Close()
+	direct.Subscribe(context.Background(), "chan", slow)
+	published := make(chan struct{})
+	go func() {
+		direct.Publish(context.Background(), "chan", []byte("x"))
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatal("sync publish returned before the handler did")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	b := NewAsyncLocal(0)
+	defer b.Close()
+	var got atomic.Int32
+	b.Subscribe(context.Background(), "chan", func(c string, d []byte) {
+		slow(c, d)
+		got.Add(1)
+	})
+	done := make(chan struct{})
+	go func() {
+		b.Publish(context.Background(), "chan", []byte("x"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("async publish waited for the handler")
+	}
+
+	close(release)
+	<-published
+	deadline := time.After(time.Second)
+	for got.Load() != 1 {
+		select {
+		case <-deadline:
+			t.Fatal("timeout waiting for async delivery")
+		default:
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestAsyncLocalOrder(t *testing.T) {
+	b := NewAsyncLocal(0)
+	defer b.Close()
+
+	const n = 500
+	received := make(chan int, n)
+	b.Subscribe(context.Background(), "chan", func(_ string, data []byte) {
+		i, _ := strconv.Atoi(string(data))
+		received <- i
+	})
+	buf := make([]byte, 0, 8)
+	for i := 0; i < n; i++ {
+		// the broker must copy, the publisher reuses its buffer
+		buf = strconv.AppendInt(buf[:0], int64(i), 10)
+		if err := b.Publish(context.Background(), "chan", buf); err != nil {
+			t.Fatalf("publish %d: %v", i, err)
+		}
+	}
+	for want := 0; want < n; want++ {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected message %d, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %d", want)
+		}
+	}
+}
+
+func TestAsyncLocalSubscriberFull(t *testing.T) {
+	b := NewAsyncLocal(1)
+	defer b.Close()
+
+	release := make(chan struct{})
+	var got atomic.Int32
+	b.Subscribe(context.Background(), "chan", func(_ string, _ []byte) {
+		<-release
+		got.Add(1)
+	})
+
+	var full bool
+	for i := 0; i < 4; i++ {
+		if err := b.Publish(context.Background(), "chan", []byte("x")); err == ErrSubscriberFull {
+			full = true
+		}
+	}
+	close(release)
+	if !full {
+		t.Error("expected ErrSubscriberFull once the buffer filled")
+	}
+}
+
+func TestAsyncLocalUnsubscribe(t *testing.T) {
+	b := NewAsyncLocal(0)
+	defer b.Close()
+
+	var got atomic.Int32
+	b.Subscribe(context.Background(), "chan", func(_ string, _ []byte) { got.Add(1) })
+	b.Unsubscribe(context.Background(), "chan")
+	b.Publish(context.Background(), "chan", []byte("x"))
+	time.Sleep(20 * time.Millisecond)
+	if got.Load() != 0 {
+		t.Errorf("expected no delivery after unsubscribe, got %d", got.Load())
+	}
+}
@@ -1,12 +1,38 @@
 package broker
 
-import "context"
+import (
+	"context"
+	"log"
+	"time"
+)
 
 type MessageHandler func(channel string, data []byte)
 
+// deliver calls handler, recovering a panic so one bad message can't stop
+// delivery on the channel.
+func deliver(handler MessageHandler, channel string, data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("broker: %s handler panic: %v", channel, r)
+		}
+	}()
+	handler(channel, data)
+}
+
 type Broker interface {
 	Publish(ctx context.Context, channel string, data []byte) error
 	Subscribe(ctx context.Context, channel string, handler MessageHandler) error
 	Unsubscribe(ctx context.Context, channel string) error
 	Close() error
 }
+
+// MatchQueue is implemented by brokers that can hold matchmaking queues
+// shared by every node, so peers waiting on different nodes can be matched.
+type MatchQueue interface {
+	// MatchOrEnqueue atomically takes the need oldest entries from queue if
+	// that many are waiting, or else appends entry and returns none. Entries
+	// queued more than maxAge ago are dropped instead of taken.
+	MatchOrEnqueue(ctx context.Context, queue string, entry []byte, need int, maxAge time.Duration) ([][]byte, error)
+	// RemoveFromMatchQueue drops entry from queue if it is still waiting.
+	RemoveFromMatchQueue(ctx context.Context, queue string, entry []byte) error
+}
@@ -1,13 +1,23 @@
 package broker
 
 import (
+	"bytes"
 	"context"
 	"sync"
+	"time"
 )
 
 type LocalBroker struct {
 	subscribers map[string][]MessageHandler
 	mu          sync.RWMutex
+
+	queues  map[string][]queuedEntry
+	queueMu sync.Mutex
+}
+
+type queuedEntry struct {
+	data []byte
+	at   time.Time
 }
 
 func NewLocal() *LocalBroker {
@@ -21,7 +31,7 @@ func (b *LocalBroker) Publish(_ context.Context, channel string, data []byte) er
 	handlers := b.subscribers[channel]
 	b.mu.RUnlock()
 	for _, h := range handlers {
-		h(channel, data)
+		deliver(h, channel, data)
 	}
 	return nil
 }
@@ -40,6 +50,46 @@ func (b *LocalBroker) Unsubscribe(_ context.Context, channel string) error {
 	return nil
 }
 
+// MatchOrEnqueue implements MatchQueue for hubs sharing this broker in one
+// process.
+func (b *LocalBroker) MatchOrEnqueue(_ context.Context, queue string, entry []byte, need int, maxAge time.Duration) ([][]byte, error) {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	if b.queues == nil {
+		b.queues = make(map[string][]queuedEntry)
+	}
+	cutoff := time.Now().Add(-maxAge)
+	waiting := b.queues[queue][:0]
+	for _, e := range b.queues[queue] {
+		if e.at.After(cutoff) {
+			waiting = append(waiting, e)
+		}
+	}
+	if len(waiting) >= need {
+		taken := make([][]byte, need)
+		for i := range taken {
+			taken[i] = waiting[i].data
+		}
+		b.queues[queue] = waiting[need:]
+		return taken, nil
+	}
+	b.queues[queue] = append(waiting, queuedEntry{data: append([]byte(nil), entry...), at: time.Now()})
+	return nil, nil
+}
+
+func (b *LocalBroker) RemoveFromMatchQueue(_ context.Context, queue string, entry []byte) error {
+	b.queueMu.Lock()
+	defer b.queueMu.Unlock()
+	waiting := b.queues[queue]
+	for i, e := range waiting {
+		if bytes.Equal(e.data, entry) {
+			b.queues[queue] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
 func (b *LocalBroker) Close() error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
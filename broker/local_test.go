@@ -42,6 +42,33 @@ func TestLocalPublishSubscribe(t *testing.T) {
 	mu.Unlock()
 }
 
+func TestLocalHandlerPanic(t *testing.T) {
+	b := NewLocal()
+	defer b.Close()
+
+	var received atomic.Int32
+	b.Subscribe(context.Background(), "test-chan", func(channel string, data []byte) {
+		if string(data) == "bad" {
+			panic("bad message")
+		}
+		received.Add(1)
+	})
+	var other atomic.Int32
+	b.Subscribe(context.Background(), "test-chan", func(channel string, data []byte) {
+		other.Add(1)
+	})
+
+	b.Publish(context.Background(), "test-chan", []byte("bad"))
+	b.Publish(context.Background(), "test-chan", []byte("good"))
+
+	if received.Load() != 1 {
+		t.Errorf("expected the panicking handler to keep receiving, got %d", received.Load())
+	}
+	if other.Load() != 2 {
+		t.Errorf("expected the other handler to get both messages, got %d", other.Load())
+	}
+}
+
 func TestLocalPublishNoSubscribers(t *testing.T) {
 	b := NewLocal()
 	defer b.Close()
@@ -155,3 +182,31 @@ func BenchmarkLocalPublish(b *testing.B) {
 		br.Publish(context.Background(), "bench", data)
 	}
 }
+
+func TestLocalMatchQueue(t *testing.T) {
+	b := NewLocal()
+	defer b.Close()
+	ctx := context.Background()
+
+	if taken, _ := b.MatchOrEnqueue(ctx, "q", []byte("a"), 2, time.Minute); taken != nil {
+		t.Fatalf("first entry should wait, took %q", taken)
+	}
+	b.MatchOrEnqueue(ctx, "q", []byte("b"), 2, time.Minute)
+	b.MatchOrEnqueue(ctx, "other", []byte("x"), 1, time.Minute)
+	b.RemoveFromMatchQueue(ctx, "q", []byte("b"))
+	if taken, _ := b.MatchOrEnqueue(ctx, "q", []byte("c"), 2, time.Minute); taken != nil {
+		t.Fatalf("removed entry should not count, took %q", taken)
+	}
+
+	taken, err := b.MatchOrEnqueue(ctx, "q", []byte("d"), 2, time.Minute)
+	if err != nil || len(taken) != 2 || string(taken[0]) != "a" || string(taken[1]) != "c" {
+		t.Fatalf("expected oldest two entries taken, got %q %v", taken, err)
+	}
+
+	// stale entries are dropped rather than matched
+	b.MatchOrEnqueue(ctx, "stale", []byte("old"), 1, time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if taken, _ := b.MatchOrEnqueue(ctx, "stale", []byte("new"), 1, 10*time.Millisecond); taken != nil {
+		t.Errorf("stale entry should not be taken, got %q", taken)
+	}
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// Pinger is implemented by brokers that can report their health.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// MultiBroker fans every operation out to several brokers, e.g. an old and a
+// new Redis during a migration. Handlers receive messages from any of them,
+// so a message published through more than one broker can arrive twice.
+type MultiBroker struct {
+	brokers []Broker
+
+	// AnyHealthy makes Ping succeed while at least one broker answers,
+	// instead of failing as soon as one does not.
+	AnyHealthy bool
+}
+
+func NewMulti(brokers ...Broker) *MultiBroker {
+	return &MultiBroker{brokers: brokers}
+}
+
+func (m *MultiBroker) Publish(ctx context.Context, channel string, data []byte) error {
+	var errs []error
+	for _, b := range m.brokers {
+		if err := b.Publish(ctx, channel, data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiBroker) Subscribe(ctx context.Context, channel string, handler MessageHandler) error {
+	var errs []error
+	for _, b := range m.brokers {
+		if err := b.Subscribe(ctx, channel, handler); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiBroker) Unsubscribe(ctx context.Context, channel string) error {
+	var errs []error
+	for _, b := range m.brokers {
+		if err := b.Unsubscribe(ctx, channel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiBroker) Close() error {
+	var errs []error
+	for _, b := range m.brokers {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Ping checks every broker that implements Pinger; brokers that don't are
+// assumed healthy.
+func (m *MultiBroker) Ping(ctx context.Context) error {
+	var errs []error
+	for _, b := range m.brokers {
+		p, ok := b.(Pinger)
+		if !ok {
+			if m.AnyHealthy {
+				return nil
+			}
+			continue
+		}
+		err := p.Ping(ctx)
+		if err == nil && m.AnyHealthy {
+			return nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
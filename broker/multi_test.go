@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+type pingBroker struct {
+	*LocalBroker
+	err error
+}
+
+func (b *pingBroker) Ping(context.Context) error { return b.err }
+
+func TestMultiPublishReachesEachBroker(t *testing.T) {
+	b1 := NewLocal()
+	b2 := NewLocal()
+	m := NewMulti(b1, b2)
+	defer m.Close()
+
+	var got1, got2 atomic.Int32
+	b1.Subscribe(context.Background(), "chan", func(_ string, _ []byte) { got1.Add(1) })
+	b2.Subscribe(context.Background(), "chan", func(_ string, _ []byte) { got2.Add(1) })
+
+	if err := m.Publish(context.Background(), "chan", []byte("hello")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if got1.Load() != 1 || got2.Load() != 1 {
+		t.Errorf("expected one delivery per broker, got %d and %d", got1.Load(), got2.Load())
+	}
+}
+
+func TestMultiSubscribeReceivesFromAny(t *testing.T) {
+	b1 := NewLocal()
+	b2 := NewLocal()
+	m := NewMulti(b1, b2)
+	defer m.Close()
+
+	var got atomic.Int32
+	m.Subscribe(context.Background(), "chan", func(_ string, _ []byte) { got.Add(1) })
+
+	b1.Publish(context.Background(), "chan", []byte("from old"))
+	b2.Publish(context.Background(), "chan", []byte("from new"))
+	if got.Load() != 2 {
+		t.Errorf("expected messages from both brokers, got %d", got.Load())
+	}
+
+	m.Unsubscribe(context.Background(), "chan")
+	b1.Publish(context.Background(), "chan", []byte("after"))
+	if got.Load() != 2 {
+		t.Error("unsubscribe should remove the handler from every broker")
+	}
+}
+
+func TestMultiPing(t *testing.T) {
+	healthy := &pingBroker{LocalBroker: NewLocal()}
+	failing := &pingBroker{LocalBroker: NewLocal(), err: errors.New("down")}
+
+	m := NewMulti(healthy, failing)
+	if err := m.Ping(context.Background()); err == nil {
+		t.Error("expected ping error when one broker fails")
+	}
+
+	m.AnyHealthy = true
+	if err := m.Ping(context.Background()); err != nil {
+		t.Errorf("expected ping to pass with one healthy broker: %v", err)
+	}
+
+	m = NewMulti(failing, failing)
+	m.AnyHealthy = true
+	if err := m.Ping(context.Background()); err == nil {
+		t.Error("expected ping error when every broker fails")
+	}
+}
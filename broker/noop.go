@@ -0,0 +1,19 @@
+package broker
+
+import "context"
+
+// NoopBroker drops everything. A hub given one delivers locally only and
+// skips its broker subscriptions entirely, for single-node deployments.
+type NoopBroker struct{}
+
+func NewNoop() *NoopBroker {
+	return &NoopBroker{}
+}
+
+func (NoopBroker) Publish(context.Context, string, []byte) error { return nil }
+
+func (NoopBroker) Subscribe(context.Context, string, MessageHandler) error { return nil }
+
+func (NoopBroker) Unsubscribe(context.Context, string) error { return nil }
+
+func (NoopBroker) Close() error { return nil }
@@ -2,7 +2,10 @@ package broker
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -43,7 +46,7 @@ func (b *RedisBroker) Subscribe(ctx context.Context, channel string, handler Mes
 	go func() {
 		ch := ps.Channel()
 		for msg := range ch {
-			handler(channel, []byte(msg.Payload))
+			deliver(handler, channel, []byte(msg.Payload))
 		}
 	}()
 	return nil
@@ -62,6 +65,77 @@ func (b *RedisBroker) Unsubscribe(ctx context.Context, channel string) error {
 	return nil
 }
 
+// matchOrEnqueueScript pops entries from the head of the list until it has
+// ARGV[2] fresh ones, skipping any queued before ARGV[3] (unix ms). Short of
+// that it puts them back and appends ARGV[1]. Entries are stored as
+// "<unix ms>|<entry>".
+var matchOrEnqueueScript = redis.NewScript(`
+local need = tonumber(ARGV[2])
+local cutoff = tonumber(ARGV[3])
+local taken = {}
+while #taken < need do
+  local e = redis.call('LPOP', KEYS[1])
+  if not e then break end
+  local ts = tonumber(string.match(e, '^(%d+)|'))
+  if ts and ts >= cutoff then
+    taken[#taken + 1] = e
+  end
+end
+if #taken == need then
+  return taken
+end
+for i = #taken, 1, -1 do
+  redis.call('LPUSH', KEYS[1], taken[i])
+end
+redis.call('RPUSH', KEYS[1], ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {}
+`)
+
+// removeQueuedScript removes the first stored entry whose part after the
+// timestamp is ARGV[1].
+var removeQueuedScript = redis.NewScript(`
+for _, e in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+  local sep = string.find(e, '|', 1, true)
+  if sep and string.sub(e, sep + 1) == ARGV[1] then
+    return redis.call('LREM', KEYS[1], 1, e)
+  end
+end
+return 0
+`)
+
+// MatchOrEnqueue implements MatchQueue with a Redis list per queue, changed
+// only by Lua scripts so nodes never take the same entry.
+func (b *RedisBroker) MatchOrEnqueue(ctx context.Context, queue string, entry []byte, need int, maxAge time.Duration) ([][]byte, error) {
+	now := time.Now()
+	stored := strconv.AppendInt(nil, now.UnixMilli(), 10)
+	stored = append(append(stored, '|'), entry...)
+	res, err := matchOrEnqueueScript.Run(ctx, b.client, []string{"peer:mm:" + queue},
+		stored, need, now.Add(-maxAge).UnixMilli(), maxAge.Milliseconds()).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	taken := make([][]byte, len(res))
+	for i, e := range res {
+		if sep := strings.IndexByte(e, '|'); sep >= 0 {
+			e = e[sep+1:]
+		}
+		taken[i] = []byte(e)
+	}
+	return taken, nil
+}
+
+func (b *RedisBroker) RemoveFromMatchQueue(ctx context.Context, queue string, entry []byte) error {
+	return removeQueuedScript.Run(ctx, b.client, []string{"peer:mm:" + queue}, entry).Err()
+}
+
+func (b *RedisBroker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
 func (b *RedisBroker) Close() error {
 	b.mu.Lock()
 	for _, ps := range b.pubsub {
@@ -98,6 +98,36 @@ func TestRedisPublishSubscribe(t *testing.T) {
 	}
 }
 
+func TestRedisHandlerPanic(t *testing.T) {
+	skipIfNoRedis(t)
+
+	b := newTestRedisBroker(t, "test-node-panic")
+	defer b.Close()
+
+	var received atomic.Int32
+	ctx := context.Background()
+	b.Subscribe(ctx, "test-panic", func(channel string, data []byte) {
+		if string(data) == "bad" {
+			panic("bad message")
+		}
+		received.Add(1)
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	b.Publish(ctx, "test-panic", []byte("bad"))
+	b.Publish(ctx, "test-panic", []byte("good"))
+
+	deadline := time.After(3 * time.Second)
+	for received.Load() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("subscription stopped after a handler panic")
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
 func TestRedisPublishNoSubscribers(t *testing.T) {
 	skipIfNoRedis(t)
 
@@ -369,3 +399,31 @@ func BenchmarkRedisPublish(b *testing.B) {
 		br.Publish(ctx, "bench-channel", data)
 	}
 }
+
+func TestRedisMatchQueue(t *testing.T) {
+	skipIfNoRedis(t)
+
+	a := newTestRedisBroker(t, "test-node-mm-a")
+	defer a.Close()
+	b := newTestRedisBroker(t, "test-node-mm-b")
+	defer b.Close()
+
+	ctx := context.Background()
+	queue := "test-" + time.Now().Format("150405.000000")
+	defer a.client.Del(ctx, "peer:mm:"+queue)
+
+	if taken, err := a.MatchOrEnqueue(ctx, queue, []byte(`{"n":1}`), 2, time.Minute); err != nil || taken != nil {
+		t.Fatalf("first entry should wait, took %q err %v", taken, err)
+	}
+	b.MatchOrEnqueue(ctx, queue, []byte(`{"n":2}`), 2, time.Minute)
+	if err := a.RemoveFromMatchQueue(ctx, queue, []byte(`{"n":2}`)); err != nil {
+		t.Fatalf("remove error: %v", err)
+	}
+	b.MatchOrEnqueue(ctx, queue, []byte(`{"n":3}`), 2, time.Minute)
+
+	// entries queued by either node are visible to the other
+	taken, err := a.MatchOrEnqueue(ctx, queue, []byte(`{"n":4}`), 2, time.Minute)
+	if err != nil || len(taken) != 2 || string(taken[0]) != `{"n":1}` || string(taken[1]) != `{"n":3}` {
+		t.Fatalf("expected oldest two entries taken, got %q %v", taken, err)
+	}
+}
@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"peerserver/protocol"
+
+	"github.com/coder/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+var (
+	ErrClosed        = errors.New("client closed")
+	ErrNotRegistered = errors.New("client not registered")
+)
+
+// ServerError is an error message returned by the server.
+type ServerError struct {
+	Code    int
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Message)
+}
+
+// Handler receives inbound messages. Handlers run on the client's read
+// goroutine, one message at a time, and must not block for long.
+type Handler func(msg *protocol.Message)
+
+// Client is a connection to a peer server. Connect, then Register, then use
+// the helpers or Send; inbound messages go to OnMessage handlers.
+type Client struct {
+	Fingerprint  string
+	Alias        string
+	WriteTimeout time.Duration
+
+	conn       *websocket.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	handlers   map[string][]Handler
+	mu         sync.RWMutex
+	registered bool
+	done       chan struct{}
+	err        error
+	closeOnce  sync.Once
+}
+
+// Connect dials the server's WebSocket endpoint, e.g. "ws://host:8080/ws".
+// opts may be nil.
+func Connect(ctx context.Context, url string, opts *websocket.DialOptions) (*Client, error) {
+	conn, _, err := websocket.Dial(ctx, url, opts)
+	if err != nil {
+		return nil, err
+	}
+	cctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		conn:         conn,
+		ctx:          cctx,
+		cancel:       cancel,
+		handlers:     make(map[string][]Handler),
+		done:         make(chan struct{}),
+		WriteTimeout: 10 * time.Second,
+	}, nil
+}
+
+// Register sends the register message and waits for the server's answer.
+// reg.PublicKey is required. On success the read loop starts and handlers
+// begin receiving messages.
+func (c *Client) Register(ctx context.Context, reg protocol.RegisterPayload) (protocol.RegisteredPayload, error) {
+	var rp protocol.RegisteredPayload
+	payload, err := json.Marshal(reg)
+	if err != nil {
+		return rp, err
+	}
+	if err := c.write(ctx, &protocol.Message{Type: protocol.TypeRegister, Payload: payload}); err != nil {
+		return rp, err
+	}
+
+	_, data, err := c.conn.Read(ctx)
+	if err != nil {
+		return rp, err
+	}
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return rp, err
+	}
+	switch msg.Type {
+	case protocol.TypeRegistered:
+	case protocol.TypeError:
+		return rp, decodeError(msg)
+	default:
+		return rp, fmt.Errorf("unexpected %s before registered", msg.Type)
+	}
+	if err := json.Unmarshal(msg.Payload, &rp); err != nil {
+		return rp, err
+	}
+
+	c.mu.Lock()
+	c.Fingerprint = rp.Fingerprint
+	c.Alias = rp.Alias
+	c.registered = true
+	c.mu.Unlock()
+
+	go c.readLoop()
+	return rp, nil
+}
+
+// OnMessage adds a handler for messages of type typ, "" for every message.
+func (c *Client) OnMessage(typ string, h Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[typ] = append(c.handlers[typ], h)
+}
+
+// Send writes msg as is.
+func (c *Client) Send(msg *protocol.Message) error {
+	c.mu.RLock()
+	registered := c.registered
+	c.mu.RUnlock()
+	if !registered {
+		return ErrNotRegistered
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.WriteTimeout)
+	defer cancel()
+	return c.write(ctx, msg)
+}
+
+func (c *Client) Join(namespace, appType string, meta map[string]interface{}) error {
+	return c.sendPayload(protocol.TypeJoin, "", protocol.JoinPayload{Namespace: namespace, AppType: appType, Meta: meta})
+}
+
+func (c *Client) Leave(namespace string) error {
+	return c.sendPayload(protocol.TypeLeave, "", protocol.LeavePayload{Namespace: namespace})
+}
+
+func (c *Client) Signal(to string, signal protocol.SignalPayload) error {
+	return c.sendPayload(protocol.TypeSignal, to, signal)
+}
+
+// Relay sends payload, encoded as JSON, to the peer to.
+func (c *Client) Relay(to string, payload interface{}) error {
+	return c.sendPayload(protocol.TypeRelay, to, payload)
+}
+
+// Broadcast sends data, encoded as JSON, to the other members of namespace.
+func (c *Client) Broadcast(namespace string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return c.sendPayload(protocol.TypeBroadcast, "", protocol.BroadcastPayload{Namespace: namespace, Data: raw})
+}
+
+// Done is closed when the connection ends; Err then says why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		c.cancel()
+		err = c.conn.Close(websocket.StatusNormalClosure, "")
+	})
+	return err
+}
+
+func (c *Client) sendPayload(typ, to string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.Send(&protocol.Message{Type: typ, To: to, Payload: data})
+}
+
+func (c *Client) write(ctx context.Context, msg *protocol.Message) error {
+	data, err := protocol.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return c.conn.Write(ctx, websocket.MessageText, data)
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.Read(c.ctx)
+		if err != nil {
+			c.err = err
+			return
+		}
+		msg, err := protocol.Decode(data)
+		if err != nil {
+			continue
+		}
+		c.mu.RLock()
+		handlers := append(append([]Handler(nil), c.handlers[msg.Type]...), c.handlers[""]...)
+		c.mu.RUnlock()
+		for _, h := range handlers {
+			h(msg)
+		}
+	}
+}
+
+func decodeError(msg *protocol.Message) error {
+	var ep protocol.ErrorPayload
+	if err := json.Unmarshal(msg.Payload, &ep); err != nil {
+		return err
+	}
+	return &ServerError{Code: ep.Code, Message: ep.Message}
+}
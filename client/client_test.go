@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"peerserver/broker"
+	"peerserver/config"
+	"peerserver/hub"
+	"peerserver/protocol"
+	"peerserver/server"
+)
+
+func newTestServer(t *testing.T) string {
+	t.Helper()
+	cfg := config.Default()
+	cfg.MaxPeers = 100
+	h := hub.New(cfg.ShardCount, cfg.MaxPeers, broker.NewLocal())
+	srv := server.New(cfg, h)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", srv.HandleWebSocket)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ts.Close()
+		h.Shutdown()
+	})
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+}
+
+func connect(t *testing.T, url, key string) (*Client, <-chan *protocol.Message) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Connect(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	msgs := make(chan *protocol.Message, 16)
+	c.OnMessage("", func(msg *protocol.Message) { msgs <- msg })
+
+	rp, err := c.Register(ctx, protocol.RegisterPayload{PublicKey: key})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if rp.Fingerprint == "" || c.Fingerprint != rp.Fingerprint {
+		t.Fatalf("fingerprint not set: %+v", rp)
+	}
+	return c, msgs
+}
+
+func waitFor(t *testing.T, msgs <-chan *protocol.Message, typ string) *protocol.Message {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-msgs:
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", typ)
+			return nil
+		}
+	}
+}
+
+func TestClientJoinAndSignal(t *testing.T) {
+	url := newTestServer(t)
+	a, aMsgs := connect(t, url, "client-key-a")
+	b, bMsgs := connect(t, url, "client-key-b")
+
+	if err := a.Join("client-room", "test", nil); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	waitFor(t, aMsgs, protocol.TypePeerList)
+	if err := b.Join("client-room", "test", nil); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	waitFor(t, bMsgs, protocol.TypePeerList)
+	waitFor(t, aMsgs, protocol.TypePeerJoined)
+
+	if err := a.Signal(b.Fingerprint, protocol.SignalPayload{SignalType: "offer", SDP: "v=0"}); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	msg := waitFor(t, bMsgs, protocol.TypeSignal)
+	if msg.From != a.Fingerprint {
+		t.Fatalf("expected signal from %s, got %s", a.Fingerprint, msg.From)
+	}
+	var sp protocol.SignalPayload
+	if err := json.Unmarshal(msg.Payload, &sp); err != nil || sp.SDP != "v=0" {
+		t.Fatalf("unexpected signal payload: %s", msg.Payload)
+	}
+}
+
+func TestClientRegisterRejected(t *testing.T) {
+	url := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := Connect(ctx, url, nil)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.Register(ctx, protocol.RegisterPayload{})
+	var se *ServerError
+	if !errors.As(err, &se) || se.Code != 400 {
+		t.Fatalf("expected 400 server error, got %v", err)
+	}
+	if err := c.Join("room", "test", nil); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"time"
@@ -34,54 +36,147 @@ func (d Duration) MarshalJSON() ([]byte, error) {
 }
 
 type Config struct {
-	Host               string   `json:"host"`
-	Port               int      `json:"port"`
-	MaxPeers           int      `json:"max_peers"`
-	ShardCount         int      `json:"shard_count"`
-	WriteTimeout       Duration `json:"write_timeout"`
-	ReadTimeout        Duration `json:"read_timeout"`
-	PingInterval       Duration `json:"ping_interval"`
-	PongWait           Duration `json:"pong_wait"`
-	MaxMessageSize     int64    `json:"max_message_size"`
-	BrokerType         string   `json:"broker_type"`
-	RedisAddr          string   `json:"redis_addr"`
-	RedisPassword      string   `json:"redis_password"`
-	RedisDB            int      `json:"redis_db"`
-	RateLimitPerSec    int      `json:"rate_limit_per_sec"`
-	RateLimitBurst     int      `json:"rate_limit_burst"`
-	RateLimitShards    int      `json:"rate_limit_shards"`
-	TLSCert            string   `json:"tls_cert"`
-	TLSKey             string   `json:"tls_key"`
-	MetricsEnabled     bool     `json:"metrics_enabled"`
-	MetricsPort        int      `json:"metrics_port"`
-	CompressionEnabled bool     `json:"compression_enabled"`
-	SendBufferSize     int      `json:"send_buffer_size"`
+	Host                      string            `json:"host"`
+	Port                      int               `json:"port"`
+	MaxPeers                  int               `json:"max_peers"`
+	ShardCount                int               `json:"shard_count"`
+	WriteTimeout              Duration          `json:"write_timeout"`
+	ReadTimeout               Duration          `json:"read_timeout"`
+	TCPKeepAlive              Duration          `json:"tcp_keepalive"`
+	TCPNoDelay                bool              `json:"tcp_no_delay"`
+	PingInterval              Duration          `json:"ping_interval"`
+	PongWait                  Duration          `json:"pong_wait"`
+	MinPingInterval           Duration          `json:"min_ping_interval"`
+	MaxPingInterval           Duration          `json:"max_ping_interval"`
+	MaxMessageSize            int64             `json:"max_message_size"`
+	BrokerType                string            `json:"broker_type"`
+	RedisAddr                 string            `json:"redis_addr"`
+	RedisPassword             string            `json:"redis_password"`
+	RedisDB                   int               `json:"redis_db"`
+	BrokerFallbackLocal       bool              `json:"broker_fallback_local"`
+	RateLimitPerSec           int               `json:"rate_limit_per_sec"`
+	RateLimitBurst            int               `json:"rate_limit_burst"`
+	RateLimitShards           int               `json:"rate_limit_shards"`
+	GlobalRateLimitPerSec     int               `json:"global_rate_limit_per_sec"`
+	TLSCert                   string            `json:"tls_cert"`
+	TLSKey                    string            `json:"tls_key"`
+	TLSPort                   int               `json:"tls_port"`
+	MetricsEnabled            bool              `json:"metrics_enabled"`
+	MetricsPort               int               `json:"metrics_port"`
+	MetricsNamespaceAllowlist []string          `json:"metrics_namespace_allowlist"`
+	PprofEnabled              bool              `json:"pprof_enabled"`
+	AdminToken                string            `json:"admin_token"`
+	AllowedOrigins            []string          `json:"allowed_origins"`
+	CompressionEnabled        bool              `json:"compression_enabled"`
+	CompressionMode           string            `json:"compression_mode"`
+	CompressionThreshold      int               `json:"compression_threshold"`
+	SendBufferSize            int               `json:"send_buffer_size"`
+	ServerFullMessage         string            `json:"server_full_message"`
+	ServerFullRetryAfter      Duration          `json:"server_full_retry_after"`
+	MaxRoomIdleTTL            Duration          `json:"max_room_idle_ttl"`
+	MaxMatchGroupSize         int               `json:"max_match_group_size"`
+	MaxMatchRequestsPerPeer   int               `json:"max_match_requests_per_peer"`
+	DropOldestMatchRequest    bool              `json:"drop_oldest_match_request"`
+	MaxSignalAllMembers       int               `json:"max_signal_all_members"`
+	SnapshotPath              string            `json:"snapshot_path"`
+	DisableAliases            bool              `json:"disable_aliases"`
+	HandlerWorkers            int               `json:"handler_workers"`
+	MaxMessagesPerConnection  int64             `json:"max_messages_per_connection"`
+	MaxBroadcastSize          map[string]int    `json:"max_broadcast_size"`
+	MatchAutoRoom             bool              `json:"match_auto_room"`
+	MatchRoomLifetime         Duration          `json:"match_room_lifetime"`
+	AllowCrossNamespaceSignal bool              `json:"allow_cross_namespace_signal"`
+	TrustBrokerNamespaces     bool              `json:"trust_broker_namespaces"`
+	MaxNamespaces             int               `json:"max_namespaces"`
+	WriteBatchMax             int               `json:"write_batch_max"`
+	WelcomeMessages           map[string]string `json:"welcome_messages"`
+	EchoEnabled               bool              `json:"echo_enabled"`
+	MaxEchoConnections        int               `json:"max_echo_connections"`
+	MaxJoinsPerSec            int               `json:"max_joins_per_sec"`
+	MaxAliasLength            int               `json:"max_alias_length"`
+	AliasScope                string            `json:"alias_scope"`
+	SharedMatchmaking         bool              `json:"shared_matchmaking"`
+	MaxSDPBytes               int               `json:"max_sdp_bytes"`
+	MaxCandidateBytes         int               `json:"max_candidate_bytes"`
+	MaxBroadcastRecipients    int               `json:"max_broadcast_recipients"`
+	AsyncBroadcastThreshold   int               `json:"async_broadcast_threshold"`
+	MaxConcurrentBroadcasts   int               `json:"max_concurrent_broadcasts"`
+	MaxPendingJoins           int               `json:"max_pending_joins"`
+	MaxPendingJoinsPerPeer    int               `json:"max_pending_joins_per_peer"`
+	MaxRoomsJoinedPerPeer     int               `json:"max_rooms_joined_per_peer"`
+	ReliableAckTimeout        Duration          `json:"reliable_ack_timeout"`
+	ReliableRetries           int               `json:"reliable_retries"`
+	MaxReliableInFlight       int               `json:"max_reliable_in_flight"`
+	MaxPresenceWatch          int               `json:"max_presence_watch"`
+	HandlerBurst              int               `json:"handler_burst"`
+	NodeID                    string            `json:"node_id"`
+	FingerprintSalt           string            `json:"fingerprint_salt"`
+	DisconnectGrace           Duration          `json:"disconnect_grace"`
+	SlowHandlerThreshold      Duration          `json:"slow_handler_threshold"`
+	AuditLogPath              string            `json:"audit_log_path"`
+	AuditLogMaxBytes          int64             `json:"audit_log_max_bytes"`
+	AuditHashPayloads         bool              `json:"audit_hash_payloads"`
+
+	// per-namespace windows, keys match like MaxBroadcastSize
+	BroadcastCoalesce map[string]Duration `json:"broadcast_coalesce"`
+
+	// named limits a peer gets instead of RateLimitPerSec/RateLimitBurst by
+	// registering with the tier's token
+	RateLimitTiers map[string]RateLimitTier `json:"rate_limit_tiers"`
+}
+
+// RateLimitTier is a per-peer message rate and burst for peers that register
+// with its Token.
+type RateLimitTier struct {
+	RatePerSec int    `json:"rate_per_sec"`
+	Burst      int    `json:"burst"`
+	Token      string `json:"token"`
 }
 
 func Default() *Config {
 	return &Config{
-		Host:               "0.0.0.0",
-		Port:               8080,
-		MaxPeers:           100000,
-		ShardCount:         64,
-		WriteTimeout:       Duration{10 * time.Second},
-		ReadTimeout:        Duration{60 * time.Second},
-		PingInterval:       Duration{30 * time.Second},
-		PongWait:           Duration{35 * time.Second},
-		MaxMessageSize:     65536,
-		BrokerType:         "local",
-		RedisAddr:          "localhost:6379",
-		RedisPassword:      "",
-		RedisDB:            0,
-		RateLimitPerSec:    100,
-		RateLimitBurst:     200,
-		RateLimitShards:    32,
-		TLSCert:            "",
-		TLSKey:             "",
-		MetricsEnabled:     true,
-		MetricsPort:        9090,
-		CompressionEnabled: false,
-		SendBufferSize:     32,
+		Host:                    "0.0.0.0",
+		Port:                    8080,
+		MaxPeers:                100000,
+		ShardCount:              64,
+		WriteTimeout:            Duration{10 * time.Second},
+		ReadTimeout:             Duration{60 * time.Second},
+		PingInterval:            Duration{30 * time.Second},
+		PongWait:                Duration{35 * time.Second},
+		MinPingInterval:         Duration{5 * time.Second},
+		MaxPingInterval:         Duration{2 * time.Minute},
+		MaxMessageSize:          65536,
+		BrokerType:              "local",
+		RedisAddr:               "localhost:6379",
+		RedisPassword:           "",
+		RedisDB:                 0,
+		RateLimitPerSec:         100,
+		RateLimitBurst:          200,
+		RateLimitShards:         32,
+		TLSCert:                 "",
+		TLSKey:                  "",
+		MetricsEnabled:          false,
+		TCPNoDelay:              true,
+		MetricsPort:             9090,
+		CompressionEnabled:      false,
+		SendBufferSize:          32,
+		ServerFullMessage:       "server full",
+		MaxRoomIdleTTL:          Duration{time.Hour},
+		MaxMatchGroupSize:       16,
+		MaxMatchRequestsPerPeer: 8,
+		MaxSignalAllMembers:     16,
+		WriteBatchMax:           64,
+		MaxEchoConnections:      16,
+		MaxAliasLength:          64,
+		AliasScope:              "global",
+		MaxPendingJoins:         100,
+		MaxPendingJoinsPerPeer:  8,
+		MaxRoomsJoinedPerPeer:   32,
+		ReliableAckTimeout:      Duration{time.Second},
+		ReliableRetries:         3,
+		MaxReliableInFlight:     64,
+		MaxPresenceWatch:        256,
+		HandlerBurst:            16,
 	}
 }
 
@@ -91,8 +186,94 @@ func LoadFromFile(path string) (*Config, error) {
 	if err != nil {
 		return cfg, err
 	}
-	err = json.Unmarshal(data, cfg)
-	return cfg, err
+	if err := json.Unmarshal(stripComments(data), cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validateTiers()
+}
+
+// ErrInvalidConfig wraps errors from LoadFromFile for a file that parsed but
+// holds settings that can't be used, as opposed to one that couldn't be read
+// or parsed.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// validateTiers rejects rate_limit_tiers that can't work as intended: a
+// tier without a token is never picked, one whose rate or burst isn't
+// positive would cut its peers off, and two tiers sharing a token leave it
+// to chance which one a peer gets.
+func (c *Config) validateTiers() error {
+	tokens := make(map[string]string, len(c.RateLimitTiers))
+	for name, tier := range c.RateLimitTiers {
+		if tier.Token == "" {
+			return fmt.Errorf("%w: rate_limit_tiers %q: token required", ErrInvalidConfig, name)
+		}
+		if tier.RatePerSec <= 0 || tier.Burst <= 0 {
+			return fmt.Errorf("%w: rate_limit_tiers %q: rate_per_sec and burst must be positive", ErrInvalidConfig, name)
+		}
+		if other, ok := tokens[tier.Token]; ok {
+			return fmt.Errorf("%w: rate_limit_tiers %q and %q share a token", ErrInvalidConfig, other, name)
+		}
+		tokens[tier.Token] = name
+	}
+	return nil
+}
+
+// BroadcastCoalesceWindows returns BroadcastCoalesce as plain durations.
+func (c *Config) BroadcastCoalesceWindows() map[string]time.Duration {
+	if len(c.BroadcastCoalesce) == 0 {
+		return nil
+	}
+	out := make(map[string]time.Duration, len(c.BroadcastCoalesce))
+	for ns, d := range c.BroadcastCoalesce {
+		out[ns] = d.Duration
+	}
+	return out
+}
+
+// stripComments blanks out // line and /* */ block comments outside of
+// strings so annotated config files parse as plain JSON. Comments become
+// spaces (newlines are kept) so error offsets still point at the right line.
+func stripComments(data []byte) []byte {
+	out := make([]byte, len(data))
+	copy(out, data)
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			continue
+		}
+		if c != '/' || i+1 >= len(out) {
+			continue
+		}
+		switch out[i+1] {
+		case '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out); i++ {
+				if out[i] == '*' && i+1 < len(out) && out[i+1] == '/' {
+					out[i], out[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		}
+	}
+	return out
 }
 
 func LoadFromEnv() *Config {
@@ -120,6 +301,14 @@ func LoadFromEnv() *Config {
 	if v := os.Getenv("TLS_KEY"); v != "" {
 		cfg.TLSKey = v
 	}
+	if v := os.Getenv("TLS_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil {
+			cfg.TLSPort = port
+		}
+	}
+	if v := os.Getenv("PEER_ADMIN_TOKEN"); v != "" {
+		cfg.AdminToken = v
+	}
 	if v := os.Getenv("PEER_MAX_PEERS"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
 			cfg.MaxPeers = n
@@ -128,6 +317,15 @@ func LoadFromEnv() *Config {
 	if v := os.Getenv("PEER_COMPRESSION"); v == "true" || v == "1" {
 		cfg.CompressionEnabled = true
 	}
+	if v := os.Getenv("PEER_COMPRESSION_MODE"); v != "" {
+		cfg.CompressionMode = v
+	}
+	if v := os.Getenv("PEER_FINGERPRINT_SALT"); v != "" {
+		cfg.FingerprintSalt = v
+	}
+	if v := os.Getenv("PEER_NODE_ID"); v != "" {
+		cfg.NodeID = v
+	}
 	if v := os.Getenv("PEER_SEND_BUFFER"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
 			cfg.SendBufferSize = n
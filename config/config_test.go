@@ -1,7 +1,9 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -46,7 +48,8 @@ func TestLoadFromFileStringDurations(t *testing.T) {
 		"ping_interval": "15s",
 		"pong_wait": "20s",
 		"compression_enabled": true,
-		"send_buffer_size": 64
+		"send_buffer_size": 64,
+		"broadcast_coalesce": {"ticker-*": "5ms"}
 	}`
 	tmpFile, err := os.CreateTemp("", "config-*.json")
 	if err != nil {
@@ -84,6 +87,45 @@ func TestLoadFromFileStringDurations(t *testing.T) {
 	if cfg.SendBufferSize != 64 {
 		t.Errorf("expected send_buffer_size 64, got %d", cfg.SendBufferSize)
 	}
+	if got := cfg.BroadcastCoalesceWindows()["ticker-*"]; got != 5*time.Millisecond {
+		t.Errorf("expected broadcast_coalesce ticker-* 5ms, got %v", got)
+	}
+}
+
+func TestLoadFromFileWithComments(t *testing.T) {
+	content := `{
+		// listen on loopback only
+		"host": "127.0.0.1",
+		"port": 9090, // inline comment
+		/* block comment
+		   spanning lines, "quoted": 1 */
+		"server_full_message": "see http://example.com/status /* not a comment */",
+		"ping_interval": /* inline block */ "15s"
+	}`
+	tmpFile, err := os.CreateTemp("", "config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString(content)
+	tmpFile.Close()
+
+	cfg, err := LoadFromFile(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("load error: %v", err)
+	}
+	if cfg.Host != "127.0.0.1" {
+		t.Errorf("expected host 127.0.0.1, got %s", cfg.Host)
+	}
+	if cfg.Port != 9090 {
+		t.Errorf("expected port 9090, got %d", cfg.Port)
+	}
+	if cfg.ServerFullMessage != "see http://example.com/status /* not a comment */" {
+		t.Errorf("comment markers inside strings should be kept, got %q", cfg.ServerFullMessage)
+	}
+	if cfg.PingInterval.Duration != 15*time.Second {
+		t.Errorf("expected ping_interval 15s, got %v", cfg.PingInterval.Duration)
+	}
 }
 
 func TestLoadFromFileMillisecondDurations(t *testing.T) {
@@ -132,8 +174,29 @@ func TestLoadFromFileInvalidJSON(t *testing.T) {
 	tmpFile.Close()
 
 	_, err = LoadFromFile(tmpFile.Name())
-	if err == nil {
-		t.Error("expected error for invalid json")
+	if err == nil || errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("expected a parse error for invalid json, got %v", err)
+	}
+}
+
+func TestLoadFromFileInvalidTiers(t *testing.T) {
+	for name, tiers := range map[string]string{
+		"no token":     `{"free": {"rate_per_sec": 10, "burst": 10}}`,
+		"zero rate":    `{"free": {"rate_per_sec": 0, "burst": 10, "token": "a"}}`,
+		"zero burst":   `{"free": {"rate_per_sec": 10, "burst": 0, "token": "a"}}`,
+		"shared token": `{"free": {"rate_per_sec": 10, "burst": 10, "token": "a"}, "pro": {"rate_per_sec": 50, "burst": 50, "token": "a"}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(path, []byte(`{"rate_limit_tiers": `+tiers+`}`), 0o600)
+		if _, err := LoadFromFile(path); !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: expected ErrInvalidConfig, got %v", name, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"rate_limit_tiers": {"free": {"rate_per_sec": 10, "burst": 10, "token": "a"}, "pro": {"rate_per_sec": 50, "burst": 50, "token": "b"}}}`), 0o600)
+	if _, err := LoadFromFile(path); err != nil {
+		t.Errorf("expected valid tiers to load, got %v", err)
 	}
 }
 
@@ -146,6 +209,7 @@ func TestLoadFromEnv(t *testing.T) {
 	os.Setenv("PEER_COMPRESSION", "true")
 	os.Setenv("PEER_SEND_BUFFER", "128")
 	os.Setenv("PEER_MAX_PEERS", "50000")
+	os.Setenv("PEER_NODE_ID", "0123456789abcdef0123456789abcdef")
 	defer func() {
 		os.Unsetenv("PEER_HOST")
 		os.Unsetenv("PEER_PORT")
@@ -155,6 +219,7 @@ func TestLoadFromEnv(t *testing.T) {
 		os.Unsetenv("PEER_COMPRESSION")
 		os.Unsetenv("PEER_SEND_BUFFER")
 		os.Unsetenv("PEER_MAX_PEERS")
+		os.Unsetenv("PEER_NODE_ID")
 	}()
 
 	cfg := LoadFromEnv()
@@ -182,6 +247,9 @@ func TestLoadFromEnv(t *testing.T) {
 	if cfg.MaxPeers != 50000 {
 		t.Errorf("expected max_peers 50000, got %d", cfg.MaxPeers)
 	}
+	if cfg.NodeID != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("expected node_id from env, got %s", cfg.NodeID)
+	}
 }
 
 func TestLoadFromEnvInvalidPort(t *testing.T) {
@@ -3,15 +3,25 @@ package hub
 import (
 	"context"
 	"crypto/rand"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"log"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"peerserver/audit"
 	"peerserver/broker"
 	"peerserver/matchmaker"
+	"peerserver/middleware"
 	"peerserver/namespace"
 	"peerserver/peer"
 	"peerserver/protocol"
@@ -26,9 +36,161 @@ type Shard struct {
 	mu    sync.RWMutex
 }
 
+// Options holds optional hub behaviour, the zero value keeps the defaults.
+type Options struct {
+	// MaxRoomIdleTTL caps the idle_ttl_ms a room creator may request,
+	// 0 disables idle room closing.
+	MaxRoomIdleTTL time.Duration
+	// RoomSweepInterval is how often idle rooms are checked, default 5s.
+	RoomSweepInterval time.Duration
+	// JoinRequestTimeout is how long a join to an approval_required room
+	// waits for the owner, default 60s.
+	JoinRequestTimeout time.Duration
+	// MaxPendingJoins caps the joins waiting for approval per room, and
+	// MaxPendingJoinsPerPeer those one peer may have waiting across rooms;
+	// joins over either get 429. Defaults 100 and 8.
+	MaxPendingJoins        int
+	MaxPendingJoinsPerPeer int
+	// MaxRoomsJoinedPerPeer is how many rooms a peer may be a member of at
+	// once, counted apart from plain namespaces. Creating or joining one
+	// more gets 429. 0 disables.
+	MaxRoomsJoinedPerPeer int
+	// ReliableAckTimeout is how long a reliable relay waits for the
+	// target's relay_ack before it is sent again, default 1s.
+	ReliableAckTimeout time.Duration
+	// ReliableRetries is how many times an unacknowledged reliable relay is
+	// sent again before its sender gets relay_failed; 0 gives up after the
+	// first ReliableAckTimeout.
+	ReliableRetries int
+	// MaxReliableInFlight caps the reliable relays one sender may have
+	// waiting for an ack, default 64.
+	MaxReliableInFlight int
+	// MaxMatchGroupSize is the largest group_size a match request may ask
+	// for, default 16.
+	MaxMatchGroupSize int
+	// MaxMatchRequestsPerPeer is how many namespaces a peer may be waiting
+	// for a match in at once, default 8.
+	MaxMatchRequestsPerPeer int
+	// DropOldestMatchRequest makes a match request over the cap replace the
+	// peer's oldest one instead of being rejected.
+	DropOldestMatchRequest bool
+	// MaxSignalAllMembers is the largest namespace (excluding the sender) a
+	// signal_all may fan out to, default 16.
+	MaxSignalAllMembers int
+	// HandlerWorkers is the size of the pool that runs HandleMessage for
+	// Dispatch, 0 handles messages inline on the caller's goroutine.
+	HandlerWorkers int
+	// HandlerBurst is how many queued messages a worker handles for one
+	// peer before moving it to the back of the queue, so a peer flooding
+	// messages can't hold a worker while others wait. Default 16.
+	HandlerBurst int
+	// DisableAliases turns off alias registration and resolution, peers are
+	// only addressable by fingerprint.
+	DisableAliases bool
+	// AliasScope is AliasScopeGlobal (the default) for aliases unique across
+	// the server, or AliasScopeNamespace for aliases unique per namespace and
+	// only resolvable by members of that namespace.
+	AliasScope string
+	// SnapshotPath is where room definitions and aliases are saved on
+	// Shutdown and restored from on start, empty disables.
+	SnapshotPath string
+	// RestoredRoomGrace is how long a restored room survives empty while its
+	// members reconnect, and a restored alias while its owner does, default
+	// 5m.
+	RestoredRoomGrace time.Duration
+	// TargetClaimWindow is how long a require_target signal/relay waits for
+	// another node to claim the target before replying 404, default 500ms.
+	TargetClaimWindow time.Duration
+	// MatchSessionTTL is how long a formed match can be recovered with
+	// match_lookup, default 2m.
+	MatchSessionTTL time.Duration
+	// MaxBroadcastSize limits len(data) of broadcasts per namespace. Keys
+	// are namespace names or prefixes ending in "*"; the exact name wins,
+	// then the longest prefix. Unlisted namespaces are only bound by the
+	// message size.
+	MaxBroadcastSize map[string]int
+	// MatchAutoRoom creates a room sized to each formed match, joins the
+	// matched peers to it and reports it as room_id in matched.
+	MatchAutoRoom bool
+	// MatchRoomLifetime makes MatchAutoRoom rooms one-shot: only the
+	// matched peers may join them, and they close with reason "expired"
+	// this long after the match even if still in use. Like any room they
+	// are gone once everyone leaves. 0 keeps them ordinary rooms.
+	MatchRoomLifetime time.Duration
+	// SharedMatchmaking queues match requests in the broker so peers on
+	// different nodes match each other. Needs a broker that implements
+	// broker.MatchQueue. Auto rooms are only made when every matched peer
+	// is on the forming node.
+	SharedMatchmaking bool
+	// AllowCrossNamespaceSignal lets signal and relay reach any local peer
+	// by fingerprint, skipping the shared namespace check. Only for trusted
+	// deployments.
+	AllowCrossNamespaceSignal bool
+	// TrustBrokerNamespaces delivers signals and relays from the broker
+	// without re-checking that the target shares a namespace with the
+	// sender, for clusters with nodes that don't stamp FromNamespaces yet.
+	TrustBrokerNamespaces bool
+	// Welcome maps namespaces to a message sent to each peer right after
+	// its peer_list on join. Keys match like MaxBroadcastSize. A room's own
+	// motd, set by its owner, wins over this.
+	Welcome map[string]string
+	// MaxNamespaces caps how many namespaces, rooms included, may exist at
+	// once; joining, watching or creating a new one beyond it fails with
+	// 503. 0 means no cap.
+	MaxNamespaces int
+	// MaxJoinsPerSec limits how fast one peer may join namespaces and rooms;
+	// joins over it get 429. 0 means no limit.
+	MaxJoinsPerSec int
+	// MaxSDPBytes and MaxCandidateBytes limit the sdp and candidate of a
+	// signal; bigger ones get 413 instead of being forwarded. 0 means no
+	// limit beyond the message size.
+	MaxSDPBytes       int
+	MaxCandidateBytes int
+	// MaxBroadcastRecipients rejects broadcasts into namespaces with more
+	// local members than this besides the sender, with 400. 0 means no cap.
+	MaxBroadcastRecipients int
+	// AsyncBroadcastThreshold hands the fan-out of broadcasts into
+	// namespaces with more members than this to a background worker, so
+	// the sender's next messages aren't held up. 0 always fans out inline.
+	// Broadcasts into a namespace stay in order: while one is queued the
+	// next go to the worker too, and a full queue makes the sender wait.
+	AsyncBroadcastThreshold int
+	// MaxConcurrentBroadcasts caps how many peers' broadcasts may be fanning
+	// out at once. One over it waits up to broadcastSlotWait for a slot and
+	// then gets 503. 0 means no cap.
+	MaxConcurrentBroadcasts int
+	// MaxPeerListBytes is the most a peer_list message may encode to; longer
+	// lists are sent in chunks. Default 65536, the default max message size.
+	MaxPeerListBytes int
+	// DisconnectGrace delays the peer_left sent when a peer disconnects. If
+	// the peer reconnects and is back in a namespace by then, that
+	// namespace never hears it left, so a brief drop mid-negotiation
+	// doesn't make partners tear down. 0 sends peer_left at once.
+	DisconnectGrace time.Duration
+	// SlowHandlerThreshold logs HandleMessage calls that take longer than
+	// this, with the message type, sender and time taken, at most once per
+	// slowHandlerLogEvery. 0 disables.
+	SlowHandlerThreshold time.Duration
+	// BroadcastCoalesce holds plain broadcasts into matching namespaces for
+	// a short window and sends those arriving within it to each member as
+	// one batch message. Keys match like MaxBroadcastSize.
+	BroadcastCoalesce map[string]time.Duration
+	// NodeID fixes the hub's node ID, 32 lowercase hex chars; a random one
+	// is generated when empty or malformed. Nodes sharing an ID drop each
+	// other's broker messages, which a startup announcement detects.
+	NodeID string
+	// AuditSink, when set, gets a record of every signal, relay, join and
+	// kick this node accepts from its peers. The hub doesn't close it.
+	AuditSink audit.Sink
+	// AuditHashPayloads adds the SHA-256 of signal and relay payloads to
+	// their audit records; otherwise payloads are left out entirely.
+	AuditHashPayloads bool
+}
+
 type Hub struct {
 	shards     []*Shard
 	shardCount int
+	shardChars int
 	nsMgr      *namespace.Manager
 	matchmaker *matchmaker.Matchmaker
 	broker     broker.Broker
@@ -39,428 +201,2577 @@ type Hub struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	nodeID     string
+	localOnly  bool
+	opts       Options
+	claims     sync.Map
+	joinReqs   *joinRequests
+	reliable   *reliableRelays
+	presence   *presenceIndex
+	identities *identityIndex
+	coalesce   *coalescer
+	roomKeys   *roomKeys
+	held       *heldLeaves
+	workers    *dispatcher
+	requestSeq atomic.Uint64
+	joinLimit  *middleware.RateLimiter
+
+	// set when the matchmaker queues through the broker
+	sharedMatch bool
+
+	// expires aliases restored from the snapshot whose owners didn't come
+	// back, nil when none were restored
+	aliasGrace *time.Timer
+
+	// custom message types, msgType -> MessageHandler
+	custom sync.Map
+
+	// random per hub, unlike nodeID which may be configured; see
+	// announceNode
+	instance      string
+	nodeCollision atomic.Bool
+
+	// large broadcasts waiting for the fan-out worker, nil when
+	// AsyncBroadcastThreshold is off, and how many each namespace has
+	// queued or running there
+	fanout       chan func()
+	fanoutMu     sync.Mutex
+	fanoutQueued map[string]int
+
+	// one token per broadcast fanning out, nil when MaxConcurrentBroadcasts
+	// is off
+	broadcastSlots chan struct{}
+
+	// when a slow handler was last logged (unix ns) and how many went
+	// unlogged since
+	slowLoggedAt   atomic.Int64
+	slowSuppressed atomic.Int64
+
+	// in-flight HandleMessage calls, drained by Shutdown before peers close
+	handlers     sync.WaitGroup
+	handlersMu   sync.Mutex
+	shuttingDown bool
+
+	// messages dropped, by cause; see DropStats
+	publishErrors      atomic.Int64
+	targetNotFound     atomic.Int64
+	broadcastsRejected atomic.Int64
 }
 
-func New(shardCount, maxPeers int, b broker.Broker) *Hub {
-	shards := make([]*Shard, shardCount)
-	for i := range shards {
-		shards[i] = &Shard{peers: make(map[string]*peer.Peer)}
-	}
-	nsMgr := namespace.NewManager(maxPeers)
+// Alias scopes for Options.AliasScope.
+const (
+	AliasScopeGlobal    = "global"
+	AliasScopeNamespace = "namespace"
+)
 
-	nodeBytes := make([]byte, 16)
-	rand.Read(nodeBytes)
-	nodeID := hex.EncodeToString(nodeBytes)
+// maxPendingPerPeer bounds how many messages a peer may have waiting for the
+// worker pool before new ones are rejected as rate limited.
+const maxPendingPerPeer = 256
 
-	ctx, cancel := context.WithCancel(context.Background())
+// handlerDrainTimeout bounds how long Shutdown waits for in-flight handlers
+// before closing peers under them.
+const handlerDrainTimeout = 5 * time.Second
 
-	h := &Hub{
-		shards:     shards,
-		shardCount: shardCount,
-		nsMgr:      nsMgr,
-		matchmaker: matchmaker.New(nsMgr),
-		broker:     b,
-		maxPeers:   maxPeers,
-		done:       make(chan struct{}),
-		ctx:        ctx,
-		cancel:     cancel,
-		nodeID:     nodeID,
+// fanoutQueueSize bounds how many large broadcasts may wait for the fan-out
+// worker before senders wait for room.
+const fanoutQueueSize = 64
+
+// broadcastSlotWait is how long a broadcast waits for a free
+// MaxConcurrentBroadcasts slot before it is rejected.
+const broadcastSlotWait = 100 * time.Millisecond
+
+// maxLeaveMessageLen bounds the farewell message a leave may attach to
+// peer_left.
+const maxLeaveMessageLen = 256
+
+// maxCorrelationLen bounds the correlation token a match request may carry.
+const maxCorrelationLen = 128
+
+// maxWatchedNamespaces bounds how many namespaces one peer may watch. A
+// watch keeps its namespace alive, even empty, until the peer unwatches or
+// disconnects.
+const maxWatchedNamespaces = 64
+
+// maxCoalescedBytes flushes a namespace's coalesced broadcasts early once
+// they add up to this much.
+const maxCoalescedBytes = 32 << 10
+
+// maxMotdLen bounds the motd a room owner may set.
+const maxMotdLen = 1024
+
+// slowHandlerLogEvery rate limits SlowHandlerThreshold logging.
+const slowHandlerLogEvery = time.Second
+
+// dispatcher feeds the handler worker pool. A peer with queued messages is
+// in queues and owned by at most one worker, which keeps its messages in
+// order while different peers are handled in parallel.
+type dispatcher struct {
+	mu     sync.Mutex
+	queues map[*peer.Peer][][]byte
+	work   chan *peer.Peer
+}
+
+type pendingJoin struct {
+	peer  *peer.Peer
+	timer *time.Timer
+	// the join_room's, for the joiner's reply whichever way it goes
+	requestID string
+}
+
+// joinRequests tracks joins waiting for a room owner's approval.
+type joinRequests struct {
+	pending map[string]map[string]*pendingJoin
+	// pending joins per requester fingerprint, across rooms
+	byPeer     map[string]int
+	maxPerRoom int
+	maxPerPeer int
+	mu         sync.Mutex
+}
+
+var (
+	errRoomJoinsPending = errors.New("too many pending joins for room")
+	errPeerJoinsPending = errors.New("too many pending joins")
+)
+
+func newJoinRequests(maxPerRoom, maxPerPeer int) *joinRequests {
+	return &joinRequests{
+		pending:    make(map[string]map[string]*pendingJoin),
+		byPeer:     make(map[string]int),
+		maxPerRoom: maxPerRoom,
+		maxPerPeer: maxPerPeer,
 	}
+}
 
-	b.Subscribe(ctx, "signal", func(_ string, data []byte) {
-		h.handleBrokerMessage(data)
-	})
-	b.Subscribe(ctx, "relay", func(_ string, data []byte) {
-		h.handleBrokerMessage(data)
-	})
-	b.Subscribe(ctx, "broadcast", func(_ string, data []byte) {
-		h.handleBrokerBroadcast(data)
-	})
+// add records a pending join. It returns false if the peer already has one
+// for the room, and an error if the room or the peer is at its cap.
+func (jr *joinRequests) add(roomID string, p *peer.Peer, requestID string, timeout time.Duration, onTimeout func()) (bool, error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	room := jr.pending[roomID]
+	if _, ok := room[p.Fingerprint]; ok {
+		return false, nil
+	}
+	if len(room) >= jr.maxPerRoom {
+		return false, errRoomJoinsPending
+	}
+	if jr.byPeer[p.Fingerprint] >= jr.maxPerPeer {
+		return false, errPeerJoinsPending
+	}
+	if room == nil {
+		room = make(map[string]*pendingJoin)
+		jr.pending[roomID] = room
+	}
+	room[p.Fingerprint] = &pendingJoin{peer: p, timer: time.AfterFunc(timeout, onTimeout), requestID: requestID}
+	jr.byPeer[p.Fingerprint]++
+	return true, nil
+}
 
-	go h.maintenance()
-	return h
+// take removes and returns a pending join.
+func (jr *joinRequests) take(roomID, fingerprint string) (*pendingJoin, bool) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	room := jr.pending[roomID]
+	pj, ok := room[fingerprint]
+	if !ok {
+		return nil, false
+	}
+	pj.timer.Stop()
+	delete(room, fingerprint)
+	if len(room) == 0 {
+		delete(jr.pending, roomID)
+	}
+	if jr.byPeer[fingerprint]--; jr.byPeer[fingerprint] <= 0 {
+		delete(jr.byPeer, fingerprint)
+	}
+	return pj, true
 }
 
-func (h *Hub) shardFor(fingerprint string) *Shard {
-	// fingerprint is already a hex-encoded sha256, use first 4 hex chars directly
-	if len(fingerprint) >= 4 {
-		var idx uint32
-		for i := 0; i < 4; i++ {
-			c := fingerprint[i]
-			var v byte
-			if c >= '0' && c <= '9' {
-				v = c - '0'
-			} else if c >= 'a' && c <= 'f' {
-				v = c - 'a' + 10
-			} else if c >= 'A' && c <= 'F' {
-				v = c - 'A' + 10
+// dropPeer removes every pending join of fingerprint's, for a requester
+// that is gone.
+func (jr *joinRequests) dropPeer(fingerprint string) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	if jr.byPeer[fingerprint] == 0 {
+		return
+	}
+	for roomID, room := range jr.pending {
+		if pj, ok := room[fingerprint]; ok {
+			pj.timer.Stop()
+			delete(room, fingerprint)
+			if len(room) == 0 {
+				delete(jr.pending, roomID)
 			}
-			idx = (idx << 4) | uint32(v)
 		}
-		return h.shards[idx&uint32(h.shardCount-1)]
 	}
-	// fallback
-	return h.shards[0]
+	delete(jr.byPeer, fingerprint)
 }
 
-func (h *Hub) Register(p *peer.Peer) bool {
-	shard := h.shardFor(p.Fingerprint)
-	shard.mu.Lock()
+// dropRoom removes and returns the pending joins for a room that is gone.
+func (jr *joinRequests) dropRoom(roomID string) []*pendingJoin {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	room := jr.pending[roomID]
+	dropped := make([]*pendingJoin, 0, len(room))
+	for fingerprint, pj := range room {
+		pj.timer.Stop()
+		if jr.byPeer[fingerprint]--; jr.byPeer[fingerprint] <= 0 {
+			delete(jr.byPeer, fingerprint)
+		}
+		dropped = append(dropped, pj)
+	}
+	delete(jr.pending, roomID)
+	return dropped
+}
 
-	// check max peers inside lock to prevent race
-	current := h.peerCount.Load()
-	if existing, ok := shard.peers[p.Fingerprint]; ok {
-		// replacing existing peer, no net count change needed beyond swap
-		existing.Close()
-		shard.peers[p.Fingerprint] = p
-		shard.mu.Unlock()
+type relayKey struct {
+	from, to string
+	seq      uint64
+}
 
-		if p.Alias != "" {
-			h.storeAlias(p.Alias, p.Fingerprint)
+type inflightRelay struct {
+	sender    *peer.Peer
+	target    *peer.Peer
+	data      []byte
+	sends     int
+	timer     *time.Timer
+	requestID string
+}
+
+// reliableRelays tracks reliable relays until their target acks them.
+type reliableRelays struct {
+	inflight map[relayKey]*inflightRelay
+	// in-flight relays per sender fingerprint
+	bySender map[string]int
+	mu       sync.Mutex
+}
+
+// MessageHandler handles a custom message type registered with
+// RegisterHandler. msg is released once it returns and must not be kept.
+type MessageHandler func(p *peer.Peer, msg *protocol.Message)
+
+// ErrCoreMessageType is returned by RegisterHandler for a built-in or empty
+// message type.
+var ErrCoreMessageType = errors.New("hub: cannot register handler for core message type")
+
+var (
+	errRelayInFlight   = errors.New("seq already in flight")
+	errTooManyInFlight = errors.New("too many unacknowledged relays")
+)
+
+func newReliableRelays() *reliableRelays {
+	return &reliableRelays{
+		inflight: make(map[relayKey]*inflightRelay),
+		bySender: make(map[string]int),
+	}
+}
+
+// add tracks r and arms its retry timer, failing if the seq is already in
+// flight to the target or the sender has max relays in flight.
+func (rr *reliableRelays) add(key relayKey, r *inflightRelay, max int, timeout time.Duration, onTimeout func()) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if _, ok := rr.inflight[key]; ok {
+		return errRelayInFlight
+	}
+	if rr.bySender[key.from] >= max {
+		return errTooManyInFlight
+	}
+	r.timer = time.AfterFunc(timeout, onTimeout)
+	rr.inflight[key] = r
+	rr.bySender[key.from]++
+	return nil
+}
+
+// take removes and returns an in-flight relay.
+func (rr *reliableRelays) take(key relayKey) (*inflightRelay, bool) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	r, ok := rr.inflight[key]
+	if ok {
+		rr.removeLocked(key, r)
+	}
+	return r, ok
+}
+
+func (rr *reliableRelays) removeLocked(key relayKey, r *inflightRelay) {
+	r.timer.Stop()
+	delete(rr.inflight, key)
+	if rr.bySender[key.from]--; rr.bySender[key.from] <= 0 {
+		delete(rr.bySender, key.from)
+	}
+}
+
+// drop forgets every relay from or to fingerprint, e.g. when it leaves, or
+// all of them when fingerprint is empty.
+func (rr *reliableRelays) drop(fingerprint string) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	for key, r := range rr.inflight {
+		if fingerprint == "" || key.from == fingerprint || key.to == fingerprint {
+			rr.removeLocked(key, r)
 		}
-		return true
 	}
+}
+
+// heldLeaves records the namespaces each disconnected fingerprint's
+// peer_left is being held back in by DisconnectGrace, so a rejoin within the
+// grace sends no second peer_joined either.
+type heldLeaves struct {
+	byPeer map[string]map[string]struct{}
+	mu     sync.Mutex
+}
+
+func (hl *heldLeaves) hold(fingerprint string, namespaces []string) {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	held := hl.byPeer[fingerprint]
+	if held == nil {
+		held = make(map[string]struct{}, len(namespaces))
+		hl.byPeer[fingerprint] = held
+	}
+	for _, ns := range namespaces {
+		held[ns] = struct{}{}
+	}
+}
 
-	if int(current) >= h.maxPeers {
-		shard.mu.Unlock()
+// take reports whether fingerprint's peer_left in ns was being held, and
+// stops holding it.
+func (hl *heldLeaves) take(fingerprint, ns string) bool {
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+	held, ok := hl.byPeer[fingerprint]
+	if !ok {
+		return false
+	}
+	if _, ok = held[ns]; !ok {
 		return false
 	}
+	delete(held, ns)
+	if len(held) == 0 {
+		delete(hl.byPeer, fingerprint)
+	}
+	return true
+}
 
-	shard.peers[p.Fingerprint] = p
-	shard.mu.Unlock()
-	h.peerCount.Add(1)
+// presenceIndex maps watched fingerprints to the peers that asked for their
+// presence at registration.
+type presenceIndex struct {
+	watchers map[string]map[*peer.Peer]struct{}
+	mu       sync.RWMutex
+}
 
-	if p.Alias != "" {
-		h.storeAlias(p.Alias, p.Fingerprint)
+func (pi *presenceIndex) watch(p *peer.Peer) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	for _, fp := range p.WatchPresence {
+		if pi.watchers[fp] == nil {
+			pi.watchers[fp] = make(map[*peer.Peer]struct{})
+		}
+		pi.watchers[fp][p] = struct{}{}
 	}
-	return true
 }
 
-func (h *Hub) storeAlias(alias, fingerprint string) bool {
-	existing, loaded := h.aliases.LoadOrStore(alias, fingerprint)
-	if !loaded {
-		return true
+func (pi *presenceIndex) unwatch(p *peer.Peer) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+	for _, fp := range p.WatchPresence {
+		delete(pi.watchers[fp], p)
+		if len(pi.watchers[fp]) == 0 {
+			delete(pi.watchers, fp)
+		}
 	}
-	return existing.(string) == fingerprint
 }
 
-func (h *Hub) Unregister(fingerprint string) {
-	shard := h.shardFor(fingerprint)
-	shard.mu.Lock()
-	p, ok := shard.peers[fingerprint]
-	if ok {
-		delete(shard.peers, fingerprint)
+func (pi *presenceIndex) watchersOf(fingerprint string) []*peer.Peer {
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+	watchers := make([]*peer.Peer, 0, len(pi.watchers[fingerprint]))
+	for w := range pi.watchers[fingerprint] {
+		watchers = append(watchers, w)
 	}
-	shard.mu.Unlock()
+	return watchers
+}
 
-	if !ok {
+// identityIndex maps identities to the connected peers registered under
+// them, one per device.
+type identityIndex struct {
+	devices map[string]map[*peer.Peer]struct{}
+	mu      sync.RWMutex
+}
+
+func (ii *identityIndex) add(p *peer.Peer) {
+	if p.Identity == "" {
 		return
 	}
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	if ii.devices[p.Identity] == nil {
+		ii.devices[p.Identity] = make(map[*peer.Peer]struct{})
+	}
+	ii.devices[p.Identity][p] = struct{}{}
+}
 
-	h.peerCount.Add(-1)
-	h.matchmaker.RemoveFromAllQueues(fingerprint)
+func (ii *identityIndex) remove(p *peer.Peer) {
+	if p.Identity == "" {
+		return
+	}
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	delete(ii.devices[p.Identity], p)
+	if len(ii.devices[p.Identity]) == 0 {
+		delete(ii.devices, p.Identity)
+	}
+}
 
-	for _, ns := range p.GetNamespaces() {
-		if nsObj, exists := h.nsMgr.Get(ns); exists {
-			nsObj.Remove(fingerprint)
-			notify := protocol.NewMessage(protocol.TypePeerLeft, fingerprint, nil)
-			notify.Namespace = ns
-			nsObj.Broadcast(notify, fingerprint)
+func (ii *identityIndex) devicesOf(identity string) []*peer.Peer {
+	ii.mu.RLock()
+	defer ii.mu.RUnlock()
+	devices := make([]*peer.Peer, 0, len(ii.devices[identity]))
+	for p := range ii.devices[identity] {
+		devices = append(devices, p)
+	}
+	return devices
+}
 
-			if nsObj.IsRoom {
-				h.nsMgr.RemoveIfEmpty(ns)
+// coalescer holds broadcasts per namespace for BroadcastCoalesce.
+type coalescer struct {
+	pending map[*namespace.Namespace]*coalescedBroadcasts
+	mu      sync.Mutex
+}
+
+type coalescedBroadcasts struct {
+	msgs  [][]byte
+	from  []string
+	size  int
+	timer *time.Timer
+}
+
+// add queues data from sender for ns. flush gets the queued broadcasts once
+// window has passed since the first, with timed set as it runs on the
+// timer's goroutine, or right away on the caller's when they grow past
+// maxCoalescedBytes.
+func (c *coalescer) add(ns *namespace.Namespace, data []byte, from string, window time.Duration, flush func(msgs [][]byte, from []string, timed bool)) {
+	c.mu.Lock()
+	b := c.pending[ns]
+	if b == nil {
+		b = &coalescedBroadcasts{}
+		c.pending[ns] = b
+		b.timer = time.AfterFunc(window, func() {
+			if b := c.take(ns, b); b != nil {
+				flush(b.msgs, b.from, true)
 			}
+		})
+	}
+	b.msgs = append(b.msgs, data)
+	b.from = append(b.from, from)
+	b.size += len(data)
+	full := b.size >= maxCoalescedBytes
+	c.mu.Unlock()
+
+	if full {
+		if b := c.take(ns, b); b != nil {
+			b.timer.Stop()
+			flush(b.msgs, b.from, false)
 		}
 	}
+}
 
-	if p.Alias != "" {
-		h.aliases.Delete(p.Alias)
+// takeAll removes every pending batch and stops its timer, for Shutdown to
+// send them.
+func (c *coalescer) takeAll() map[*namespace.Namespace]*coalescedBroadcasts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending
+	c.pending = make(map[*namespace.Namespace]*coalescedBroadcasts)
+	for _, b := range pending {
+		b.timer.Stop()
+	}
+	return pending
+}
+
+// take removes b if it is still ns's pending batch, so only one of the
+// timer and an early flush sends it.
+func (c *coalescer) take(ns *namespace.Namespace, b *coalescedBroadcasts) *coalescedBroadcasts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[ns] != b {
+		return nil
 	}
-	p.Close()
+	delete(c.pending, ns)
+	return b
 }
 
-func (h *Hub) GetPeer(fingerprint string) (*peer.Peer, bool) {
-	shard := h.shardFor(fingerprint)
-	shard.mu.RLock()
-	defer shard.mu.RUnlock()
-	p, ok := shard.peers[fingerprint]
-	return p, ok
+// roomKeyTTL is how long a create_room idempotency key is remembered.
+const roomKeyTTL = 5 * time.Minute
+
+type roomKey struct {
+	owner string
+	key   string
 }
 
-func (h *Hub) ResolveAlias(alias string) (string, bool) {
-	fp, ok := h.aliases.Load(alias)
-	if ok {
-		return fp.(string), true
-	}
-	return "", false
+type createdRoom struct {
+	resp    protocol.RoomCreatedPayload
+	expires time.Time
 }
 
-func (h *Hub) HandleMessage(p *peer.Peer, data []byte) {
-	msg, err := protocol.Decode(data)
-	if err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid message"))
-		return
+// roomKeys remembers recent create_room idempotency keys per owner so a
+// retried create gets its original room_created back.
+type roomKeys struct {
+	keys map[roomKey]createdRoom
+	mu   sync.Mutex
+}
+
+func newRoomKeys() *roomKeys {
+	return &roomKeys{keys: make(map[roomKey]createdRoom)}
+}
+
+func (rk *roomKeys) put(owner, key string, resp protocol.RoomCreatedPayload) {
+	rk.mu.Lock()
+	defer rk.mu.Unlock()
+	now := time.Now()
+	for k, c := range rk.keys {
+		if now.After(c.expires) {
+			delete(rk.keys, k)
+		}
 	}
-	msg.From = p.Fingerprint
-	msg.Timestamp = time.Now().UnixMilli()
+	rk.keys[roomKey{owner, key}] = createdRoom{resp: resp, expires: now.Add(roomKeyTTL)}
+}
 
-	switch msg.Type {
-	case protocol.TypeJoin:
-		h.handleJoin(p, msg)
-	case protocol.TypeLeave:
-		h.handleLeave(p, msg)
-	case protocol.TypeSignal:
-		h.handleSignal(p, msg)
-	case protocol.TypeDiscover:
-		h.handleDiscover(p, msg)
-	case protocol.TypeMatch:
-		h.handleMatch(p, msg)
-	case protocol.TypeRelay:
-		h.handleRelay(p, msg)
-	case protocol.TypeBroadcast:
-		h.handleBroadcast(p, msg)
-	case protocol.TypeMetadata:
-		h.handleMetadata(p, msg)
-	case protocol.TypeCreateRoom:
-		h.handleCreateRoom(p, msg)
-	case protocol.TypeJoinRoom:
-		h.handleJoinRoom(p, msg)
-	case protocol.TypeRoomInfo:
-		h.handleRoomInfo(p, msg)
-	case protocol.TypeKick:
-		h.handleKick(p, msg)
-	case protocol.TypePing:
-		p.LastPing = time.Now()
-		p.SendRaw(protocol.PongBytes)
-	default:
-		p.SendMessage(protocol.NewError(400, "unknown message type"))
+func (rk *roomKeys) get(owner, key string) (protocol.RoomCreatedPayload, bool) {
+	rk.mu.Lock()
+	defer rk.mu.Unlock()
+	c, ok := rk.keys[roomKey{owner, key}]
+	if !ok || time.Now().After(c.expires) {
+		return protocol.RoomCreatedPayload{}, false
 	}
+	return c.resp, true
+}
 
-	protocol.ReleaseMessage(msg)
+func New(shardCount, maxPeers int, b broker.Broker) *Hub {
+	return NewWithOptions(shardCount, maxPeers, b, Options{})
 }
 
-func (h *Hub) handleJoin(p *peer.Peer, msg *protocol.Message) {
-	var payload protocol.JoinPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid join payload"))
-		return
+func NewWithOptions(shardCount, maxPeers int, b broker.Broker, opts Options) *Hub {
+	if opts.RoomSweepInterval <= 0 {
+		opts.RoomSweepInterval = 5 * time.Second
 	}
-	if payload.Namespace == "" {
-		p.SendMessage(protocol.NewError(400, "namespace required"))
+	if opts.JoinRequestTimeout <= 0 {
+		opts.JoinRequestTimeout = 60 * time.Second
+	}
+	if opts.TargetClaimWindow <= 0 {
+		opts.TargetClaimWindow = 500 * time.Millisecond
+	}
+	if opts.MaxPendingJoins <= 0 {
+		opts.MaxPendingJoins = 100
+	}
+	if opts.MaxPendingJoinsPerPeer <= 0 {
+		opts.MaxPendingJoinsPerPeer = 8
+	}
+	if opts.ReliableAckTimeout <= 0 {
+		opts.ReliableAckTimeout = time.Second
+	}
+	if opts.ReliableRetries < 0 {
+		opts.ReliableRetries = 0
+	}
+	if opts.MaxReliableInFlight <= 0 {
+		opts.MaxReliableInFlight = 64
+	}
+	if opts.MaxMatchGroupSize <= 0 {
+		opts.MaxMatchGroupSize = 16
+	}
+	if opts.MatchSessionTTL <= 0 {
+		opts.MatchSessionTTL = matchmaker.DefaultSessionTTL
+	}
+	if opts.MaxMatchRequestsPerPeer <= 0 {
+		opts.MaxMatchRequestsPerPeer = 8
+	}
+	if opts.MaxSignalAllMembers <= 0 {
+		opts.MaxSignalAllMembers = 16
+	}
+	if opts.RestoredRoomGrace <= 0 {
+		opts.RestoredRoomGrace = 5 * time.Minute
+	}
+	if opts.HandlerBurst <= 0 {
+		opts.HandlerBurst = 16
+	}
+	if opts.MaxPeerListBytes <= 0 {
+		opts.MaxPeerListBytes = 65536
+	}
+
+	shards := make([]*Shard, shardCount)
+	for i := range shards {
+		shards[i] = &Shard{peers: make(map[string]*peer.Peer)}
+	}
+	nsMgr := namespace.NewManager(maxPeers)
+	nsMgr.SetMaxNamespaces(opts.MaxNamespaces)
+	nsMgr.SetAliasIndex(opts.AliasScope == AliasScopeNamespace)
+
+	nodeID := ResolveNodeID(opts.NodeID)
+	instanceBytes := make([]byte, 8)
+	rand.Read(instanceBytes)
+
+	// a nil or noop broker means single node: no publishing, no subscriptions
+	_, localOnly := b.(*broker.NoopBroker)
+	if b == nil {
+		b, localOnly = broker.NewNoop(), true
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h := &Hub{
+		shards:     shards,
+		shardCount: shardCount,
+		shardChars: shardPrefixLen(shardCount),
+		nsMgr:      nsMgr,
+		matchmaker: matchmaker.New(nsMgr),
+		broker:     b,
+		maxPeers:   maxPeers,
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
+		nodeID:     nodeID,
+		instance:   hex.EncodeToString(instanceBytes),
+		localOnly:  localOnly,
+		opts:       opts,
+		joinReqs:   newJoinRequests(opts.MaxPendingJoins, opts.MaxPendingJoinsPerPeer),
+		reliable:   newReliableRelays(),
+		presence:   &presenceIndex{watchers: make(map[string]map[*peer.Peer]struct{})},
+		identities: &identityIndex{devices: make(map[string]map[*peer.Peer]struct{})},
+		coalesce:   &coalescer{pending: make(map[*namespace.Namespace]*coalescedBroadcasts)},
+		roomKeys:   newRoomKeys(),
+		held:       &heldLeaves{byPeer: make(map[string]map[string]struct{})},
+	}
+
+	h.matchmaker.SetSessionTTL(opts.MatchSessionTTL)
+	if opts.MaxJoinsPerSec > 0 {
+		h.joinLimit = middleware.NewRateLimiter(opts.MaxJoinsPerSec, opts.MaxJoinsPerSec, 0)
+	}
+
+	if opts.SnapshotPath != "" {
+		if err := h.loadSnapshot(opts.SnapshotPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("snapshot load error: %v", err)
+		}
+	}
+
+	if opts.SharedMatchmaking {
+		if q, ok := b.(broker.MatchQueue); ok && !localOnly {
+			h.matchmaker.SetShared(q, nodeID)
+			h.sharedMatch = true
+		} else {
+			log.Printf("shared_matchmaking needs a broker with match queues, matching locally")
+		}
+	}
+
+	if !localOnly {
+		b.Subscribe(ctx, "signal", func(_ string, data []byte) {
+			h.handleBrokerMessage(data)
+		})
+		b.Subscribe(ctx, "relay", func(_ string, data []byte) {
+			h.handleBrokerMessage(data)
+		})
+		b.Subscribe(ctx, "broadcast", func(_ string, data []byte) {
+			h.handleBrokerBroadcast(data)
+		})
+		b.Subscribe(ctx, "control", func(_ string, data []byte) {
+			h.handleBrokerControl(data)
+		})
+		if h.sharedMatch {
+			b.Subscribe(ctx, "matchmaking", func(_ string, data []byte) {
+				h.handleBrokerMatch(data)
+			})
+		}
+		h.announceNode(false)
+	}
+
+	go h.maintenance()
+	if opts.AsyncBroadcastThreshold > 0 {
+		h.fanout = make(chan func(), fanoutQueueSize)
+		h.fanoutQueued = make(map[string]int)
+		go h.fanoutWorker()
+	}
+	if opts.MaxConcurrentBroadcasts > 0 {
+		h.broadcastSlots = make(chan struct{}, opts.MaxConcurrentBroadcasts)
+	}
+	if opts.MaxRoomIdleTTL > 0 || opts.MatchRoomLifetime > 0 {
+		go h.roomSweeper()
+	}
+	if opts.HandlerWorkers > 0 {
+		h.workers = &dispatcher{
+			queues: make(map[*peer.Peer][][]byte),
+			work:   make(chan *peer.Peer, opts.HandlerWorkers*64),
+		}
+		for i := 0; i < opts.HandlerWorkers; i++ {
+			go h.handlerWorker()
+		}
+	}
+	return h
+}
+
+// fanOut runs send, the fan-out of a broadcast into ns, on the fan-out
+// worker when ns is over AsyncBroadcastThreshold. One worker keeps
+// broadcasts in order, so once ns has one queued its later broadcasts are
+// queued behind it whatever its size, and a full queue blocks rather than
+// letting send run inline ahead of them.
+func (h *Hub) fanOut(ns *namespace.Namespace, send func()) {
+	if h.fanout == nil {
+		send()
+		return
+	}
+	h.fanoutMu.Lock()
+	if h.fanoutQueued[ns.Name] == 0 && ns.Count() <= h.opts.AsyncBroadcastThreshold {
+		h.fanoutMu.Unlock()
+		send()
+		return
+	}
+	h.fanoutQueued[ns.Name]++
+	h.fanoutMu.Unlock()
+
+	job := func() {
+		send()
+		h.fanoutMu.Lock()
+		if h.fanoutQueued[ns.Name]--; h.fanoutQueued[ns.Name] <= 0 {
+			delete(h.fanoutQueued, ns.Name)
+		}
+		h.fanoutMu.Unlock()
+	}
+	select {
+	case h.fanout <- job:
+	case <-h.done:
+	}
+}
+
+// acquireBroadcast takes a MaxConcurrentBroadcasts slot for a peer's or
+// another node's broadcast, waiting up to broadcastSlotWait, and reports
+// whether it got one. The slot covers the broadcast's inline fan-out; one
+// handed to the fan-out worker is already bounded by its queue.
+func (h *Hub) acquireBroadcast() bool {
+	if h.broadcastSlots == nil {
+		return true
+	}
+	select {
+	case h.broadcastSlots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(broadcastSlotWait)
+	defer timer.Stop()
+	select {
+	case h.broadcastSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		h.broadcastsRejected.Add(1)
+		return false
+	}
+}
+
+// waitBroadcastSlot is acquireBroadcast for the hub's own broadcasts, such
+// as coalesced batches, which have no sender to refuse and so wait for a
+// slot however long it takes. It reports false if the hub shut down first.
+func (h *Hub) waitBroadcastSlot() bool {
+	if h.broadcastSlots == nil {
+		return true
+	}
+	select {
+	case h.broadcastSlots <- struct{}{}:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+func (h *Hub) releaseBroadcast() {
+	if h.broadcastSlots != nil {
+		<-h.broadcastSlots
+	}
+}
+
+func (h *Hub) fanoutWorker() {
+	for {
+		select {
+		case send := <-h.fanout:
+			send()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Dispatch hands a message to the worker pool, or handles it inline when no
+// pool is configured. Messages from one peer are always handled in order.
+func (h *Hub) Dispatch(p *peer.Peer, data []byte) {
+	d := h.workers
+	if d == nil {
+		h.HandleMessage(p, data)
+		return
+	}
+
+	d.mu.Lock()
+	pending, scheduled := d.queues[p]
+	if len(pending) >= maxPendingPerPeer {
+		d.mu.Unlock()
+		p.RecordError(429, "rate limited")
+		p.SendRaw(protocol.RateLimitBytes)
+		return
+	}
+	d.queues[p] = append(pending, data)
+	d.mu.Unlock()
+
+	if !scheduled {
+		select {
+		case d.work <- p:
+		case <-h.done:
+		}
+	}
+}
+
+func (h *Hub) handlerWorker() {
+	d := h.workers
+	for {
+		select {
+		case p := <-d.work:
+			h.drainPeer(p)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// drainPeer handles a peer's queued messages until none are left, then
+// releases the peer so the next Dispatch schedules it again. After
+// HandlerBurst messages a peer with more waiting goes to the back of the
+// queue, still owned by the pool, so other peers get a turn.
+func (h *Hub) drainPeer(p *peer.Peer) {
+	d := h.workers
+	for handled := 0; ; handled++ {
+		d.mu.Lock()
+		pending := d.queues[p]
+		if len(pending) == 0 {
+			delete(d.queues, p)
+			d.mu.Unlock()
+			return
+		}
+		if handled >= h.opts.HandlerBurst {
+			d.mu.Unlock()
+			select {
+			case d.work <- p:
+				return
+			default:
+				// queue full, keep going rather than block a worker on it
+				handled = 0
+			}
+			d.mu.Lock()
+			pending = d.queues[p]
+		}
+		data := pending[0]
+		pending[0] = nil
+		d.queues[p] = pending[1:]
+		d.mu.Unlock()
+
+		// the peer may have disconnected while its messages were queued
+		if p.IsClosed() {
+			continue
+		}
+		h.HandleMessage(p, data)
+	}
+}
+
+func (h *Hub) shardFor(fingerprint string) *Shard {
+	return h.shards[shardIndex(fingerprint, h.shardCount, h.shardChars)]
+}
+
+// shardPrefixLen is how many leading hex chars of a fingerprint shardIndex
+// reads for count shards: just enough to address them all when count is a
+// power of two, two more otherwise so the modulo bias stays under 1%, and at
+// most 8 (32 bits).
+func shardPrefixLen(count int) int {
+	n := 1
+	for n < 8 && 1<<(4*n) < count {
+		n++
+	}
+	if count&(count-1) != 0 {
+		n += 2
+	}
+	if n > 8 {
+		n = 8
+	}
+	return n
+}
+
+// shardIndex maps a fingerprint to one of count shards. Fingerprints are hex
+// sha256, so their first prefixLen chars are already uniform; shorter or
+// non-hex ones are hashed whole instead.
+func shardIndex(fingerprint string, count, prefixLen int) uint32 {
+	if len(fingerprint) >= prefixLen {
+		var idx uint32
+		isHex := true
+		for i := 0; i < prefixLen && isHex; i++ {
+			c := fingerprint[i]
+			switch {
+			case c >= '0' && c <= '9':
+				idx = idx<<4 | uint32(c-'0')
+			case c >= 'a' && c <= 'f':
+				idx = idx<<4 | uint32(c-'a'+10)
+			case c >= 'A' && c <= 'F':
+				idx = idx<<4 | uint32(c-'A'+10)
+			default:
+				isHex = false
+			}
+		}
+		if isHex {
+			return idx % uint32(count)
+		}
+	}
+	// fnv-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(fingerprint); i++ {
+		h ^= uint32(fingerprint[i])
+		h *= 16777619
+	}
+	return h % uint32(count)
+}
+
+func (h *Hub) Register(p *peer.Peer) bool {
+	shard := h.shardFor(p.Fingerprint)
+	shard.mu.Lock()
+
+	// check max peers inside lock to prevent race
+	current := h.peerCount.Load()
+	if existing, ok := shard.peers[p.Fingerprint]; ok {
+		// replacing existing peer, no net count change needed beyond swap
+		shard.peers[p.Fingerprint] = p
+		shard.mu.Unlock()
+		// tell the old connection why it is going away, off the caller's path
+		go existing.CloseWithMessage(protocol.ReplacedBytes, time.Second)
+
+		if p.Alias != "" {
+			h.storeAlias(p.Alias, p.Fingerprint)
+		}
+		h.identities.remove(existing)
+		h.identities.add(p)
+		h.presence.unwatch(existing)
+		h.registerPresence(p)
+		switch {
+		case sharesPresence(p) && !sharesPresence(existing):
+			h.announcePresence(p, protocol.PresenceOnline)
+		case !sharesPresence(p) && sharesPresence(existing):
+			h.announcePresence(p, protocol.PresenceOffline)
+		}
+		return true
+	}
+
+	if int(current) >= h.maxPeers {
+		shard.mu.Unlock()
+		return false
+	}
+
+	shard.peers[p.Fingerprint] = p
+	shard.mu.Unlock()
+	h.peerCount.Add(1)
+
+	if p.Alias != "" {
+		h.storeAlias(p.Alias, p.Fingerprint)
+	}
+	h.identities.add(p)
+	h.registerPresence(p)
+	if sharesPresence(p) {
+		h.announcePresence(p, protocol.PresenceOnline)
+	}
+	return true
+}
+
+// sharesPresence reports whether p's watchers hear about it. Observers stay
+// invisible.
+func sharesPresence(p *peer.Peer) bool {
+	return p.SharePresence && !p.Observer
+}
+
+// registerPresence indexes p's watch list and tells it which of the peers
+// it watches are already online.
+func (h *Hub) registerPresence(p *peer.Peer) {
+	if len(p.WatchPresence) == 0 {
+		return
+	}
+	h.presence.watch(p)
+	for _, fp := range p.WatchPresence {
+		if watched, ok := h.GetPeer(fp); ok && sharesPresence(watched) {
+			p.SendMessage(presenceMessage(watched, protocol.PresenceOnline))
+		}
+	}
+}
+
+// announcePresence tells everyone watching p that it came online or went
+// offline.
+func (h *Hub) announcePresence(p *peer.Peer, status string) {
+	watchers := h.presence.watchersOf(p.Fingerprint)
+	if len(watchers) == 0 {
+		return
+	}
+	data, err := protocol.Encode(presenceMessage(p, status))
+	if err != nil {
+		return
+	}
+	for _, w := range watchers {
+		w.SendRaw(data)
+	}
+}
+
+func presenceMessage(p *peer.Peer, status string) *protocol.Message {
+	return protocol.NewMessage(protocol.TypePresence, p.Fingerprint, protocol.PresencePayload{
+		Fingerprint: p.Fingerprint,
+		Alias:       p.Alias,
+		Status:      status,
+	})
+}
+
+func (h *Hub) storeAlias(alias, fingerprint string) bool {
+	// namespace scoped aliases are indexed by each namespace on join
+	if h.opts.DisableAliases || h.opts.AliasScope == AliasScopeNamespace {
+		return false
+	}
+	existing, loaded := h.aliases.LoadOrStore(alias, fingerprint)
+	if !loaded {
+		return true
+	}
+	return existing.(string) == fingerprint
+}
+
+func (h *Hub) Unregister(fingerprint string) {
+	h.unregister(fingerprint, nil)
+}
+
+// UnregisterPeer is Unregister for a specific connection. If p has already
+// been replaced by a newer connection with the same fingerprint, only p's
+// own leftover namespace entries are removed and the newer peer is left
+// registered.
+func (h *Hub) UnregisterPeer(p *peer.Peer) {
+	h.unregister(p.Fingerprint, p)
+}
+
+// UnregisterOnDone unregisters p as soon as ctx is done, so capacity is freed
+// even if the connection's own cleanup is late. Calling the returned stop
+// function cancels the watchdog.
+func (h *Hub) UnregisterOnDone(ctx context.Context, p *peer.Peer) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		h.UnregisterPeer(p)
+	})
+}
+
+func (h *Hub) unregister(fingerprint string, expect *peer.Peer) {
+	shard := h.shardFor(fingerprint)
+	shard.mu.Lock()
+	p, ok := shard.peers[fingerprint]
+	if ok && expect != nil && p != expect {
+		ok = false
+	}
+	if ok {
+		delete(shard.peers, fingerprint)
+	}
+	shard.mu.Unlock()
+
+	if !ok {
+		if expect != nil {
+			h.removeStalePeer(expect)
+		}
+		return
+	}
+
+	// closed before its namespaces are read, so a join racing with this
+	// either lands in time to be cleaned up here or sees p closed and
+	// undoes itself; see undoClosedJoin
+	p.Close()
+	h.peerCount.Add(-1)
+	h.matchmaker.RemoveFromAllQueues(fingerprint)
+
+	var left []string
+	for _, ns := range p.GetNamespaces() {
+		if nsObj, exists := h.nsMgr.Get(ns); exists {
+			nsObj.Remove(fingerprint)
+			if !p.Observer {
+				if h.opts.DisconnectGrace > 0 {
+					left = append(left, ns)
+				} else {
+					h.notifyLeft(nsObj, fingerprint)
+				}
+			}
+
+			if nsObj.IsRoom {
+				h.removeEmptyRoom(ns)
+			}
+		}
+	}
+	h.holdLeft(fingerprint, left)
+	h.unwatchAll(p)
+	h.joinReqs.dropPeer(fingerprint)
+	h.reliable.drop(fingerprint)
+	h.identities.remove(p)
+	h.presence.unwatch(p)
+	if sharesPresence(p) {
+		h.announcePresence(p, protocol.PresenceOffline)
+	}
+	if h.joinLimit != nil {
+		h.joinLimit.Remove(joinLimitKey(fingerprint))
+	}
+
+	if p.Alias != "" {
+		h.aliases.Delete(p.Alias)
+	}
+}
+
+// notifyLeft tells ns and its watchers that fingerprint left.
+func (h *Hub) notifyLeft(ns *namespace.Namespace, fingerprint string) {
+	notify := protocol.NewMessage(protocol.TypePeerLeft, fingerprint, nil)
+	notify.Namespace = ns.Name
+	ns.Broadcast(notify, fingerprint)
+	h.notifyWatchers(ns, notify)
+}
+
+// holdLeft holds back fingerprint's peer_left in namespaces for
+// DisconnectGrace.
+func (h *Hub) holdLeft(fingerprint string, namespaces []string) {
+	if len(namespaces) == 0 {
+		return
+	}
+	h.held.hold(fingerprint, namespaces)
+	time.AfterFunc(h.opts.DisconnectGrace, func() { h.notifyLeftAfterGrace(fingerprint, namespaces) })
+}
+
+// notifyLeftAfterGrace sends the peer_left held back by DisconnectGrace to
+// each namespace fingerprint was in, except those it has rejoined since.
+func (h *Hub) notifyLeftAfterGrace(fingerprint string, namespaces []string) {
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	current, reconnected := h.GetPeer(fingerprint)
+	for _, name := range namespaces {
+		// a rejoin takes the hold
+		if !h.held.take(fingerprint, name) || (reconnected && current.InNamespace(name)) {
+			continue
+		}
+		if ns, ok := h.nsMgr.Get(name); ok {
+			h.notifyLeft(ns, fingerprint)
+		}
+	}
+}
+
+// removeStalePeer drops a replaced connection from the namespaces that still
+// point at it, without touching the peer count, queues or alias that now
+// belong to the newer connection.
+func (h *Hub) removeStalePeer(p *peer.Peer) {
+	p.Close()
+	var left []string
+	for _, ns := range p.GetNamespaces() {
+		nsObj, exists := h.nsMgr.Get(ns)
+		if !exists || !nsObj.RemovePeer(p) {
+			continue
+		}
+		if !p.Observer {
+			if h.opts.DisconnectGrace > 0 {
+				left = append(left, ns)
+			} else {
+				h.notifyLeft(nsObj, p.Fingerprint)
+			}
+		}
+		if nsObj.IsRoom {
+			h.removeEmptyRoom(ns)
+		}
+	}
+	h.holdLeft(p.Fingerprint, left)
+	h.unwatchAll(p)
+	h.identities.remove(p)
+	h.presence.unwatch(p)
+}
+
+// undoClosedJoin takes p back out of ns if it was closed while joining, and
+// reports whether it did. Unregister closes p before reading its namespaces,
+// so a join it missed always sees p closed here. Callers check before
+// announcing peer_joined, so there is no peer_left to send.
+func (h *Hub) undoClosedJoin(p *peer.Peer, ns *namespace.Namespace) bool {
+	if !p.IsClosed() {
+		return false
+	}
+	ns.RemovePeer(p)
+	p.LeaveNamespace(ns.Name)
+	if ns.IsRoom {
+		h.removeEmptyRoom(ns.Name)
+	}
+	return true
+}
+
+func (h *Hub) GetPeer(fingerprint string) (*peer.Peer, bool) {
+	shard := h.shardFor(fingerprint)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	p, ok := shard.peers[fingerprint]
+	return p, ok
+}
+
+// ResolveAlias returns the fingerprint behind alias. With namespace scoped
+// aliases it is looked up among the members of ns, which must be given;
+// otherwise ns is ignored.
+func (h *Hub) ResolveAlias(ns, alias string) (string, bool) {
+	if h.opts.DisableAliases {
+		return "", false
+	}
+	if h.opts.AliasScope == AliasScopeNamespace {
+		nsObj, ok := h.nsMgr.Get(ns)
+		if !ok {
+			return "", false
+		}
+		return nsObj.ResolveAlias(alias)
+	}
+	fp, ok := h.aliases.Load(alias)
+	if ok {
+		return fp.(string), true
+	}
+	return "", false
+}
+
+func (h *Hub) HandleMessage(p *peer.Peer, data []byte) {
+	if !h.enterHandler() {
+		return
+	}
+	defer h.handlers.Done()
+
+	var msgType, requestID string
+	if h.opts.SlowHandlerThreshold > 0 {
+		start := time.Now()
+		defer func() { h.noteHandlerTime(p, msgType, requestID, time.Since(start)) }()
+	}
+
+	if len(data) > 0 && data[0] == peer.BinaryMarker {
+		msgType = "binary broadcast"
+		h.handleBinaryBroadcast(p, data[1:])
+		return
+	}
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid message"))
+		return
+	}
+	// handlers may release msg, keep the type and id for noteHandlerTime
+	msgType = msg.Type
+	msg.From = p.Fingerprint
+	msg.Timestamp = time.Now().UnixMilli()
+	// set by nodes for the broker, never taken from a client; a forged
+	// claim_id would cancel another sender's pending claim
+	msg.NodeID = ""
+	msg.ClaimID = ""
+	msg.FromNamespaces = nil
+	if msg.RequestID == "" {
+		msg.RequestID = h.nextRequestID()
+	}
+	requestID = msg.RequestID
+	if msg.Expired(msg.Timestamp) {
+		p.SendMessage(protocol.NewErrorFor(msg, 408, "message expired"))
+		protocol.ReleaseMessage(msg)
+		return
+	}
+	if p.Observer && !observerAllowed(msg.Type) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "observers cannot send"))
+		protocol.ReleaseMessage(msg)
+		return
+	}
+	// only relays may be sent gzipped; broadcasts say so in their payload
+	if msg.Encoding != "" && msg.Type != protocol.TypeRelay {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "unsupported encoding"))
+		protocol.ReleaseMessage(msg)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.TypeJoin:
+		h.handleJoin(p, msg)
+	case protocol.TypeLeave:
+		h.handleLeave(p, msg)
+	case protocol.TypeSignal:
+		h.handleSignal(p, msg)
+	case protocol.TypeSignalAll:
+		h.handleSignalAll(p, msg)
+	case protocol.TypeDiscover:
+		h.handleDiscover(p, msg)
+	case protocol.TypeMatch:
+		h.handleMatch(p, msg)
+	case protocol.TypeMatchLookup:
+		h.handleMatchLookup(p, msg)
+	case protocol.TypeRelay:
+		h.handleRelay(p, msg)
+	case protocol.TypeRelayAck:
+		h.handleRelayAck(p, msg)
+	case protocol.TypeBroadcast:
+		h.handleBroadcast(p, msg)
+	case protocol.TypeMetadata:
+		h.handleMetadata(p, msg)
+	case protocol.TypeSetReady:
+		h.handleSetReady(p, msg)
+	case protocol.TypeLobbyStatus:
+		h.handleLobbyStatus(p, msg)
+	case protocol.TypeUpdateInfo:
+		h.handleUpdateInfo(p, msg)
+	case protocol.TypeCreateRoom:
+		h.handleCreateRoom(p, msg)
+	case protocol.TypeJoinRoom:
+		h.handleJoinRoom(p, msg)
+	case protocol.TypeRoomInfo:
+		h.handleRoomInfo(p, msg)
+	case protocol.TypeKick:
+		h.handleKick(p, msg)
+	case protocol.TypeMyRooms:
+		h.handleMyRooms(p)
+	case protocol.TypeRoomRelay:
+		h.handleRoomRelay(p, msg)
+	case protocol.TypeSetRoomMeta:
+		h.handleSetRoomMeta(p, msg)
+	case protocol.TypeWatch:
+		h.handleWatch(p, msg)
+	case protocol.TypeUnwatch:
+		h.handleUnwatch(p, msg)
+	case protocol.TypeApproveJoin:
+		h.handleJoinDecision(p, msg, true)
+	case protocol.TypeDenyJoin:
+		h.handleJoinDecision(p, msg, false)
+	case protocol.TypePing:
+		p.LastPing = time.Now()
+		p.SendRaw(protocol.PongBytes)
+	default:
+		if fn, ok := h.custom.Load(msg.Type); ok {
+			fn.(MessageHandler)(p, msg)
+			break
+		}
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "unknown message type"))
+	}
+
+	protocol.ReleaseMessage(msg)
+}
+
+// RegisterHandler makes HandleMessage pass messages of msgType to fn, with
+// From set to the sender. It replaces any handler registered before for
+// msgType. Built-in types can't be overridden.
+func (h *Hub) RegisterHandler(msgType string, fn MessageHandler) error {
+	if msgType == "" || protocol.IsCoreType(msgType) {
+		return ErrCoreMessageType
+	}
+	h.custom.Store(msgType, fn)
+	return nil
+}
+
+// enterHandler registers an in-flight handler, false once Shutdown has
+// started and the message should be dropped.
+func (h *Hub) enterHandler() bool {
+	h.handlersMu.Lock()
+	defer h.handlersMu.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+// drainHandlers stops new messages from being handled and waits up to
+// timeout for the ones in flight, false if some were still running.
+func (h *Hub) drainHandlers(timeout time.Duration) bool {
+	h.handlersMu.Lock()
+	h.shuttingDown = true
+	h.handlersMu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// nextRequestID names a message the client sent without a request_id. The
+// node prefix keeps ids unique across nodes sharing a broker.
+func (h *Hub) nextRequestID() string {
+	return h.nodeID[:8] + "-" + strconv.FormatUint(h.requestSeq.Add(1), 36)
+}
+
+// observerAllowed lists the message types an observer connection may send:
+// joining, leaving and looking around, and acking relays it was sent.
+// Anything that reaches or changes what other peers see is refused, as is
+// any type added later or by RegisterHandler until it is listed here.
+func observerAllowed(typ string) bool {
+	switch typ {
+	case protocol.TypeJoin, protocol.TypeLeave, protocol.TypeDiscover, protocol.TypeMatchLookup,
+		protocol.TypeRelayAck, protocol.TypeMetadata, protocol.TypeLobbyStatus,
+		protocol.TypeJoinRoom, protocol.TypeRoomInfo, protocol.TypeMyRooms,
+		protocol.TypeWatch, protocol.TypeUnwatch, protocol.TypePing:
+		return true
+	}
+	return false
+}
+
+// noteHandlerTime logs a HandleMessage call that took longer than
+// SlowHandlerThreshold. Logs are at least slowHandlerLogEvery apart; the
+// next one says how many slow calls were skipped in between.
+func (h *Hub) noteHandlerTime(p *peer.Peer, msgType, requestID string, elapsed time.Duration) {
+	if elapsed <= h.opts.SlowHandlerThreshold {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := h.slowLoggedAt.Load()
+	if now-last < int64(slowHandlerLogEvery) || !h.slowLoggedAt.CompareAndSwap(last, now) {
+		h.slowSuppressed.Add(1)
+		return
+	}
+	if skipped := h.slowSuppressed.Swap(0); skipped > 0 {
+		log.Printf("slow handler: %s from %s [request_id=%s] took %v (%d more not logged)", msgType, p.Fingerprint, requestID, elapsed, skipped)
+		return
+	}
+	log.Printf("slow handler: %s from %s [request_id=%s] took %v", msgType, p.Fingerprint, requestID, elapsed)
+}
+
+// allowJoin charges a join to p's join rate, replying 429 when it is spent.
+func (h *Hub) allowJoin(p *peer.Peer, msg *protocol.Message) bool {
+	if h.joinLimit == nil {
+		return true
+	}
+	ok, retry := h.joinLimit.AllowWithRetry(joinLimitKey(p.Fingerprint))
+	if !ok {
+		e := protocol.NewErrorRetry(429, "join rate limited", (retry + time.Millisecond - 1).Milliseconds())
+		e.RequestID = msg.RequestID
+		p.SendMessage(e)
+	}
+	return ok
+}
+
+func joinLimitKey(fingerprint string) string {
+	return fingerprint + ":join"
+}
+
+func (h *Hub) handleJoin(p *peer.Peer, msg *protocol.Message) {
+	if !h.allowJoin(p, msg) {
+		return
+	}
+	var payload protocol.JoinPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid join payload"))
+		return
+	}
+	if payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+
+	ns := h.nsMgr.GetOrCreate(payload.Namespace)
+	if ns == nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 503, "namespace capacity reached"))
+		return
+	}
+	// rooms are joined through join_room, which applies reservations,
+	// approval and MaxRoomsJoinedPerPeer
+	if ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "use join_room"))
+		return
+	}
+	if !ns.Add(p) {
+		p.SendMessage(protocol.NewErrorFor(msg, 429, "namespace full"))
+		return
+	}
+	p.JoinNamespace(payload.Namespace, payload.AppType, payload.Version, payload.Meta)
+	if h.undoClosedJoin(p, ns) {
+		return
+	}
+	h.audit(audit.EventJoin, p, payload.Namespace, "", nil)
+
+	// back within DisconnectGrace, the namespace never heard it left
+	rejoined := h.held.take(p.Fingerprint, payload.Namespace)
+	if !p.Observer && !rejoined {
+		notify := protocol.NewMessage(protocol.TypePeerJoined, p.Fingerprint, p.InfoForNamespace(payload.Namespace))
+		notify.Namespace = payload.Namespace
+		ns.Broadcast(notify, p.Fingerprint)
+		h.notifyWatchers(ns, notify)
+	}
+
+	peers, _ := ns.ListFields(50, nil, payload.Fields)
+	h.sendPeerList(p, msg, protocol.PeerListPayload{
+		Namespace: payload.Namespace,
+		Peers:     peers,
+		Total:     ns.VisibleCount(),
+	})
+	h.sendWelcome(p, ns)
+}
+
+// peerListOverhead is room left in each peer_list chunk for the message
+// envelope and the chunk and last fields.
+const peerListOverhead = 128
+
+// sendPeerList sends list as one peer_list, or split into chunks when it
+// would encode to more than MaxPeerListBytes. A single peer too big for a
+// chunk still goes in one of its own. Chunks that wouldn't all fit in p's
+// send buffer get a 413 error for req instead, as a list missing chunks
+// can't be reassembled.
+func (h *Hub) sendPeerList(p *peer.Peer, req *protocol.Message, list protocol.PeerListPayload) {
+	resp := protocol.NewMessage(protocol.TypePeerList, "", list)
+	if len(resp.Payload)+peerListOverhead <= h.opts.MaxPeerListBytes {
+		p.SendMessage(resp)
+		return
+	}
+
+	all := list.Peers
+	list.Peers = nil
+	empty, _ := json.Marshal(list)
+	budget := h.opts.MaxPeerListBytes - peerListOverhead - len(empty)
+
+	var chunks [][]protocol.PeerInfo
+	start, size := 0, 0
+	for i, pi := range all {
+		data, _ := json.Marshal(pi)
+		// one more byte for the comma
+		if n := len(data) + 1; i > start && size+n > budget {
+			chunks = append(chunks, all[start:i])
+			start, size = i, n
+		} else {
+			size += n
+		}
+	}
+	chunks = append(chunks, all[start:])
+
+	if len(chunks) > cap(p.Send)-len(p.Send) {
+		p.SendMessage(protocol.NewErrorFor(req, 413, "peer list too large, use a smaller limit"))
+		return
+	}
+	for i, peers := range chunks {
+		list.Peers = peers
+		list.Chunk = i + 1
+		list.Last = i == len(chunks)-1
+		if err := p.SendMessage(protocol.NewMessage(protocol.TypePeerList, "", list)); err != nil {
+			return
+		}
+	}
+}
+
+// sendWelcome sends p the namespace's welcome message, if it has one.
+func (h *Hub) sendWelcome(p *peer.Peer, ns *namespace.Namespace) {
+	motd := ns.Motd()
+	if motd == "" {
+		motd, _ = matchNamespace(h.opts.Welcome, ns.Name)
+	}
+	if motd == "" {
+		return
+	}
+	welcome := protocol.NewMessage(protocol.TypeWelcome, "", protocol.WelcomePayload{Namespace: ns.Name, Message: motd})
+	welcome.Namespace = ns.Name
+	p.SendMessage(welcome)
+}
+
+func (h *Hub) handleLeave(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.LeavePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	if len(payload.Message) > maxLeaveMessageLen {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "leave message too large"))
+		return
+	}
+
+	ns := payload.Namespace
+	if nsObj, ok := h.nsMgr.Get(ns); ok {
+		nsObj.Remove(p.Fingerprint)
+		if !p.Observer {
+			var farewell interface{}
+			if payload.Message != "" {
+				farewell = protocol.PeerLeftPayload{Message: payload.Message}
+			}
+			notify := protocol.NewMessage(protocol.TypePeerLeft, p.Fingerprint, farewell)
+			notify.Namespace = ns
+			nsObj.Broadcast(notify, p.Fingerprint)
+			h.notifyWatchers(nsObj, notify)
+		}
+
+		if nsObj.IsRoom {
+			h.removeEmptyRoom(ns)
+		}
+	}
+	p.LeaveNamespace(ns)
+	h.matchmaker.RemoveFromQueue(p.Fingerprint, ns)
+}
+
+func (h *Hub) handleSignal(p *peer.Peer, msg *protocol.Message) {
+	to := msg.To
+	if to == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "target peer required"))
+		return
+	}
+	if !h.checkSignalSize(p, msg) {
+		return
+	}
+	if fp, ok := h.resolveTarget(p, msg.Namespace, to); ok {
+		to = fp
+		msg.To = to
+	}
+
+	h.touchRoom(p, msg.Namespace)
+
+	target, ok := h.GetPeer(to)
+	if ok {
+		if !h.opts.AllowCrossNamespaceSignal && !p.SharesNamespace(target) {
+			p.SendMessage(protocol.NewErrorFor(msg, 403, "no shared namespace"))
+			return
+		}
+		h.audit(audit.EventSignal, p, msg.Namespace, to, msg.Payload)
+		forward(target, msg)
+		return
+	}
+	if h.localOnly {
+		h.targetNotFound.Add(1)
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "target not found"))
+		return
+	}
+
+	// cross-node: stamp origin and publish
+	h.audit(audit.EventSignal, p, msg.Namespace, to, msg.Payload)
+	h.stampOrigin(p, msg)
+	if msg.RequireTarget {
+		msg.ClaimID = h.awaitClaim(p, msg.RequestID)
+	}
+	data, _ := protocol.Encode(msg)
+	h.publish("signal", data)
+}
+
+// checkSignalSize enforces MaxSDPBytes and MaxCandidateBytes, replying 413
+// when the signal is over either. The payload is only decoded when a limit
+// is set.
+func (h *Hub) checkSignalSize(p *peer.Peer, msg *protocol.Message) bool {
+	if h.opts.MaxSDPBytes <= 0 && h.opts.MaxCandidateBytes <= 0 {
+		return true
+	}
+	var payload protocol.SignalPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid signal payload"))
+		return false
+	}
+	if h.opts.MaxSDPBytes > 0 && len(payload.SDP) > h.opts.MaxSDPBytes {
+		p.SendMessage(protocol.NewErrorFor(msg, 413, "sdp too large"))
+		return false
+	}
+	if h.opts.MaxCandidateBytes > 0 && len(payload.Candidate) > h.opts.MaxCandidateBytes {
+		p.SendMessage(protocol.NewErrorFor(msg, 413, "candidate too large"))
+		return false
+	}
+	return true
+}
+
+// handleSignalAll forwards one signal to every other member of msg.Namespace
+// as an individual signal, for mesh setups where each pair negotiates.
+func (h *Hub) handleSignalAll(p *peer.Peer, msg *protocol.Message) {
+	if msg.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	ns, ok := h.nsMgr.Get(msg.Namespace)
+	if !ok || !ns.Has(p.Fingerprint) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
+		return
+	}
+	if ns.VisibleCount()-1 > h.opts.MaxSignalAllMembers {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace too large for signal_all"))
+		return
+	}
+	if !h.checkSignalSize(p, msg) {
+		return
+	}
+
+	ns.Touch()
+
+	out := protocol.Message{
+		Type:      protocol.TypeSignal,
+		From:      p.Fingerprint,
+		Namespace: msg.Namespace,
+		Payload:   msg.Payload,
+		Timestamp: msg.Timestamp,
+		ExpiresAt: msg.ExpiresAt,
+	}
+	for _, target := range ns.Snapshot() {
+		if target.Fingerprint == p.Fingerprint || target.Observer {
+			continue
+		}
+		out.To = target.Fingerprint
+		h.audit(audit.EventSignal, p, msg.Namespace, target.Fingerprint, msg.Payload)
+		forward(target, &out)
+	}
+}
+
+// handleWatch subscribes p to a namespace's roster events (peer_joined,
+// peer_left, namespace_count) without joining it, so it gets no broadcasts
+// and is not listed.
+func (h *Hub) handleWatch(p *peer.Peer, msg *protocol.Message) {
+	// a watch can create its namespace, so it is limited like a join
+	if !h.allowJoin(p, msg) {
+		return
+	}
+	var payload protocol.WatchPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	if !slices.Contains(p.Watching(), payload.Namespace) && len(p.Watching()) >= maxWatchedNamespaces {
+		p.SendMessage(protocol.NewErrorFor(msg, 429, "too many watched namespaces"))
+		return
+	}
+	ns := h.nsMgr.GetOrCreate(payload.Namespace)
+	if ns == nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 503, "namespace capacity reached"))
+		return
+	}
+	if ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "cannot watch rooms"))
+		return
+	}
+	ns.Watch(p)
+	p.Watch(payload.Namespace)
+
+	p.SendMessage(protocol.NewMessage(protocol.TypeNsCount, "", protocol.NamespaceCountPayload{
+		Namespace: payload.Namespace,
+		Count:     ns.VisibleCount(),
+	}))
+}
+
+func (h *Hub) handleUnwatch(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.WatchPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	if ns, ok := h.nsMgr.Get(payload.Namespace); ok {
+		ns.Unwatch(p)
+	}
+	p.Unwatch(payload.Namespace)
+}
+
+// notifyWatchers forwards a roster event to the namespace's watchers,
+// followed by the new member count.
+func (h *Hub) notifyWatchers(ns *namespace.Namespace, notify *protocol.Message) {
+	watchers := ns.Watchers()
+	if len(watchers) == 0 {
+		return
+	}
+	data, err := protocol.Encode(notify)
+	if err != nil {
+		return
+	}
+	count := protocol.NewMessage(protocol.TypeNsCount, "", protocol.NamespaceCountPayload{
+		Namespace: ns.Name,
+		Count:     ns.VisibleCount(),
+	})
+	countData, err := protocol.Encode(count)
+	if err != nil {
+		return
+	}
+	for _, w := range watchers {
+		if w.Fingerprint == notify.From {
+			continue
+		}
+		w.SendRaw(data)
+		w.SendRaw(countData)
+	}
+}
+
+func (h *Hub) unwatchAll(p *peer.Peer) {
+	for _, name := range p.Watching() {
+		if ns, ok := h.nsMgr.Get(name); ok {
+			ns.Unwatch(p)
+		}
+	}
+}
+
+func (h *Hub) handleDiscover(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.DiscoverPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid discover payload"))
+		return
+	}
+
+	ns, ok := h.nsMgr.Get(payload.Namespace)
+	if !ok {
+		p.SendMessage(protocol.NewMessage(protocol.TypePeerList, "", protocol.PeerListPayload{
+			Namespace: payload.Namespace,
+			Peers:     []protocol.PeerInfo{},
+			Total:     0,
+		}))
+		return
+	}
+
+	if ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "cannot discover room peers"))
+		return
+	}
+
+	limit := payload.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	var filter func(protocol.PeerInfo) bool
+	if payload.Region != "" {
+		filter = func(info protocol.PeerInfo) bool {
+			return info.Region == payload.Region || (payload.IncludeNoRegion && info.Region == "")
+		}
+	}
+	peers, total := ns.ListFields(limit, filter, payload.Fields)
+	h.sendPeerList(p, msg, protocol.PeerListPayload{
+		Namespace: payload.Namespace,
+		Peers:     peers,
+		Total:     total,
+	})
+}
+
+func (h *Hub) handleMatch(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.MatchPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid match payload"))
+		return
+	}
+
+	groupSize := payload.GroupSize
+	if groupSize < 2 {
+		groupSize = 2
+	}
+	if groupSize > h.opts.MaxMatchGroupSize {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "group_size too large"))
+		return
+	}
+	if len(payload.Correlation) > maxCorrelationLen {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "correlation too long"))
+		return
+	}
+	// last, as with DropOldestMatchRequest it evicts a queued request to
+	// make room, which a rejected request must not do
+	if !h.allowMatchRequest(p, payload.Namespace) {
+		p.SendMessage(protocol.NewErrorFor(msg, 429, "too many match requests"))
+		return
+	}
+
+	result := h.matchmaker.RequestCorrelatedMatch(p, payload.Namespace, payload.Criteria, groupSize, payload.Correlation)
+	if result == nil {
+		p.SendMessage(protocol.NewMessage(protocol.TypeMatch, "", map[string]string{"status": "waiting"}))
+		return
+	}
+
+	var room *namespace.Namespace
+	if h.opts.MatchAutoRoom && h.allLocal(result.Peers) {
+		room = h.createMatchRoom(result)
+	}
+
+	matched := protocol.NewMessage(protocol.TypeMatched, "", result)
+	matched.Namespace = payload.Namespace
+	if h.sharedMatch {
+		matched.NodeID = h.nodeID
+		if data, err := protocol.Encode(matched); err == nil {
+			h.publish("matchmaking", data)
+		}
+		matched.NodeID = ""
+	}
+	// pre-encode once for all recipients
+	matchData, err := protocol.Encode(matched)
+	if err != nil {
+		return
+	}
+	for _, pi := range result.Peers {
+		if target, ok := h.GetPeer(pi.Fingerprint); ok {
+			target.SendRaw(matchData)
+		}
+	}
+	if room == nil {
+		return
+	}
+	// the room's peer_list, as for any join; they all joined at once, so
+	// there is no peer_joined between them
+	peers := room.List(room.MaxSize())
+	for _, pi := range result.Peers {
+		if target, ok := room.Get(pi.Fingerprint); ok {
+			h.sendPeerList(target, nil, protocol.PeerListPayload{
+				Namespace: room.Name,
+				Peers:     peers,
+				Total:     room.VisibleCount(),
+			})
+		}
+	}
+}
+
+// allLocal reports whether every peer is connected to this node.
+func (h *Hub) allLocal(peers []protocol.PeerInfo) bool {
+	for _, pi := range peers {
+		if _, ok := h.GetPeer(pi.Fingerprint); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// handleBrokerMatch delivers a match another node formed from the shared
+// queues to the matched peers connected here.
+func (h *Hub) handleBrokerMatch(data []byte) {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return
+	}
+	defer protocol.ReleaseMessage(msg)
+
+	if msg.NodeID == h.nodeID || msg.Type != protocol.TypeMatched {
+		return
+	}
+	var result protocol.MatchedPayload
+	if err := json.Unmarshal(msg.Payload, &result); err != nil || result.SessionID == "" {
+		return
+	}
+	h.matchmaker.AdoptMatch(&result)
+
+	msg.NodeID = ""
+	matchData, err := protocol.Encode(msg)
+	if err != nil {
+		return
+	}
+	for _, pi := range result.Peers {
+		if target, ok := h.GetPeer(pi.Fingerprint); ok {
+			target.SendRaw(matchData)
+		}
+	}
+}
+
+// createMatchRoom makes an ownerless room with room for exactly the matched
+// group and joins every matched peer to it, so a full server can't keep
+// them apart. With MatchRoomLifetime the room is reserved for the group and
+// expires. Having no owner, nobody can kick from it, set its meta or
+// approve joins. It returns the room and sets result.RoomID, or returns nil
+// and sets result.RoomError.
+func (h *Hub) createMatchRoom(result *protocol.MatchedPayload) *namespace.Namespace {
+	roomID := "match-" + result.SessionID
+	room, created := h.nsMgr.CreateRoomFunc(roomID, len(result.Peers), "", func(ns *namespace.Namespace) {
+		if lifetime := h.opts.MatchRoomLifetime; lifetime > 0 {
+			fingerprints := make([]string, len(result.Peers))
+			for i, pi := range result.Peers {
+				fingerprints[i] = pi.Fingerprint
+			}
+			ns.Reserve(fingerprints)
+			ns.ExpireAt(time.Now().Add(lifetime))
+		}
+		for _, pi := range result.Peers {
+			if target, ok := h.GetPeer(pi.Fingerprint); ok && ns.Add(target) {
+				target.JoinNamespace(roomID, "room", "", nil)
+			}
+		}
+	})
+	if !created {
+		if _, exists := h.nsMgr.Get(roomID); exists {
+			result.RoomError = "room already exists"
+		} else {
+			result.RoomError = "too many namespaces"
+		}
+		return nil
+	}
+	result.RoomID = roomID
+	h.matchmaker.SetSessionRoom(result.SessionID, roomID)
+	return room
+}
+
+// handleMatchLookup resends a recent matched to one of its participants, e.g.
+// after a reconnect lost the original.
+func (h *Hub) handleMatchLookup(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.MatchLookupPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.SessionID == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "session_id required"))
+		return
+	}
+
+	result, found, participant := h.matchmaker.LookupSession(payload.SessionID, p.Fingerprint)
+	if !found {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "session not found"))
+		return
+	}
+	if !participant {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not a session participant"))
+		return
+	}
+
+	matched := protocol.NewMessage(protocol.TypeMatched, "", result)
+	matched.Namespace = result.Namespace
+	p.SendMessage(matched)
+}
+
+// allowMatchRequest applies MaxMatchRequestsPerPeer. Re-requesting in a
+// namespace the peer already waits in doesn't count against the cap.
+func (h *Hub) allowMatchRequest(p *peer.Peer, ns string) bool {
+	active := h.matchmaker.ActiveRequests(p.Fingerprint)
+	if len(active) < h.opts.MaxMatchRequestsPerPeer {
+		return true
+	}
+	for _, n := range active {
+		if n == ns {
+			return true
+		}
+	}
+	if !h.opts.DropOldestMatchRequest {
+		return false
+	}
+	h.matchmaker.RemoveFromQueue(p.Fingerprint, active[0])
+	return true
+}
+
+func (h *Hub) handleRelay(p *peer.Peer, msg *protocol.Message) {
+	to := msg.To
+	if to == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "target peer required"))
+		return
+	}
+	if msg.Encoding != "" && msg.Encoding != protocol.EncodingGzip {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "unsupported encoding"))
+		return
+	}
+	// checked before any target gets it, not when one needs it inflated
+	if msg.Encoding == protocol.EncodingGzip {
+		if _, err := protocol.Gunzip(msg.Payload, maxInflatedSize); err != nil {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid gzip payload"))
+			return
+		}
+	}
+	if msg.ToIdentity {
+		if msg.Reliable {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "reliable relay needs a single target"))
+			return
+		}
+		h.relayToIdentity(p, msg)
+		return
+	}
+	if fp, ok := h.resolveTarget(p, msg.Namespace, to); ok {
+		to = fp
+		msg.To = to
+	}
+
+	h.touchRoom(p, msg.Namespace)
+
+	target, ok := h.GetPeer(to)
+	if ok {
+		if !h.opts.AllowCrossNamespaceSignal && !p.SharesNamespace(target) {
+			p.SendMessage(protocol.NewErrorFor(msg, 403, "no shared namespace"))
+			return
+		}
+		h.audit(audit.EventRelay, p, msg.Namespace, to, msg.Payload)
+		if msg.Reliable {
+			h.relayReliable(p, target, msg)
+			return
+		}
+		if err := forwardRelay(target, msg); err != nil {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid gzip payload"))
+		}
+		return
+	}
+	if h.localOnly {
+		h.targetNotFound.Add(1)
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "target not found"))
+		return
+	}
+	// acks can't come back over the broker, so nothing would settle it
+	if msg.Reliable {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "reliable relay needs a target on this node"))
+		return
+	}
+
+	h.audit(audit.EventRelay, p, msg.Namespace, to, msg.Payload)
+	h.stampOrigin(p, msg)
+	if msg.RequireTarget {
+		msg.ClaimID = h.awaitClaim(p, msg.RequestID)
+	}
+	data, _ := protocol.Encode(msg)
+	h.publish("relay", data)
+}
+
+// audit records event by p in AuditSink, if one is set.
+func (h *Hub) audit(event string, p *peer.Peer, ns, to string, payload []byte) {
+	if h.opts.AuditSink == nil {
+		return
+	}
+	r := audit.Record{
+		Time:      time.Now(),
+		Event:     event,
+		Namespace: ns,
+		From:      p.Fingerprint,
+		To:        to,
+	}
+	if h.opts.AuditHashPayloads && len(payload) > 0 {
+		sum := sha256.Sum256(payload)
+		r.PayloadSHA256 = hex.EncodeToString(sum[:])
+	}
+	h.opts.AuditSink.Record(r)
+}
+
+// stampOrigin marks a signal or relay from p for the broker with this node
+// and, unless cross-namespace signals are allowed, p's namespaces so the
+// delivering node can re-check them.
+func (h *Hub) stampOrigin(p *peer.Peer, msg *protocol.Message) {
+	msg.NodeID = h.nodeID
+	if !h.opts.AllowCrossNamespaceSignal {
+		msg.FromNamespaces = p.GetNamespaces()
+	}
+}
+
+// brokerSenderAllowed is the delivering node's side of the shared namespace
+// check: target must be in one of the namespaces the origin stamped, rather
+// than this node trusting the origin to have checked.
+func (h *Hub) brokerSenderAllowed(target *peer.Peer, msg *protocol.Message) bool {
+	if h.opts.AllowCrossNamespaceSignal || h.opts.TrustBrokerNamespaces {
+		return true
+	}
+	for _, ns := range msg.FromNamespaces {
+		if target.InNamespace(ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayToIdentity delivers a relay to every device of the identity in
+// msg.To but the sender's own: those here that share a namespace with p,
+// and through the broker those on other nodes.
+func (h *Hub) relayToIdentity(p *peer.Peer, msg *protocol.Message) {
+	h.touchRoom(p, msg.Namespace)
+	h.audit(audit.EventRelay, p, msg.Namespace, msg.To, msg.Payload)
+
+	delivered := false
+	for _, device := range h.identities.devicesOf(msg.To) {
+		if device == p || (!h.opts.AllowCrossNamespaceSignal && !p.SharesNamespace(device)) {
+			continue
+		}
+		if err := forwardRelay(device, msg); err != nil {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid gzip payload"))
+			return
+		}
+		delivered = true
+	}
+	if !h.localOnly {
+		h.stampOrigin(p, msg)
+		data, _ := protocol.Encode(msg)
+		h.publish("relay", data)
+		return
+	}
+	if !delivered {
+		h.targetNotFound.Add(1)
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "target not found"))
+	}
+}
+
+// resolveTarget resolves an alias p addressed a signal or relay to. Namespace
+// scoped aliases need the namespace named on the message, and p must be in
+// it so aliases don't leak across namespaces.
+func (h *Hub) resolveTarget(p *peer.Peer, ns, alias string) (string, bool) {
+	if h.opts.AliasScope == AliasScopeNamespace && !p.InNamespace(ns) {
+		return "", false
+	}
+	return h.ResolveAlias(ns, alias)
+}
+
+// forward hands a client's signal or relay to a local target, encoded once
+// by the fast path and queued as is. SendMessage would also decode it looking
+// for an error payload to record, which a forwarded message never is.
+func forward(target *peer.Peer, msg *protocol.Message) {
+	data, err := protocol.Encode(msg)
+	if err != nil {
+		return
+	}
+	target.SendRaw(data)
+}
+
+// maxInflatedSize bounds what gzip relays and broadcasts may inflate to for
+// peers that didn't register with gzip.
+const maxInflatedSize = 1 << 20
+
+// forwardRelay is forward for relays, inflating a gzip payload for targets
+// that didn't register with gzip.
+func forwardRelay(target *peer.Peer, msg *protocol.Message) error {
+	data, err := relayData(target, msg)
+	if err != nil {
+		return err
+	}
+	target.SendRaw(data)
+	return nil
+}
+
+// relayData encodes msg for target, see forwardRelay.
+func relayData(target *peer.Peer, msg *protocol.Message) ([]byte, error) {
+	if msg.Type != protocol.TypeRelay || msg.Encoding != protocol.EncodingGzip || target.Gzip {
+		return protocol.Encode(msg)
+	}
+	plain, err := protocol.Gunzip(msg.Payload, maxInflatedSize)
+	if err != nil {
+		return nil, err
+	}
+	out := *msg
+	out.Payload = plain
+	out.Encoding = ""
+	return protocol.Encode(&out)
+}
+
+// relayReliable forwards a reliable relay and sends it again every
+// ReliableAckTimeout until target acks its seq, giving up with relay_failed
+// to p after ReliableRetries.
+func (h *Hub) relayReliable(p, target *peer.Peer, msg *protocol.Message) {
+	if msg.Seq == 0 {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "seq required"))
+		return
+	}
+	data, err := relayData(target, msg)
+	if err != nil {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid gzip payload"))
+		return
+	}
+	key := relayKey{from: p.Fingerprint, to: target.Fingerprint, seq: msg.Seq}
+	r := &inflightRelay{sender: p, target: target, data: data, sends: 1, requestID: msg.RequestID}
+	err = h.reliable.add(key, r, h.opts.MaxReliableInFlight, h.opts.ReliableAckTimeout, func() {
+		h.retryRelay(key)
+	})
+	switch err {
+	case nil:
+		target.SendRaw(data)
+	case errRelayInFlight:
+		p.SendMessage(protocol.NewErrorFor(msg, 409, err.Error()))
+	default:
+		p.SendMessage(protocol.NewErrorFor(msg, 429, err.Error()))
+	}
+}
+
+// retryRelay runs when a reliable relay's ack is overdue.
+func (h *Hub) retryRelay(key relayKey) {
+	rr := h.reliable
+	rr.mu.Lock()
+	r, ok := rr.inflight[key]
+	if !ok {
+		rr.mu.Unlock()
 		return
 	}
-
-	ns := h.nsMgr.GetOrCreate(payload.Namespace)
-	if !ns.Add(p) {
-		p.SendMessage(protocol.NewError(429, "namespace full"))
+	if r.sends <= h.opts.ReliableRetries {
+		r.sends++
+		r.timer.Reset(h.opts.ReliableAckTimeout)
+		rr.mu.Unlock()
+		r.target.SendRaw(r.data)
 		return
 	}
-	p.JoinNamespace(payload.Namespace, payload.AppType, payload.Version, payload.Meta)
-
-	notify := protocol.NewMessage(protocol.TypePeerJoined, p.Fingerprint, p.InfoForNamespace(payload.Namespace))
-	notify.Namespace = payload.Namespace
-	ns.Broadcast(notify, p.Fingerprint)
-
-	peers := ns.List(50)
-	resp := protocol.NewMessage(protocol.TypePeerList, "", protocol.PeerListPayload{
-		Namespace: payload.Namespace,
-		Peers:     peers,
-		Total:     ns.Count(),
-	})
-	p.SendMessage(resp)
+	rr.removeLocked(key, r)
+	rr.mu.Unlock()
+	r.sender.SendMessage(&protocol.Message{Type: protocol.TypeRelayFailed, From: key.to, Seq: key.seq, RequestID: r.requestID})
 }
 
-func (h *Hub) handleLeave(p *peer.Peer, msg *protocol.Message) {
-	var payload struct {
-		Namespace string `json:"namespace"`
+// handleRelayAck settles a reliable relay p received and passes the ack on
+// to its sender. Acks for relays no longer in flight are ignored.
+func (h *Hub) handleRelayAck(p *peer.Peer, msg *protocol.Message) {
+	if msg.To == "" || msg.Seq == 0 {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "to and seq required"))
+		return
 	}
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
-		p.SendMessage(protocol.NewError(400, "namespace required"))
+	r, ok := h.reliable.take(relayKey{from: msg.To, to: p.Fingerprint, seq: msg.Seq})
+	if !ok {
 		return
 	}
+	forward(r.sender, &protocol.Message{Type: protocol.TypeRelayAck, From: p.Fingerprint, Seq: msg.Seq})
+}
 
-	ns := payload.Namespace
-	if nsObj, ok := h.nsMgr.Get(ns); ok {
-		nsObj.Remove(p.Fingerprint)
-		notify := protocol.NewMessage(protocol.TypePeerLeft, p.Fingerprint, nil)
-		notify.Namespace = ns
-		nsObj.Broadcast(notify, p.Fingerprint)
+// plainBroadcast encodes the inflated form of a gzip broadcast, for peers
+// that didn't register with gzip. Data that doesn't inflate is
+// protocol.ErrInvalidGzip.
+func plainBroadcast(msg *protocol.Message, payload protocol.BroadcastPayload) ([]byte, error) {
+	plain, err := protocol.Gunzip(payload.Data, maxInflatedSize)
+	if err != nil {
+		return nil, err
+	}
+	payload.Data = plain
+	payload.Encoding = ""
+	out := *msg
+	out.Payload, _ = json.Marshal(payload)
+	return protocol.Encode(&out)
+}
 
-		if nsObj.IsRoom {
-			h.nsMgr.RemoveIfEmpty(ns)
+// awaitClaim registers a pending claim and replies 404 to the sender unless
+// the node holding the target claims it within the window.
+func (h *Hub) awaitClaim(p *peer.Peer, requestID string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	timer := time.AfterFunc(h.opts.TargetClaimWindow, func() {
+		if _, pending := h.claims.LoadAndDelete(id); pending {
+			h.targetNotFound.Add(1)
+			e := protocol.NewError(404, "target not found")
+			e.RequestID = requestID
+			p.SendMessage(e)
 		}
-	}
-	p.LeaveNamespace(ns)
-	h.matchmaker.RemoveFromQueue(p.Fingerprint, ns)
+	})
+	h.claims.Store(id, timer)
+	return id
 }
 
-func (h *Hub) handleSignal(p *peer.Peer, msg *protocol.Message) {
-	to := msg.To
-	if to == "" {
-		p.SendMessage(protocol.NewError(400, "target peer required"))
+// publish sends data to the broker, counting failures since nobody else
+// would notice the message was lost.
+func (h *Hub) publish(channel string, data []byte) {
+	// after Shutdown cancels ctx the broker is going away, that's not a loss
+	if h.ctx.Err() != nil {
 		return
 	}
-	if fp, ok := h.ResolveAlias(to); ok {
-		to = fp
-		msg.To = to
-	}
-
-	target, ok := h.GetPeer(to)
-	if ok {
-		if !p.SharesNamespace(target) {
-			p.SendMessage(protocol.NewError(403, "no shared namespace"))
-			return
-		}
-		target.SendMessage(msg)
-		return
+	if err := h.broker.Publish(h.ctx, channel, data); err != nil {
+		h.publishErrors.Add(1)
 	}
-
-	// cross-node: stamp nodeID and publish
-	msg.NodeID = h.nodeID
-	data, _ := protocol.Encode(msg)
-	h.broker.Publish(h.ctx, "signal", data)
 }
 
-func (h *Hub) handleDiscover(p *peer.Peer, msg *protocol.Message) {
-	var payload protocol.DiscoverPayload
+func (h *Hub) handleBroadcast(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.BroadcastPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid discover payload"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid broadcast payload"))
 		return
 	}
-
 	ns, ok := h.nsMgr.Get(payload.Namespace)
 	if !ok {
-		p.SendMessage(protocol.NewMessage(protocol.TypePeerList, "", protocol.PeerListPayload{
-			Namespace: payload.Namespace,
-			Peers:     []protocol.PeerInfo{},
-			Total:     0,
-		}))
 		return
 	}
 
-	if ns.IsRoom {
-		p.SendMessage(protocol.NewError(403, "cannot discover room peers"))
+	// verify sender is in namespace
+	if !ns.Has(p.Fingerprint) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
 		return
 	}
 
-	limit := payload.Limit
-	if limit <= 0 {
-		limit = 50
-	}
-	peers := ns.List(limit)
-	resp := protocol.NewMessage(protocol.TypePeerList, "", protocol.PeerListPayload{
-		Namespace: payload.Namespace,
-		Peers:     peers,
-		Total:     ns.Count(),
-	})
-	p.SendMessage(resp)
-}
-
-func (h *Hub) handleMatch(p *peer.Peer, msg *protocol.Message) {
-	var payload protocol.MatchPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid match payload"))
+	if limit := h.maxBroadcastSize(payload.Namespace); limit > 0 && len(payload.Data) > limit {
+		p.SendMessage(protocol.NewErrorFor(msg, 413, "broadcast too large"))
 		return
 	}
-
-	groupSize := payload.GroupSize
-	if groupSize < 2 {
-		groupSize = 2
+	if payload.Encoding != "" && payload.Encoding != protocol.EncodingGzip {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "unsupported encoding"))
+		return
 	}
-
-	result := h.matchmaker.RequestMatch(p, payload.Namespace, payload.Criteria, groupSize)
-	if result == nil {
-		p.SendMessage(protocol.NewMessage(protocol.TypeMatch, "", map[string]string{"status": "waiting"}))
+	members := ns.Count()
+	if max := h.opts.MaxBroadcastRecipients; max > 0 && members-1 > max {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace too large for broadcast"))
 		return
 	}
 
-	matched := protocol.NewMessage(protocol.TypeMatched, "", result)
-	matched.Namespace = payload.Namespace
-	// pre-encode once for all recipients
-	matchData, err := protocol.Encode(matched)
-	if err != nil {
+	if !h.acquireBroadcast() {
+		p.SendMessage(protocol.NewErrorFor(msg, 503, "too many broadcasts"))
 		return
 	}
-	for _, pi := range result.Peers {
-		if target, ok := h.GetPeer(pi.Fingerprint); ok {
-			target.SendRaw(matchData)
-		}
-	}
-}
+	defer h.releaseBroadcast()
 
-func (h *Hub) handleRelay(p *peer.Peer, msg *protocol.Message) {
-	to := msg.To
-	if to == "" {
-		p.SendMessage(protocol.NewError(400, "target peer required"))
+	ns.Touch()
+
+	// pre-encode once, broadcast raw
+	data, err := protocol.Encode(msg)
+	if err != nil {
 		return
 	}
-	if fp, ok := h.ResolveAlias(to); ok {
-		to = fp
-		msg.To = to
-	}
-
-	target, ok := h.GetPeer(to)
-	if ok {
-		if !p.SharesNamespace(target) {
-			p.SendMessage(protocol.NewError(403, "no shared namespace"))
+	if payload.Encoding == protocol.EncodingGzip {
+		// inflated up front, so bad data reaches nobody
+		plain, err := plainBroadcast(msg, payload)
+		if err != nil {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid gzip payload"))
 			return
 		}
-		target.SendMessage(msg)
+		h.fanOut(ns, func() { ns.BroadcastGzip(data, plain, p.Fingerprint) })
+	} else {
+		h.broadcastRaw(ns, data, p.Fingerprint)
+	}
+	if h.localOnly {
 		return
 	}
 
+	// publish to broker for cross-node
 	msg.NodeID = h.nodeID
-	data, _ := protocol.Encode(msg)
-	h.broker.Publish(h.ctx, "relay", data)
+	brokerData, _ := protocol.Encode(msg)
+	h.publish("broadcast", brokerData)
 }
 
-func (h *Hub) handleBroadcast(p *peer.Peer, msg *protocol.Message) {
-	var payload protocol.BroadcastPayload
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid broadcast payload"))
+// handleBinaryBroadcast fans out a binary broadcast frame: verbatim to
+// binary-mode members, as a broadcast with base64 data to the others and to
+// other nodes.
+func (h *Hub) handleBinaryBroadcast(p *peer.Peer, frame []byte) {
+	if p.Observer {
+		p.SendMessage(protocol.NewError(403, "observers cannot send"))
 		return
 	}
-	ns, ok := h.nsMgr.Get(payload.Namespace)
+	name, data, err := protocol.DecodeBinaryBroadcast(frame)
+	if err != nil {
+		p.SendMessage(protocol.NewError(400, "invalid binary frame"))
+		return
+	}
+	ns, ok := h.nsMgr.Get(name)
 	if !ok {
 		return
 	}
-
-	// verify sender is in namespace
 	if !ns.Has(p.Fingerprint) {
 		p.SendMessage(protocol.NewError(403, "not in namespace"))
 		return
 	}
+	if limit := h.maxBroadcastSize(name); limit > 0 && len(data) > limit {
+		p.SendMessage(protocol.NewError(413, "broadcast too large"))
+		return
+	}
+	members := ns.Count()
+	if max := h.opts.MaxBroadcastRecipients; max > 0 && members-1 > max {
+		p.SendMessage(protocol.NewError(400, "namespace too large for broadcast"))
+		return
+	}
 
-	// pre-encode once, broadcast raw
-	data, err := protocol.Encode(msg)
+	if !h.acquireBroadcast() {
+		p.SendMessage(protocol.NewError(503, "too many broadcasts"))
+		return
+	}
+	defer h.releaseBroadcast()
+
+	ns.Touch()
+
+	encoded, _ := json.Marshal(data)
+	msg := protocol.NewMessage(protocol.TypeBroadcast, p.Fingerprint, protocol.BroadcastPayload{
+		Namespace: name,
+		Data:      encoded,
+		Encoding:  "base64",
+	})
+	msg.Timestamp = time.Now().UnixMilli()
+	text, err := protocol.Encode(msg)
 	if err != nil {
 		return
 	}
-	ns.BroadcastRaw(data, p.Fingerprint)
+	binary := protocol.EncodeBinaryBroadcast(name, p.Fingerprint, data)
+	h.fanOut(ns, func() { ns.BroadcastDual(text, binary, p.Fingerprint) })
+	if h.localOnly {
+		return
+	}
 
-	// publish to broker for cross-node
+	// other nodes get the text form and deliver it as a plain broadcast
 	msg.NodeID = h.nodeID
 	brokerData, _ := protocol.Encode(msg)
-	h.broker.Publish(h.ctx, "broadcast", brokerData)
+	h.publish("broadcast", brokerData)
+}
+
+// maxBroadcastSize returns the MaxBroadcastSize entry for ns, 0 if none.
+func (h *Hub) maxBroadcastSize(ns string) int {
+	limit, _ := matchNamespace(h.opts.MaxBroadcastSize, ns)
+	return limit
+}
+
+// matchNamespace looks ns up in a per-namespace setting whose keys are names
+// or prefixes ending in "*": the exact name wins, then the longest prefix.
+func matchNamespace[T any](m map[string]T, ns string) (T, bool) {
+	if v, ok := m[ns]; ok {
+		return v, true
+	}
+	var found T
+	best := -1
+	for pattern, v := range m {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && len(prefix) > best && strings.HasPrefix(ns, prefix) {
+			found, best = v, len(prefix)
+		}
+	}
+	return found, best >= 0
 }
 
 func (h *Hub) handleMetadata(p *peer.Peer, msg *protocol.Message) {
 	var payload protocol.MetadataPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid metadata payload"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid metadata payload"))
 		return
 	}
 	p.UpdateMeta(payload.Meta)
 }
 
+// handleUpdateInfo changes what p advertises in a namespace it is in and
+// tells the other members with peer_updated, without a leave and rejoin.
+func (h *Hub) handleUpdateInfo(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.UpdateNamespaceInfoPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	ns, ok := h.nsMgr.Get(payload.Namespace)
+	if !ok || !p.UpdateNamespace(payload.Namespace, payload.AppType, payload.Version, payload.Meta) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
+		return
+	}
+	if p.Observer {
+		return
+	}
+	notify := protocol.NewMessage(protocol.TypePeerUpdated, p.Fingerprint, p.InfoForNamespace(payload.Namespace))
+	notify.Namespace = payload.Namespace
+	ns.Broadcast(notify, p.Fingerprint)
+	// watchers see it too, without a count since membership didn't change
+	if watchers := ns.Watchers(); len(watchers) > 0 {
+		if data, err := protocol.Encode(notify); err == nil {
+			for _, w := range watchers {
+				w.SendRaw(data)
+			}
+		}
+	}
+}
+
+func (h *Hub) handleSetReady(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.SetReadyPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	if p.Observer {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "observers cannot be ready"))
+		return
+	}
+	ns, ok := h.nsMgr.Get(payload.Namespace)
+	if !ok {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
+		return
+	}
+	changed, ok := p.SetReady(payload.Namespace, payload.Ready)
+	if !ok {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
+		return
+	}
+	if !changed {
+		return
+	}
+	notify := protocol.NewMessage(protocol.TypeReadyChanged, p.Fingerprint, protocol.ReadyChangedPayload{
+		Namespace:   payload.Namespace,
+		Fingerprint: p.Fingerprint,
+		Ready:       payload.Ready,
+	})
+	notify.Namespace = payload.Namespace
+	ns.Broadcast(notify, p.Fingerprint)
+}
+
+// handleLobbyStatus reports how many of a namespace's visible members are
+// ready. Only members may ask.
+func (h *Hub) handleLobbyStatus(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.LobbyStatusPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Namespace == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "namespace required"))
+		return
+	}
+	ns, ok := h.nsMgr.Get(payload.Namespace)
+	if !ok || !p.InNamespace(payload.Namespace) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "not in namespace"))
+		return
+	}
+	status := protocol.LobbyStatusPayload{Namespace: payload.Namespace}
+	for _, member := range ns.Snapshot() {
+		if member.Observer {
+			continue
+		}
+		status.Total++
+		if member.IsReady(payload.Namespace) {
+			status.Ready++
+		}
+	}
+	reply := protocol.NewMessage(protocol.TypeLobbyStatus, "", status)
+	reply.Namespace = payload.Namespace
+	p.SendMessage(reply)
+}
+
 func (h *Hub) handleCreateRoom(p *peer.Peer, msg *protocol.Message) {
 	var payload protocol.CreateRoomPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid create_room payload"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid create_room payload"))
 		return
 	}
 	if payload.RoomID == "" {
-		p.SendMessage(protocol.NewError(400, "room_id required"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id required"))
 		return
 	}
 	maxSize := payload.MaxSize
@@ -471,56 +2782,212 @@ func (h *Hub) handleCreateRoom(p *peer.Peer, msg *protocol.Message) {
 		maxSize = 30
 	}
 
-	ns, created := h.nsMgr.CreateRoom(payload.RoomID, maxSize, p.Fingerprint)
-	if !created {
-		p.SendMessage(protocol.NewError(409, "room already exists"))
+	idleTTL := time.Duration(payload.IdleTTLMs) * time.Millisecond
+	if idleTTL < 0 || h.opts.MaxRoomIdleTTL <= 0 {
+		idleTTL = 0
+	}
+	if idleTTL > h.opts.MaxRoomIdleTTL {
+		idleTTL = h.opts.MaxRoomIdleTTL
+	}
+
+	if !h.allowRoomJoin(p, msg) {
 		return
 	}
 
-	ns.Add(p)
-	p.JoinNamespace(payload.RoomID, "room", "", nil)
+	// the owner joins before the room is visible, so a racing join or
+	// cleanup never sees it empty or without its settings
+	room, created := h.nsMgr.CreateRoomFunc(payload.RoomID, maxSize, p.Fingerprint, func(ns *namespace.Namespace) {
+		ns.SetIdleTTL(idleTTL)
+		ns.SetApprovalRequired(payload.ApprovalRequired)
+		ns.Add(p)
+		p.JoinNamespace(payload.RoomID, "room", "", nil)
+	})
+	if !created {
+		if _, exists := h.nsMgr.Get(payload.RoomID); !exists {
+			p.SendMessage(protocol.NewErrorFor(msg, 503, "namespace capacity reached"))
+			return
+		}
+		if payload.IdempotencyKey != "" {
+			// a retry of a create that already succeeded
+			resp, ok := h.roomKeys.get(p.Fingerprint, payload.IdempotencyKey)
+			if existing, exists := h.nsMgr.Get(payload.RoomID); ok && exists && resp.RoomID == payload.RoomID && existing.Owner == p.Fingerprint {
+				p.SendMessage(protocol.NewMessage(protocol.TypeRoomCreated, "", resp))
+				return
+			}
+		}
+		p.SendMessage(protocol.NewErrorFor(msg, 409, "room already exists"))
+		return
+	}
+	if h.undoClosedJoin(p, room) {
+		return
+	}
 
-	p.SendMessage(protocol.NewMessage(protocol.TypeRoomCreated, "", protocol.RoomCreatedPayload{
-		RoomID:  payload.RoomID,
-		MaxSize: maxSize,
-		Owner:   p.Fingerprint,
-	}))
+	resp := protocol.RoomCreatedPayload{
+		RoomID:    payload.RoomID,
+		MaxSize:   maxSize,
+		Owner:     p.Fingerprint,
+		IdleTTLMs: idleTTL.Milliseconds(),
+	}
+	if payload.IdempotencyKey != "" {
+		h.roomKeys.put(p.Fingerprint, payload.IdempotencyKey, resp)
+	}
+	p.SendMessage(protocol.NewMessage(protocol.TypeRoomCreated, "", resp))
 }
 
 func (h *Hub) handleJoinRoom(p *peer.Peer, msg *protocol.Message) {
+	if !h.allowJoin(p, msg) {
+		return
+	}
 	var payload protocol.JoinRoomPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid join_room payload"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid join_room payload"))
 		return
 	}
 	if payload.RoomID == "" {
-		p.SendMessage(protocol.NewError(400, "room_id required"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id required"))
 		return
 	}
 
 	ns, ok := h.nsMgr.Get(payload.RoomID)
 	if !ok || !ns.IsRoom {
-		p.SendMessage(protocol.NewError(404, "room not found"))
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
+		return
+	}
+
+	if !ns.Admits(p.Fingerprint) {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "room is reserved"))
 		return
 	}
+	if ns.ApprovalRequired() && p.Fingerprint != ns.Owner && !ns.Has(p.Fingerprint) {
+		// refused up front rather than after the owner's approval, where
+		// completeRoomJoin checks again
+		if h.allowRoomJoin(p, msg) {
+			h.requestJoinApproval(p, ns, msg)
+		}
+		return
+	}
+
+	h.completeRoomJoin(p, ns, msg)
+}
+
+// allowRoomJoin applies MaxRoomsJoinedPerPeer before p creates or joins
+// another room.
+func (h *Hub) allowRoomJoin(p *peer.Peer, msg *protocol.Message) bool {
+	if h.opts.MaxRoomsJoinedPerPeer <= 0 || h.roomCount(p) < h.opts.MaxRoomsJoinedPerPeer {
+		return true
+	}
+	p.SendMessage(protocol.NewErrorFor(msg, 429, "too many rooms"))
+	return false
+}
+
+// roomCount returns how many of p's namespaces are rooms.
+func (h *Hub) roomCount(p *peer.Peer) int {
+	n := 0
+	for _, name := range p.GetNamespaces() {
+		if ns, ok := h.nsMgr.Get(name); ok && ns.IsRoom {
+			n++
+		}
+	}
+	return n
+}
 
+func (h *Hub) completeRoomJoin(p *peer.Peer, ns *namespace.Namespace, req *protocol.Message) {
+	// checked again for joins that waited on approval, as p may have joined
+	// other rooms meanwhile
+	if !ns.Has(p.Fingerprint) && !h.allowRoomJoin(p, req) {
+		return
+	}
 	if !ns.Add(p) {
-		p.SendMessage(protocol.NewError(429, "room full"))
+		p.SendMessage(protocol.NewErrorFor(req, 429, "room full"))
+		return
+	}
+	p.JoinNamespace(ns.Name, "room", "", nil)
+	if h.undoClosedJoin(p, ns) {
 		return
 	}
-	p.JoinNamespace(payload.RoomID, "room", "", nil)
+	h.audit(audit.EventJoin, p, ns.Name, "", nil)
+	ns.Touch()
 
-	notify := protocol.NewMessage(protocol.TypePeerJoined, p.Fingerprint, p.InfoForNamespace(payload.RoomID))
-	notify.Namespace = payload.RoomID
-	ns.Broadcast(notify, p.Fingerprint)
+	rejoined := h.held.take(p.Fingerprint, ns.Name)
+	if !p.Observer && !rejoined {
+		notify := protocol.NewMessage(protocol.TypePeerJoined, p.Fingerprint, p.InfoForNamespace(ns.Name))
+		notify.Namespace = ns.Name
+		ns.Broadcast(notify, p.Fingerprint)
+	}
 
 	peers := ns.List(ns.MaxSize())
-	resp := protocol.NewMessage(protocol.TypePeerList, "", protocol.PeerListPayload{
-		Namespace: payload.RoomID,
+	h.sendPeerList(p, req, protocol.PeerListPayload{
+		Namespace: ns.Name,
 		Peers:     peers,
-		Total:     ns.Count(),
+		Total:     ns.VisibleCount(),
+	})
+	h.sendWelcome(p, ns)
+}
+
+func (h *Hub) requestJoinApproval(p *peer.Peer, ns *namespace.Namespace, req *protocol.Message) {
+	owner, ok := h.GetPeer(ns.Owner)
+	if !ok {
+		p.SendMessage(protocol.NewErrorFor(req, 404, "room owner not available"))
+		return
+	}
+
+	roomID := ns.Name
+	fingerprint := p.Fingerprint
+	// req goes back to the pool before the timeout fires
+	timedOut := protocol.NewErrorFor(req, 408, "join request timed out")
+	added, err := h.joinReqs.add(roomID, p, req.RequestID, h.opts.JoinRequestTimeout, func() {
+		if pj, ok := h.joinReqs.take(roomID, fingerprint); ok {
+			pj.peer.SendMessage(timedOut)
+		}
 	})
-	p.SendMessage(resp)
+	if err != nil {
+		p.SendMessage(protocol.NewErrorFor(req, 429, err.Error()))
+		return
+	}
+	if added {
+		owner.SendMessage(protocol.NewMessage(protocol.TypeJoinRequest, p.Fingerprint, protocol.JoinRequestPayload{
+			RoomID: roomID,
+			Peer:   p.Info(),
+		}))
+	}
+	p.SendMessage(protocol.NewMessage(protocol.TypeJoinRoom, "", map[string]string{
+		"status":  "pending",
+		"room_id": roomID,
+	}))
+}
+
+func (h *Hub) handleJoinDecision(p *peer.Peer, msg *protocol.Message, approve bool) {
+	var payload protocol.JoinDecisionPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.RoomID == "" || payload.Fingerprint == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id and fingerprint required"))
+		return
+	}
+
+	ns, ok := h.nsMgr.Get(payload.RoomID)
+	if !ok || !ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
+		return
+	}
+	if ns.Owner != p.Fingerprint {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "only room owner can approve joins"))
+		return
+	}
+
+	pj, ok := h.joinReqs.take(payload.RoomID, payload.Fingerprint)
+	if !ok {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "join request not found"))
+		return
+	}
+	// replies to the joiner answer its join_room, not the owner's decision
+	joinReq := &protocol.Message{RequestID: pj.requestID}
+	if !approve {
+		pj.peer.SendMessage(protocol.NewErrorFor(joinReq, 403, "join denied"))
+		return
+	}
+	if pj.peer.IsClosed() {
+		return
+	}
+	h.completeRoomJoin(pj.peer, ns, joinReq)
 }
 
 func (h *Hub) handleRoomInfo(p *peer.Peer, msg *protocol.Message) {
@@ -528,62 +2995,165 @@ func (h *Hub) handleRoomInfo(p *peer.Peer, msg *protocol.Message) {
 		RoomID string `json:"room_id"`
 	}
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.RoomID == "" {
-		p.SendMessage(protocol.NewError(400, "room_id required"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id required"))
 		return
 	}
 
 	ns, ok := h.nsMgr.Get(payload.RoomID)
 	if !ok || !ns.IsRoom {
-		p.SendMessage(protocol.NewError(404, "room not found"))
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
 		return
 	}
 
 	p.SendMessage(protocol.NewMessage(protocol.TypeRoomInfo, "", protocol.RoomInfoPayload{
 		RoomID:    payload.RoomID,
-		PeerCount: ns.Count(),
+		PeerCount: ns.VisibleCount(),
 		MaxSize:   ns.MaxSize(),
 		Owner:     ns.Owner,
 	}))
 }
 
+// handleMyRooms lists the rooms p owns, e.g. for a host that reconnected.
+func (h *Hub) handleMyRooms(p *peer.Peer) {
+	owned := h.nsMgr.RoomsOwnedBy(p.Fingerprint)
+	rooms := make([]protocol.RoomInfoPayload, 0, len(owned))
+	for _, ns := range owned {
+		rooms = append(rooms, protocol.RoomInfoPayload{
+			RoomID:    ns.Name,
+			PeerCount: ns.VisibleCount(),
+			MaxSize:   ns.MaxSize(),
+			Owner:     ns.Owner,
+		})
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+	p.SendMessage(protocol.NewMessage(protocol.TypeMyRooms, "", protocol.MyRoomsPayload{Rooms: rooms}))
+}
+
 func (h *Hub) handleKick(p *peer.Peer, msg *protocol.Message) {
 	var payload protocol.KickPayload
 	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		p.SendMessage(protocol.NewError(400, "invalid kick payload"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "invalid kick payload"))
 		return
 	}
 	if payload.RoomID == "" || payload.Fingerprint == "" {
-		p.SendMessage(protocol.NewError(400, "room_id and fingerprint required"))
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id and fingerprint required"))
 		return
 	}
 
 	ns, ok := h.nsMgr.Get(payload.RoomID)
 	if !ok || !ns.IsRoom {
-		p.SendMessage(protocol.NewError(404, "room not found"))
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
 		return
 	}
 	if ns.Owner != p.Fingerprint {
-		p.SendMessage(protocol.NewError(403, "only room owner can kick"))
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "only room owner can kick"))
 		return
 	}
 
 	target, ok := h.GetPeer(payload.Fingerprint)
+	if !ok && h.localOnly {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "peer not found"))
+		return
+	}
 	if !ok {
-		p.SendMessage(protocol.NewError(404, "peer not found"))
+		// target may be on another node, owner check already passed here
+		// so the target's node only has to enforce it, and checks it is in
+		// the room there
+		h.audit(audit.EventKick, p, payload.RoomID, payload.Fingerprint, nil)
+		msg.NodeID = h.nodeID
+		data, _ := protocol.Encode(msg)
+		h.publish("control", data)
+		return
+	}
+	if !ns.Has(target.Fingerprint) {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "peer not in room"))
+		return
+	}
+
+	h.audit(audit.EventKick, p, payload.RoomID, payload.Fingerprint, nil)
+	h.kickFromRoom(target, payload.RoomID, p.Fingerprint)
+}
+
+func (h *Hub) handleSetRoomMeta(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.SetRoomMetaPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.RoomID == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id required"))
+		return
+	}
+
+	ns, ok := h.nsMgr.Get(payload.RoomID)
+	if !ok || !ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
+		return
+	}
+	if ns.Owner != p.Fingerprint {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "only room owner can set room meta"))
+		return
+	}
+	if motd := payload.Meta.Motd; motd != nil {
+		if len(*motd) > maxMotdLen {
+			p.SendMessage(protocol.NewErrorFor(msg, 400, "motd too large"))
+			return
+		}
+		ns.SetMotd(*motd)
+	}
+}
+
+// handleRoomRelay sends the owner's payload to every other room member as its
+// own message, addressed to that member, rather than one shared broadcast
+// frame.
+func (h *Hub) handleRoomRelay(p *peer.Peer, msg *protocol.Message) {
+	var payload protocol.RoomRelayPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.RoomID == "" {
+		p.SendMessage(protocol.NewErrorFor(msg, 400, "room_id required"))
+		return
+	}
+
+	ns, ok := h.nsMgr.Get(payload.RoomID)
+	if !ok || !ns.IsRoom {
+		p.SendMessage(protocol.NewErrorFor(msg, 404, "room not found"))
+		return
+	}
+	if ns.Owner != p.Fingerprint {
+		p.SendMessage(protocol.NewErrorFor(msg, 403, "only room owner can relay"))
 		return
 	}
 
-	ns.Remove(payload.Fingerprint)
-	target.LeaveNamespace(payload.RoomID)
+	ns.Touch()
+	for _, member := range ns.Snapshot() {
+		if member.Fingerprint == p.Fingerprint {
+			continue
+		}
+		member.SendMessage(&protocol.Message{
+			Type:      protocol.TypeRoomRelay,
+			From:      p.Fingerprint,
+			To:        member.Fingerprint,
+			Namespace: payload.RoomID,
+			Payload:   msg.Payload,
+			Timestamp: msg.Timestamp,
+			RequestID: msg.RequestID,
+		})
+	}
+}
+
+func (h *Hub) kickFromRoom(target *peer.Peer, roomID, by string) {
+	ns, ok := h.nsMgr.Get(roomID)
+	if ok {
+		ns.Remove(target.Fingerprint)
+	}
+	target.LeaveNamespace(roomID)
 
-	target.SendMessage(protocol.NewMessage(protocol.TypeKick, p.Fingerprint, protocol.KickPayload{
-		RoomID:      payload.RoomID,
-		Fingerprint: payload.Fingerprint,
+	target.SendMessage(protocol.NewMessage(protocol.TypeKick, by, protocol.KickPayload{
+		RoomID:      roomID,
+		Fingerprint: target.Fingerprint,
 	}))
 
-	notify := protocol.NewMessage(protocol.TypePeerLeft, payload.Fingerprint, nil)
-	notify.Namespace = payload.RoomID
-	ns.Broadcast(notify, payload.Fingerprint)
+	if ok {
+		notify := protocol.NewMessage(protocol.TypePeerLeft, target.Fingerprint, nil)
+		notify.Namespace = roomID
+		ns.Broadcast(notify, target.Fingerprint)
+		h.removeEmptyRoom(roomID)
+	}
 }
 
 func (h *Hub) handleBrokerMessage(data []byte) {
@@ -593,8 +3163,12 @@ func (h *Hub) handleBrokerMessage(data []byte) {
 	}
 	defer protocol.ReleaseMessage(msg)
 
-	// skip messages from self
-	if msg.NodeID == h.nodeID {
+	// skip messages from self and ones that expired while queued
+	if msg.NodeID == h.nodeID || msg.Expired(time.Now().UnixMilli()) {
+		return
+	}
+
+	if !validBrokerOrigin(msg) {
 		return
 	}
 
@@ -602,13 +3176,38 @@ func (h *Hub) handleBrokerMessage(data []byte) {
 	if to == "" {
 		return
 	}
+	if msg.ToIdentity {
+		devices := h.identities.devicesOf(to)
+		allowed := devices[:0]
+		for _, device := range devices {
+			if h.brokerSenderAllowed(device, msg) {
+				allowed = append(allowed, device)
+			}
+		}
+		msg.NodeID = ""
+		msg.FromNamespaces = nil
+		for _, device := range allowed {
+			forwardRelay(device, msg)
+		}
+		return
+	}
 	target, ok := h.GetPeer(to)
-	if !ok {
+	if !ok || !h.brokerSenderAllowed(target, msg) {
 		return
 	}
-	// clear nodeID before forwarding to client
+
+	if claimID := msg.ClaimID; claimID != "" {
+		claim := &protocol.Message{Type: protocol.TypeTargetClaim, NodeID: h.nodeID, ClaimID: claimID}
+		claimData, _ := protocol.Encode(claim)
+		h.publish("control", claimData)
+	}
+
+	// clear broker fields before forwarding to client
 	msg.NodeID = ""
-	target.SendMessage(msg)
+	msg.ClaimID = ""
+	msg.RequireTarget = false
+	msg.FromNamespaces = nil
+	forwardRelay(target, msg)
 }
 
 func (h *Hub) handleBrokerBroadcast(data []byte) {
@@ -618,8 +3217,12 @@ func (h *Hub) handleBrokerBroadcast(data []byte) {
 	}
 	defer protocol.ReleaseMessage(msg)
 
-	// skip messages from self
-	if msg.NodeID == h.nodeID {
+	// skip messages from self and ones that expired while queued
+	if msg.NodeID == h.nodeID || msg.Expired(time.Now().UnixMilli()) {
+		return
+	}
+
+	if !validBrokerOrigin(msg) {
 		return
 	}
 
@@ -631,6 +3234,14 @@ func (h *Hub) handleBrokerBroadcast(data []byte) {
 	if !ok {
 		return
 	}
+	// remote broadcasts fan out here too, so they share the cap; with no
+	// sender to answer, one that can't get a slot is dropped and counted
+	if !h.acquireBroadcast() {
+		return
+	}
+	defer h.releaseBroadcast()
+
+	ns.Touch()
 
 	// clear nodeID before forwarding
 	msg.NodeID = ""
@@ -638,17 +3249,217 @@ func (h *Hub) handleBrokerBroadcast(data []byte) {
 	if err != nil {
 		return
 	}
-	ns.BroadcastRaw(rawData, msg.From)
+	from := msg.From
+	if payload.Encoding == protocol.EncodingGzip {
+		plain, err := plainBroadcast(msg, payload)
+		if err != nil {
+			return
+		}
+		h.fanOut(ns, func() { ns.BroadcastGzip(rawData, plain, from) })
+		return
+	}
+	h.broadcastRaw(ns, rawData, from)
+}
+
+// broadcastRaw fans an encoded plain broadcast from from out to ns, through
+// the coalescer when ns has a BroadcastCoalesce window.
+func (h *Hub) broadcastRaw(ns *namespace.Namespace, data []byte, from string) {
+	window, _ := matchNamespace(h.opts.BroadcastCoalesce, ns.Name)
+	if window <= 0 {
+		h.fanOut(ns, func() { ns.BroadcastRaw(data, from) })
+		return
+	}
+	h.coalesce.add(ns, data, from, window, func(msgs [][]byte, from []string, timed bool) {
+		// a timed flush is a broadcast of its own, while an early one runs
+		// in the slot of the broadcast that filled it
+		if timed {
+			if !h.waitBroadcastSlot() {
+				return
+			}
+			defer h.releaseBroadcast()
+		}
+		h.fanOut(ns, func() { ns.BroadcastBatch(msgs, from) })
+	})
+}
+
+func (h *Hub) handleBrokerControl(data []byte) {
+	msg, err := protocol.Decode(data)
+	if err != nil {
+		return
+	}
+	defer protocol.ReleaseMessage(msg)
+
+	if msg.Type == protocol.TypeNodeAnnounce {
+		h.handleNodeAnnounce(msg)
+		return
+	}
+
+	// skip messages from self
+	if msg.NodeID == h.nodeID {
+		return
+	}
+
+	switch msg.Type {
+	case protocol.TypeKick:
+		// From is shown to the target as who kicked it
+		if !validBrokerOrigin(msg) {
+			return
+		}
+		var payload protocol.KickPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			return
+		}
+		target, ok := h.GetPeer(payload.Fingerprint)
+		if !ok || !target.InNamespace(payload.RoomID) {
+			return
+		}
+		h.kickFromRoom(target, payload.RoomID, msg.From)
+	case protocol.TypeTargetClaim:
+		if v, ok := h.claims.LoadAndDelete(msg.ClaimID); ok {
+			v.(*time.Timer).Stop()
+		}
+	}
+}
+
+// announceNode publishes this hub's node ID and instance on the control
+// channel. A node that already uses the ID answers with its own
+// announcement, so both sides of a collision find out.
+func (h *Hub) announceNode(reply bool) {
+	msg := protocol.NewMessage(protocol.TypeNodeAnnounce, "", protocol.NodeAnnouncePayload{
+		Instance: h.instance,
+		Reply:    reply,
+	})
+	msg.NodeID = h.nodeID
+	data, err := protocol.Encode(msg)
+	if err != nil {
+		return
+	}
+	h.publish("control", data)
+}
+
+func (h *Hub) handleNodeAnnounce(msg *protocol.Message) {
+	var payload protocol.NodeAnnouncePayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return
+	}
+	if msg.NodeID != h.nodeID || payload.Instance == h.instance {
+		return
+	}
+	if !h.nodeCollision.Swap(true) {
+		log.Printf("WARNING: node id %s is used by another node, broker messages between them are lost; set a unique node_id", h.nodeID)
+	}
+	if !payload.Reply {
+		h.announceNode(true)
+	}
+}
+
+// NodeIDCollision reports whether another node announced this hub's node ID.
+func (h *Hub) NodeIDCollision() bool {
+	return h.nodeCollision.Load()
 }
 
 func (h *Hub) PeerCount() int64 {
 	return h.peerCount.Load()
 }
 
+// ShardCounts returns the number of peers held by each shard, in shard order.
+func (h *Hub) ShardCounts() []int {
+	counts := make([]int, len(h.shards))
+	for i, shard := range h.shards {
+		shard.mu.RLock()
+		counts[i] = len(shard.peers)
+		shard.mu.RUnlock()
+	}
+	return counts
+}
+
+// ForEachPeer calls fn for every registered peer. fn runs under a shard read
+// lock and must not register or unregister peers.
+func (h *Hub) ForEachPeer(fn func(*peer.Peer)) {
+	for _, shard := range h.shards {
+		shard.mu.RLock()
+		for _, p := range shard.peers {
+			fn(p)
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// SendQueueStats samples how many messages are waiting in each peer's send
+// buffer and returns the largest depth and the 95th percentile.
+func (h *Hub) SendQueueStats() (max, p95 int) {
+	depths := make([]int, 0, h.PeerCount())
+	h.ForEachPeer(func(p *peer.Peer) {
+		depths = append(depths, len(p.Send))
+	})
+	if len(depths) == 0 {
+		return 0, 0
+	}
+	sort.Ints(depths)
+	idx := (len(depths)*95+99)/100 - 1
+	return depths[len(depths)-1], depths[idx]
+}
+
+// DropStats counts messages the server dropped, by cause.
+func (h *Hub) DropStats() map[string]int64 {
+	return map[string]int64{
+		"send_buffer_full":     peer.BufferFullDrops(),
+		"broker_publish_error": h.publishErrors.Load(),
+		"target_not_found":     h.targetNotFound.Load(),
+		"broadcast_rejected":   h.broadcastsRejected.Load(),
+	}
+}
+
+// HubStats is a snapshot of the hub's load, as served on /stats.
+type HubStats struct {
+	TotalPeers            int64            `json:"total_peers"`
+	Namespaces            map[string]int   `json:"namespaces"`
+	SendQueueMax          int              `json:"send_queue_max"`
+	SendQueueP95          int              `json:"send_queue_p95"`
+	Dropped               map[string]int64 `json:"dropped"`
+	CompressedConnections int              `json:"compressed_connections"`
+}
+
+func (h *Hub) Stats() HubStats {
+	queueMax, queueP95 := h.SendQueueStats()
+	return HubStats{
+		TotalPeers:            h.PeerCount(),
+		Namespaces:            h.NamespaceStats(),
+		SendQueueMax:          queueMax,
+		SendQueueP95:          queueP95,
+		Dropped:               h.DropStats(),
+		CompressedConnections: h.CompressedCount(),
+	}
+}
+
+// CompressedCount returns how many connected peers negotiated
+// permessage-deflate.
+func (h *Hub) CompressedCount() int {
+	n := 0
+	h.ForEachPeer(func(p *peer.Peer) {
+		if p.Compressed {
+			n++
+		}
+	})
+	return n
+}
+
 func (h *Hub) NamespaceStats() map[string]int {
 	return h.nsMgr.Stats()
 }
 
+// MatchBuckets reports the peers waiting for a match here, by namespace
+// and criteria; see matchmaker.Inspect.
+func (h *Hub) MatchBuckets() []matchmaker.Bucket {
+	return h.matchmaker.Inspect()
+}
+
+// CleanupNamespaces removes empty namespaces now rather than on the next
+// maintenance tick and returns how many were removed.
+func (h *Hub) CleanupNamespaces() int {
+	return h.nsMgr.CleanupReport()
+}
+
 func (h *Hub) NodeID() string {
 	return h.nodeID
 }
@@ -666,9 +3477,113 @@ func (h *Hub) maintenance() {
 	}
 }
 
+// touchRoom marks the room a signal or relay was sent in as active, if p
+// is in it. Traffic in one room doesn't keep the peer's other rooms open.
+func (h *Hub) touchRoom(p *peer.Peer, name string) {
+	if h.opts.MaxRoomIdleTTL <= 0 || name == "" || !p.InNamespace(name) {
+		return
+	}
+	if ns, ok := h.nsMgr.Get(name); ok && ns.IsRoom {
+		ns.Touch()
+	}
+}
+
+func (h *Hub) roomSweeper() {
+	ticker := time.NewTicker(h.opts.RoomSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.sweepIdleRooms(now)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// sweepIdleRooms closes rooms that have been silent for longer than their
+// idle TTL, and one-shot rooms that outlived their lifetime.
+func (h *Hub) sweepIdleRooms(now time.Time) {
+	for _, ns := range h.nsMgr.Rooms() {
+		switch {
+		case ns.LifetimeExpired(now):
+			h.closeRoom(ns, "expired")
+		case ns.IdleExpired(now):
+			h.closeRoom(ns, "inactive")
+		}
+	}
+}
+
+func (h *Hub) closeRoom(ns *namespace.Namespace, reason string) {
+	if !h.nsMgr.RemoveNamespace(ns) {
+		return
+	}
+	notify := protocol.NewMessage(protocol.TypeRoomClosed, "", protocol.RoomClosedPayload{
+		RoomID: ns.Name,
+		Reason: reason,
+	})
+	notify.Namespace = ns.Name
+	data, err := protocol.Encode(notify)
+	if err != nil {
+		return
+	}
+	for _, p := range ns.Snapshot() {
+		ns.Remove(p.Fingerprint)
+		p.LeaveNamespace(ns.Name)
+		p.SendRaw(data)
+	}
+	h.refuseWaitingJoins(ns.Name)
+}
+
+// removeEmptyRoom removes the room name if nobody is left in it.
+func (h *Hub) removeEmptyRoom(name string) {
+	if h.nsMgr.RemoveIfEmpty(name) {
+		h.refuseWaitingJoins(name)
+	}
+}
+
+// refuseWaitingJoins answers the joins still waiting on a room that is gone
+// with a 404, as no owner is left to decide them.
+func (h *Hub) refuseWaitingJoins(roomID string) {
+	for _, pj := range h.joinReqs.dropRoom(roomID) {
+		pj.peer.SendMessage(protocol.NewErrorFor(&protocol.Message{RequestID: pj.requestID}, 404, "room closed"))
+	}
+}
+
 func (h *Hub) Shutdown() {
+	h.DrainMatchmaking("server draining")
+	// let handlers finish publishing and replying before ctx is cancelled
+	// and their peers are closed
+	if !h.drainHandlers(handlerDrainTimeout) {
+		log.Printf("shutdown: handlers still running after %v", handlerDrainTimeout)
+	}
+	// snapshot once in-flight handlers are done with the rooms, and before
+	// peers are closed and their rooms emptied
+	if h.opts.SnapshotPath != "" {
+		if err := h.saveSnapshot(h.opts.SnapshotPath); err != nil {
+			log.Printf("snapshot save error: %v", err)
+		}
+	}
+	// coalesced broadcasts still waiting for their window go out now, before
+	// their members are closed
+	for ns, b := range h.coalesce.takeAll() {
+		ns.BroadcastBatch(b.msgs, b.from)
+	}
 	close(h.done)
 	h.cancel()
+	h.matchmaker.Close()
+	h.reliable.drop("")
+	h.claims.Range(func(id, timer any) bool {
+		timer.(*time.Timer).Stop()
+		h.claims.Delete(id)
+		return true
+	})
+	if h.aliasGrace != nil {
+		h.aliasGrace.Stop()
+	}
+	if h.joinLimit != nil {
+		h.joinLimit.Close()
+	}
 	for _, shard := range h.shards {
 		shard.mu.Lock()
 		for _, p := range shard.peers {
@@ -681,25 +3596,208 @@ func (h *Hub) Shutdown() {
 	}
 }
 
-// shardFor helper for external use if needed
-func shardIndex(fingerprint string, count int) uint32 {
-	if len(fingerprint) >= 4 {
-		var idx uint32
-		for i := 0; i < 4; i++ {
-			c := fingerprint[i]
-			var v byte
-			switch {
-			case c >= '0' && c <= '9':
-				v = c - '0'
-			case c >= 'a' && c <= 'f':
-				v = c - 'a' + 10
-			case c >= 'A' && c <= 'F':
-				v = c - 'A' + 10
-			}
-			idx = (idx << 4) | uint32(v)
+// ReconnectAll asks every connected peer to reconnect, e.g. to pick up a new
+// client before a breaking protocol change. Each gets a random delay_ms
+// within jitter to spread the reconnects; with grace > 0 a peer still
+// connected that long after its delay is closed with CloseReconnect. It
+// returns how many peers were asked.
+func (h *Hub) ReconnectAll(jitter, grace time.Duration, reason string) int {
+	n := 0
+	h.ForEachPeer(func(p *peer.Peer) {
+		var delay time.Duration
+		if jitter > 0 {
+			delay = time.Duration(mrand.Int63n(int64(jitter)))
+		}
+		p.SendMessage(protocol.NewMessage(protocol.TypeReconnect, "", protocol.ReconnectPayload{
+			DelayMs: delay.Milliseconds(),
+			Reason:  reason,
+		}))
+		if grace > 0 && p.Conn != nil {
+			conn := p.Conn
+			time.AfterFunc(delay+grace, func() {
+				conn.Close(protocol.CloseReconnect, "reconnect requested")
+			})
+		}
+		n++
+	})
+	return n
+}
+
+// DrainMatchmaking cancels every pending match request and tells each waiter
+// with match_cancelled so it can re-queue elsewhere. The notices are written
+// straight to the connections since they usually precede a shutdown.
+func (h *Hub) DrainMatchmaking(reason string) {
+	var wg sync.WaitGroup
+	h.matchmaker.Drain(func(p *peer.Peer, ns string) {
+		data, err := protocol.Encode(protocol.NewMessage(protocol.TypeMatchCancel, "", protocol.MatchCancelledPayload{
+			Namespace: ns,
+			Reason:    reason,
+		}))
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.WriteNow(data, time.Second)
+		}()
+	})
+	wg.Wait()
+}
+
+// RoomSnapshot is the persistent part of a room. Members are not kept, a
+// restored room starts empty.
+type RoomSnapshot struct {
+	ID               string `json:"id"`
+	Owner            string `json:"owner"`
+	MaxSize          int    `json:"max_size"`
+	IdleTTLMs        int64  `json:"idle_ttl_ms,omitempty"`
+	ApprovalRequired bool   `json:"approval_required,omitempty"`
+}
+
+type snapshotFile struct {
+	Rooms   []RoomSnapshot    `json:"rooms"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+func (h *Hub) SnapshotRooms() []RoomSnapshot {
+	rooms := h.nsMgr.Rooms()
+	snaps := make([]RoomSnapshot, 0, len(rooms))
+	for _, ns := range rooms {
+		snaps = append(snaps, RoomSnapshot{
+			ID:               ns.Name,
+			Owner:            ns.Owner,
+			MaxSize:          ns.MaxSize(),
+			IdleTTLMs:        ns.IdleTTL().Milliseconds(),
+			ApprovalRequired: ns.ApprovalRequired(),
+		})
+	}
+	return snaps
+}
+
+// RestoreRooms recreates empty rooms from a snapshot, skipping IDs that
+// already exist, and returns how many were restored.
+func (h *Hub) RestoreRooms(snaps []RoomSnapshot) int {
+	holdUntil := time.Now().Add(h.opts.RestoredRoomGrace)
+	restored := 0
+	for _, snap := range snaps {
+		if snap.ID == "" {
+			continue
+		}
+		ns, created := h.nsMgr.CreateRoom(snap.ID, snap.MaxSize, snap.Owner)
+		if !created {
+			continue
+		}
+		idleTTL := time.Duration(snap.IdleTTLMs) * time.Millisecond
+		if idleTTL > h.opts.MaxRoomIdleTTL {
+			idleTTL = h.opts.MaxRoomIdleTTL
+		}
+		ns.SetIdleTTL(idleTTL)
+		ns.SetApprovalRequired(snap.ApprovalRequired)
+		ns.Hold(holdUntil)
+		restored++
+	}
+	return restored
+}
+
+func (h *Hub) saveSnapshot(path string) error {
+	snap := snapshotFile{
+		Rooms:   h.SnapshotRooms(),
+		Aliases: make(map[string]string),
+	}
+	h.aliases.Range(func(k, v any) bool {
+		snap.Aliases[k.(string)] = v.(string)
+		return true
+	})
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a truncated snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (h *Hub) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap snapshotFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	n := h.RestoreRooms(snap.Rooms)
+	for alias, fp := range snap.Aliases {
+		h.storeAlias(alias, fp)
+	}
+	if len(snap.Aliases) > 0 {
+		h.aliasGrace = time.AfterFunc(h.opts.RestoredRoomGrace, func() {
+			h.expireRestoredAliases(snap.Aliases)
+		})
+	}
+	log.Printf("restored %d rooms and %d aliases from %s", n, len(snap.Aliases), path)
+	return nil
+}
+
+// ResolveNodeID returns id if it is a valid node ID, 32 lowercase hex chars,
+// and a random one otherwise. Callers that need the ID before the hub exists,
+// like the Redis broker, resolve it first and pass it in Options.NodeID.
+func ResolveNodeID(id string) string {
+	if isHex(id, 32) {
+		return id
+	}
+	if id != "" {
+		log.Printf("WARNING: invalid node_id %q, generating one", id)
+	}
+	nodeBytes := make([]byte, 16)
+	rand.Read(nodeBytes)
+	return hex.EncodeToString(nodeBytes)
+}
+
+// expireRestoredAliases drops the restored aliases whose owner hasn't
+// registered again with the same alias, so they don't stay reserved for a
+// peer that never returns.
+func (h *Hub) expireRestoredAliases(aliases map[string]string) {
+	for alias, fp := range aliases {
+		if p, ok := h.GetPeer(fp); ok && p.Alias == alias {
+			continue
+		}
+		h.aliases.CompareAndDelete(alias, fp)
+	}
+}
+
+// validBrokerOrigin reports whether a message from the broker was plausibly
+// stamped by another hub: a node ID in the form the hub generates and a From
+// that is a real fingerprint. Anything else is dropped rather than forwarded
+// with a spoofed sender.
+func validBrokerOrigin(msg *protocol.Message) bool {
+	return isHex(msg.NodeID, 32) && isHex(msg.From, 64)
+}
+
+// isHex reports whether s is exactly n lowercase hex characters, the form of
+// fingerprints (sha256) and node IDs (16 random bytes).
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
 		}
-		return idx & uint32(count-1)
 	}
-	h := binary.BigEndian.Uint32([]byte(fingerprint))
-	return h & uint32(count-1)
+	return true
 }
@@ -1,15 +1,23 @@
 package hub
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"peerserver/audit"
 	"peerserver/broker"
 	"peerserver/peer"
 	"peerserver/protocol"
@@ -17,7 +25,7 @@ import (
 	"github.com/coder/websocket"
 )
 
-func makePeer(t *testing.T, fingerprint string) (*peer.Peer, func()) {
+func makePeer(t testing.TB, fingerprint string) (*peer.Peer, func()) {
 	t.Helper()
 
 	var serverConn *websocket.Conn
@@ -57,6 +65,50 @@ func makePeer(t *testing.T, fingerprint string) (*peer.Peer, func()) {
 	return p, cleanup
 }
 
+// drain discards everything queued for p.
+func drain(p *peer.Peer) {
+	for len(p.Send) > 0 {
+		<-p.Send
+	}
+}
+
+// joinPeer makes a peer fp, applies setup to it, registers it with h and
+// joins it to ns. What the join sends is left in its buffer.
+func joinPeer(t testing.TB, h *Hub, fp, ns string, setup ...func(p *peer.Peer)) (*peer.Peer, func()) {
+	t.Helper()
+	p, cleanup := makePeer(t, fp)
+	for _, f := range setup {
+		f(p)
+	}
+	h.Register(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"` + ns + `"}`)}))
+	return p, cleanup
+}
+
+// expectType reads p's next message and fails unless it is msgType and,
+// for a nonzero code, an error with that code.
+func expectType(t testing.TB, p *peer.Peer, msgType string, code int) *protocol.Message {
+	t.Helper()
+	select {
+	case raw := <-p.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != msgType {
+			t.Fatalf("%s: expected %s, got %s: %s", p.Fingerprint, msgType, decoded.Type, decoded.Payload)
+		}
+		if code != 0 {
+			var e protocol.ErrorPayload
+			json.Unmarshal(decoded.Payload, &e)
+			if e.Code != code {
+				t.Errorf("%s: expected code %d, got %d", p.Fingerprint, code, e.Code)
+			}
+		}
+		return decoded
+	case <-time.After(time.Second):
+		t.Fatalf("%s: timeout waiting for %s", p.Fingerprint, msgType)
+		return nil
+	}
+}
+
 func newTestHub() *Hub {
 	b := broker.NewLocal()
 	return New(64, 100, b)
@@ -130,6 +182,64 @@ func TestHubRegisterReplace(t *testing.T) {
 	}
 }
 
+func TestHubPresence(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	expectPresence := func(p *peer.Peer, from, status string) {
+		t.Helper()
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			var pp protocol.PresencePayload
+			json.Unmarshal(decoded.Payload, &pp)
+			if decoded.Type != protocol.TypePresence || decoded.From != from || pp.Fingerprint != from || pp.Status != status {
+				t.Errorf("expected %s %s, got %s %+v", from, status, decoded.Type, pp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s %s", from, status)
+		}
+	}
+
+	early, c0 := makePeer(t, "early")
+	defer c0()
+	early.SharePresence = true
+	h.Register(early)
+
+	watcher, c1 := makePeer(t, "watcher")
+	defer c1()
+	watcher.WatchPresence = []string{"early", "friend", "private"}
+	h.Register(watcher)
+	// a watched peer already online is reported right away
+	expectPresence(watcher, "early", protocol.PresenceOnline)
+
+	friend, c2 := makePeer(t, "friend")
+	defer c2()
+	friend.SharePresence = true
+	friend.Alias = "bob"
+	h.Register(friend)
+	expectPresence(watcher, "friend", protocol.PresenceOnline)
+
+	// peers that don't share presence are never reported
+	private, c3 := makePeer(t, "private")
+	defer c3()
+	h.Register(private)
+	h.Unregister("private")
+
+	h.Unregister("friend")
+	expectPresence(watcher, "friend", protocol.PresenceOffline)
+	if len(watcher.Send) != 0 {
+		decoded, _ := protocol.Decode(<-watcher.Send)
+		t.Errorf("unexpected %s for %s", decoded.Type, decoded.From)
+	}
+
+	// once the watcher leaves it gets nothing more
+	h.Unregister("watcher")
+	if n := len(h.presence.watchersOf("early")); n != 0 {
+		t.Errorf("expected no watchers after unregister, got %d", n)
+	}
+}
+
 func TestHubUnregister(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -149,6 +259,107 @@ func TestHubUnregister(t *testing.T) {
 	}
 }
 
+func TestHubDisconnectGrace(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{DisconnectGrace: 50 * time.Millisecond})
+	defer h.Shutdown()
+
+	// waitLeft reports whether partner got peer_left for fp before timeout,
+	// skipping other messages
+	waitLeft := func(partner *peer.Peer, fp string, timeout time.Duration) bool {
+		deadline := time.After(timeout)
+		for {
+			select {
+			case raw := <-partner.Send:
+				decoded, _ := protocol.Decode(raw)
+				if decoded.Type == protocol.TypePeerLeft && decoded.From == fp {
+					return true
+				}
+			case <-deadline:
+				return false
+			}
+		}
+	}
+
+	partner, cp := joinPeer(t, h, "partner", "lobby")
+	defer cp()
+
+	flapper, c1 := joinPeer(t, h, "flapper", "lobby")
+	defer c1()
+	drain(partner)
+	h.Unregister("flapper")
+	if waitLeft(partner, "flapper", 20*time.Millisecond) {
+		t.Fatal("peer_left should wait for the grace period")
+	}
+	back, c2 := joinPeer(t, h, "flapper", "lobby")
+	defer c2()
+	if len(partner.Send) != 0 {
+		t.Error("a rejoin within the grace should not announce peer_joined again")
+	}
+	if waitLeft(partner, "flapper", 150*time.Millisecond) {
+		t.Error("peer_left should be suppressed when the peer reconnects within the grace")
+	}
+	if flapper == back || !back.InNamespace("lobby") {
+		t.Fatal("expected a new connection back in the namespace")
+	}
+
+	// the usual reconnect: a new socket replaces a half-open one, whose
+	// cleanup runs after
+	again, c3 := makePeer(t, "flapper")
+	defer c3()
+	h.Register(again)
+	h.UnregisterPeer(back)
+	if waitLeft(partner, "flapper", 20*time.Millisecond) {
+		t.Fatal("peer_left for a replaced connection should wait for the grace period")
+	}
+	h.HandleMessage(again, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	if waitLeft(partner, "flapper", 150*time.Millisecond) {
+		t.Error("peer_left should be suppressed when the replacement rejoins within the grace")
+	}
+
+	h.Unregister("flapper")
+	if !waitLeft(partner, "flapper", time.Second) {
+		t.Error("expected peer_left once the grace passed without a reconnect")
+	}
+}
+
+func TestHubUnregisterOnDone(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	// no readPump here, only the watchdog can unregister
+	ctx, cancel := context.WithCancel(context.Background())
+	h.UnregisterOnDone(ctx, p)
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for h.PeerCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if h.PeerCount() != 0 {
+		t.Fatalf("expected peer count 0 after cancel, got %d", h.PeerCount())
+	}
+	if !p.IsClosed() {
+		t.Error("expected peer to be closed")
+	}
+
+	// a stopped watchdog leaves the peer alone
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p2)
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	stop := h.UnregisterOnDone(ctx2, p2)
+	stop()
+	cancel2()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h.GetPeer("fp2"); !ok {
+		t.Error("stopped watchdog should not unregister")
+	}
+}
+
 func TestHubUnregisterNonExistent(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -167,12 +378,12 @@ func TestHubAliasResolution(t *testing.T) {
 
 	h.Register(p)
 
-	fp, ok := h.ResolveAlias("cool-fox")
+	fp, ok := h.ResolveAlias("", "cool-fox")
 	if !ok || fp != "fp1" {
 		t.Error("should resolve alias to fingerprint")
 	}
 
-	_, ok = h.ResolveAlias("nonexistent-alias")
+	_, ok = h.ResolveAlias("", "nonexistent-alias")
 	if ok {
 		t.Error("should not resolve nonexistent alias")
 	}
@@ -193,7 +404,7 @@ func TestHubAliasCollision(t *testing.T) {
 	h.Register(p2)
 
 	// alias should still point to fp1 (first one stored)
-	fp, ok := h.ResolveAlias("same-alias")
+	fp, ok := h.ResolveAlias("", "same-alias")
 	if !ok {
 		t.Fatal("alias should resolve")
 	}
@@ -212,7 +423,7 @@ func TestHubAliasCleanupOnUnregister(t *testing.T) {
 	h.Register(p)
 
 	h.Unregister("fp1")
-	_, ok := h.ResolveAlias("my-alias")
+	_, ok := h.ResolveAlias("", "my-alias")
 	if ok {
 		t.Error("alias should be cleaned up after unregister")
 	}
@@ -282,6 +493,144 @@ func TestHubHandleJoinEmptyNamespace(t *testing.T) {
 	}
 }
 
+func TestHubMaxNamespaces(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxNamespaces: 1})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "first", AppType: "app"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	if decoded, _ := protocol.Decode(<-p1.Send); decoded.Type != protocol.TypePeerList {
+		t.Fatalf("expected peer_list, got %s", decoded.Type)
+	}
+
+	newPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "second", AppType: "app"})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: newPayload}))
+	decoded, _ := protocol.Decode(<-p2.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 503 {
+		t.Fatalf("expected 503 for a new namespace at the cap, got %s %s", decoded.Type, decoded.Payload)
+	}
+
+	// the existing namespace is still joinable
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	if decoded, _ := protocol.Decode(<-p2.Send); decoded.Type != protocol.TypePeerList {
+		t.Errorf("expected peer_list for the existing namespace, got %s", decoded.Type)
+	}
+}
+
+func TestHubWelcomeAfterPeerList(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		Welcome: map[string]string{"lobby-*": "be nice"},
+	})
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby-eu", AppType: "app"})
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	if decoded, _ := protocol.Decode(<-p.Send); decoded.Type != protocol.TypePeerList {
+		t.Fatalf("expected peer_list first, got %s", decoded.Type)
+	}
+	decoded, _ := protocol.Decode(<-p.Send)
+	var wp protocol.WelcomePayload
+	json.Unmarshal(decoded.Payload, &wp)
+	if decoded.Type != protocol.TypeWelcome || wp.Message != "be nice" || wp.Namespace != "lobby-eu" {
+		t.Fatalf("expected welcome for lobby-eu, got %s %s", decoded.Type, decoded.Payload)
+	}
+
+	// namespaces without a welcome get nothing extra
+	otherPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "other", AppType: "app"})
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: otherPayload}))
+	<-p.Send
+	select {
+	case raw := <-p.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("unexpected %s after joining a namespace without welcome", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubRoomMotd(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	guest, gc := makePeer(t, "guest")
+	defer gc()
+	h.Register(owner)
+	h.Register(guest)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 4})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-owner.Send
+
+	motd := "welcome to room1"
+	metaPayload, _ := json.Marshal(protocol.SetRoomMetaPayload{RoomID: "room1", Meta: protocol.RoomMeta{Motd: &motd}})
+	h.HandleMessage(guest, mustEncode(&protocol.Message{Type: protocol.TypeSetRoomMeta, Payload: metaPayload}))
+	decoded, _ := protocol.Decode(<-guest.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 403 {
+		t.Fatalf("expected 403 for non-owner set_room_meta, got %s %s", decoded.Type, decoded.Payload)
+	}
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeSetRoomMeta, Payload: metaPayload}))
+
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "room1"})
+	h.HandleMessage(guest, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload}))
+	if decoded, _ := protocol.Decode(<-guest.Send); decoded.Type != protocol.TypePeerList {
+		t.Fatalf("expected peer_list first, got %s", decoded.Type)
+	}
+	decoded, _ = protocol.Decode(<-guest.Send)
+	var wp protocol.WelcomePayload
+	json.Unmarshal(decoded.Payload, &wp)
+	if decoded.Type != protocol.TypeWelcome || wp.Message != motd {
+		t.Fatalf("expected room motd, got %s %s", decoded.Type, decoded.Payload)
+	}
+}
+
+func TestHubCreateRoomAtNamespaceCap(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxNamespaces: 1})
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	expectCode := func(room string, want int) {
+		t.Helper()
+		createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: room, MaxSize: 4})
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+		decoded, _ := protocol.Decode(<-p.Send)
+		if want == 0 {
+			if decoded.Type != protocol.TypeRoomCreated {
+				t.Fatalf("%s: expected room_created, got %s %s", room, decoded.Type, decoded.Payload)
+			}
+			return
+		}
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != want {
+			t.Fatalf("%s: expected %d, got %s %s", room, want, decoded.Type, decoded.Payload)
+		}
+	}
+
+	expectCode("room1", 0)
+	expectCode("room2", 503)
+	// an existing room is still reported as such, not as capacity
+	expectCode("room1", 409)
+}
+
 func TestHubHandleLeave(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -306,6 +655,55 @@ func TestHubHandleLeave(t *testing.T) {
 	}
 }
 
+func TestHubLeaveFarewellMessage(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "test-ns", AppType: "game"})
+	joinMsg := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	h.HandleMessage(p1, joinMsg)
+	<-p1.Send // peer_list
+	h.HandleMessage(p2, joinMsg)
+	<-p2.Send // peer_list
+	<-p1.Send // peer_joined
+
+	tooLong, _ := json.Marshal(protocol.LeavePayload{Namespace: "test-ns", Message: strings.Repeat("x", maxLeaveMessageLen+1)})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: tooLong}))
+	raw := <-p2.Send
+	decoded, _ := protocol.Decode(raw)
+	if decoded.Type != protocol.TypeError {
+		t.Fatalf("expected error for oversized farewell, got %s", decoded.Type)
+	}
+	if !p2.InNamespace("test-ns") {
+		t.Fatal("rejected leave should keep the peer in the namespace")
+	}
+
+	leavePayload, _ := json.Marshal(protocol.LeavePayload{Namespace: "test-ns", Message: "gg"})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: leavePayload}))
+
+	select {
+	case raw := <-p1.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypePeerLeft || decoded.From != "fp2" {
+			t.Fatalf("expected peer_left from fp2, got %s from %s", decoded.Type, decoded.From)
+		}
+		var left protocol.PeerLeftPayload
+		json.Unmarshal(decoded.Payload, &left)
+		if left.Message != "gg" {
+			t.Errorf("expected farewell 'gg', got %q", left.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for peer_left")
+	}
+}
+
 func TestHubHandleSignalSharedNamespace(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -423,6 +821,101 @@ func TestHubHandleSignalNoTarget(t *testing.T) {
 	}
 }
 
+func TestHubNoopBrokerLocalOnly(t *testing.T) {
+	h := New(64, 100, broker.NewNoop())
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("shared", "app", "", nil)
+	p2.JoinNamespace("shared", "app", "", nil)
+
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", Payload: []byte(`{"signal_type":"offer"}`)}))
+	select {
+	case raw := <-p2.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeSignal || decoded.From != "fp1" {
+			t.Errorf("expected signal from fp1, got %s from %s", decoded.Type, decoded.From)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for local signal")
+	}
+
+	// an unknown target can't be on another node, so it fails right away
+	// instead of being published and waiting for a claim
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "elsewhere", RequireTarget: true}))
+	select {
+	case raw := <-p1.Send:
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != 404 {
+			t.Errorf("expected 404 error, got %s %s", decoded.Type, decoded.Payload)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected an immediate 404")
+	}
+	h.claims.Range(func(k, _ interface{}) bool {
+		t.Errorf("unexpected pending claim %v", k)
+		return true
+	})
+}
+
+func TestHubDropStats(t *testing.T) {
+	h := New(64, 100, broker.NewNoop())
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("shared", "app", "", nil)
+	p2.JoinNamespace("shared", "app", "", nil)
+
+	before := h.DropStats()
+	for i := 0; i < cap(p2.Send); i++ {
+		p2.Send <- []byte("filler")
+	}
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", Payload: []byte(`{"signal_type":"offer"}`)}))
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "gone", Payload: []byte(`{"signal_type":"offer"}`)}))
+
+	after := h.DropStats()
+	if got := after["send_buffer_full"] - before["send_buffer_full"]; got < 1 {
+		t.Errorf("expected a send_buffer_full drop, got %d", got)
+	}
+	if got := after["target_not_found"] - before["target_not_found"]; got != 1 {
+		t.Errorf("expected 1 target_not_found drop, got %d", got)
+	}
+}
+
+func TestHubNilBroker(t *testing.T) {
+	h := New(64, 100, nil)
+	defer h.Shutdown()
+	if !h.localOnly {
+		t.Fatal("expected a nil broker to mean local only")
+	}
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "elsewhere"}))
+	select {
+	case raw := <-p.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeError {
+			t.Errorf("expected error, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
 func TestHubHandleSignalViaAlias(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -468,6 +961,56 @@ func TestHubHandleSignalViaAlias(t *testing.T) {
 	}
 }
 
+func TestHubNamespaceScopedAliases(t *testing.T) {
+	h := NewWithOptions(64, 100, nil, Options{AliasScope: AliasScopeNamespace})
+	defer h.Shutdown()
+
+	withAlias := func(p *peer.Peer) { p.Alias = "brave-fox-42" }
+	red, c1 := joinPeer(t, h, "red", "tenant-a", withAlias)
+	defer c1()
+	blue, c2 := joinPeer(t, h, "blue", "tenant-b", withAlias)
+	defer c2()
+	sender, c0 := joinPeer(t, h, "sender", "tenant-a")
+	defer c0()
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"tenant-b"}`)}))
+	for _, p := range []*peer.Peer{sender, red, blue} {
+		drain(p)
+	}
+	if _, ok := h.ResolveAlias("", "brave-fox-42"); ok {
+		t.Error("scoped alias should not resolve without a namespace")
+	}
+
+	if fp, ok := h.ResolveAlias("tenant-a", "brave-fox-42"); !ok || fp != "red" {
+		t.Errorf("expected red in tenant-a, got %q %v", fp, ok)
+	}
+	if fp, ok := h.ResolveAlias("tenant-b", "brave-fox-42"); !ok || fp != "blue" {
+		t.Errorf("expected blue in tenant-b, got %q %v", fp, ok)
+	}
+
+	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer"})
+	signal := func(from *peer.Peer, ns string) {
+		h.HandleMessage(from, mustEncode(&protocol.Message{
+			Type:      protocol.TypeSignal,
+			To:        "brave-fox-42",
+			Namespace: ns,
+			Payload:   signalPayload,
+		}))
+	}
+	signal(sender, "tenant-b")
+	if decoded := expectType(t, blue, protocol.TypeSignal, 0); decoded.To != "blue" {
+		t.Errorf("expected signal to blue, got it to %s", decoded.To)
+	}
+	if len(red.Send) > 0 {
+		t.Error("signal should reach only the alias holder in the named namespace")
+	}
+
+	// no namespace, or one the sender is not in, does not resolve
+	signal(sender, "")
+	expectType(t, sender, protocol.TypeError, 404)
+	signal(red, "tenant-b")
+	expectType(t, red, protocol.TypeError, 404)
+}
+
 func TestHubHandleBroadcast(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -514,19 +1057,505 @@ func TestHubHandleBroadcast(t *testing.T) {
 	}
 }
 
-func TestHubHandleBroadcastNotInNamespace(t *testing.T) {
+func TestHubBinaryBroadcast(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
 
-	p1, c1 := makePeer(t, "outsider")
+	sender, c1 := makePeer(t, "sender")
 	defer c1()
-	p2, c2 := makePeer(t, "insider")
+	binPeer, c2 := makePeer(t, "bin")
 	defer c2()
+	textPeer, c3 := makePeer(t, "text")
+	defer c3()
+	binPeer.Binary = true
+	for _, p := range []*peer.Peer{sender, binPeer, textPeer} {
+		h.Register(p)
+		joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "game", AppType: "app"})
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	}
+	for _, p := range []*peer.Peer{sender, binPeer, textPeer} {
+		for len(p.Send) > 0 {
+			<-p.Send
+		}
+	}
 
-	h.Register(p1)
-	h.Register(p2)
+	state := []byte{0x00, 0x01, 0xfe, 0xff}
+	frame := append([]byte{peer.BinaryMarker, 4}, "game"...)
+	h.HandleMessage(sender, append(frame, state...))
 
-	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "private-ns", AppType: "game"})
+	typ, got := peer.Frame(<-binPeer.Send)
+	if typ != websocket.MessageBinary {
+		t.Fatalf("binary peer should get a binary frame, got %v", typ)
+	}
+	if want := protocol.EncodeBinaryBroadcast("game", "sender", state); string(got) != string(want) {
+		t.Errorf("binary frame mismatch: got %v want %v", got, want)
+	}
+
+	typ, got = peer.Frame(<-textPeer.Send)
+	decoded, _ := protocol.Decode(got)
+	if typ != websocket.MessageText || decoded.Type != protocol.TypeBroadcast || decoded.From != "sender" {
+		t.Fatalf("text peer should get a broadcast, got %v %s", typ, got)
+	}
+	var bp protocol.BroadcastPayload
+	json.Unmarshal(decoded.Payload, &bp)
+	var data []byte
+	json.Unmarshal(bp.Data, &data)
+	if bp.Encoding != "base64" || bp.Namespace != "game" || string(data) != string(state) {
+		t.Errorf("unexpected text broadcast payload %s", decoded.Payload)
+	}
+
+	select {
+	case raw := <-sender.Send:
+		t.Errorf("sender should not receive its own broadcast, got %q", raw)
+	default:
+	}
+}
+
+func TestHubBroadcastSizeLimitPerNamespace(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		MaxBroadcastSize: map[string]int{"chat-*": 16, "chat-vip": 1024},
+	})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	h.Register(p1)
+	for _, ns := range []string{"chat-lobby", "chat-vip", "signaling"} {
+		p1.JoinNamespace(ns, "app", "", nil)
+		h.nsMgr.GetOrCreate(ns).Add(p1)
+	}
+
+	large := []byte(`"` + strings.Repeat("x", 100) + `"`)
+	broadcast := func(ns string) *protocol.Message {
+		payload, _ := json.Marshal(protocol.BroadcastPayload{Namespace: ns, Data: large})
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: payload}))
+		select {
+		case raw := <-p1.Send:
+			decoded, _ := protocol.Decode(raw)
+			return decoded
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+
+	got := broadcast("chat-lobby")
+	if got == nil {
+		t.Fatal("expected 413 for large broadcast in chat-lobby")
+	}
+	var ep protocol.ErrorPayload
+	json.Unmarshal(got.Payload, &ep)
+	if got.Type != protocol.TypeError || ep.Code != 413 {
+		t.Errorf("expected 413, got %s %d", got.Type, ep.Code)
+	}
+
+	// exact entry overrides the prefix, unlisted namespaces are unrestricted
+	for _, ns := range []string{"chat-vip", "signaling"} {
+		if got := broadcast(ns); got != nil {
+			t.Errorf("expected broadcast in %s to be allowed, got %s", ns, got.Type)
+		}
+	}
+}
+
+func TestHubBroadcastCoalesce(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		BroadcastCoalesce: map[string]time.Duration{"ticker-*": 30 * time.Millisecond},
+	})
+	defer h.Shutdown()
+
+	a, c1 := joinPeer(t, h, "fp-a", "ticker-1")
+	defer c1()
+	b, c2 := joinPeer(t, h, "fp-b", "ticker-1")
+	defer c2()
+	watcher, c3 := joinPeer(t, h, "fp-w", "ticker-1")
+	defer c3()
+	for _, p := range []*peer.Peer{a, b, watcher} {
+		drain(p)
+	}
+
+	send := func(p *peer.Peer, n int) {
+		payload := fmt.Sprintf(`{"namespace":"ticker-1","data":{"n":%d}}`, n)
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: []byte(payload)}))
+	}
+	send(a, 1)
+	send(b, 2)
+	send(a, 3)
+	if len(watcher.Send) != 0 {
+		t.Fatal("broadcasts should be held for the coalescing window")
+	}
+
+	readBatch := func(p *peer.Peer) []int {
+		t.Helper()
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			var entries []*protocol.Message
+			if decoded.Type == protocol.TypeBatch {
+				json.Unmarshal(decoded.Payload, &entries)
+			} else {
+				entries = []*protocol.Message{decoded}
+			}
+			var got []int
+			for _, e := range entries {
+				var bp struct {
+					Data struct{ N int } `json:"data"`
+				}
+				json.Unmarshal(e.Payload, &bp)
+				got = append(got, bp.Data.N)
+			}
+			if len(p.Send) != 0 {
+				t.Errorf("%s: expected one frame, got more", p.Fingerprint)
+			}
+			return got
+		case <-time.After(time.Second):
+			t.Fatalf("%s: timeout waiting for the batch", p.Fingerprint)
+			return nil
+		}
+	}
+	if got := readBatch(watcher); fmt.Sprint(got) != "[1 2 3]" {
+		t.Errorf("watcher: expected [1 2 3] in one batch, got %v", got)
+	}
+	if got := readBatch(a); fmt.Sprint(got) != "[2]" {
+		t.Errorf("a: expected only b's broadcast, got %v", got)
+	}
+	if got := readBatch(b); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("b: expected a's broadcasts, got %v", got)
+	}
+
+	// namespaces without a window broadcast at once
+	x, c4 := joinPeer(t, h, "fp-x", "plain")
+	defer c4()
+	y, c5 := joinPeer(t, h, "fp-y", "plain")
+	defer c5()
+	drain(x)
+	h.HandleMessage(y, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: []byte(`{"namespace":"plain","data":1}`)}))
+	if len(x.Send) != 1 {
+		t.Errorf("expected an uncoalesced broadcast delivered immediately, got %d", len(x.Send))
+	}
+}
+
+func TestHubBroadcastCoalesceSlotAndShutdown(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		BroadcastCoalesce:       map[string]time.Duration{"ticker-*": 10 * time.Millisecond, "slow-*": time.Hour},
+		MaxConcurrentBroadcasts: 1,
+	})
+
+	sender, c1 := joinPeer(t, h, "fp-s", "ticker-1")
+	defer c1()
+	watcher, c2 := joinPeer(t, h, "fp-w", "ticker-1")
+	defer c2()
+	for _, p := range []*peer.Peer{sender, watcher} {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"slow-1"}`)}))
+		drain(p)
+	}
+
+	// a timed flush waits for a MaxConcurrentBroadcasts slot like any broadcast
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: []byte(`{"namespace":"ticker-1","data":1}`)}))
+	h.broadcastSlots <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	if len(watcher.Send) != 0 {
+		t.Fatal("coalesced batch should wait for a free broadcast slot")
+	}
+	<-h.broadcastSlots
+	select {
+	case <-watcher.Send:
+	case <-time.After(time.Second):
+		t.Fatal("coalesced batch should go out once a slot is free")
+	}
+
+	// a batch whose window hasn't passed goes out on shutdown
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: []byte(`{"namespace":"slow-1","data":2}`)}))
+	if len(watcher.Send) != 0 {
+		t.Fatal("broadcast should be held for the coalescing window")
+	}
+	h.Shutdown()
+	if len(watcher.Send) != 1 {
+		t.Errorf("expected the pending batch delivered on shutdown, got %d messages", len(watcher.Send))
+	}
+}
+
+func TestHubMaxConcurrentBroadcasts(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxConcurrentBroadcasts: 2})
+	defer h.Shutdown()
+
+	sender, c1 := makePeer(t, "storm-1")
+	defer c1()
+	other, c2 := makePeer(t, "storm-2")
+	defer c2()
+	ns := h.nsMgr.GetOrCreate("storm")
+	for _, p := range []*peer.Peer{sender, other} {
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("storm", "game", "", nil)
+	}
+	broadcast := mustEncode(&protocol.Message{
+		Type:    protocol.TypeBroadcast,
+		Payload: []byte(`{"namespace":"storm","data":"hi"}`),
+	})
+
+	// two broadcasts still fanning out hold every slot
+	h.broadcastSlots <- struct{}{}
+	h.broadcastSlots <- struct{}{}
+	h.HandleMessage(sender, broadcast)
+	decoded, _ := protocol.Decode(<-sender.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 503 {
+		t.Fatalf("expected 503 with every slot taken, got %s %+v", decoded.Type, ep)
+	}
+	if len(other.Send) != 0 {
+		t.Fatal("rejected broadcast was delivered")
+	}
+	if n := h.DropStats()["broadcast_rejected"]; n != 1 {
+		t.Errorf("expected 1 rejected broadcast, got %d", n)
+	}
+
+	// one finishing within broadcastSlotWait lets a waiting broadcast through
+	time.AfterFunc(20*time.Millisecond, func() { <-h.broadcastSlots })
+	h.HandleMessage(sender, broadcast)
+	select {
+	case raw := <-other.Send:
+		if decoded, _ := protocol.Decode(raw); decoded.Type != protocol.TypeBroadcast {
+			t.Errorf("expected broadcast, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the queued broadcast")
+	}
+	if len(sender.Send) != 0 {
+		t.Error("queued broadcast should not be rejected")
+	}
+	if n := len(h.broadcastSlots); n != 1 {
+		t.Errorf("expected the broadcast to give its slot back, %d taken", n)
+	}
+}
+
+func TestHubMaxConcurrentBroadcastsConcurrentSenders(t *testing.T) {
+	h := NewWithOptions(64, 1000, broker.NewLocal(), Options{MaxConcurrentBroadcasts: 2})
+	defer h.Shutdown()
+
+	const senders = 16
+	ns := h.nsMgr.GetOrCreate("storm")
+	peers := make([]*peer.Peer, 0, senders)
+	for i := 0; i < senders; i++ {
+		p, c := makePeer(t, fmt.Sprintf("storm-%d", i))
+		defer c()
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("storm", "game", "", nil)
+		peers = append(peers, p)
+	}
+	listener, lc := makePeer(t, "listener")
+	defer lc()
+	listener.Send = make(chan []byte, senders)
+	h.Register(listener)
+	ns.Add(listener)
+	listener.JoinNamespace("storm", "game", "", nil)
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer.Peer) {
+			defer wg.Done()
+			h.HandleMessage(p, mustEncode(&protocol.Message{
+				Type:    protocol.TypeBroadcast,
+				Payload: []byte(`{"namespace":"storm","data":"hi"}`),
+			}))
+		}(p)
+	}
+	wg.Wait()
+
+	// every broadcast either reached the listener or was refused with a 503
+	rejected := 0
+	for _, p := range peers {
+		for len(p.Send) > 0 {
+			decoded, _ := protocol.Decode(<-p.Send)
+			if decoded.Type == protocol.TypeError {
+				rejected++
+			}
+		}
+	}
+	if got := len(listener.Send) + rejected; got != senders {
+		t.Errorf("expected %d broadcasts delivered or refused, got %d delivered and %d refused", senders, len(listener.Send), rejected)
+	}
+	if n := h.DropStats()["broadcast_rejected"]; n != int64(rejected) {
+		t.Errorf("expected %d rejected broadcasts counted, got %d", rejected, n)
+	}
+	if n := len(h.broadcastSlots); n != 0 {
+		t.Errorf("expected every slot given back, %d taken", n)
+	}
+}
+
+func TestHubMaxConcurrentBroadcastsFromBroker(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxConcurrentBroadcasts: 1})
+	defer h.Shutdown()
+
+	member, c := makePeer(t, "member")
+	defer c()
+	h.Register(member)
+	ns := h.nsMgr.GetOrCreate("storm")
+	ns.Add(member)
+	member.JoinNamespace("storm", "game", "", nil)
+
+	remote := mustEncode(&protocol.Message{
+		Type:    protocol.TypeBroadcast,
+		From:    generateTestFingerprint(1),
+		NodeID:  strings.Repeat("ab", 16),
+		Payload: []byte(`{"namespace":"storm","data":"hi"}`),
+	})
+
+	h.broadcastSlots <- struct{}{}
+	h.handleBrokerBroadcast(remote)
+	if len(member.Send) != 0 {
+		t.Fatal("broker broadcast should wait for a slot like a peer's")
+	}
+	if n := h.DropStats()["broadcast_rejected"]; n != 1 {
+		t.Errorf("expected 1 rejected broadcast, got %d", n)
+	}
+
+	<-h.broadcastSlots
+	h.handleBrokerBroadcast(remote)
+	if len(member.Send) != 1 {
+		t.Errorf("expected the broker broadcast delivered with a free slot, got %d", len(member.Send))
+	}
+	if n := len(h.broadcastSlots); n != 0 {
+		t.Errorf("expected the slot given back, %d taken", n)
+	}
+}
+
+func TestHubBroadcastFanOut(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{AsyncBroadcastThreshold: 4, MaxBroadcastRecipients: 8})
+	defer h.Shutdown()
+
+	ns := h.nsMgr.GetOrCreate("big")
+	members := make([]*peer.Peer, 9)
+	for i := range members {
+		p, c := makePeer(t, fmt.Sprintf("fan-%d", i))
+		defer c()
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("big", "game", "", nil)
+		members[i] = p
+	}
+	sender := members[0]
+	broadcast := mustEncode(&protocol.Message{
+		Type:    protocol.TypeBroadcast,
+		Payload: []byte(`{"namespace":"big","data":"hi"}`),
+	})
+
+	// hold the fan-out worker so the broadcast can only be delivered by it
+	release := make(chan struct{})
+	h.fanout <- func() { <-release }
+
+	done := make(chan struct{})
+	go func() {
+		h.HandleMessage(sender, broadcast)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sender blocked on a large broadcast")
+	}
+	for _, p := range members[1:] {
+		if len(p.Send) != 0 {
+			t.Fatalf("%s got the broadcast inline", p.Fingerprint)
+		}
+	}
+
+	close(release)
+	for _, p := range members[1:] {
+		select {
+		case raw := <-p.Send:
+			if decoded, _ := protocol.Decode(raw); decoded.Type != protocol.TypeBroadcast {
+				t.Errorf("expected broadcast, got %s", decoded.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for broadcast on %s", p.Fingerprint)
+		}
+	}
+
+	// one more member puts the namespace over the recipient cap
+	extra, c := makePeer(t, "fan-extra")
+	defer c()
+	h.Register(extra)
+	ns.Add(extra)
+	extra.JoinNamespace("big", "game", "", nil)
+	h.HandleMessage(sender, broadcast)
+	decoded, _ := protocol.Decode(<-sender.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 400 {
+		t.Errorf("expected 400 over the recipient cap, got %s %+v", decoded.Type, ep)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(extra.Send) != 0 {
+		t.Error("broadcast over the cap was delivered")
+	}
+}
+
+func TestHubBroadcastFanOutKeepsOrder(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{AsyncBroadcastThreshold: 4})
+	defer h.Shutdown()
+
+	ns := h.nsMgr.GetOrCreate("big")
+	members := make([]*peer.Peer, 6)
+	for i := range members {
+		p, c := makePeer(t, fmt.Sprintf("fan-%d", i))
+		defer c()
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("big", "game", "", nil)
+		members[i] = p
+	}
+	sender, receiver := members[0], members[1]
+	broadcast := func(data string) {
+		h.HandleMessage(sender, mustEncode(&protocol.Message{
+			Type:    protocol.TypeBroadcast,
+			Payload: []byte(`{"namespace":"big","data":"` + data + `"}`),
+		}))
+	}
+
+	release := make(chan struct{})
+	h.fanout <- func() { <-release }
+	broadcast("first")
+
+	// small enough for inline now, but must not overtake the queued one
+	for _, p := range members[2:] {
+		ns.Remove(p.Fingerprint)
+	}
+	broadcast("second")
+	if len(receiver.Send) != 0 {
+		t.Fatal("second broadcast delivered ahead of the queued first")
+	}
+
+	close(release)
+	for _, want := range []string{`"first"`, `"second"`} {
+		select {
+		case raw := <-receiver.Send:
+			decoded, _ := protocol.Decode(raw)
+			var bp protocol.BroadcastPayload
+			json.Unmarshal(decoded.Payload, &bp)
+			if string(bp.Data) != want {
+				t.Errorf("expected %s, got %s", want, bp.Data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s", want)
+		}
+	}
+}
+
+func TestHubHandleBroadcastNotInNamespace(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "outsider")
+	defer c1()
+	p2, c2 := makePeer(t, "insider")
+	defer c2()
+
+	h.Register(p1)
+	h.Register(p2)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "private-ns", AppType: "game"})
 	joinMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
 	h.HandleMessage(p2, joinMsg)
 	<-p2.Send
@@ -612,6 +1641,43 @@ func TestHubHandleUnknownType(t *testing.T) {
 	}
 }
 
+func TestHubErrorEchoesRequestID(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	expectError := func() *protocol.Message {
+		t.Helper()
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != protocol.TypeError {
+				t.Fatalf("expected error, got %s", decoded.Type)
+			}
+			return decoded
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+			return nil
+		}
+	}
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeSignal, RequestID: "req-42"}))
+	if got := expectError(); got.RequestID != "req-42" {
+		t.Errorf("expected request_id req-42, got %q", got.RequestID)
+	}
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: "unknown_type"}))
+	first := expectError()
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: "unknown_type"}))
+	second := expectError()
+	if first.RequestID == "" || first.RequestID == second.RequestID {
+		t.Errorf("expected distinct generated request ids, got %q and %q", first.RequestID, second.RequestID)
+	}
+}
+
 func TestHubHandleDiscover(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -683,6 +1749,97 @@ func TestHubHandleDiscoverNonExistent(t *testing.T) {
 	}
 }
 
+func TestHubMyRooms(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	owner, c1 := makePeer(t, "owner")
+	defer c1()
+	other, c2 := makePeer(t, "other")
+	defer c2()
+	h.Register(owner)
+	h.Register(other)
+
+	for _, id := range []string{"room-b", "room-a"} {
+		createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: id, MaxSize: 10})
+		h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+		<-owner.Send // room_created
+	}
+
+	myRooms := func(p *peer.Peer) protocol.MyRoomsPayload {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeMyRooms}))
+		raw := <-p.Send
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeMyRooms {
+			t.Fatalf("expected my_rooms, got %s", decoded.Type)
+		}
+		var mr protocol.MyRoomsPayload
+		json.Unmarshal(decoded.Payload, &mr)
+		return mr
+	}
+
+	mr := myRooms(owner)
+	if len(mr.Rooms) != 2 || mr.Rooms[0].RoomID != "room-a" || mr.Rooms[1].RoomID != "room-b" {
+		t.Fatalf("expected room-a and room-b, got %+v", mr.Rooms)
+	}
+	if mr.Rooms[0].MaxSize != 10 {
+		t.Errorf("expected max_size 10, got %d", mr.Rooms[0].MaxSize)
+	}
+
+	if mr := myRooms(other); mr.Rooms == nil || len(mr.Rooms) != 0 {
+		t.Errorf("expected empty room list for non-owner, got %+v", mr.Rooms)
+	}
+}
+
+func TestHubCreateRoomIdempotencyKey(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	owner, c1 := makePeer(t, "owner")
+	defer c1()
+	other, c2 := makePeer(t, "other")
+	defer c2()
+	h.Register(owner)
+	h.Register(other)
+
+	create := func(p *peer.Peer, key string) (*protocol.Message, protocol.ErrorPayload) {
+		payload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "retry-room", MaxSize: 8, IdempotencyKey: key})
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: payload}))
+		raw := <-p.Send
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		if decoded.Type == protocol.TypeError {
+			json.Unmarshal(decoded.Payload, &ep)
+		}
+		return decoded, ep
+	}
+
+	if msg, _ := create(owner, "k1"); msg.Type != protocol.TypeRoomCreated {
+		t.Fatalf("expected room_created, got %s", msg.Type)
+	}
+
+	// retry with the same key succeeds with the original response
+	msg, _ := create(owner, "k1")
+	if msg.Type != protocol.TypeRoomCreated {
+		t.Fatalf("expected retry to return room_created, got %s", msg.Type)
+	}
+	var rc protocol.RoomCreatedPayload
+	json.Unmarshal(msg.Payload, &rc)
+	if rc.RoomID != "retry-room" || rc.MaxSize != 8 || rc.Owner != "owner" {
+		t.Errorf("unexpected retried room_created: %+v", rc)
+	}
+
+	// another key, no key, or another peer's key is a genuine conflict
+	for _, tc := range []struct {
+		p   *peer.Peer
+		key string
+	}{{owner, "k2"}, {owner, ""}, {other, "k1"}} {
+		if msg, ep := create(tc.p, tc.key); msg.Type != protocol.TypeError || ep.Code != 409 {
+			t.Errorf("%s/%q: expected 409, got %s %d", tc.p.Fingerprint, tc.key, msg.Type, ep.Code)
+		}
+	}
+}
+
 func TestHubHandleCreateRoom(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -714,28 +1871,234 @@ func TestHubHandleCreateRoom(t *testing.T) {
 	}
 }
 
-func TestHubHandleCreateRoomDuplicate(t *testing.T) {
+func TestHubCreateRoomRace(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
 
-	p, c := makePeer(t, "fp1")
-	defer c()
-	h.Register(p)
-
-	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 10})
-	createMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
-	h.HandleMessage(p, createMsg)
-	<-p.Send // room_created
-
-	h.HandleMessage(p, createMsg)
-	select {
-	case raw := <-p.Send:
-		decoded, _ := protocol.Decode(raw)
-		if decoded.Type != protocol.TypeError {
-			t.Errorf("expected error for duplicate room, got %s", decoded.Type)
+	for i := 0; i < 50; i++ {
+		roomID := fmt.Sprintf("race-%d", i)
+		a, c1 := makePeer(t, "fp-a")
+		b, c2 := makePeer(t, "fp-b")
+		h.Register(a)
+		h.Register(b)
+
+		createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: roomID, MaxSize: 10})
+		createMsg := mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, p := range []*peer.Peer{a, b} {
+			wg.Add(1)
+			go func(p *peer.Peer) {
+				defer wg.Done()
+				<-start
+				h.HandleMessage(p, createMsg)
+			}(p)
 		}
-	case <-time.After(time.Second):
-		t.Error("timeout")
+		close(start)
+		wg.Wait()
+
+		var winners []*peer.Peer
+		for _, p := range []*peer.Peer{a, b} {
+			decoded, _ := protocol.Decode(<-p.Send)
+			switch decoded.Type {
+			case protocol.TypeRoomCreated:
+				winners = append(winners, p)
+			case protocol.TypeError:
+				var e protocol.ErrorPayload
+				json.Unmarshal(decoded.Payload, &e)
+				if e.Code != 409 {
+					t.Errorf("%s: expected 409 for the losing creator, got %d", roomID, e.Code)
+				}
+			default:
+				t.Errorf("%s: unexpected %s", roomID, decoded.Type)
+			}
+		}
+		if len(winners) != 1 {
+			t.Fatalf("%s: expected exactly one creator to succeed, got %d", roomID, len(winners))
+		}
+		ns, ok := h.nsMgr.Get(roomID)
+		if !ok || ns.Owner != winners[0].Fingerprint || !ns.Has(winners[0].Fingerprint) || ns.Count() != 1 {
+			t.Errorf("%s: expected the owner %s as the only member", roomID, winners[0].Fingerprint)
+		}
+		c1()
+		c2()
+	}
+}
+
+func TestHubMaxRoomsJoinedPerPeer(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxRoomsJoinedPerPeer: 2})
+	defer h.Shutdown()
+
+	owner, c1 := makePeer(t, "owner")
+	defer c1()
+	p, c2 := makePeer(t, "fp1")
+	defer c2()
+	h.Register(owner)
+	h.Register(p)
+
+	for _, id := range []string{"r1", "r2", "r3"} {
+		h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: []byte(`{"room_id":"` + id + `"}`)}))
+		if id == "r3" {
+			expectType(t, owner, protocol.TypeError, 429)
+		} else {
+			expectType(t, owner, protocol.TypeRoomCreated, 0)
+		}
+	}
+	if _, ok := h.nsMgr.Get("r3"); ok {
+		t.Error("r3 should not have been created over the limit")
+	}
+
+	// plain namespaces don't count against the room limit
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	expectType(t, p, protocol.TypePeerList, 0)
+
+	for _, id := range []string{"r1", "r2"} {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: []byte(`{"room_id":"` + id + `"}`)}))
+		expectType(t, p, protocol.TypePeerList, 0)
+	}
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: []byte(`{"room_id":"r5"}`)}))
+	expectType(t, p, protocol.TypeError, 429)
+
+	// rejoining a room already counted is allowed
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: []byte(`{"room_id":"r1"}`)}))
+	expectType(t, p, protocol.TypePeerList, 0)
+	drain(p)
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: []byte(`{"namespace":"r2"}`)}))
+	drain(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: []byte(`{"room_id":"r5"}`)}))
+	expectType(t, p, protocol.TypeRoomCreated, 0)
+}
+
+func TestHubMaxRoomsJoinedPerPeerAfterApproval(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxRoomsJoinedPerPeer: 1})
+	defer h.Shutdown()
+	owner, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	// the joiner fills its one room while the owner decides
+	h.HandleMessage(joiner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: []byte(`{"room_id":"own"}`)}))
+	drain(joiner)
+
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeApproveJoin, Payload: decision}))
+
+	if decoded := expectType(t, joiner, protocol.TypeError, 429); decoded.RequestID != "join-1" {
+		t.Errorf("expected the 429 for join-1, got request_id %q", decoded.RequestID)
+	}
+	if joiner.InNamespace("private") {
+		t.Error("approved join over the room limit should not be completed")
+	}
+}
+
+func TestHubMaxRoomsJoinedPerPeerUnlimited(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{})
+	defer h.Shutdown()
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	for i := 0; i < 40; i++ {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: []byte(fmt.Sprintf(`{"room_id":"r%d"}`, i))}))
+	}
+	if n := h.roomCount(p); n != 40 {
+		t.Errorf("expected no room limit with 0, got %d rooms", n)
+	}
+}
+
+func TestHubLobbyReady(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	a, c1 := joinPeer(t, h, "fp-a", "lobby")
+	defer c1()
+	b, c2 := joinPeer(t, h, "fp-b", "lobby")
+	defer c2()
+	obs, c3 := joinPeer(t, h, "fp-obs", "lobby", func(p *peer.Peer) { p.Observer = true })
+	defer c3()
+	members := []*peer.Peer{a, b, obs}
+	for _, p := range members {
+		drain(p)
+	}
+
+	setReady := func(p *peer.Peer, ready bool) {
+		payload, _ := json.Marshal(protocol.SetReadyPayload{Namespace: "lobby", Ready: ready})
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeSetReady, Payload: payload}))
+	}
+	status := func() protocol.LobbyStatusPayload {
+		t.Helper()
+		h.HandleMessage(b, mustEncode(&protocol.Message{Type: protocol.TypeLobbyStatus, Payload: []byte(`{"namespace":"lobby"}`)}))
+		decoded := expectType(t, b, protocol.TypeLobbyStatus, 0)
+		var s protocol.LobbyStatusPayload
+		json.Unmarshal(decoded.Payload, &s)
+		return s
+	}
+
+	if s := status(); s.Ready != 0 || s.Total != 2 {
+		t.Errorf("expected 0/2 ready, got %d/%d", s.Ready, s.Total)
+	}
+
+	setReady(a, true)
+	for _, p := range []*peer.Peer{b, obs} {
+		decoded := expectType(t, p, protocol.TypeReadyChanged, 0)
+		var rc protocol.ReadyChangedPayload
+		json.Unmarshal(decoded.Payload, &rc)
+		if rc.Fingerprint != "fp-a" || !rc.Ready {
+			t.Errorf("%s: expected ready_changed for fp-a, got %+v", p.Fingerprint, rc)
+		}
+	}
+	if len(a.Send) != 0 {
+		t.Error("the sender should not receive its own ready_changed")
+	}
+	if s := status(); s.Ready != 1 || s.Total != 2 {
+		t.Errorf("expected 1/2 ready, got %d/%d", s.Ready, s.Total)
+	}
+
+	// repeating the same state notifies nobody
+	setReady(a, true)
+	if len(b.Send) != 0 {
+		t.Error("an unchanged ready flag should not be broadcast")
+	}
+
+	setReady(a, false)
+	for _, p := range members {
+		drain(p)
+	}
+	if s := status(); s.Ready != 0 {
+		t.Errorf("expected 0 ready after unsetting, got %d", s.Ready)
+	}
+
+	setReady(obs, true)
+	expectType(t, obs, protocol.TypeError, 403)
+	outsider, c4 := makePeer(t, "fp-out")
+	defer c4()
+	h.Register(outsider)
+	setReady(outsider, true)
+	expectType(t, outsider, protocol.TypeError, 403)
+}
+
+func TestHubHandleCreateRoomDuplicate(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 10})
+	createMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
+	h.HandleMessage(p, createMsg)
+	<-p.Send // room_created
+
+	h.HandleMessage(p, createMsg)
+	select {
+	case raw := <-p.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeError {
+			t.Errorf("expected error for duplicate room, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout")
 	}
 }
 
@@ -939,6 +2302,228 @@ func TestHubHandleKickNotOwner(t *testing.T) {
 	}
 }
 
+func TestHubRoomRelay(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	m1, c1 := makePeer(t, "member1")
+	defer c1()
+	m2, c2 := makePeer(t, "member2")
+	defer c2()
+	h.Register(owner)
+	h.Register(m1)
+	h.Register(m2)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 10})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "room1"})
+	h.HandleMessage(m1, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload}))
+	h.HandleMessage(m2, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload}))
+
+	// next returns p's next room_relay or error, skipping room setup traffic
+	next := func(p *peer.Peer) *protocol.Message {
+		t.Helper()
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case raw := <-p.Send:
+				decoded, _ := protocol.Decode(raw)
+				if decoded.Type == protocol.TypeRoomRelay || decoded.Type == protocol.TypeError {
+					return decoded
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for room_relay on %s", p.Fingerprint)
+				return nil
+			}
+		}
+	}
+
+	relayPayload, _ := json.Marshal(protocol.RoomRelayPayload{RoomID: "room1", Data: []byte(`{"state":"round-2"}`)})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeRoomRelay, Payload: relayPayload}))
+
+	for _, m := range []*peer.Peer{m1, m2} {
+		got := next(m)
+		if got.Type != protocol.TypeRoomRelay || got.From != "owner" || got.To != m.Fingerprint {
+			t.Fatalf("expected room_relay from owner to %s, got %s from %s to %s", m.Fingerprint, got.Type, got.From, got.To)
+		}
+		var rp protocol.RoomRelayPayload
+		json.Unmarshal(got.Payload, &rp)
+		if string(rp.Data) != `{"state":"round-2"}` {
+			t.Errorf("unexpected data %s", rp.Data)
+		}
+	}
+	select {
+	case raw := <-owner.Send:
+		if decoded, _ := protocol.Decode(raw); decoded.Type == protocol.TypeRoomRelay {
+			t.Error("owner should not receive its own room_relay")
+		}
+	default:
+	}
+
+	h.HandleMessage(m1, mustEncode(&protocol.Message{Type: protocol.TypeRoomRelay, Payload: relayPayload}))
+	got := next(m1)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(got.Payload, &ep)
+	if got.Type != protocol.TypeError || ep.Code != 403 {
+		t.Errorf("expected 403 for non-owner room_relay, got %s %s", got.Type, got.Payload)
+	}
+	select {
+	case raw := <-m2.Send:
+		if decoded, _ := protocol.Decode(raw); decoded.Type == protocol.TypeRoomRelay {
+			t.Error("non-owner room_relay was delivered")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubKickTargetChecks(t *testing.T) {
+	h := New(64, 100, broker.NewNoop())
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	outsider, c := makePeer(t, "outsider")
+	defer c()
+	h.Register(owner)
+	h.Register(outsider)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 10})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-owner.Send
+
+	kick := func(fp, want string) {
+		t.Helper()
+		kickPayload, _ := json.Marshal(protocol.KickPayload{RoomID: "room1", Fingerprint: fp})
+		h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeKick, Payload: kickPayload}))
+		decoded, _ := protocol.Decode(<-owner.Send)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 404 || ep.Message != want {
+			t.Errorf("kick %s: expected 404 %s, got %+v", fp, want, ep)
+		}
+	}
+	kick("nobody", "peer not found")
+	kick("outsider", "peer not in room")
+	if len(outsider.Send) != 0 {
+		t.Error("a peer outside the room should not be sent a kick")
+	}
+}
+
+func TestHubBrokerKickNeedsValidOrigin(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	target, tc := makePeer(t, "target")
+	defer tc()
+	h.Register(target)
+	ns, _ := h.nsMgr.CreateRoom("room1", 10, "owner")
+	ns.Add(target)
+	target.JoinNamespace("room1", "room", "", nil)
+
+	kickPayload, _ := json.Marshal(protocol.KickPayload{RoomID: "room1", Fingerprint: "target"})
+	h.handleBrokerControl(mustEncode(&protocol.Message{Type: protocol.TypeKick, From: "owner", NodeID: "elsewhere", Payload: kickPayload}))
+	if !ns.Has("target") || len(target.Send) != 0 {
+		t.Error("a kick without a valid node and sender should be dropped")
+	}
+}
+
+func TestHubKickAcrossNodes(t *testing.T) {
+	b := broker.NewLocal()
+	hA := New(64, 100, b)
+	defer hA.Shutdown()
+	hB := New(64, 100, b)
+	defer hB.Shutdown()
+
+	// a real fingerprint, as other nodes drop kicks from anything else
+	owner, oc := makePeer(t, generateTestFingerprint(1))
+	defer oc()
+	target, tc := makePeer(t, "target")
+	defer tc()
+	member, mc := makePeer(t, "member")
+	defer mc()
+
+	hA.Register(owner)
+	hB.Register(target)
+	hB.Register(member)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "room1", MaxSize: 10})
+	createMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
+	hA.HandleMessage(owner, createMsg)
+	<-owner.Send
+
+	// the room also lives on node B with the target and another member in it
+	nsB, _ := hB.nsMgr.CreateRoom("room1", 10, owner.Fingerprint)
+	nsB.Add(target)
+	target.JoinNamespace("room1", "room", "", nil)
+	nsB.Add(member)
+	member.JoinNamespace("room1", "room", "", nil)
+
+	kickPayload, _ := json.Marshal(protocol.KickPayload{RoomID: "room1", Fingerprint: "target"})
+	kickMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeKick, Payload: kickPayload})
+	hA.HandleMessage(owner, kickMsg)
+
+	select {
+	case raw := <-target.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeKick {
+			t.Errorf("expected kick, got %s", decoded.Type)
+		}
+		if decoded.From != owner.Fingerprint {
+			t.Errorf("expected kick from owner, got %s", decoded.From)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for cross-node kick")
+	}
+
+	if nsB.Has("target") {
+		t.Error("target should be removed from room on its node")
+	}
+	if target.InNamespace("room1") {
+		t.Error("target should no longer be in room1")
+	}
+
+	select {
+	case raw := <-member.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypePeerLeft {
+			t.Errorf("expected peer_left, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for peer_left on target node")
+	}
+
+	// owner should not get an error for a remote target
+	select {
+	case raw := <-owner.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("owner should not receive a response, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubBrokerKickIgnoredForNonMember(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	msg := protocol.NewMessage(protocol.TypeKick, "remote-owner", protocol.KickPayload{RoomID: "room1", Fingerprint: "fp1"})
+	msg.NodeID = "other-node-id"
+	data, _ := protocol.Encode(msg)
+
+	h.handleBrokerControl(data)
+
+	select {
+	case <-p.Send:
+		t.Error("peer not in room should not be kicked")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
 func TestHubHandleMetadata(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -995,49 +2580,399 @@ func TestHubHandleRelay(t *testing.T) {
 	}
 }
 
-func TestHubHandleRelayNoSharedNamespace(t *testing.T) {
-	h := newTestHub()
-	defer h.Shutdown()
+func setupReliablePair(t *testing.T, opts Options) (*Hub, *peer.Peer, *peer.Peer, func()) {
+	t.Helper()
+	h := NewWithOptions(64, 100, broker.NewLocal(), opts)
+	sender, c1 := makePeer(t, "sender")
+	target, c2 := makePeer(t, "target")
+	ns := h.nsMgr.GetOrCreate("rel")
+	for _, p := range []*peer.Peer{sender, target} {
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("rel", "game", "", nil)
+	}
+	return h, sender, target, func() { h.Shutdown(); c1(); c2() }
+}
 
-	p1, c1 := makePeer(t, "fp1")
-	defer c1()
-	p2, c2 := makePeer(t, "fp2")
-	defer c2()
+func reliableRelay(seq uint64) []byte {
+	return mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "target", Payload: []byte(`{"n":1}`), Reliable: true, Seq: seq})
+}
 
-	h.Register(p1)
-	h.Register(p2)
+func TestHubReliableRelayAcked(t *testing.T) {
+	h, sender, target, cleanup := setupReliablePair(t, Options{ReliableAckTimeout: 30 * time.Millisecond})
+	defer cleanup()
 
-	join1, _ := json.Marshal(protocol.JoinPayload{Namespace: "ns1"})
-	join1Msg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: join1})
-	h.HandleMessage(p1, join1Msg)
-	<-p1.Send
+	h.HandleMessage(sender, reliableRelay(7))
+	decoded, _ := protocol.Decode(<-target.Send)
+	if decoded.Type != protocol.TypeRelay || !decoded.Reliable || decoded.Seq != 7 || decoded.From != "sender" {
+		t.Fatalf("expected reliable relay seq 7 from sender, got %+v", decoded)
+	}
 
-	join2, _ := json.Marshal(protocol.JoinPayload{Namespace: "ns2"})
-	join2Msg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: join2})
-	h.HandleMessage(p2, join2Msg)
-	<-p2.Send
+	h.HandleMessage(target, mustEncode(&protocol.Message{Type: protocol.TypeRelayAck, To: "sender", Seq: 7}))
+	decoded, _ = protocol.Decode(<-sender.Send)
+	if decoded.Type != protocol.TypeRelayAck || decoded.Seq != 7 || decoded.From != "target" {
+		t.Errorf("expected relay_ack seq 7 from target, got %+v", decoded)
+	}
 
-	relayMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRelay, To: "fp2"})
-	h.HandleMessage(p1, relayMsg)
+	// acked, so nothing is sent again
+	time.Sleep(100 * time.Millisecond)
+	if len(target.Send) != 0 {
+		t.Errorf("acked relay was resent %d times", len(target.Send))
+	}
+	if len(sender.Send) != 0 {
+		t.Error("sender got more than the ack")
+	}
+}
+
+func TestHubReliableRelayUnacked(t *testing.T) {
+	h, sender, target, cleanup := setupReliablePair(t, Options{ReliableAckTimeout: 20 * time.Millisecond, ReliableRetries: 2})
+	defer cleanup()
+
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "target", Payload: []byte(`{"n":1}`), Reliable: true, Seq: 1, RequestID: "req-1"}))
 
+	// the first send plus two retries, then the sender is told
+	for i := 0; i < 3; i++ {
+		select {
+		case raw := <-target.Send:
+			if decoded, _ := protocol.Decode(raw); decoded.Seq != 1 {
+				t.Errorf("send %d: expected seq 1, got %d", i, decoded.Seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for send %d", i)
+		}
+	}
 	select {
-	case raw := <-p1.Send:
+	case raw := <-sender.Send:
 		decoded, _ := protocol.Decode(raw)
-		if decoded.Type != protocol.TypeError {
-			t.Errorf("expected error, got %s", decoded.Type)
+		if decoded.Type != protocol.TypeRelayFailed || decoded.Seq != 1 || decoded.From != "target" || decoded.RequestID != "req-1" {
+			t.Errorf("expected relay_failed seq 1 for req-1, got %+v", decoded)
 		}
 	case <-time.After(time.Second):
-		t.Error("timeout")
+		t.Fatal("timeout waiting for relay_failed")
+	}
+	if len(target.Send) != 0 {
+		t.Error("relay was sent more than retries allow")
+	}
+
+	// a late ack is ignored
+	h.HandleMessage(target, mustEncode(&protocol.Message{Type: protocol.TypeRelayAck, To: "sender", Seq: 1}))
+	time.Sleep(10 * time.Millisecond)
+	if len(sender.Send) != 0 {
+		t.Error("late ack should not reach the sender")
 	}
 }
 
-func TestHubHandleMatch(t *testing.T) {
-	h := newTestHub()
+func TestHubReliableRelayNoRetries(t *testing.T) {
+	h, sender, target, cleanup := setupReliablePair(t, Options{ReliableAckTimeout: 20 * time.Millisecond})
+	defer cleanup()
+
+	h.HandleMessage(sender, reliableRelay(3))
+	<-target.Send
+	select {
+	case raw := <-sender.Send:
+		if decoded, _ := protocol.Decode(raw); decoded.Type != protocol.TypeRelayFailed {
+			t.Errorf("expected relay_failed, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for relay_failed")
+	}
+	if len(target.Send) != 0 {
+		t.Error("relay was sent again with no retries configured")
+	}
+
+	// a target that isn't here could only be reached through the broker,
+	// which carries no acks back
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "elsewhere", Payload: []byte(`{}`), Reliable: true, Seq: 4}))
+	decoded, _ := protocol.Decode(<-sender.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 400 {
+		t.Errorf("expected 400 for a reliable relay off this node, got %s %+v", decoded.Type, ep)
+	}
+}
+
+func TestHubRelayToIdentity(t *testing.T) {
+	// no broker, so nothing is left to other nodes
+	h := NewWithOptions(64, 100, nil, Options{})
 	defer h.Shutdown()
 
-	p1, c1 := makePeer(t, "fp1")
+	alice := func(p *peer.Peer) { p.Identity = "alice" }
+	phone, c1 := joinPeer(t, h, "phone", "chat", alice)
 	defer c1()
-	p2, c2 := makePeer(t, "fp2")
+	laptop, c2 := joinPeer(t, h, "laptop", "chat", alice)
+	defer c2()
+	away, c3 := joinPeer(t, h, "away", "elsewhere", alice)
+	defer c3()
+	sender, c4 := joinPeer(t, h, "sender", "chat")
+	defer c4()
+	for _, p := range []*peer.Peer{phone, laptop, away, sender} {
+		drain(p)
+	}
+
+	relay := mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "alice", ToIdentity: true, Payload: []byte(`{"n":1}`)})
+	h.HandleMessage(sender, relay)
+	for _, p := range []*peer.Peer{phone, laptop} {
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != protocol.TypeRelay || decoded.From != "sender" || decoded.To != "alice" || !decoded.ToIdentity {
+				t.Errorf("%s: unexpected %s from %s to %s", p.Fingerprint, decoded.Type, decoded.From, decoded.To)
+			}
+		default:
+			t.Errorf("%s: expected the relay addressed to its identity", p.Fingerprint)
+		}
+	}
+	if len(away.Send) != 0 {
+		t.Error("a device sharing no namespace with the sender should not receive it")
+	}
+
+	// a device relaying to its own identity reaches the others only
+	h.HandleMessage(phone, relay)
+	if len(phone.Send) != 0 || len(laptop.Send) != 1 {
+		t.Errorf("expected only laptop to receive, got phone %d laptop %d", len(phone.Send), len(laptop.Send))
+	}
+	<-laptop.Send
+
+	reliable := mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "alice", ToIdentity: true, Reliable: true, Seq: 1, Payload: []byte(`{}`)})
+	h.HandleMessage(sender, reliable)
+	expectType(t, sender, protocol.TypeError, 400)
+
+	h.Unregister("phone")
+	h.Unregister("laptop")
+	drain(sender) // peer_left
+	h.HandleMessage(sender, relay)
+	expectType(t, sender, protocol.TypeError, 404)
+}
+
+func TestHubReliableRelayLimits(t *testing.T) {
+	h, sender, target, cleanup := setupReliablePair(t, Options{ReliableAckTimeout: time.Minute, MaxReliableInFlight: 1})
+	defer cleanup()
+
+	expectError := func(code int) {
+		t.Helper()
+		decoded, _ := protocol.Decode(<-sender.Send)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != code {
+			t.Errorf("expected %d, got %s %+v", code, decoded.Type, ep)
+		}
+	}
+
+	h.HandleMessage(sender, reliableRelay(0))
+	expectError(400)
+
+	h.HandleMessage(sender, reliableRelay(1))
+	<-target.Send
+	h.HandleMessage(sender, reliableRelay(1))
+	expectError(409)
+	h.HandleMessage(sender, reliableRelay(2))
+	expectError(429)
+
+	// the target leaving clears what was in flight to it
+	h.Unregister("target")
+	if n := len(h.reliable.inflight); n != 0 {
+		t.Errorf("expected nothing in flight after the target left, got %d", n)
+	}
+}
+
+func TestHubGzipRelay(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	sender, c0 := makePeer(t, "sender")
+	defer c0()
+	zipped, c1 := makePeer(t, "zipped")
+	defer c1()
+	plain, c2 := makePeer(t, "plain")
+	defer c2()
+	zipped.Gzip = true
+	ns := h.nsMgr.GetOrCreate("gz")
+	for _, p := range []*peer.Peer{sender, zipped, plain} {
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("gz", "game", "", nil)
+	}
+
+	payload, _ := protocol.Gzip([]byte(`{"state":[1,2,3]}`))
+	relay := func(to string, payload []byte) {
+		h.HandleMessage(sender, mustEncode(&protocol.Message{
+			Type: protocol.TypeRelay, To: to, Payload: payload, Encoding: protocol.EncodingGzip, RequestID: "r1",
+		}))
+	}
+
+	relay("zipped", payload)
+	decoded, _ := protocol.Decode(<-zipped.Send)
+	if decoded.Encoding != protocol.EncodingGzip || string(decoded.Payload) != string(payload) {
+		t.Errorf("expected gzip payload passed through, got %q %s", decoded.Encoding, decoded.Payload)
+	}
+
+	relay("plain", payload)
+	decoded, _ = protocol.Decode(<-plain.Send)
+	if decoded.Encoding != "" || string(decoded.Payload) != `{"state":[1,2,3]}` {
+		t.Errorf("expected inflated payload, got %q %s", decoded.Encoding, decoded.Payload)
+	}
+
+	// refused even for a target that would take it compressed
+	for _, to := range []string{"plain", "zipped"} {
+		relay(to, []byte(`"bm90IGd6aXA="`))
+		decoded, _ = protocol.Decode(<-sender.Send)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 400 || ep.Message != "invalid gzip payload" || decoded.RequestID != "r1" {
+			t.Errorf("%s: expected 400 for a bad gzip payload, got %+v %q", to, ep, decoded.RequestID)
+		}
+	}
+	if len(plain.Send) != 0 || len(zipped.Send) != 0 {
+		t.Error("bad gzip payload was delivered")
+	}
+}
+
+func TestHubGzipBroadcast(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	sender, c0 := makePeer(t, "sender")
+	defer c0()
+	zipped, c1 := makePeer(t, "zipped")
+	defer c1()
+	plain, c2 := makePeer(t, "plain")
+	defer c2()
+	zipped.Gzip = true
+	ns := h.nsMgr.GetOrCreate("gz")
+	for _, p := range []*peer.Peer{sender, zipped, plain} {
+		h.Register(p)
+		ns.Add(p)
+		p.JoinNamespace("gz", "game", "", nil)
+	}
+
+	data, _ := protocol.Gzip([]byte(`{"event":"start"}`))
+	payload, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "gz", Data: data, Encoding: protocol.EncodingGzip})
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: payload}))
+
+	var bp protocol.BroadcastPayload
+	decoded, _ := protocol.Decode(<-zipped.Send)
+	json.Unmarshal(decoded.Payload, &bp)
+	if bp.Encoding != protocol.EncodingGzip || string(bp.Data) != string(data) {
+		t.Errorf("expected gzip data passed through, got %+v", bp)
+	}
+
+	decoded, _ = protocol.Decode(<-plain.Send)
+	bp = protocol.BroadcastPayload{}
+	json.Unmarshal(decoded.Payload, &bp)
+	if bp.Encoding != "" || string(bp.Data) != `{"event":"start"}` || decoded.From != "sender" {
+		t.Errorf("expected inflated data from sender, got %s %+v", decoded.From, bp)
+	}
+
+	expectRefused := func(payload []byte, want string) {
+		t.Helper()
+		h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: payload}))
+		decoded, _ := protocol.Decode(<-sender.Send)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 400 || ep.Message != want {
+			t.Errorf("expected 400 %s, got %+v", want, ep)
+		}
+		if len(zipped.Send) != 0 || len(plain.Send) != 0 {
+			t.Errorf("refused broadcast (%s) was delivered", want)
+		}
+	}
+	// bad data reaches nobody, not even peers that would take it compressed
+	payload, _ = json.Marshal(protocol.BroadcastPayload{Namespace: "gz", Data: []byte(`"bm90IGd6aXA="`), Encoding: protocol.EncodingGzip})
+	expectRefused(payload, "invalid gzip payload")
+	payload, _ = json.Marshal(protocol.BroadcastPayload{Namespace: "gz", Data: []byte(`"aGk="`), Encoding: "base64"})
+	expectRefused(payload, "unsupported encoding")
+}
+
+func TestHubEncodingOnlyOnRelay(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", Encoding: protocol.EncodingGzip, Payload: []byte(`"x"`)}))
+	decoded, _ := protocol.Decode(<-p.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 400 || ep.Message != "unsupported encoding" {
+		t.Errorf("expected 400 unsupported encoding on a signal, got %+v", ep)
+	}
+}
+
+func TestHubHandleRelayNoSharedNamespace(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+
+	h.Register(p1)
+	h.Register(p2)
+
+	join1, _ := json.Marshal(protocol.JoinPayload{Namespace: "ns1"})
+	join1Msg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: join1})
+	h.HandleMessage(p1, join1Msg)
+	<-p1.Send
+
+	join2, _ := json.Marshal(protocol.JoinPayload{Namespace: "ns2"})
+	join2Msg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: join2})
+	h.HandleMessage(p2, join2Msg)
+	<-p2.Send
+
+	relayMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRelay, To: "fp2"})
+	h.HandleMessage(p1, relayMsg)
+
+	select {
+	case raw := <-p1.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeError {
+			t.Errorf("expected error, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout")
+	}
+}
+
+func TestHubAllowCrossNamespaceSignal(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{AllowCrossNamespaceSignal: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("ns1", "tool", "", nil)
+	p2.JoinNamespace("ns2", "tool", "", nil)
+
+	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer"})
+	for _, typ := range []string{protocol.TypeSignal, protocol.TypeRelay} {
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: typ, To: "fp2", Payload: signalPayload}))
+
+		select {
+		case raw := <-p2.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != typ {
+				t.Errorf("expected %s to be delivered, got %s", typ, decoded.Type)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timeout waiting for %s across namespaces", typ)
+		}
+	}
+}
+
+func TestHubHandleMatch(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
 	defer c2()
 
 	h.Register(p1)
@@ -1151,6 +3086,12 @@ func TestHubBrokerSkipSelfNode(t *testing.T) {
 	}
 }
 
+// well-formed identities for messages that arrive via the broker
+var (
+	remoteFingerprint = strings.Repeat("a1", 32)
+	remoteNodeID      = strings.Repeat("b2", 16)
+)
+
 func TestHubBrokerDeliverFromOtherNode(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -1158,10 +3099,13 @@ func TestHubBrokerDeliverFromOtherNode(t *testing.T) {
 	p, c := makePeer(t, "fp1")
 	defer c()
 	h.Register(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	<-p.Send // peer_list
 
-	msg := protocol.NewMessage(protocol.TypeSignal, "remote-peer", nil)
+	msg := protocol.NewMessage(protocol.TypeSignal, remoteFingerprint, nil)
 	msg.To = "fp1"
-	msg.NodeID = "other-node-id"
+	msg.NodeID = remoteNodeID
+	msg.FromNamespaces = []string{"lobby"}
 	data, _ := protocol.Encode(msg)
 
 	h.handleBrokerMessage(data)
@@ -1172,14 +3116,63 @@ func TestHubBrokerDeliverFromOtherNode(t *testing.T) {
 		if decoded.Type != protocol.TypeSignal {
 			t.Errorf("expected signal, got %s", decoded.Type)
 		}
-		if decoded.NodeID != "" {
-			t.Error("nodeID should be stripped before forwarding to client")
+		if decoded.NodeID != "" || decoded.FromNamespaces != nil {
+			t.Error("broker fields should be stripped before forwarding to client")
 		}
 	case <-time.After(time.Second):
 		t.Error("timeout")
 	}
 }
 
+func TestHubBrokerDropsUnsharedSender(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	p.Identity = "id1"
+	h.Register(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	<-p.Send // peer_list
+
+	tests := []struct {
+		name       string
+		namespaces []string
+		toIdentity bool
+	}{
+		{"no namespaces", nil, false},
+		{"other namespace", []string{"elsewhere"}, false},
+		{"identity relay", []string{"elsewhere"}, true},
+	}
+	for _, tt := range tests {
+		msg := &protocol.Message{Type: protocol.TypeRelay, From: remoteFingerprint, To: "fp1", NodeID: remoteNodeID,
+			FromNamespaces: tt.namespaces, Payload: []byte(`{"data":1}`)}
+		if tt.toIdentity {
+			msg.To = "id1"
+			msg.ToIdentity = true
+		}
+		h.handleBrokerMessage(mustEncode(msg))
+		select {
+		case raw := <-p.Send:
+			t.Errorf("%s: expected the relay dropped, got %s", tt.name, raw)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// a cluster mid-upgrade can turn the re-check off
+	trusting := NewWithOptions(64, 100, broker.NewLocal(), Options{TrustBrokerNamespaces: true})
+	defer trusting.Shutdown()
+	q, c2 := makePeer(t, "fp2")
+	defer c2()
+	trusting.Register(q)
+	trusting.handleBrokerMessage(mustEncode(&protocol.Message{Type: protocol.TypeRelay, From: remoteFingerprint, To: "fp2", NodeID: remoteNodeID}))
+	select {
+	case <-q.Send:
+	case <-time.After(time.Second):
+		t.Error("expected delivery with TrustBrokerNamespaces")
+	}
+}
+
 func TestHubConcurrentRegister(t *testing.T) {
 	b := broker.NewLocal()
 	h := New(64, 1000, b)
@@ -1255,6 +3248,72 @@ func TestHubNamespaceStats(t *testing.T) {
 	}
 }
 
+func TestHubShardCounts(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	for i := 0; i < 20; i++ {
+		p, c := makePeer(t, fmt.Sprintf("%04x-peer", i*997))
+		defer c()
+		h.Register(p)
+	}
+
+	counts := h.ShardCounts()
+	if len(counts) != 64 {
+		t.Fatalf("expected 64 shard counts, got %d", len(counts))
+	}
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if int64(total) != h.PeerCount() {
+		t.Errorf("shard counts sum %d != peer count %d", total, h.PeerCount())
+	}
+}
+
+func TestShardIndexDistribution(t *testing.T) {
+	for _, count := range []int{1, 2, 7, 10, 64, 100, 256, 1000, 4096} {
+		prefix := shardPrefixLen(count)
+		if prefix < 1 || prefix > 8 || (1<<(4*prefix) < count && prefix < 8) {
+			t.Fatalf("count %d: bad prefix length %d", count, prefix)
+		}
+
+		const perShard = 200
+		counts := make([]int, count)
+		for i := 0; i < count*perShard; i++ {
+			fp := generateTestFingerprint(i)
+			idx := shardIndex(fp, count, prefix)
+			if int(idx) >= count {
+				t.Fatalf("count %d: index %d out of range", count, idx)
+			}
+			counts[idx]++
+		}
+		for idx, n := range counts {
+			if n < perShard/2 || n > perShard*2 {
+				t.Errorf("count %d: shard %d got %d, want about %d", count, idx, n, perShard)
+			}
+		}
+	}
+
+	// short and non-hex ids are hashed, not piled onto shard 0
+	seen := map[uint32]bool{}
+	for i := 0; i < 200; i++ {
+		idx := shardIndex(fmt.Sprintf("fp%d", i), 64, shardPrefixLen(64))
+		if idx >= 64 {
+			t.Fatalf("index %d out of range", idx)
+		}
+		seen[idx] = true
+	}
+	if len(seen) < 32 {
+		t.Errorf("short ids spread over only %d of 64 shards", len(seen))
+	}
+}
+
+func generateTestFingerprint(i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("key-%d", i)))
+	return hex.EncodeToString(sum[:])
+}
+
 func TestHubRoomAutoCleanup(t *testing.T) {
 	h := newTestHub()
 	defer h.Shutdown()
@@ -1288,3 +3347,2638 @@ func TestHubRoomAutoCleanup(t *testing.T) {
 		t.Error("timeout")
 	}
 }
+
+func TestHubShutdownNoGoroutineLeak(t *testing.T) {
+	p, c := makePeer(t, "fp1")
+	defer c()
+	baseline := runtime.NumGoroutine()
+
+	h := newTestHub()
+	h.Register(p)
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", GroupSize: 2})
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload}))
+	h.Shutdown()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("expected goroutines to return to baseline %d, got %d", baseline, n)
+	}
+	if h.matchmaker.QueueSize("match-ns") != 0 {
+		t.Error("pending match requests should be dropped on shutdown")
+	}
+}
+
+func mustEncode(msg *protocol.Message) []byte {
+	data, _ := protocol.Encode(msg)
+	return data
+}
+
+func TestHubRoomIdleTTLClosesSilentRoom(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		MaxRoomIdleTTL:    time.Second,
+		RoomSweepInterval: 10 * time.Millisecond,
+	})
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	member, mc := makePeer(t, "member")
+	defer mc()
+	h.Register(owner)
+	h.Register(member)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "idle-room", MaxSize: 4, IdleTTLMs: 50})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	raw := <-owner.Send
+	created, _ := protocol.Decode(raw)
+	var rc protocol.RoomCreatedPayload
+	json.Unmarshal(created.Payload, &rc)
+	if rc.IdleTTLMs != 50 {
+		t.Errorf("expected idle_ttl_ms 50, got %d", rc.IdleTTLMs)
+	}
+
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "idle-room"})
+	h.HandleMessage(member, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload}))
+	<-member.Send // peer_list
+	<-owner.Send  // peer_joined
+
+	for _, p := range []*peer.Peer{owner, member} {
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != protocol.TypeRoomClosed {
+				t.Fatalf("expected room_closed, got %s", decoded.Type)
+			}
+			var payload protocol.RoomClosedPayload
+			json.Unmarshal(decoded.Payload, &payload)
+			if payload.Reason != "inactive" {
+				t.Errorf("expected reason inactive, got %s", payload.Reason)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for room_closed")
+		}
+		if p.InNamespace("idle-room") {
+			t.Error("peer should have left the closed room")
+		}
+	}
+
+	if _, ok := h.nsMgr.Get("idle-room"); ok {
+		t.Error("idle room should be removed")
+	}
+}
+
+func TestHubRoomIdleTTLActivityKeepsRoom(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxRoomIdleTTL: time.Minute})
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	h.Register(owner)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "busy-room", IdleTTLMs: 100})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-owner.Send
+
+	ns, _ := h.nsMgr.Get("busy-room")
+	start := ns.LastActivity()
+
+	bcastPayload, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "busy-room", Data: []byte(`"tick"`)})
+	time.Sleep(5 * time.Millisecond)
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: bcastPayload}))
+	if !ns.LastActivity().After(start) {
+		t.Error("broadcast should update room activity")
+	}
+
+	h.sweepIdleRooms(ns.LastActivity().Add(50 * time.Millisecond))
+	if _, ok := h.nsMgr.Get("busy-room"); !ok {
+		t.Error("recently active room should not be closed")
+	}
+	h.sweepIdleRooms(ns.LastActivity().Add(200 * time.Millisecond))
+	if _, ok := h.nsMgr.Get("busy-room"); ok {
+		t.Error("room idle past its TTL should be closed")
+	}
+}
+
+func TestHubRoomIdleTTLSignalTouchesOnlyItsRoom(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxRoomIdleTTL: time.Minute})
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	other, otc := makePeer(t, "other")
+	defer otc()
+	h.Register(owner)
+	h.Register(other)
+
+	for _, id := range []string{"room-a", "room-b"} {
+		createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: id, IdleTTLMs: 100})
+		h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+		<-owner.Send
+	}
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "room-a"})
+	h.HandleMessage(other, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload}))
+	drain(other)
+	drain(owner)
+
+	roomA, _ := h.nsMgr.Get("room-a")
+	roomB, _ := h.nsMgr.Get("room-b")
+	startA, startB := roomA.LastActivity(), roomB.LastActivity()
+
+	time.Sleep(5 * time.Millisecond)
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "other", Namespace: "room-a", Payload: []byte(`{}`)}))
+	if !roomA.LastActivity().After(startA) {
+		t.Error("signal should update the activity of the room it was sent in")
+	}
+	if !roomB.LastActivity().Equal(startB) {
+		t.Error("signal should not update the sender's other rooms")
+	}
+
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "other", Payload: []byte(`{}`)}))
+	if !roomB.LastActivity().Equal(startB) {
+		t.Error("signal without a namespace should not update any room")
+	}
+}
+
+func TestHubRoomIdleTTLClamped(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxRoomIdleTTL: time.Second})
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	h.Register(owner)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "long-room", IdleTTLMs: 3600000})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-owner.Send
+
+	ns, _ := h.nsMgr.Get("long-room")
+	if ns.IdleTTL() != time.Second {
+		t.Errorf("expected idle ttl clamped to 1s, got %v", ns.IdleTTL())
+	}
+}
+
+func TestHubRequireTargetNotFound(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{TargetClaimWindow: 20 * time.Millisecond})
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer"})
+	h.HandleMessage(p, mustEncode(&protocol.Message{
+		Type:          protocol.TypeSignal,
+		To:            "nobody",
+		RequireTarget: true,
+		Payload:       signalPayload,
+	}))
+
+	select {
+	case raw := <-p.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeError {
+			t.Fatalf("expected error, got %s", decoded.Type)
+		}
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 404 {
+			t.Errorf("expected 404, got %d", ep.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for target not found")
+	}
+}
+
+func TestHubClientCannotSetClaimID(t *testing.T) {
+	b := broker.NewLocal()
+	h := NewWithOptions(64, 100, b, Options{})
+	defer h.Shutdown()
+
+	published := make(chan *protocol.Message, 1)
+	b.Subscribe(context.Background(), "signal", func(_ string, data []byte) {
+		msg, _ := protocol.Decode(data)
+		published <- msg
+	})
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+	h.HandleMessage(p, mustEncode(&protocol.Message{
+		Type:    protocol.TypeSignal,
+		To:      "remote",
+		ClaimID: "someone-elses-claim",
+		NodeID:  "forged-node",
+		Payload: []byte(`{"signal_type":"offer"}`),
+	}))
+	select {
+	case msg := <-published:
+		if msg.ClaimID != "" || msg.NodeID != h.NodeID() {
+			t.Errorf("expected a clean claim_id and this node's id, got %q %q", msg.ClaimID, msg.NodeID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the published signal")
+	}
+}
+
+func TestHubRequireTargetClaimedByOtherNode(t *testing.T) {
+	b := broker.NewLocal()
+	opts := Options{TargetClaimWindow: 50 * time.Millisecond}
+	hA := NewWithOptions(64, 100, b, opts)
+	defer hA.Shutdown()
+	hB := NewWithOptions(64, 100, b, opts)
+	defer hB.Shutdown()
+
+	sender, sc := makePeer(t, remoteFingerprint)
+	defer sc()
+	target, tc := makePeer(t, "target")
+	defer tc()
+	hA.Register(sender)
+	hB.Register(target)
+	hA.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	hB.HandleMessage(target, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)}))
+	<-sender.Send // peer_list
+	<-target.Send // peer_list
+
+	relayPayload, _ := json.Marshal(map[string]string{"data": "hi"})
+	hA.HandleMessage(sender, mustEncode(&protocol.Message{
+		Type:          protocol.TypeRelay,
+		To:            "target",
+		RequireTarget: true,
+		Payload:       relayPayload,
+	}))
+
+	select {
+	case raw := <-target.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeRelay {
+			t.Errorf("expected relay, got %s", decoded.Type)
+		}
+		if decoded.ClaimID != "" || decoded.NodeID != "" {
+			t.Error("broker fields should be stripped before delivery")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for relay")
+	}
+
+	select {
+	case raw := <-sender.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("sender should not get a response for a claimed target, got %s", decoded.Type)
+	case <-time.After(150 * time.Millisecond):
+	}
+}
+
+func TestHubExpiredMessageRejected(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("ns", "game", "", nil)
+	p2.JoinNamespace("ns", "game", "", nil)
+
+	relayPayload, _ := json.Marshal(map[string]string{"move": "e4"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{
+		Type:      protocol.TypeRelay,
+		To:        "fp2",
+		ExpiresAt: time.Now().Add(-time.Second).UnixMilli(),
+		Payload:   relayPayload,
+	}))
+
+	select {
+	case raw := <-p1.Send:
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != 408 {
+			t.Errorf("expected 408 error, got %s %d", decoded.Type, ep.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for expiry error")
+	}
+	select {
+	case <-p2.Send:
+		t.Error("expired relay should not be delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.HandleMessage(p1, mustEncode(&protocol.Message{
+		Type:      protocol.TypeRelay,
+		To:        "fp2",
+		ExpiresAt: time.Now().Add(time.Minute).UnixMilli(),
+		Payload:   relayPayload,
+	}))
+	select {
+	case raw := <-p2.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeRelay {
+			t.Errorf("expected relay, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("fresh relay should be delivered")
+	}
+}
+
+func TestHubBrokerDropsExpiredMessage(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	msg := protocol.NewMessage(protocol.TypeSignal, remoteFingerprint, nil)
+	msg.To = "fp1"
+	msg.NodeID = remoteNodeID
+	msg.ExpiresAt = time.Now().Add(-time.Millisecond).UnixMilli()
+	h.handleBrokerMessage(mustEncode(msg))
+
+	select {
+	case <-p.Send:
+		t.Error("expired broker message should be dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func setupApprovalRoom(t *testing.T, h *Hub) (*peer.Peer, *peer.Peer, func()) {
+	t.Helper()
+	owner, oc := makePeer(t, "owner")
+	joiner, jc := makePeer(t, "joiner")
+	h.Register(owner)
+	h.Register(joiner)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "private", MaxSize: 4, ApprovalRequired: true})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-owner.Send
+
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "private"})
+	h.HandleMessage(joiner, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, RequestID: "join-1", Payload: joinPayload}))
+
+	raw := <-joiner.Send
+	status, _ := protocol.Decode(raw)
+	if status.Type != protocol.TypeJoinRoom || !strings.Contains(string(status.Payload), "pending") {
+		t.Fatalf("expected pending join status, got %s %s", status.Type, status.Payload)
+	}
+
+	raw = <-owner.Send
+	req, _ := protocol.Decode(raw)
+	if req.Type != protocol.TypeJoinRequest {
+		t.Fatalf("expected join_request, got %s", req.Type)
+	}
+	var jr protocol.JoinRequestPayload
+	json.Unmarshal(req.Payload, &jr)
+	if jr.RoomID != "private" || jr.Peer.Fingerprint != "joiner" {
+		t.Errorf("unexpected join_request payload %+v", jr)
+	}
+
+	ns, _ := h.nsMgr.Get("private")
+	if ns.Has("joiner") {
+		t.Error("joiner should not be added before approval")
+	}
+	return owner, joiner, func() { oc(); jc() }
+}
+
+func TestHubPendingJoinCaps(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxPendingJoins: 2, MaxPendingJoinsPerPeer: 1})
+	defer h.Shutdown()
+
+	owner, oc := makePeer(t, "owner")
+	defer oc()
+	h.Register(owner)
+	for _, room := range []string{"private", "other"} {
+		createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: room, MaxSize: 8, ApprovalRequired: true})
+		h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+		<-owner.Send
+	}
+
+	joinRoom := func(p *peer.Peer, room string) (*protocol.Message, protocol.ErrorPayload) {
+		t.Helper()
+		payload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: room})
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: payload}))
+		decoded, _ := protocol.Decode(<-p.Send)
+		var ep protocol.ErrorPayload
+		if decoded.Type == protocol.TypeError {
+			json.Unmarshal(decoded.Payload, &ep)
+		}
+		return decoded, ep
+	}
+
+	joiners := make([]*peer.Peer, 3)
+	for i := range joiners {
+		p, c := makePeer(t, fmt.Sprintf("joiner-%d", i))
+		defer c()
+		h.Register(p)
+		joiners[i] = p
+	}
+	for _, p := range joiners[:2] {
+		if decoded, _ := joinRoom(p, "private"); decoded.Type != protocol.TypeJoinRoom {
+			t.Fatalf("expected pending for %s, got %s", p.Fingerprint, decoded.Type)
+		}
+	}
+
+	// the third pending request for the room is over its cap
+	if _, ep := joinRoom(joiners[2], "private"); ep.Code != 429 || ep.Message != "too many pending joins for room" {
+		t.Errorf("expected 429 room cap, got %+v", ep)
+	}
+	// a peer already waiting on one room can't queue on another
+	if _, ep := joinRoom(joiners[0], "other"); ep.Code != 429 || ep.Message != "too many pending joins" {
+		t.Errorf("expected 429 peer cap, got %+v", ep)
+	}
+	// repeating a pending request is not counted again
+	if decoded, _ := joinRoom(joiners[0], "private"); decoded.Type != protocol.TypeJoinRoom {
+		t.Errorf("expected pending status on repeat, got %s", decoded.Type)
+	}
+
+	// deciding a request frees its slot
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner-0"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeDenyJoin, Payload: decision}))
+	<-joiners[0].Send
+	if decoded, _ := joinRoom(joiners[2], "private"); decoded.Type != protocol.TypeJoinRoom {
+		t.Errorf("expected pending once a slot freed, got %s", decoded.Type)
+	}
+	if decoded, _ := joinRoom(joiners[0], "other"); decoded.Type != protocol.TypeJoinRoom {
+		t.Errorf("expected pending for a peer with nothing waiting, got %s", decoded.Type)
+	}
+}
+
+func TestHubRoomApprovalApprove(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	owner, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeApproveJoin, Payload: decision}))
+
+	raw := <-joiner.Send
+	decoded, _ := protocol.Decode(raw)
+	if decoded.Type != protocol.TypePeerList {
+		t.Errorf("expected peer_list after approval, got %s", decoded.Type)
+	}
+	raw = <-owner.Send
+	decoded, _ = protocol.Decode(raw)
+	if decoded.Type != protocol.TypePeerJoined {
+		t.Errorf("expected peer_joined for owner, got %s", decoded.Type)
+	}
+	if !joiner.InNamespace("private") {
+		t.Error("joiner should be in room after approval")
+	}
+}
+
+func TestHubRoomApprovalDeny(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	owner, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeDenyJoin, RequestID: "deny-1", Payload: decision}))
+
+	raw := <-joiner.Send
+	decoded, _ := protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 403 {
+		t.Errorf("expected 403 on deny, got %s %d", decoded.Type, ep.Code)
+	}
+	// the joiner matches the answer to its own join_room
+	if decoded.RequestID != "join-1" {
+		t.Errorf("expected the joiner's request id, got %q", decoded.RequestID)
+	}
+	if joiner.InNamespace("private") {
+		t.Error("denied joiner should not be in room")
+	}
+
+	// the request is gone, a second decision is a 404
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeApproveJoin, Payload: decision}))
+	raw = <-owner.Send
+	decoded, _ = protocol.Decode(raw)
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 404 {
+		t.Errorf("expected 404 for stale decision, got %d", ep.Code)
+	}
+}
+
+func TestHubRoomApprovalFullKeepsRequestID(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	owner, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	// the room fills up while the request waits
+	ns, _ := h.nsMgr.Get("private")
+	for i := 0; i < ns.MaxSize()-1; i++ {
+		p, c := makePeer(t, fmt.Sprintf("filler-%d", i))
+		defer c()
+		ns.Add(p)
+	}
+
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeApproveJoin, RequestID: "approve-1", Payload: decision}))
+
+	decoded, _ := protocol.Decode(<-joiner.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 429 || decoded.RequestID != "join-1" {
+		t.Errorf("expected 429 for join-1, got %d for %q", ep.Code, decoded.RequestID)
+	}
+}
+
+func TestHubRoomApprovalJoinerLeaves(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	_, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	h.Unregister(joiner.Fingerprint)
+	if _, ok := h.joinReqs.take("private", "joiner"); ok {
+		t.Error("a disconnected joiner's request should be dropped")
+	}
+	if n := h.joinReqs.byPeer["joiner"]; n != 0 {
+		t.Errorf("expected the joiner's pending count cleared, got %d", n)
+	}
+}
+
+func TestHubRoomApprovalRoomCloses(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	owner, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	// the owner leaving empties the room, nobody is left to decide
+	leavePayload, _ := json.Marshal(protocol.LeavePayload{Namespace: "private"})
+	h.HandleMessage(owner, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: leavePayload}))
+
+	select {
+	case raw := <-joiner.Send:
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 404 || ep.Message != "room closed" || decoded.RequestID != "join-1" {
+			t.Errorf("expected 404 room closed for join-1, got %d %q for %q", ep.Code, ep.Message, decoded.RequestID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("joiner was not told the room closed")
+	}
+	if _, ok := h.joinReqs.take("private", "joiner"); ok {
+		t.Error("the closed room's requests should be dropped")
+	}
+}
+
+func TestHubRoomApprovalNotOwner(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+	_, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	decision, _ := json.Marshal(protocol.JoinDecisionPayload{RoomID: "private", Fingerprint: "joiner"})
+	h.HandleMessage(joiner, mustEncode(&protocol.Message{Type: protocol.TypeApproveJoin, Payload: decision}))
+
+	raw := <-joiner.Send
+	decoded, _ := protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 403 {
+		t.Errorf("expected 403 for non-owner approval, got %d", ep.Code)
+	}
+}
+
+func TestHubRoomApprovalTimeout(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{JoinRequestTimeout: 20 * time.Millisecond})
+	defer h.Shutdown()
+	_, joiner, cleanup := setupApprovalRoom(t, h)
+	defer cleanup()
+
+	select {
+	case raw := <-joiner.Send:
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if ep.Code != 408 {
+			t.Errorf("expected 408 on timeout, got %d", ep.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for join request expiry")
+	}
+}
+
+func TestHubObserver(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	sender, c1 := makePeer(t, "sender")
+	defer c1()
+	obs, c2 := makePeer(t, "observer")
+	defer c2()
+	obs.Observer = true
+
+	h.Register(sender)
+	h.Register(obs)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "watched", AppType: "game"})
+	joinMsg := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	h.HandleMessage(sender, joinMsg)
+	<-sender.Send
+	h.HandleMessage(obs, joinMsg)
+	<-obs.Send
+
+	// no peer_joined for the observer
+	select {
+	case raw := <-sender.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("observer join should be silent, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	discPayload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "watched"})
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discPayload}))
+	raw := <-sender.Send
+	decoded, _ := protocol.Decode(raw)
+	var pl protocol.PeerListPayload
+	json.Unmarshal(decoded.Payload, &pl)
+	if pl.Total != 1 {
+		t.Errorf("expected total 1, got %d", pl.Total)
+	}
+	for _, info := range pl.Peers {
+		if info.Fingerprint == "observer" {
+			t.Error("observer should not be discoverable")
+		}
+	}
+
+	bcastPayload, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "watched", Data: []byte(`"hello"`)})
+	h.HandleMessage(sender, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: bcastPayload}))
+	select {
+	case raw := <-obs.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeBroadcast {
+			t.Errorf("expected broadcast, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("observer should receive broadcasts")
+	}
+
+	for _, typ := range []string{
+		protocol.TypeSignal, protocol.TypeSignalAll, protocol.TypeRelay, protocol.TypeBroadcast, protocol.TypeMatch,
+		protocol.TypeUpdateInfo, protocol.TypeCreateRoom, protocol.TypeKick, protocol.TypeSetReady, "custom-type",
+	} {
+		h.HandleMessage(obs, mustEncode(&protocol.Message{Type: typ, To: "sender", Payload: bcastPayload}))
+		raw := <-obs.Send
+		decoded, _ := protocol.Decode(raw)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != 403 {
+			t.Errorf("%s from observer: expected 403, got %s %d", typ, decoded.Type, ep.Code)
+		}
+	}
+	select {
+	case raw := <-sender.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("sender should not hear from observer, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// looking around is still allowed
+	h.HandleMessage(obs, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discPayload}))
+	expectType(t, obs, protocol.TypePeerList, 0)
+	h.HandleMessage(obs, mustEncode(&protocol.Message{Type: protocol.TypePing}))
+	expectType(t, obs, protocol.TypePong, 0)
+}
+
+func TestHubMatchGroupSizeLimit(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxMatchGroupSize: 4})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	h.Register(p1)
+	p1.JoinNamespace("match-ns", "game", "1.0", nil)
+
+	tooBig, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", GroupSize: 1000000})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: tooBig}))
+	raw := <-p1.Send
+	decoded, _ := protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 400 {
+		t.Errorf("expected 400 for oversized group, got %s %d", decoded.Type, ep.Code)
+	}
+
+	ok, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", GroupSize: 4})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: ok}))
+	raw = <-p1.Send
+	decoded, _ = protocol.Decode(raw)
+	if decoded.Type != protocol.TypeMatch {
+		t.Errorf("expected waiting status for valid group size, got %s", decoded.Type)
+	}
+}
+
+func TestHubMatchCorrelation(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("match-ns", "game", "1.0", nil)
+	p2.JoinNamespace("match-ns", "game", "1.0", nil)
+
+	long, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", Correlation: strings.Repeat("x", maxCorrelationLen+1)})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: long}))
+	decoded, _ := protocol.Decode(<-p1.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 400 {
+		t.Fatalf("expected 400 for oversized correlation, got %s %d", decoded.Type, ep.Code)
+	}
+
+	req1, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", Correlation: "party-a"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: req1}))
+	<-p1.Send // waiting
+	req2, _ := json.Marshal(protocol.MatchPayload{Namespace: "match-ns", Correlation: "party-b"})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: req2}))
+
+	for _, p := range []*peer.Peer{p1, p2} {
+		decoded, _ := protocol.Decode(<-p.Send)
+		var result protocol.MatchedPayload
+		json.Unmarshal(decoded.Payload, &result)
+		got := make(map[string]string)
+		for _, pi := range result.Peers {
+			got[pi.Fingerprint] = pi.Correlation
+		}
+		if decoded.Type != protocol.TypeMatched || got["fp1"] != "party-a" || got["fp2"] != "party-b" {
+			t.Errorf("%s: expected correlations echoed per peer, got %s %v", p.Fingerprint, decoded.Type, got)
+		}
+	}
+}
+
+func TestHubMatchRequestsPerPeerLimit(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxMatchRequestsPerPeer: 2})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	h.Register(p1)
+
+	request := func(ns string) *protocol.Message {
+		payload, _ := json.Marshal(protocol.MatchPayload{Namespace: ns, GroupSize: 2})
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: payload}))
+		raw := <-p1.Send
+		decoded, _ := protocol.Decode(raw)
+		return decoded
+	}
+
+	for _, ns := range []string{"q1", "q2"} {
+		if got := request(ns); got.Type != protocol.TypeMatch {
+			t.Fatalf("expected waiting in %s, got %s", ns, got.Type)
+		}
+	}
+
+	got := request("q3")
+	var ep protocol.ErrorPayload
+	json.Unmarshal(got.Payload, &ep)
+	if got.Type != protocol.TypeError || ep.Code != 429 {
+		t.Fatalf("expected 429 for third request, got %s %d", got.Type, ep.Code)
+	}
+	if h.matchmaker.QueueSize("q3") != 0 {
+		t.Error("rejected request should not be queued")
+	}
+
+	// repeating a request in a namespace already waited in is allowed
+	if got := request("q1"); got.Type != protocol.TypeMatch {
+		t.Errorf("expected re-request in q1 to be accepted, got %s", got.Type)
+	}
+}
+
+func TestHubMatchRequestsDropOldest(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxMatchRequestsPerPeer: 2, DropOldestMatchRequest: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	h.Register(p1)
+
+	for _, ns := range []string{"q1", "q2", "q3"} {
+		payload, _ := json.Marshal(protocol.MatchPayload{Namespace: ns, GroupSize: 2})
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: payload}))
+		raw := <-p1.Send
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeMatch {
+			t.Fatalf("expected waiting in %s, got %s", ns, decoded.Type)
+		}
+	}
+
+	if h.matchmaker.QueueSize("q1") != 0 {
+		t.Error("expected oldest request in q1 to be dropped")
+	}
+	if h.matchmaker.QueueSize("q2") != 1 || h.matchmaker.QueueSize("q3") != 1 {
+		t.Error("expected requests in q2 and q3 to be waiting")
+	}
+}
+
+func TestHubMatchRejectedRequestKeepsQueue(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxMatchRequestsPerPeer: 1, DropOldestMatchRequest: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	h.Register(p1)
+
+	payload, _ := json.Marshal(protocol.MatchPayload{Namespace: "q1", GroupSize: 2})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: payload}))
+	expectType(t, p1, protocol.TypeMatch, 0)
+
+	// invalid requests are refused before they can evict the queued one
+	for _, bad := range []protocol.MatchPayload{
+		{Namespace: "q2", GroupSize: 2, Correlation: strings.Repeat("x", maxCorrelationLen+1)},
+		{Namespace: "q2", GroupSize: 1000},
+	} {
+		payload, _ := json.Marshal(bad)
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: payload}))
+		expectType(t, p1, protocol.TypeError, 400)
+	}
+	if h.matchmaker.QueueSize("q1") != 1 {
+		t.Error("a rejected request should leave the queued one in place")
+	}
+}
+
+func TestHubMatchAutoRoom(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MatchAutoRoom: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "auto-ns", GroupSize: 2})
+	matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	h.HandleMessage(p1, matchMsg)
+	<-p1.Send // waiting
+	h.HandleMessage(p2, matchMsg)
+
+	raw := <-p2.Send
+	decoded, _ := protocol.Decode(raw)
+	var mp protocol.MatchedPayload
+	json.Unmarshal(decoded.Payload, &mp)
+	if decoded.Type != protocol.TypeMatched || mp.RoomID == "" {
+		t.Fatalf("expected matched with room_id, got %s %+v", decoded.Type, mp)
+	}
+
+	ns, ok := h.nsMgr.Get(mp.RoomID)
+	if !ok || !ns.IsRoom {
+		t.Fatalf("expected room %s to exist", mp.RoomID)
+	}
+	if ns.MaxSize() != 2 {
+		t.Errorf("expected room capacity 2, got %d", ns.MaxSize())
+	}
+	for _, p := range []*peer.Peer{p1, p2} {
+		if !ns.Has(p.Fingerprint) || !p.InNamespace(mp.RoomID) {
+			t.Errorf("expected %s to be in the match room", p.Fingerprint)
+		}
+	}
+
+	// each gets the room's roster after matched, as from a join
+	<-p1.Send // matched
+	for _, p := range []*peer.Peer{p1, p2} {
+		decoded, _ := protocol.Decode(<-p.Send)
+		var list protocol.PeerListPayload
+		json.Unmarshal(decoded.Payload, &list)
+		if decoded.Type != protocol.TypePeerList || list.Namespace != mp.RoomID || len(list.Peers) != 2 {
+			t.Errorf("%s: expected the room's peer_list, got %s %s", p.Fingerprint, decoded.Type, decoded.Payload)
+		}
+	}
+
+	result, _, _ := h.matchmaker.LookupSession(mp.SessionID, "fp1")
+	if result == nil || result.RoomID != mp.RoomID {
+		t.Errorf("expected lookup to include room_id, got %+v", result)
+	}
+}
+
+func TestHubMatchAutoRoomFails(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MatchAutoRoom: true, MaxNamespaces: 1})
+	defer h.Shutdown()
+	h.nsMgr.GetOrCreate("taken")
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "auto-ns", GroupSize: 2})
+	matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	h.HandleMessage(p1, matchMsg)
+	<-p1.Send // waiting
+	h.HandleMessage(p2, matchMsg)
+
+	decoded, _ := protocol.Decode(<-p2.Send)
+	var mp protocol.MatchedPayload
+	json.Unmarshal(decoded.Payload, &mp)
+	if decoded.Type != protocol.TypeMatched || mp.RoomID != "" || mp.RoomError != "too many namespaces" {
+		t.Errorf("expected matched saying why there is no room, got %s %s", decoded.Type, decoded.Payload)
+	}
+	if len(p2.Send) != 0 {
+		t.Error("no peer_list expected without a room")
+	}
+}
+
+func TestHubMatchRoomOneShot(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{
+		MatchAutoRoom:     true,
+		MatchRoomLifetime: 100 * time.Millisecond,
+		RoomSweepInterval: 10 * time.Millisecond,
+	})
+	defer h.Shutdown()
+
+	match := func(ns string, fps ...string) (string, []*peer.Peer) {
+		t.Helper()
+		var peers []*peer.Peer
+		for _, fp := range fps {
+			p, c := makePeer(t, fp)
+			t.Cleanup(c)
+			h.Register(p)
+			peers = append(peers, p)
+		}
+		matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: ns, GroupSize: 2})
+		matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+		h.HandleMessage(peers[0], matchMsg)
+		<-peers[0].Send // waiting
+		h.HandleMessage(peers[1], matchMsg)
+		<-peers[0].Send // matched
+		decoded, _ := protocol.Decode(<-peers[1].Send)
+		var mp protocol.MatchedPayload
+		json.Unmarshal(decoded.Payload, &mp)
+		if mp.RoomID == "" {
+			t.Fatalf("expected a match room, got %s %s", decoded.Type, decoded.Payload)
+		}
+		for _, p := range peers {
+			<-p.Send // peer_list
+		}
+		return mp.RoomID, peers
+	}
+
+	// the room outlives neither its lifetime nor its members
+	roomID, peers := match("duel", "fp1", "fp2")
+	outsider, c := makePeer(t, "outsider")
+	defer c()
+	h.Register(outsider)
+	h.HandleMessage(outsider, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: []byte(`{"room_id":"` + roomID + `"}`)}))
+	decoded, _ := protocol.Decode(<-outsider.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 403 {
+		t.Errorf("expected 403 for a peer outside the match, got %s %+v", decoded.Type, ep)
+	}
+	// a plain join can't get around the reservation either
+	h.HandleMessage(outsider, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"` + roomID + `"}`)}))
+	decoded, _ = protocol.Decode(<-outsider.Send)
+	ep = protocol.ErrorPayload{}
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 403 || ep.Message != "use join_room" {
+		t.Errorf("expected 403 use join_room for a plain join, got %s %+v", decoded.Type, ep)
+	}
+	if outsider.InNamespace(roomID) {
+		t.Error("outsider joined the reserved room")
+	}
+
+	for _, p := range peers {
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			var rc protocol.RoomClosedPayload
+			json.Unmarshal(decoded.Payload, &rc)
+			if decoded.Type != protocol.TypeRoomClosed || rc.Reason != "expired" {
+				t.Errorf("%s: expected room_closed expired, got %s %s", p.Fingerprint, decoded.Type, decoded.Payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: timeout waiting for room_closed", p.Fingerprint)
+		}
+		if p.InNamespace(roomID) {
+			t.Errorf("%s: should have left the expired room", p.Fingerprint)
+		}
+	}
+	if _, ok := h.nsMgr.Get(roomID); ok {
+		t.Error("expired room should be removed")
+	}
+
+	roomID, peers = match("duel-2", "fp3", "fp4")
+	for _, p := range peers {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: []byte(`{"namespace":"` + roomID + `"}`)}))
+	}
+	if _, ok := h.nsMgr.Get(roomID); ok {
+		t.Error("room should close once every matched peer left")
+	}
+}
+
+// testSharedMatch puts one peer on each of two hubs in the same shared
+// queue and checks both get the same matched.
+func testSharedMatch(t *testing.T, bA, bB broker.Broker, ns string) {
+	t.Helper()
+	opts := Options{SharedMatchmaking: true, MatchAutoRoom: true}
+	hA := NewWithOptions(64, 100, bA, opts)
+	defer hA.Shutdown()
+	hB := NewWithOptions(64, 100, bB, opts)
+	defer hB.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	hA.Register(p1)
+	hB.Register(p2)
+
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: ns, GroupSize: 2})
+	matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	hA.HandleMessage(p1, matchMsg)
+	if decoded, _ := protocol.Decode(<-p1.Send); decoded.Type != protocol.TypeMatch {
+		t.Fatalf("expected waiting, got %s", decoded.Type)
+	}
+	if got := hA.matchmaker.ActiveRequests("fp1"); len(got) != 1 {
+		t.Fatalf("expected fp1 waiting in one queue, got %v", got)
+	}
+	hB.HandleMessage(p2, matchMsg)
+
+	var sessions []string
+	for _, p := range []*peer.Peer{p1, p2} {
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			var mp protocol.MatchedPayload
+			json.Unmarshal(decoded.Payload, &mp)
+			if decoded.Type != protocol.TypeMatched || len(mp.Peers) != 2 {
+				t.Fatalf("expected matched with 2 peers for %s, got %s %+v", p.Fingerprint, decoded.Type, mp)
+			}
+			if decoded.NodeID != "" {
+				t.Errorf("node_id leaked to %s", p.Fingerprint)
+			}
+			if mp.RoomID != "" {
+				t.Errorf("auto room made for a match across nodes: %s", mp.RoomID)
+			}
+			sessions = append(sessions, mp.SessionID)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout waiting for matched on %s", p.Fingerprint)
+		}
+	}
+	if sessions[0] != sessions[1] {
+		t.Errorf("expected one session, got %v", sessions)
+	}
+
+	// the waiting peer's node no longer counts it as waiting and can
+	// answer a lookup for the session
+	if got := hA.matchmaker.ActiveRequests("fp1"); len(got) != 0 {
+		t.Errorf("expected fp1 no longer waiting, got %v", got)
+	}
+	if result, _, participant := hA.matchmaker.LookupSession(sessions[0], "fp1"); result == nil || !participant {
+		t.Error("expected the session to be known on node A")
+	}
+}
+
+func TestHubSharedMatchmaking(t *testing.T) {
+	b := broker.NewLocal()
+	testSharedMatch(t, b, b, "shared-ns")
+}
+
+func TestHubSharedMatchmakingRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("skipping redis test: set REDIS_TEST_ADDR to enable")
+	}
+	bA, err := broker.NewRedis(addr, "", 0, "node-a")
+	if err != nil {
+		t.Fatalf("redis connection failed: %v", err)
+	}
+	defer bA.Close()
+	bB, err := broker.NewRedis(addr, "", 0, "node-b")
+	if err != nil {
+		t.Fatalf("redis connection failed: %v", err)
+	}
+	defer bB.Close()
+	testSharedMatch(t, bA, bB, fmt.Sprintf("shared-ns-%d", time.Now().UnixNano()))
+}
+
+func TestHubNodeIDCollision(t *testing.T) {
+	b := broker.NewLocal()
+	defer b.Close()
+	const nodeID = "0123456789abcdef0123456789abcdef"
+
+	h1 := NewWithOptions(64, 100, b, Options{NodeID: nodeID})
+	defer h1.Shutdown()
+	if h1.NodeID() != nodeID {
+		t.Fatalf("expected forced node id, got %s", h1.NodeID())
+	}
+	other := NewWithOptions(64, 100, b, Options{})
+	defer other.Shutdown()
+	if h1.NodeIDCollision() || other.NodeIDCollision() {
+		t.Fatal("distinct node ids should not collide")
+	}
+
+	h2 := NewWithOptions(64, 100, b, Options{NodeID: nodeID})
+	defer h2.Shutdown()
+	// the newcomer's announcement reaches h1, whose answer reaches h2
+	if !h1.NodeIDCollision() || !h2.NodeIDCollision() {
+		t.Errorf("expected both nodes to detect the collision, got %v and %v", h1.NodeIDCollision(), h2.NodeIDCollision())
+	}
+	if other.NodeIDCollision() {
+		t.Error("an unrelated node should not report a collision")
+	}
+
+	malformed := NewWithOptions(64, 100, nil, Options{NodeID: "not-hex"})
+	defer malformed.Shutdown()
+	if !isHex(malformed.NodeID(), 32) {
+		t.Errorf("expected a generated node id for a malformed one, got %q", malformed.NodeID())
+	}
+}
+
+func TestHubSharedMatchmakingLeave(t *testing.T) {
+	b := broker.NewLocal()
+	opts := Options{SharedMatchmaking: true}
+	hA := NewWithOptions(64, 100, b, opts)
+	defer hA.Shutdown()
+	hB := NewWithOptions(64, 100, b, opts)
+	defer hB.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	hA.Register(p1)
+	hB.Register(p2)
+
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "shared-ns", GroupSize: 2})
+	matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	hA.HandleMessage(p1, matchMsg)
+	<-p1.Send // waiting
+
+	// a peer that disconnects leaves the shared queue, so the next request
+	// waits instead of matching it
+	hA.Unregister("fp1")
+	hB.HandleMessage(p2, matchMsg)
+	if decoded, _ := protocol.Decode(<-p2.Send); decoded.Type != protocol.TypeMatch {
+		t.Errorf("expected waiting, got %s", decoded.Type)
+	}
+}
+
+func TestHubMatchLookup(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p3, c3 := makePeer(t, "fp3")
+	defer c3()
+	h.Register(p1)
+	h.Register(p2)
+	h.Register(p3)
+
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "lookup-ns", GroupSize: 2})
+	matchMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	h.HandleMessage(p1, matchMsg)
+	<-p1.Send // waiting
+	h.HandleMessage(p2, matchMsg)
+	<-p2.Send // matched
+
+	// p1 "missed" its matched
+	raw := <-p1.Send
+	decoded, _ := protocol.Decode(raw)
+	var original protocol.MatchedPayload
+	json.Unmarshal(decoded.Payload, &original)
+
+	lookup, _ := json.Marshal(protocol.MatchLookupPayload{SessionID: original.SessionID})
+	lookupMsg := mustEncode(&protocol.Message{Type: protocol.TypeMatchLookup, Payload: lookup})
+
+	h.HandleMessage(p1, lookupMsg)
+	raw = <-p1.Send
+	decoded, _ = protocol.Decode(raw)
+	var recovered protocol.MatchedPayload
+	json.Unmarshal(decoded.Payload, &recovered)
+	if decoded.Type != protocol.TypeMatched || recovered.SessionID != original.SessionID || len(recovered.Peers) != 2 {
+		t.Errorf("expected participant to recover session, got %s %+v", decoded.Type, recovered)
+	}
+
+	h.HandleMessage(p3, lookupMsg)
+	raw = <-p3.Send
+	decoded, _ = protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 403 {
+		t.Errorf("expected 403 for non-participant, got %s %d", decoded.Type, ep.Code)
+	}
+}
+
+func TestHubSignalAll(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	peers := make([]*peer.Peer, 3)
+	for i, fp := range []string{"mesh-a", "mesh-b", "mesh-c"} {
+		p, cleanup := makePeer(t, fp)
+		defer cleanup()
+		h.Register(p)
+		peers[i] = p
+	}
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "mesh", AppType: "game"})
+	joinMsg := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	for _, p := range peers {
+		h.HandleMessage(p, joinMsg)
+	}
+	// drain peer_list and peer_joined notifications
+	for _, p := range peers {
+		for drained := false; !drained; {
+			select {
+			case <-p.Send:
+			case <-time.After(50 * time.Millisecond):
+				drained = true
+			}
+		}
+	}
+
+	offer, _ := json.Marshal(protocol.SignalPayload{SignalType: protocol.SignalOffer, SDP: "v=0"})
+	h.HandleMessage(peers[0], mustEncode(&protocol.Message{Type: protocol.TypeSignalAll, Namespace: "mesh", Payload: offer}))
+
+	for _, p := range peers[1:] {
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != protocol.TypeSignal {
+				t.Errorf("expected signal, got %s", decoded.Type)
+			}
+			if decoded.From != "mesh-a" || decoded.To != p.Fingerprint {
+				t.Errorf("expected mesh-a -> %s, got %s -> %s", p.Fingerprint, decoded.From, decoded.To)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not receive the offer", p.Fingerprint)
+		}
+	}
+
+	select {
+	case <-peers[0].Send:
+		t.Error("sender should not receive its own signal_all")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubSignalAllMemberCap(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxSignalAllMembers: 1})
+	defer h.Shutdown()
+
+	peers := make([]*peer.Peer, 3)
+	for i, fp := range []string{"mesh-a", "mesh-b", "mesh-c"} {
+		p, cleanup := makePeer(t, fp)
+		defer cleanup()
+		h.Register(p)
+		peers[i] = p
+	}
+	ns := h.nsMgr.GetOrCreate("mesh")
+	for _, p := range peers {
+		ns.Add(p)
+		p.JoinNamespace("mesh", "game", "", nil)
+	}
+
+	h.HandleMessage(peers[0], mustEncode(&protocol.Message{Type: protocol.TypeSignalAll, Namespace: "mesh", Payload: []byte(`{}`)}))
+	raw := <-peers[0].Send
+	decoded, _ := protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 400 {
+		t.Errorf("expected 400 over member cap, got %d", ep.Code)
+	}
+}
+
+func TestHubSignalSizeLimits(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxSDPBytes: 16, MaxCandidateBytes: 32})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+	ns := h.nsMgr.GetOrCreate("sig")
+	for _, p := range []*peer.Peer{p1, p2} {
+		ns.Add(p)
+		p.JoinNamespace("sig", "game", "", nil)
+	}
+
+	signal := func(payload protocol.SignalPayload) {
+		data, _ := json.Marshal(payload)
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", RequestID: "r1", Payload: data}))
+	}
+	expectError := func(msg string) {
+		t.Helper()
+		decoded, _ := protocol.Decode(<-p1.Send)
+		var ep protocol.ErrorPayload
+		json.Unmarshal(decoded.Payload, &ep)
+		if decoded.Type != protocol.TypeError || ep.Code != 413 || ep.Message != msg {
+			t.Errorf("expected 413 %s, got %s %+v", msg, decoded.Type, ep)
+		}
+		if decoded.RequestID != "r1" {
+			t.Errorf("expected request_id r1, got %q", decoded.RequestID)
+		}
+	}
+
+	signal(protocol.SignalPayload{SignalType: "offer", SDP: strings.Repeat("v", 17)})
+	expectError("sdp too large")
+	signal(protocol.SignalPayload{SignalType: "candidate", Candidate: []byte(`"` + strings.Repeat("c", 40) + `"`)})
+	expectError("candidate too large")
+
+	// signal_all is held to the same limits
+	data, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer", SDP: strings.Repeat("v", 17)})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignalAll, Namespace: "sig", RequestID: "r1", Payload: data}))
+	expectError("sdp too large")
+
+	select {
+	case raw := <-p2.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Fatalf("oversize signal was forwarded: %s", decoded.Type)
+	default:
+	}
+
+	signal(protocol.SignalPayload{SignalType: "offer", SDP: strings.Repeat("v", 16)})
+	select {
+	case raw := <-p2.Send:
+		if decoded, _ := protocol.Decode(raw); decoded.Type != protocol.TypeSignal {
+			t.Errorf("expected signal, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for signal within limits")
+	}
+}
+
+func TestHubSnapshotRestoreRooms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{SnapshotPath: path})
+	p, c := makePeer(t, "owner-fp")
+	defer c()
+	p.Alias = "brave-fox-42"
+	h.Register(p)
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "persisted", MaxSize: 8, ApprovalRequired: true})
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload}))
+	<-p.Send
+	h.Shutdown()
+
+	h2 := NewWithOptions(64, 100, broker.NewLocal(), Options{SnapshotPath: path})
+	defer h2.Shutdown()
+
+	ns, ok := h2.nsMgr.Get("persisted")
+	if !ok {
+		t.Fatal("room should be restored from snapshot")
+	}
+	if ns.Owner != "owner-fp" {
+		t.Errorf("expected owner owner-fp, got %s", ns.Owner)
+	}
+	if ns.MaxSize() != 8 || !ns.ApprovalRequired() || !ns.IsRoom {
+		t.Errorf("room settings not restored: max=%d approval=%v", ns.MaxSize(), ns.ApprovalRequired())
+	}
+	if ns.Count() != 0 {
+		t.Errorf("restored room should be empty, got %d members", ns.Count())
+	}
+	if fp, ok := h2.ResolveAlias("", "brave-fox-42"); !ok || fp != "owner-fp" {
+		t.Errorf("alias not restored, got %q", fp)
+	}
+
+	// restored rooms survive the empty-namespace cleanup during the grace period
+	h2.nsMgr.Cleanup()
+	if _, ok := h2.nsMgr.Get("persisted"); !ok {
+		t.Error("restored room should be held through cleanup")
+	}
+}
+
+func TestHubSnapshotRestoredAliasesExpire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{SnapshotPath: path})
+	gone, gc := makePeer(t, "gone-fp")
+	defer gc()
+	gone.Alias = "gone-fox"
+	back, bc := makePeer(t, "back-fp")
+	defer bc()
+	back.Alias = "back-fox"
+	h.Register(gone)
+	h.Register(back)
+	h.Shutdown()
+
+	h2 := NewWithOptions(64, 100, broker.NewLocal(), Options{SnapshotPath: path, RestoredRoomGrace: 50 * time.Millisecond})
+	defer h2.Shutdown()
+	back2, bc2 := makePeer(t, "back-fp")
+	defer bc2()
+	back2.Alias = "back-fox"
+	h2.Register(back2)
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := h2.ResolveAlias("", "gone-fox"); ok {
+		t.Error("alias of an owner that didn't return should expire after the grace period")
+	}
+	if fp, ok := h2.ResolveAlias("", "back-fox"); !ok || fp != "back-fp" {
+		t.Errorf("alias re-registered by its owner should be kept, got %q", fp)
+	}
+}
+
+func TestHubRestoreRoomsSkipsExisting(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	h.nsMgr.CreateRoom("taken", 5, "first")
+	n := h.RestoreRooms([]RoomSnapshot{
+		{ID: "taken", Owner: "second", MaxSize: 10},
+		{ID: "fresh", Owner: "second", MaxSize: 10},
+	})
+	if n != 1 {
+		t.Errorf("expected 1 restored room, got %d", n)
+	}
+	if ns, _ := h.nsMgr.Get("taken"); ns.Owner != "first" {
+		t.Errorf("existing room should be left alone, owner %s", ns.Owner)
+	}
+}
+
+func TestHubDiscoverIncludesRegion(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p2.Region = "eu-west"
+
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("region-ns", "game", "", nil)
+	p2.JoinNamespace("region-ns", "game", "", nil)
+	ns := h.nsMgr.GetOrCreate("region-ns")
+	ns.Add(p1)
+	ns.Add(p2)
+
+	discoverPayload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "region-ns"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discoverPayload}))
+
+	raw := <-p1.Send
+	decoded, _ := protocol.Decode(raw)
+	var pl protocol.PeerListPayload
+	json.Unmarshal(decoded.Payload, &pl)
+	found := false
+	for _, info := range pl.Peers {
+		if info.Fingerprint == "fp2" {
+			found = true
+			if info.Region != "eu-west" {
+				t.Errorf("expected region eu-west, got %q", info.Region)
+			}
+		}
+	}
+	if !found {
+		t.Error("fp2 missing from discover results")
+	}
+}
+
+func TestHubDiscoverChunksLargeList(t *testing.T) {
+	h := NewWithOptions(64, 1000, broker.NewLocal(), Options{MaxPeerListBytes: 2048})
+	defer h.Shutdown()
+
+	ns := h.nsMgr.GetOrCreate("big-ns")
+	const members = 100
+	for i := 0; i < members; i++ {
+		p, c := makePeer(t, fmt.Sprintf("%064d", i))
+		defer c()
+		h.Register(p)
+		p.JoinNamespace("big-ns", "game", "1.0", map[string]interface{}{"bio": strings.Repeat("x", 40)})
+		ns.Add(p)
+	}
+	asker, ca := makePeer(t, "asker")
+	defer ca()
+	h.Register(asker)
+
+	discover := func(limit int) []protocol.PeerListPayload {
+		t.Helper()
+		payload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "big-ns", Limit: limit})
+		h.HandleMessage(asker, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: payload}))
+		var parts []protocol.PeerListPayload
+		for len(asker.Send) > 0 {
+			raw := <-asker.Send
+			if len(raw) > 2048 {
+				t.Errorf("chunk of %d bytes exceeds the limit", len(raw))
+			}
+			decoded, _ := protocol.Decode(raw)
+			var pl protocol.PeerListPayload
+			json.Unmarshal(decoded.Payload, &pl)
+			parts = append(parts, pl)
+		}
+		return parts
+	}
+
+	if parts := discover(2); len(parts) != 1 || parts[0].Chunk != 0 || parts[0].Last {
+		t.Fatalf("expected a small list sent whole, got %+v", parts)
+	}
+
+	parts := discover(members)
+	if len(parts) < 2 {
+		t.Fatalf("expected the list split into chunks, got %d", len(parts))
+	}
+	seen := make(map[string]bool)
+	for i, pl := range parts {
+		if pl.Chunk != i+1 || pl.Last != (i == len(parts)-1) || pl.Total != members {
+			t.Errorf("part %d: unexpected chunk %d last %v total %d", i, pl.Chunk, pl.Last, pl.Total)
+		}
+		for _, pi := range pl.Peers {
+			seen[pi.Fingerprint] = true
+		}
+	}
+	if len(seen) != members {
+		t.Errorf("expected %d peers reassembled, got %d", members, len(seen))
+	}
+}
+
+func TestHubDiscoverChunksOverflowBuffer(t *testing.T) {
+	// small enough that 100 peers need more chunks than the default
+	// 32-message send buffer holds
+	h := NewWithOptions(64, 1000, broker.NewLocal(), Options{MaxPeerListBytes: 512})
+	defer h.Shutdown()
+
+	ns := h.nsMgr.GetOrCreate("big-ns")
+	for i := 0; i < 100; i++ {
+		p, c := makePeer(t, fmt.Sprintf("%064d", i))
+		defer c()
+		h.Register(p)
+		p.JoinNamespace("big-ns", "game", "1.0", map[string]interface{}{"bio": strings.Repeat("x", 40)})
+		ns.Add(p)
+	}
+	asker, ca := makePeer(t, "asker")
+	defer ca()
+	h.Register(asker)
+
+	payload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "big-ns", Limit: 100})
+	h.HandleMessage(asker, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, RequestID: "disc-1", Payload: payload}))
+	if len(asker.Send) != 1 {
+		t.Fatalf("expected a single reply instead of partial chunks, got %d", len(asker.Send))
+	}
+	decoded, _ := protocol.Decode(<-asker.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if decoded.Type != protocol.TypeError || ep.Code != 413 || decoded.RequestID != "disc-1" {
+		t.Errorf("expected 413 for disc-1, got %s %d %q", decoded.Type, ep.Code, decoded.RequestID)
+	}
+}
+
+func TestHubDiscoverRegionFilter(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	ns := h.nsMgr.GetOrCreate("region-ns")
+	regions := map[string]string{"fp-eu1": "eu-west", "fp-eu2": "eu-west", "fp-us": "us-east", "fp-none": ""}
+	var asker *peer.Peer
+	for fp, region := range regions {
+		p, cleanup := makePeer(t, fp)
+		defer cleanup()
+		p.Region = region
+		h.Register(p)
+		p.JoinNamespace("region-ns", "game", "", nil)
+		ns.Add(p)
+		if fp == "fp-eu1" {
+			asker = p
+		}
+	}
+
+	discover := func(payload protocol.DiscoverPayload) protocol.PeerListPayload {
+		data, _ := json.Marshal(payload)
+		h.HandleMessage(asker, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: data}))
+		raw := <-asker.Send
+		decoded, _ := protocol.Decode(raw)
+		var pl protocol.PeerListPayload
+		json.Unmarshal(decoded.Payload, &pl)
+		return pl
+	}
+
+	pl := discover(protocol.DiscoverPayload{Namespace: "region-ns", Region: "eu-west"})
+	if pl.Total != 2 || len(pl.Peers) != 2 {
+		t.Errorf("expected 2 eu-west peers, got total %d listed %d", pl.Total, len(pl.Peers))
+	}
+	for _, info := range pl.Peers {
+		if info.Region != "eu-west" {
+			t.Errorf("unexpected peer %s in region %q", info.Fingerprint, info.Region)
+		}
+	}
+
+	pl = discover(protocol.DiscoverPayload{Namespace: "region-ns", Region: "eu-west", IncludeNoRegion: true})
+	if pl.Total != 3 {
+		t.Errorf("expected 3 peers including no-region, got %d", pl.Total)
+	}
+
+	pl = discover(protocol.DiscoverPayload{Namespace: "region-ns", Region: "eu-west", Limit: 1})
+	if pl.Total != 2 || len(pl.Peers) != 1 {
+		t.Errorf("expected total 2 with 1 listed, got total %d listed %d", pl.Total, len(pl.Peers))
+	}
+}
+
+func TestHubDiscoverLeanFields(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p2.UpdateMeta(map[string]interface{}{"skill": 5})
+
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("lean-ns", "game", "", nil)
+	p2.JoinNamespace("lean-ns", "game", "", nil)
+	ns := h.nsMgr.GetOrCreate("lean-ns")
+	ns.Add(p1)
+	ns.Add(p2)
+
+	discoverPayload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "lean-ns", Fields: []string{"fingerprint", "alias"}})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discoverPayload}))
+
+	raw := <-p1.Send
+	decoded, _ := protocol.Decode(raw)
+	var pl protocol.PeerListPayload
+	json.Unmarshal(decoded.Payload, &pl)
+	if len(pl.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(pl.Peers))
+	}
+	for _, info := range pl.Peers {
+		if info.Fingerprint == "" || info.Alias == "" {
+			t.Errorf("expected fingerprint and alias to be kept, got %+v", info)
+		}
+		if len(info.Meta) != 0 || info.AppType != "" {
+			t.Errorf("expected lean entry without meta/app_type, got %+v", info)
+		}
+	}
+
+	// default stays full
+	discoverPayload, _ = json.Marshal(protocol.DiscoverPayload{Namespace: "lean-ns"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discoverPayload}))
+	raw = <-p1.Send
+	decoded, _ = protocol.Decode(raw)
+	json.Unmarshal(decoded.Payload, &pl)
+	for _, info := range pl.Peers {
+		if info.Fingerprint == "fp2" && info.Meta["skill"] == nil {
+			t.Error("expected full discover to include meta")
+		}
+	}
+}
+
+func TestHubBrokerRejectsSpoofedOrigin(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+	p.JoinNamespace("lobby", "game", "", nil)
+	h.nsMgr.GetOrCreate("lobby").Add(p)
+
+	tests := []struct {
+		name   string
+		from   string
+		nodeID string
+	}{
+		{"alias as from", "brave-fox-42", remoteNodeID},
+		{"short from", "abc123", remoteNodeID},
+		{"uppercase from", strings.ToUpper(remoteFingerprint), remoteNodeID},
+		{"empty from", "", remoteNodeID},
+		{"missing node id", remoteFingerprint, ""},
+		{"malformed node id", remoteFingerprint, "other-node-id"},
+	}
+	bcast, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "lobby", Data: []byte(`"x"`)})
+	for _, tt := range tests {
+		signal := &protocol.Message{Type: protocol.TypeSignal, From: tt.from, To: "fp1", NodeID: tt.nodeID, Payload: []byte(`{}`)}
+		h.handleBrokerMessage(mustEncode(signal))
+		broadcast := &protocol.Message{Type: protocol.TypeBroadcast, From: tt.from, NodeID: tt.nodeID, Payload: bcast}
+		h.handleBrokerBroadcast(mustEncode(broadcast))
+
+		select {
+		case raw := <-p.Send:
+			decoded, _ := protocol.Decode(raw)
+			t.Errorf("%s: spoofed broker %s should be dropped", tt.name, decoded.Type)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// a well-formed broadcast still goes through
+	h.handleBrokerBroadcast(mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, From: remoteFingerprint, NodeID: remoteNodeID, Payload: bcast}))
+	select {
+	case <-p.Send:
+	case <-time.After(time.Second):
+		t.Error("valid broker broadcast should be delivered")
+	}
+}
+
+func TestHubSendQueueStats(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	if max, p95 := h.SendQueueStats(); max != 0 || p95 != 0 {
+		t.Errorf("expected 0/0 with no peers, got %d/%d", max, p95)
+	}
+
+	for i := 0; i < 20; i++ {
+		p, c := makePeer(t, fmt.Sprintf("idle-%d", i))
+		defer c()
+		h.Register(p)
+	}
+	slow, c := makePeer(t, "slow-consumer")
+	defer c()
+	h.Register(slow)
+	for i := 0; i < cap(slow.Send); i++ {
+		slow.SendRaw([]byte(`{"type":"pong"}`))
+	}
+
+	max, p95 := h.SendQueueStats()
+	if max != cap(slow.Send) {
+		t.Errorf("expected max queue depth %d, got %d", cap(slow.Send), max)
+	}
+	if p95 != 0 {
+		t.Errorf("one slow peer out of 21 should not move p95, got %d", p95)
+	}
+}
+
+func TestHubDisableAliases(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{DisableAliases: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p2.Alias = "brave-fox-42"
+	h.Register(p1)
+	h.Register(p2)
+	p1.JoinNamespace("ns", "game", "", nil)
+	p2.JoinNamespace("ns", "game", "", nil)
+
+	if _, ok := h.ResolveAlias("", "brave-fox-42"); ok {
+		t.Error("alias resolution should fail when aliases are disabled")
+	}
+
+	// signaling by fingerprint still works
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", Payload: []byte(`{}`)}))
+	select {
+	case raw := <-p2.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeSignal {
+			t.Errorf("expected signal, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("signal by fingerprint should be delivered")
+	}
+}
+
+func TestHubDispatchPreservesPerPeerOrder(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{HandlerWorkers: 4})
+	defer h.Shutdown()
+
+	const senders = 4
+	const perSender = 100
+
+	target, tc := makePeer(t, "target")
+	defer tc()
+	target.Send = make(chan []byte, senders*perSender)
+	h.Register(target)
+	target.JoinNamespace("ns", "game", "", nil)
+
+	var peers []*peer.Peer
+	for i := 0; i < senders; i++ {
+		p, c := makePeer(t, fmt.Sprintf("sender-%d", i))
+		defer c()
+		h.Register(p)
+		p.JoinNamespace("ns", "game", "", nil)
+		peers = append(peers, p)
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer.Peer) {
+			defer wg.Done()
+			for seq := 0; seq < perSender; seq++ {
+				payload := []byte(fmt.Sprintf(`{"seq":%d}`, seq))
+				h.Dispatch(p, mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "target", Payload: payload}))
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	next := make(map[string]int)
+	for i := 0; i < senders*perSender; i++ {
+		select {
+		case raw := <-target.Send:
+			decoded, _ := protocol.Decode(raw)
+			var body struct {
+				Seq int `json:"seq"`
+			}
+			json.Unmarshal(decoded.Payload, &body)
+			if body.Seq != next[decoded.From] {
+				t.Fatalf("%s: expected seq %d, got %d", decoded.From, next[decoded.From], body.Seq)
+			}
+			next[decoded.From]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout after %d messages", i)
+		}
+	}
+}
+
+func TestHubDispatchBurstFairness(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{HandlerWorkers: 1, HandlerBurst: 4})
+	defer h.Shutdown()
+
+	spammer, c1 := makePeer(t, "spammer")
+	defer c1()
+	quiet, c2 := makePeer(t, "quiet")
+	defer c2()
+	quiet.Send = make(chan []byte, 64)
+	h.Register(spammer)
+	h.Register(quiet)
+	spammer.JoinNamespace("ns", "game", "", nil)
+	quiet.JoinNamespace("ns", "game", "", nil)
+
+	// queue both peers before the single worker sees either, spammer first
+	const spam = 20
+	d := h.workers
+	d.mu.Lock()
+	for i := 0; i < spam; i++ {
+		d.queues[spammer] = append(d.queues[spammer], mustEncode(&protocol.Message{Type: protocol.TypeRelay, To: "quiet", Payload: []byte(`{}`)}))
+	}
+	d.queues[quiet] = [][]byte{mustEncode(&protocol.Message{Type: protocol.TypePing})}
+	d.work <- spammer
+	d.work <- quiet
+	d.mu.Unlock()
+
+	relays := 0
+	for relays < spam {
+		select {
+		case raw := <-quiet.Send:
+			if string(raw) == string(protocol.PongBytes) {
+				if relays != 4 {
+					t.Errorf("expected pong after spammer's burst of 4, got it after %d relays", relays)
+				}
+				continue
+			}
+			relays++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout after %d relays", relays)
+		}
+	}
+}
+
+func TestHubRegisterHandler(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	if err := h.RegisterHandler(protocol.TypeRelay, func(*peer.Peer, *protocol.Message) {}); err != ErrCoreMessageType {
+		t.Errorf("expected ErrCoreMessageType for a core type, got %v", err)
+	}
+	if err := h.RegisterHandler("", func(*peer.Peer, *protocol.Message) {}); err != ErrCoreMessageType {
+		t.Errorf("expected ErrCoreMessageType for an empty type, got %v", err)
+	}
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	chat := mustEncode(&protocol.Message{Type: "chat", Payload: []byte(`{"text":"hi"}`)})
+	h.HandleMessage(p, chat)
+	decoded, _ := protocol.Decode(<-p.Send)
+	if decoded.Type != protocol.TypeError {
+		t.Fatalf("expected unknown type error before registering, got %s", decoded.Type)
+	}
+
+	var from string
+	err := h.RegisterHandler("chat", func(p *peer.Peer, msg *protocol.Message) {
+		from = msg.From
+		p.SendMessage(protocol.NewMessage("chat", "", msg.Payload))
+	})
+	if err != nil {
+		t.Fatalf("register chat: %v", err)
+	}
+	h.HandleMessage(p, chat)
+	decoded, _ = protocol.Decode(<-p.Send)
+	if decoded.Type != "chat" || string(decoded.Payload) != `{"text":"hi"}` {
+		t.Errorf("expected chat echoed, got %s %s", decoded.Type, decoded.Payload)
+	}
+	if from != "fp1" {
+		t.Errorf("expected the handler to see the sender, got %q", from)
+	}
+}
+
+func TestHubSlowHandlerLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{SlowHandlerThreshold: 20 * time.Millisecond})
+	defer h.Shutdown()
+	h.RegisterHandler("slow", func(*peer.Peer, *protocol.Message) { time.Sleep(40 * time.Millisecond) })
+	h.RegisterHandler("fast", func(*peer.Peer, *protocol.Message) {})
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: "fast"}))
+	if buf.Len() != 0 {
+		t.Fatalf("fast handler should not be logged: %s", buf.String())
+	}
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: "slow", RequestID: "req-9"}))
+	out := buf.String()
+	if !strings.Contains(out, "slow handler: slow from fp1 [request_id=req-9] took") {
+		t.Fatalf("expected a slow handler log, got %q", out)
+	}
+
+	// within the rate limit window the next slow call is only counted
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: "slow"}))
+	if buf.String() != out {
+		t.Errorf("expected the second slow handler rate limited, got %q", buf.String())
+	}
+	if h.slowSuppressed.Load() != 1 {
+		t.Errorf("expected 1 suppressed log, got %d", h.slowSuppressed.Load())
+	}
+}
+
+func TestHubDispatchInlineWithoutPool(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+
+	h.Dispatch(p, mustEncode(&protocol.Message{Type: protocol.TypePing}))
+	select {
+	case raw := <-p.Send:
+		if string(raw) != string(protocol.PongBytes) {
+			t.Errorf("expected pong, got %s", raw)
+		}
+	default:
+		t.Error("without a pool Dispatch should handle the message before returning")
+	}
+}
+
+func TestHubUnregisterReplacedPeer(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	watcher, wc := makePeer(t, "watcher")
+	defer wc()
+	h.Register(watcher)
+	ns := h.nsMgr.GetOrCreate("lobby")
+	ns.Add(watcher)
+	watcher.JoinNamespace("lobby", "game", "", nil)
+
+	oldConn, oc := makePeer(t, "dup")
+	defer oc()
+	h.Register(oldConn)
+	ns.Add(oldConn)
+	oldConn.JoinNamespace("lobby", "game", "", nil)
+
+	// same fingerprint reconnects and rejoins before the old read loop exits
+	newConn, nc := makePeer(t, "dup")
+	defer nc()
+	h.Register(newConn)
+	ns.Add(newConn)
+	newConn.JoinNamespace("lobby", "game", "", nil)
+
+	h.UnregisterPeer(oldConn)
+
+	if h.PeerCount() != 2 {
+		t.Errorf("expected peer count 2, got %d", h.PeerCount())
+	}
+	if got, ok := h.GetPeer("dup"); !ok || got != newConn {
+		t.Error("new connection should stay registered")
+	}
+	if got, ok := ns.Get("dup"); !ok || got != newConn {
+		t.Error("new connection should keep its namespace membership")
+	}
+	select {
+	case raw := <-watcher.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("no peer_left expected while the new connection is a member, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.UnregisterPeer(newConn)
+	if h.PeerCount() != 1 {
+		t.Errorf("expected peer count 1 after new connection leaves, got %d", h.PeerCount())
+	}
+	if ns.Has("dup") {
+		t.Error("dup should be gone from the namespace")
+	}
+}
+
+func TestHubUnregisterReplacedPeerStaleNamespace(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	oldConn, oc := makePeer(t, "dup")
+	defer oc()
+	h.Register(oldConn)
+	ns := h.nsMgr.GetOrCreate("lobby")
+	ns.Add(oldConn)
+	oldConn.JoinNamespace("lobby", "game", "", nil)
+
+	// the new connection has not rejoined yet
+	newConn, nc := makePeer(t, "dup")
+	defer nc()
+	h.Register(newConn)
+
+	h.UnregisterPeer(oldConn)
+
+	if ns.Has("dup") {
+		t.Error("old connection's namespace entry should be removed")
+	}
+	if _, ok := h.GetPeer("dup"); !ok || h.PeerCount() != 1 {
+		t.Error("new connection should stay registered")
+	}
+}
+
+func TestHubWatchNamespace(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	watcher, wc := makePeer(t, "watcher")
+	defer wc()
+	member, mc := makePeer(t, "member")
+	defer mc()
+	h.Register(watcher)
+	h.Register(member)
+
+	watchPayload, _ := json.Marshal(protocol.WatchPayload{Namespace: "lobby"})
+	h.HandleMessage(watcher, mustEncode(&protocol.Message{Type: protocol.TypeWatch, Payload: watchPayload}))
+	raw := <-watcher.Send
+	decoded, _ := protocol.Decode(raw)
+	if decoded.Type != protocol.TypeNsCount {
+		t.Fatalf("expected namespace_count ack, got %s", decoded.Type)
+	}
+
+	expectEvent := func(typ string, count int) {
+		t.Helper()
+		select {
+		case raw := <-watcher.Send:
+			decoded, _ := protocol.Decode(raw)
+			if decoded.Type != typ || decoded.From != "member" {
+				t.Errorf("expected %s from member, got %s from %s", typ, decoded.Type, decoded.From)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("watcher did not get %s", typ)
+		}
+		select {
+		case raw := <-watcher.Send:
+			decoded, _ := protocol.Decode(raw)
+			var nc protocol.NamespaceCountPayload
+			json.Unmarshal(decoded.Payload, &nc)
+			if decoded.Type != protocol.TypeNsCount || nc.Count != count {
+				t.Errorf("expected namespace_count %d, got %s %d", count, decoded.Type, nc.Count)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("watcher did not get namespace_count")
+		}
+	}
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby", AppType: "game"})
+	h.HandleMessage(member, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	raw = <-member.Send
+	decoded, _ = protocol.Decode(raw)
+	var pl protocol.PeerListPayload
+	json.Unmarshal(decoded.Payload, &pl)
+	for _, info := range pl.Peers {
+		if info.Fingerprint == "watcher" {
+			t.Error("watcher should not be listed as a member")
+		}
+	}
+	expectEvent(protocol.TypePeerJoined, 1)
+
+	// broadcasts are not delivered to watchers
+	bcast, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "lobby", Data: []byte(`"hi"`)})
+	h.HandleMessage(member, mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: bcast}))
+	select {
+	case raw := <-watcher.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("watcher should not get broadcasts, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	leavePayload, _ := json.Marshal(map[string]string{"namespace": "lobby"})
+	h.HandleMessage(member, mustEncode(&protocol.Message{Type: protocol.TypeLeave, Payload: leavePayload}))
+	expectEvent(protocol.TypePeerLeft, 0)
+
+	// unwatch stops events, and the empty namespace survives cleanup only while watched
+	h.nsMgr.Cleanup()
+	if _, ok := h.nsMgr.Get("lobby"); !ok {
+		t.Error("watched namespace should survive cleanup")
+	}
+	h.HandleMessage(watcher, mustEncode(&protocol.Message{Type: protocol.TypeUnwatch, Payload: watchPayload}))
+	h.HandleMessage(member, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	<-member.Send
+	select {
+	case raw := <-watcher.Send:
+		decoded, _ := protocol.Decode(raw)
+		t.Errorf("unwatched peer should get no events, got %s", decoded.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubWatchRoomRejected(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Register(p)
+	h.nsMgr.CreateRoom("room1", 5, "owner")
+
+	watchPayload, _ := json.Marshal(protocol.WatchPayload{Namespace: "room1"})
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeWatch, Payload: watchPayload}))
+	raw := <-p.Send
+	decoded, _ := protocol.Decode(raw)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 403 {
+		t.Errorf("expected 403 watching a room, got %d", ep.Code)
+	}
+}
+
+func TestHubWatchLimits(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	p.Send = make(chan []byte, maxWatchedNamespaces+8)
+	h.Register(p)
+
+	watch := func(ns string) {
+		h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypeWatch, Payload: []byte(`{"namespace":"` + ns + `"}`)}))
+	}
+	for i := 0; i < maxWatchedNamespaces; i++ {
+		watch(fmt.Sprintf("ns-%d", i))
+		expectType(t, p, protocol.TypeNsCount, 0)
+	}
+	watch("one-more")
+	expectType(t, p, protocol.TypeError, 429)
+	if _, ok := h.nsMgr.Get("one-more"); ok {
+		t.Error("a refused watch should not create its namespace")
+	}
+	// watching one already watched doesn't count again
+	watch("ns-0")
+	expectType(t, p, protocol.TypeNsCount, 0)
+
+	// watches share the join rate limit
+	limited := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxJoinsPerSec: 1})
+	defer limited.Shutdown()
+	q, qc := makePeer(t, "fp2")
+	defer qc()
+	limited.Register(q)
+	for i, want := range []string{protocol.TypeNsCount, protocol.TypeError} {
+		limited.HandleMessage(q, mustEncode(&protocol.Message{Type: protocol.TypeWatch, Payload: []byte(fmt.Sprintf(`{"namespace":"w-%d"}`, i))}))
+		code := 0
+		if want == protocol.TypeError {
+			code = 429
+		}
+		expectType(t, q, want, code)
+	}
+}
+
+func TestHubShutdownWhileHandling(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{HandlerWorkers: 4})
+
+	const n = 8
+	peers := make([]*peer.Peer, n)
+	for i := range peers {
+		p, c := makePeer(t, generateTestFingerprint(i))
+		defer c()
+		h.Register(p)
+		peers[i] = p
+		// keep the send buffers moving until Shutdown closes them
+		go func() {
+			for range p.Send {
+			}
+		}()
+	}
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "stress", AppType: "game"})
+	join := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	bcastPayload, _ := json.Marshal(protocol.BroadcastPayload{Namespace: "stress", Data: []byte(`"hi"`)})
+	bcast := mustEncode(&protocol.Message{Type: protocol.TypeBroadcast, Payload: bcastPayload})
+	for _, p := range peers {
+		h.HandleMessage(p, join)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		signalPayload, _ := json.Marshal(protocol.SignalPayload{
+			SignalType: "offer",
+			SDP:        "sdp",
+		})
+		signal := mustEncode(&protocol.Message{
+			Type:    protocol.TypeSignal,
+			To:      peers[(i+1)%n].Fingerprint,
+			Payload: signalPayload,
+		})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				h.Dispatch(p, bcast)
+				h.Dispatch(p, signal)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				h.HandleMessage(p, bcast)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	h.Shutdown()
+	close(stop)
+	wg.Wait()
+
+	for _, p := range peers {
+		if !p.IsClosed() {
+			t.Errorf("peer %s should be closed after shutdown", p.Fingerprint)
+		}
+	}
+}
+
+func TestHubHandleMessageAfterShutdown(t *testing.T) {
+	h := newTestHub()
+	p, c := makePeer(t, "fp1")
+	defer c()
+	h.Shutdown()
+
+	h.HandleMessage(p, mustEncode(&protocol.Message{Type: protocol.TypePing}))
+	select {
+	case raw := <-p.Send:
+		t.Errorf("message should be dropped after shutdown, got %s", raw)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHubJoinRateLimit(t *testing.T) {
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{MaxJoinsPerSec: 2})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby"})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	<-p2.Send
+
+	var limited int
+	for i := 0; i < 5; i++ {
+		payload := joinPayload
+		if i > 0 {
+			payload, _ = json.Marshal(protocol.JoinPayload{Namespace: fmt.Sprintf("churn-%d", i)})
+		}
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: payload}))
+		decoded, _ := protocol.Decode(<-p1.Send)
+		if decoded.Type == protocol.TypeError {
+			var ep protocol.ErrorPayload
+			json.Unmarshal(decoded.Payload, &ep)
+			if ep.Code != 429 || ep.RetryAfterMs <= 0 {
+				t.Errorf("expected 429 with retry hint, got %d %dms", ep.Code, ep.RetryAfterMs)
+			}
+			limited++
+		}
+	}
+	if limited != 3 {
+		t.Errorf("expected 3 of 5 joins limited, got %d", limited)
+	}
+
+	roomPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "nope"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeJoinRoom, Payload: roomPayload}))
+	decoded, _ := protocol.Decode(<-p1.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 429 {
+		t.Errorf("join_room should share the join limit, got %d", ep.Code)
+	}
+
+	// signaling is not charged to the join limit
+	<-p2.Send // peer_joined for fp1
+	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer", SDP: "sdp"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp2", Payload: signalPayload}))
+	select {
+	case raw := <-p2.Send:
+		decoded, _ := protocol.Decode(raw)
+		if decoded.Type != protocol.TypeSignal {
+			t.Errorf("expected signal, got %s", decoded.Type)
+		}
+	case <-time.After(time.Second):
+		t.Error("signal should not be join rate limited")
+	}
+}
+
+func TestHubUpdateNamespaceInfo(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	watcher, wc := makePeer(t, "watcher")
+	defer wc()
+	h.Register(p1)
+	h.Register(p2)
+	h.Register(watcher)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby", AppType: "game", Version: "1.0"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	<-p1.Send
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	<-p2.Send
+	<-p1.Send // peer_joined
+	watchPayload, _ := json.Marshal(protocol.WatchPayload{Namespace: "lobby"})
+	h.HandleMessage(watcher, mustEncode(&protocol.Message{Type: protocol.TypeWatch, Payload: watchPayload}))
+	<-watcher.Send
+	p1.UpdateMeta(map[string]interface{}{"name": "fox", "rank": "bronze"})
+
+	version := "1.1"
+	updatePayload, _ := json.Marshal(protocol.UpdateNamespaceInfoPayload{Namespace: "lobby", Version: &version, Meta: map[string]interface{}{"rank": "gold"}})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeUpdateInfo, Payload: updatePayload}))
+
+	for _, p := range []*peer.Peer{p2, watcher} {
+		decoded, _ := protocol.Decode(<-p.Send)
+		var info protocol.PeerInfo
+		json.Unmarshal(decoded.Payload, &info)
+		if decoded.Type != protocol.TypePeerUpdated || decoded.Namespace != "lobby" || info.Fingerprint != "fp1" || info.Version != "1.1" || info.AppType != "game" {
+			t.Errorf("%s: unexpected peer_updated %s %s", p.Fingerprint, decoded.Type, decoded.Payload)
+		}
+		if info.Meta["name"] != "fox" || info.Meta["rank"] != "gold" {
+			t.Errorf("%s: expected namespace meta over global meta, got %v", p.Fingerprint, info.Meta)
+		}
+	}
+	select {
+	case raw := <-p1.Send:
+		t.Errorf("updater should not be notified, got %s", raw)
+	default:
+	}
+	select {
+	case raw := <-watcher.Send:
+		t.Errorf("watcher should get no count for an update, got %s", raw)
+	default:
+	}
+
+	discoverPayload, _ := json.Marshal(protocol.DiscoverPayload{Namespace: "lobby"})
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeDiscover, Payload: discoverPayload}))
+	decoded, _ := protocol.Decode(<-p2.Send)
+	var list protocol.PeerListPayload
+	json.Unmarshal(decoded.Payload, &list)
+	for _, pi := range list.Peers {
+		if want := map[string]string{"fp1": "1.1", "fp2": "1.0"}[pi.Fingerprint]; pi.Version != want {
+			t.Errorf("expected %s at version %s in discover, got %s", pi.Fingerprint, want, pi.Version)
+		}
+	}
+
+	updatePayload, _ = json.Marshal(protocol.UpdateNamespaceInfoPayload{Namespace: "elsewhere", Version: &version})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeUpdateInfo, Payload: updatePayload}))
+	decoded, _ = protocol.Decode(<-p1.Send)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(decoded.Payload, &ep)
+	if ep.Code != 403 {
+		t.Errorf("expected 403 updating a namespace not joined, got %d", ep.Code)
+	}
+}
+
+func TestHubForwardStampsSender(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby"})
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}))
+	for len(p2.Send) > 0 {
+		<-p2.Send
+	}
+
+	relayPayload := []byte(`{"data": "hello"}`)
+	for _, typ := range []string{protocol.TypeRelay, protocol.TypeSignal} {
+		// a client-supplied from must not survive forwarding
+		h.HandleMessage(p1, mustEncode(&protocol.Message{Type: typ, From: "spoofed", To: "fp2-alias", Payload: relayPayload}))
+		decoded, _ := protocol.Decode(<-p2.Send)
+		if decoded.Type != typ || decoded.From != "fp1" || decoded.To != "fp2" || decoded.Timestamp == 0 {
+			t.Errorf("unexpected forwarded %s: from=%q to=%q ts=%d", typ, decoded.From, decoded.To, decoded.Timestamp)
+		}
+		if string(decoded.Payload) != string(relayPayload) {
+			t.Errorf("payload changed in forwarding: %s", decoded.Payload)
+		}
+	}
+}
+
+func BenchmarkHubForwardRelay(b *testing.B) {
+	p, c := makePeer(b, "fp2")
+	defer c()
+	p.Send = make(chan []byte, 1)
+	msg := &protocol.Message{
+		Type:      protocol.TypeRelay,
+		From:      generateTestFingerprint(1),
+		To:        "fp2",
+		Payload:   []byte(`{"data":"benchmark relay payload data here"}`),
+		Timestamp: time.Now().UnixMilli(),
+		RequestID: "req-1",
+	}
+
+	// how relays were sent before they had a fast encoding
+	b.Run("reflect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, _ := json.Marshal(msg)
+			p.SendRaw(data)
+			<-p.Send
+		}
+	})
+	b.Run("forward", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			forward(p, msg)
+			<-p.Send
+		}
+	})
+}
+
+func TestHubAuditSignalExchange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{AuditSink: sink, AuditHashPayloads: true})
+	defer h.Shutdown()
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	h.Register(p1)
+	h.Register(p2)
+
+	join := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"lobby"}`)})
+	h.HandleMessage(p1, join)
+	h.HandleMessage(p2, join)
+	offer := []byte(`{"signal_type":"offer","sdp":"secret-sdp"}`)
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignal, Namespace: "lobby", To: "fp2", Payload: offer}))
+	h.HandleMessage(p2, mustEncode(&protocol.Message{Type: protocol.TypeSignal, Namespace: "lobby", To: "fp1", Payload: []byte(`{"signal_type":"answer"}`)}))
+	// not audited, p3 shares no namespace with fp1
+	p3, c3 := makePeer(t, "fp3")
+	defer c3()
+	h.Register(p3)
+	h.HandleMessage(p3, mustEncode(&protocol.Message{Type: protocol.TypeSignal, To: "fp1", Payload: offer}))
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close audit log: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret-sdp")) {
+		t.Error("audit log should not contain payloads")
+	}
+	var records []audit.Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r audit.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("bad audit line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	want := []audit.Record{
+		{Event: audit.EventJoin, Namespace: "lobby", From: "fp1"},
+		{Event: audit.EventJoin, Namespace: "lobby", From: "fp2"},
+		{Event: audit.EventSignal, Namespace: "lobby", From: "fp1", To: "fp2"},
+		{Event: audit.EventSignal, Namespace: "lobby", From: "fp2", To: "fp1"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, got %+v", len(want), records)
+	}
+	sum := sha256.Sum256(offer)
+	for i, r := range records {
+		w := want[i]
+		if r.Event != w.Event || r.Namespace != w.Namespace || r.From != w.From || r.To != w.To || r.Time.IsZero() {
+			t.Errorf("record %d: expected %+v, got %+v", i, w, r)
+		}
+	}
+	if got := records[2].PayloadSHA256; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected offer hash, got %q", got)
+	}
+	if records[0].PayloadSHA256 != "" {
+		t.Error("joins carry no payload hash")
+	}
+}
+
+func TestHubAuditSignalAll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.NewFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	h := NewWithOptions(64, 100, broker.NewLocal(), Options{AuditSink: sink})
+	defer h.Shutdown()
+
+	for _, fp := range []string{"fp1", "fp2", "fp3"} {
+		_, c := joinPeer(t, h, fp, "mesh")
+		defer c()
+	}
+	// observers get no signal_all, so no record either
+	_, c := joinPeer(t, h, "obs", "mesh", func(p *peer.Peer) { p.Observer = true })
+	defer c()
+	p1, _ := h.GetPeer("fp1")
+	h.HandleMessage(p1, mustEncode(&protocol.Message{Type: protocol.TypeSignalAll, Namespace: "mesh", Payload: []byte(`{"signal_type":"offer"}`)}))
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close audit log: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	signalled := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r audit.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("bad audit line %q: %v", line, err)
+		}
+		if r.Event == audit.EventSignal {
+			if r.From != "fp1" || r.Namespace != "mesh" {
+				t.Errorf("unexpected signal record %+v", r)
+			}
+			signalled[r.To] = true
+		}
+	}
+	if len(signalled) != 2 || !signalled["fp2"] || !signalled["fp3"] {
+		t.Errorf("expected a signal record for fp2 and fp3 only, got %v", signalled)
+	}
+}
+
+func TestHubJoinRacesUnregister(t *testing.T) {
+	h := newTestHub()
+	defer h.Shutdown()
+
+	join := mustEncode(&protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"race"}`)})
+	for i := 0; i < 50; i++ {
+		fp := fmt.Sprintf("race-%d", i)
+		p, c := makePeer(t, fp)
+		h.Register(p)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.HandleMessage(p, join)
+		}()
+		go func() {
+			defer wg.Done()
+			h.UnregisterPeer(p)
+		}()
+		wg.Wait()
+		c()
+
+		if ns, ok := h.nsMgr.Get("race"); ok && ns.Has(fp) {
+			t.Fatalf("iteration %d: unregistered peer left in the namespace", i)
+		}
+	}
+}
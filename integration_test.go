@@ -33,6 +33,32 @@ func TestBrokerCreation(t *testing.T) {
 	}
 }
 
+func TestCreateBrokerRedisFallback(t *testing.T) {
+	cfg := config.Default()
+	cfg.BrokerType = "redis"
+	cfg.RedisAddr = "localhost:59999"
+	cfg.BrokerFallbackLocal = true
+
+	b, err := createBroker(cfg, "")
+	if err != nil {
+		t.Fatalf("expected fallback instead of error: %v", err)
+	}
+	defer b.Close()
+	if _, ok := b.(*broker.LocalBroker); !ok {
+		t.Errorf("expected local broker fallback, got %T", b)
+	}
+}
+
+func TestCreateBrokerRedisNoFallback(t *testing.T) {
+	cfg := config.Default()
+	cfg.BrokerType = "redis"
+	cfg.RedisAddr = "localhost:59999"
+
+	if _, err := createBroker(cfg, ""); err == nil {
+		t.Error("expected error for bad redis address without fallback")
+	}
+}
+
 func TestHubCreation(t *testing.T) {
 	b := broker.NewLocal()
 	h := hub.New(64, 1000, b)
@@ -2,12 +2,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"peerserver/audit"
 	"peerserver/broker"
 	"peerserver/config"
 	"peerserver/hub"
@@ -22,7 +24,12 @@ func main() {
 	if *configPath != "" {
 		var err error
 		cfg, err = config.LoadFromFile(*configPath)
-		if err != nil {
+		switch {
+		case errors.Is(err, config.ErrInvalidConfig):
+			// the rest of the file, tokens and TLS included, must not be
+			// swapped for defaults over one bad setting
+			log.Fatalf("config file %s: %v", *configPath, err)
+		case err != nil:
 			log.Printf("config file error: %v, using defaults", err)
 			cfg = config.LoadFromEnv()
 		}
@@ -30,16 +37,24 @@ func main() {
 		cfg = config.LoadFromEnv()
 	}
 
-	h := hub.New(cfg.ShardCount, cfg.MaxPeers, createBroker(cfg, ""))
-	// re-create broker with nodeID for redis
-	if cfg.BrokerType == "redis" {
-		h.Shutdown()
-		b, err := broker.NewRedis(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, h.NodeID())
+	opts := hubOptions(cfg)
+	if cfg.AuditLogPath != "" {
+		sink, err := audit.NewFile(cfg.AuditLogPath, cfg.AuditLogMaxBytes, 0)
 		if err != nil {
-			log.Fatalf("redis connection failed: %v", err)
+			log.Fatalf("audit log: %v", err)
 		}
-		h = hub.New(cfg.ShardCount, cfg.MaxPeers, b)
+		defer sink.Close()
+		opts.AuditSink = sink
+	}
+
+	// the redis broker is made with the hub's node ID, so settle it first
+	// rather than building a throwaway hub to get one
+	opts.NodeID = hub.ResolveNodeID(opts.NodeID)
+	b, err := createBroker(cfg, opts.NodeID)
+	if err != nil {
+		log.Fatalf("redis connection failed: %v", err)
 	}
+	h := hub.NewWithOptions(cfg.ShardCount, cfg.MaxPeers, b, opts)
 
 	srv := server.New(cfg, h)
 
@@ -61,17 +76,69 @@ func main() {
 	log.Println("server stopped")
 }
 
-func createBroker(cfg *config.Config, nodeID string) broker.Broker {
+func hubOptions(cfg *config.Config) hub.Options {
+	return hub.Options{
+		MaxRoomIdleTTL:            cfg.MaxRoomIdleTTL.Duration,
+		MaxMatchGroupSize:         cfg.MaxMatchGroupSize,
+		MaxMatchRequestsPerPeer:   cfg.MaxMatchRequestsPerPeer,
+		DropOldestMatchRequest:    cfg.DropOldestMatchRequest,
+		MaxSignalAllMembers:       cfg.MaxSignalAllMembers,
+		SnapshotPath:              cfg.SnapshotPath,
+		DisableAliases:            cfg.DisableAliases,
+		AliasScope:                cfg.AliasScope,
+		HandlerWorkers:            cfg.HandlerWorkers,
+		MaxBroadcastSize:          cfg.MaxBroadcastSize,
+		MatchAutoRoom:             cfg.MatchAutoRoom,
+		MatchRoomLifetime:         cfg.MatchRoomLifetime.Duration,
+		SharedMatchmaking:         cfg.SharedMatchmaking,
+		AllowCrossNamespaceSignal: cfg.AllowCrossNamespaceSignal,
+		TrustBrokerNamespaces:     cfg.TrustBrokerNamespaces,
+		MaxNamespaces:             cfg.MaxNamespaces,
+		Welcome:                   cfg.WelcomeMessages,
+		MaxJoinsPerSec:            cfg.MaxJoinsPerSec,
+		MaxSDPBytes:               cfg.MaxSDPBytes,
+		MaxCandidateBytes:         cfg.MaxCandidateBytes,
+		MaxBroadcastRecipients:    cfg.MaxBroadcastRecipients,
+		AsyncBroadcastThreshold:   cfg.AsyncBroadcastThreshold,
+		MaxConcurrentBroadcasts:   cfg.MaxConcurrentBroadcasts,
+		MaxPendingJoins:           cfg.MaxPendingJoins,
+		MaxPendingJoinsPerPeer:    cfg.MaxPendingJoinsPerPeer,
+		MaxRoomsJoinedPerPeer:     cfg.MaxRoomsJoinedPerPeer,
+		ReliableAckTimeout:        cfg.ReliableAckTimeout.Duration,
+		ReliableRetries:           cfg.ReliableRetries,
+		MaxReliableInFlight:       cfg.MaxReliableInFlight,
+		HandlerBurst:              cfg.HandlerBurst,
+		NodeID:                    cfg.NodeID,
+		DisconnectGrace:           cfg.DisconnectGrace.Duration,
+		SlowHandlerThreshold:      cfg.SlowHandlerThreshold.Duration,
+		AuditHashPayloads:         cfg.AuditHashPayloads,
+		BroadcastCoalesce:         cfg.BroadcastCoalesceWindows(),
+		MaxPeerListBytes:          int(cfg.MaxMessageSize),
+	}
+}
+
+func createBroker(cfg *config.Config, nodeID string) (broker.Broker, error) {
 	switch cfg.BrokerType {
 	case "redis":
 		b, err := broker.NewRedis(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, nodeID)
 		if err != nil {
-			log.Fatalf("redis connection failed: %v", err)
+			if !cfg.BrokerFallbackLocal {
+				return nil, err
+			}
+			// single-node mode until restart, no cross-node delivery
+			log.Printf("WARNING: redis connection failed: %v, falling back to local broker", err)
+			return broker.NewLocal(), nil
 		}
 		log.Println("using redis broker")
-		return b
+		return b, nil
+	case "local_async":
+		log.Println("using async local broker")
+		return broker.NewAsyncLocal(0), nil
+	case "none":
+		log.Println("broker disabled, single node only")
+		return broker.NewNoop(), nil
 	default:
 		log.Println("using local broker")
-		return broker.NewLocal()
+		return broker.NewLocal(), nil
 	}
 }
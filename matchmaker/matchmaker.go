@@ -1,22 +1,37 @@
 package matchmaker
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"peerserver/broker"
 	"peerserver/namespace"
 	"peerserver/peer"
 	"peerserver/protocol"
+
+	jsoniter "github.com/json-iterator/go"
 )
 
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
 type WaitingPeer struct {
-	Peer      *peer.Peer
-	Criteria  map[string]interface{}
-	GroupSize int
+	Peer        *peer.Peer
+	Criteria    map[string]interface{}
+	GroupSize   int
+	Correlation string
+	Enqueued    time.Time
+}
+
+func (wp *WaitingPeer) info(ns string) protocol.PeerInfo {
+	info := wp.Peer.InfoForNamespace(ns)
+	info.Correlation = wp.Correlation
+	return info
 }
 
 type Queue struct {
@@ -26,16 +41,264 @@ type Queue struct {
 	mu        sync.Mutex
 }
 
+// DefaultSessionTTL is how long a formed match stays retrievable by session
+// id.
+const DefaultSessionTTL = 2 * time.Minute
+
+// SharedTicketTTL is how long a request waits in a shared queue before other
+// nodes stop matching it; re-sending the match request renews it. It also
+// clears requests left behind by a node that died.
+const SharedTicketTTL = 5 * time.Minute
+
+// sharedOpTimeout bounds each call to the shared queue.
+const sharedOpTimeout = 2 * time.Second
+
+// ticket is the entry a node puts in a shared queue for a waiting peer.
+type ticket struct {
+	NodeID string            `json:"node_id"`
+	Peer   protocol.PeerInfo `json:"peer"`
+}
+
+// sharedTicket is this node's record of a peer waiting in a shared queue.
+type sharedTicket struct {
+	peer  *peer.Peer
+	ns    string
+	queue string
+	entry []byte
+}
+
+type session struct {
+	result  *protocol.MatchedPayload
+	expires time.Time
+}
+
+// IDFunc makes the session id of each formed match.
+type IDFunc func() string
+
 type Matchmaker struct {
-	queues map[string]*Queue
-	mu     sync.RWMutex
-	nsMgr  *namespace.Manager
+	queues    map[string]*Queue
+	mu        sync.RWMutex
+	nsMgr     *namespace.Manager
+	done      chan struct{}
+	closeOnce sync.Once
+	newID     IDFunc
+
+	// namespaces each fingerprint is waiting in, oldest first. Lock order
+	// is q.mu before activeMu.
+	active   map[string][]string
+	activeMu sync.Mutex
+
+	sessions   map[string]*session
+	sessionTTL time.Duration
+	sessionMu  sync.Mutex
+
+	// set by SetShared; tickets holds this node's waiting peers by
+	// fingerprint and namespace. Never held across a shared queue call.
+	shared   broker.MatchQueue
+	nodeID   string
+	tickets  map[string]map[string]sharedTicket
+	ticketMu sync.Mutex
 }
 
 func New(nsMgr *namespace.Manager) *Matchmaker {
-	return &Matchmaker{
-		queues: make(map[string]*Queue),
-		nsMgr:  nsMgr,
+	m := &Matchmaker{
+		queues:     make(map[string]*Queue),
+		nsMgr:      nsMgr,
+		done:       make(chan struct{}),
+		newID:      generateSessionID,
+		active:     make(map[string][]string),
+		sessions:   make(map[string]*session),
+		sessionTTL: DefaultSessionTTL,
+		tickets:    make(map[string]map[string]sharedTicket),
+	}
+	go m.sessionJanitor()
+	return m
+}
+
+// SetSessionTTL sets how long formed matches can be looked up, 0 stops
+// keeping them.
+func (m *Matchmaker) SetSessionTTL(ttl time.Duration) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	m.sessionTTL = ttl
+}
+
+// SetIDFunc replaces the random session ids with f, e.g. a fixed sequence
+// in tests. Call it before any match is requested.
+func (m *Matchmaker) SetIDFunc(f IDFunc) {
+	m.newID = f
+}
+
+// SetShared makes RequestMatch wait in queues shared with other nodes through
+// q, so peers on different nodes match. Matches formed elsewhere are handed
+// over with AdoptMatch. If q fails, requests fall back to the local queue.
+func (m *Matchmaker) SetShared(q broker.MatchQueue, nodeID string) {
+	m.shared = q
+	m.nodeID = nodeID
+}
+
+func (m *Matchmaker) storeSession(result *protocol.MatchedPayload) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if m.sessionTTL <= 0 {
+		return
+	}
+	// keep a copy so the caller may go on using its result
+	stored := *result
+	m.sessions[result.SessionID] = &session{result: &stored, expires: time.Now().Add(m.sessionTTL)}
+}
+
+// SetSessionRoom records the room created for a formed match so lookups
+// return it too.
+func (m *Matchmaker) SetSessionRoom(sessionID, roomID string) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if s, ok := m.sessions[sessionID]; ok {
+		stored := *s.result
+		stored.RoomID = roomID
+		s.result = &stored
+	}
+}
+
+// LookupSession returns the match for sessionID if it hasn't expired.
+// participant reports whether fingerprint was one of the matched peers; the
+// result is only returned to participants.
+func (m *Matchmaker) LookupSession(sessionID, fingerprint string) (result *protocol.MatchedPayload, found, participant bool) {
+	m.sessionMu.Lock()
+	s, ok := m.sessions[sessionID]
+	m.sessionMu.Unlock()
+	if !ok || time.Now().After(s.expires) {
+		return nil, false, false
+	}
+	for _, pi := range s.result.Peers {
+		if pi.Fingerprint == fingerprint {
+			return s.result, true, true
+		}
+	}
+	return nil, true, false
+}
+
+func (m *Matchmaker) sessionJanitor() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			m.sessionMu.Lock()
+			for id, s := range m.sessions {
+				if now.After(s.expires) {
+					delete(m.sessions, id)
+				}
+			}
+			m.sessionMu.Unlock()
+		}
+	}
+}
+
+// ActiveRequests returns the namespaces the peer is currently waiting for a
+// match in, oldest request first.
+func (m *Matchmaker) ActiveRequests(fingerprint string) []string {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	return append([]string(nil), m.active[fingerprint]...)
+}
+
+func (m *Matchmaker) trackActive(fingerprint, ns string) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	list := m.active[fingerprint]
+	for i, n := range list {
+		if n == ns {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	m.active[fingerprint] = append(list, ns)
+}
+
+func (m *Matchmaker) untrackActive(fingerprint, ns string) {
+	m.activeMu.Lock()
+	defer m.activeMu.Unlock()
+	list := m.active[fingerprint]
+	for i, n := range list {
+		if n == ns {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(m.active, fingerprint)
+	} else {
+		m.active[fingerprint] = list
+	}
+}
+
+// Close stops background goroutines and drops all pending match requests.
+// Safe to call more than once.
+func (m *Matchmaker) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+
+		m.mu.Lock()
+		for _, q := range m.queues {
+			q.mu.Lock()
+			q.waiting = nil
+			q.index = make(map[string][]*WaitingPeer)
+			q.mu.Unlock()
+		}
+		m.queues = make(map[string]*Queue)
+		m.mu.Unlock()
+
+		m.activeMu.Lock()
+		m.active = make(map[string][]string)
+		m.activeMu.Unlock()
+
+		m.ticketMu.Lock()
+		m.tickets = make(map[string]map[string]sharedTicket)
+		m.ticketMu.Unlock()
+
+		m.sessionMu.Lock()
+		m.sessions = make(map[string]*session)
+		m.sessionMu.Unlock()
+	})
+}
+
+// Drain removes every waiting peer from every queue and calls notify for
+// each request once the queues are unlocked.
+func (m *Matchmaker) Drain(notify func(p *peer.Peer, ns string)) {
+	type request struct {
+		peer *peer.Peer
+		ns   string
+	}
+	var drained []request
+
+	m.mu.RLock()
+	for ns, q := range m.queues {
+		q.mu.Lock()
+		for _, wp := range q.waiting {
+			drained = append(drained, request{wp.Peer, ns})
+		}
+		q.waiting = nil
+		q.index = make(map[string][]*WaitingPeer)
+		q.mu.Unlock()
+	}
+	m.mu.RUnlock()
+
+	if m.shared != nil {
+		for _, t := range m.takeTickets("") {
+			m.removeShared(t)
+			drained = append(drained, request{t.peer, t.ns})
+		}
+	}
+
+	m.activeMu.Lock()
+	m.active = make(map[string][]string)
+	m.activeMu.Unlock()
+
+	for _, r := range drained {
+		notify(r.peer, r.ns)
 	}
 }
 
@@ -76,9 +339,20 @@ func criteriaKey(groupSize int, criteria map[string]interface{}) string {
 }
 
 func (m *Matchmaker) RequestMatch(p *peer.Peer, ns string, criteria map[string]interface{}, groupSize int) *protocol.MatchedPayload {
+	return m.RequestCorrelatedMatch(p, ns, criteria, groupSize, "")
+}
+
+// RequestCorrelatedMatch is RequestMatch with a client token that is
+// returned as the peer's Correlation in the matched payload.
+func (m *Matchmaker) RequestCorrelatedMatch(p *peer.Peer, ns string, criteria map[string]interface{}, groupSize int, correlation string) *protocol.MatchedPayload {
 	if groupSize < 2 {
 		groupSize = 2
 	}
+	if m.shared != nil {
+		if result, ok := m.requestShared(p, ns, criteria, groupSize, correlation); ok {
+			return result
+		}
+	}
 
 	q := m.getQueue(ns)
 	q.mu.Lock()
@@ -114,31 +388,154 @@ func (m *Matchmaker) RequestMatch(p *peer.Peer, ns string, criteria map[string]i
 			}
 		}
 		q.waiting = filtered
+		for _, wp := range matched {
+			m.untrackActive(wp.Peer.Fingerprint, ns)
+		}
+		m.untrackActive(p.Fingerprint, ns)
 
-		sessionID := generateSessionID()
+		sessionID := m.newID()
 		peers := make([]protocol.PeerInfo, 0, groupSize)
 		for _, wp := range matched {
-			peers = append(peers, wp.Peer.InfoForNamespace(ns))
+			peers = append(peers, wp.info(ns))
 		}
-		peers = append(peers, p.InfoForNamespace(ns))
+		info := p.InfoForNamespace(ns)
+		info.Correlation = correlation
+		peers = append(peers, info)
 
-		return &protocol.MatchedPayload{
+		result := &protocol.MatchedPayload{
 			Namespace: ns,
 			Peers:     peers,
 			SessionID: sessionID,
 		}
+		m.storeSession(result)
+		return result
 	}
 
 	wp := &WaitingPeer{
-		Peer:      p,
-		Criteria:  criteria,
-		GroupSize: groupSize,
+		Peer:        p,
+		Criteria:    criteria,
+		GroupSize:   groupSize,
+		Correlation: correlation,
+		Enqueued:    time.Now(),
 	}
 	q.waiting = append(q.waiting, wp)
 	q.index[key] = append(q.index[key], wp)
+	m.trackActive(p.Fingerprint, ns)
 	return nil
 }
 
+// requestShared is RequestMatch through the shared queue. ok is false if the
+// queue could not be reached.
+func (m *Matchmaker) requestShared(p *peer.Peer, ns string, criteria map[string]interface{}, groupSize int, correlation string) (result *protocol.MatchedPayload, ok bool) {
+	m.dropTicket(p.Fingerprint, ns)
+
+	info := p.InfoForNamespace(ns)
+	info.Correlation = correlation
+	entry, err := json.Marshal(ticket{NodeID: m.nodeID, Peer: info})
+	if err != nil {
+		return nil, false
+	}
+	queue := ns + "|" + criteriaKey(groupSize, criteria)
+	ctx, cancel := context.WithTimeout(context.Background(), sharedOpTimeout)
+	defer cancel()
+	taken, err := m.shared.MatchOrEnqueue(ctx, queue, entry, groupSize-1, SharedTicketTTL)
+	if err != nil {
+		return nil, false
+	}
+
+	if len(taken) == 0 {
+		m.ticketMu.Lock()
+		if m.tickets[p.Fingerprint] == nil {
+			m.tickets[p.Fingerprint] = make(map[string]sharedTicket)
+		}
+		m.tickets[p.Fingerprint][ns] = sharedTicket{peer: p, ns: ns, queue: queue, entry: entry}
+		m.ticketMu.Unlock()
+		m.trackActive(p.Fingerprint, ns)
+		return nil, true
+	}
+
+	peers := make([]protocol.PeerInfo, 0, groupSize)
+	for _, e := range taken {
+		var t ticket
+		if json.Unmarshal(e, &t) == nil {
+			peers = append(peers, t.Peer)
+		}
+	}
+	peers = append(peers, info)
+	result = &protocol.MatchedPayload{
+		Namespace: ns,
+		Peers:     peers,
+		SessionID: m.newID(),
+	}
+	m.AdoptMatch(result)
+	return result, true
+}
+
+// AdoptMatch records a match formed from the shared queues: this node's
+// peers in it stop waiting, and the session can be looked up here too.
+func (m *Matchmaker) AdoptMatch(result *protocol.MatchedPayload) {
+	for _, pi := range result.Peers {
+		m.ticketMu.Lock()
+		_, ok := m.tickets[pi.Fingerprint][result.Namespace]
+		m.forgetTicketLocked(pi.Fingerprint, result.Namespace)
+		m.ticketMu.Unlock()
+		if ok {
+			m.untrackActive(pi.Fingerprint, result.Namespace)
+		}
+	}
+	m.storeSession(result)
+}
+
+// forgetTicketLocked drops the local record of a ticket. Must be called with
+// m.ticketMu held.
+func (m *Matchmaker) forgetTicketLocked(fingerprint, ns string) {
+	byNs := m.tickets[fingerprint]
+	delete(byNs, ns)
+	if len(byNs) == 0 {
+		delete(m.tickets, fingerprint)
+	}
+}
+
+// dropTicket takes the peer's request in ns out of the shared queue.
+func (m *Matchmaker) dropTicket(fingerprint, ns string) {
+	if m.shared == nil {
+		return
+	}
+	m.ticketMu.Lock()
+	t, ok := m.tickets[fingerprint][ns]
+	m.forgetTicketLocked(fingerprint, ns)
+	m.ticketMu.Unlock()
+	if !ok {
+		return
+	}
+	m.untrackActive(fingerprint, ns)
+	m.removeShared(t)
+}
+
+func (m *Matchmaker) removeShared(t sharedTicket) {
+	ctx, cancel := context.WithTimeout(context.Background(), sharedOpTimeout)
+	defer cancel()
+	m.shared.RemoveFromMatchQueue(ctx, t.queue, t.entry)
+}
+
+// takeTickets removes and returns the local records of tickets, all of them
+// when fingerprint is empty.
+func (m *Matchmaker) takeTickets(fingerprint string) []sharedTicket {
+	m.ticketMu.Lock()
+	defer m.ticketMu.Unlock()
+	var taken []sharedTicket
+	for fp, byNs := range m.tickets {
+		if fingerprint != "" && fp != fingerprint {
+			continue
+		}
+		for _, t := range byNs {
+			taken = append(taken, t)
+		}
+		delete(m.tickets, fp)
+	}
+	return taken
+}
+
 // removePeerLocked removes a peer from both the waiting list and the index.
 // Must be called with q.mu held.
 func (q *Queue) removePeerLocked(fingerprint string, key string) {
@@ -160,6 +557,8 @@ func (q *Queue) removePeerLocked(fingerprint string, key string) {
 }
 
 func (m *Matchmaker) RemoveFromQueue(fingerprint string, ns string) {
+	m.dropTicket(fingerprint, ns)
+
 	q := m.getQueue(ns)
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -174,12 +573,23 @@ func (m *Matchmaker) RemoveFromQueue(fingerprint string, ns string) {
 				}
 			}
 			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			m.untrackActive(fingerprint, ns)
 			return
 		}
 	}
 }
 
 func (m *Matchmaker) RemoveFromAllQueues(fingerprint string) {
+	m.activeMu.Lock()
+	delete(m.active, fingerprint)
+	m.activeMu.Unlock()
+
+	if m.shared != nil {
+		for _, t := range m.takeTickets(fingerprint) {
+			m.removeShared(t)
+		}
+	}
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, q := range m.queues {
@@ -202,6 +612,56 @@ func (m *Matchmaker) RemoveFromAllQueues(fingerprint string) {
 	}
 }
 
+// Bucket is one group of peers waiting for a match in a namespace: the same
+// group size and criteria, which is what must agree for them to match.
+type Bucket struct {
+	Namespace    string `json:"namespace"`
+	CriteriaKey  string `json:"criteria_key"`
+	Waiting      int    `json:"waiting"`
+	OldestWaitMs int64  `json:"oldest_wait_ms"`
+}
+
+// Inspect returns the non-empty local buckets, by namespace and then
+// criteria key, for debugging matches that don't form. Peers waiting in
+// shared queues are not included.
+func (m *Matchmaker) Inspect() []Bucket {
+	m.mu.RLock()
+	queues := make([]*Queue, 0, len(m.queues))
+	for _, q := range m.queues {
+		queues = append(queues, q)
+	}
+	m.mu.RUnlock()
+
+	now := time.Now()
+	var buckets []Bucket
+	for _, q := range queues {
+		q.mu.Lock()
+		for key, indexed := range q.index {
+			b := Bucket{Namespace: q.namespace, CriteriaKey: key}
+			for _, wp := range indexed {
+				if wp.Peer.IsClosed() {
+					continue
+				}
+				b.Waiting++
+				if wait := now.Sub(wp.Enqueued).Milliseconds(); wait > b.OldestWaitMs {
+					b.OldestWaitMs = wait
+				}
+			}
+			if b.Waiting > 0 {
+				buckets = append(buckets, b)
+			}
+		}
+		q.mu.Unlock()
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].Namespace != buckets[j].Namespace {
+			return buckets[i].Namespace < buckets[j].Namespace
+		}
+		return buckets[i].CriteriaKey < buckets[j].CriteriaKey
+	})
+	return buckets
+}
+
 func (m *Matchmaker) QueueSize(ns string) int {
 	m.mu.RLock()
 	q, ok := m.queues[ns]
@@ -7,7 +7,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"peerserver/broker"
 	"peerserver/namespace"
 	"peerserver/peer"
 
@@ -223,6 +225,286 @@ func TestRemoveFromAllQueues(t *testing.T) {
 	}
 }
 
+func TestActiveRequests(t *testing.T) {
+	nsMgr := namespace.NewManager(1000)
+	m := New(nsMgr)
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+
+	m.RequestMatch(p1, "game1", nil, 2)
+	m.RequestMatch(p1, "game2", nil, 2)
+	m.RequestMatch(p1, "game3", nil, 2)
+
+	active := m.ActiveRequests("peer1")
+	if len(active) != 3 || active[0] != "game1" || active[2] != "game3" {
+		t.Fatalf("expected [game1 game2 game3], got %v", active)
+	}
+
+	// matched requests are no longer active for either side
+	if result := m.RequestMatch(p2, "game2", nil, 2); result == nil {
+		t.Fatal("expected match in game2")
+	}
+	if got := m.ActiveRequests("peer2"); len(got) != 0 {
+		t.Errorf("expected no active requests for peer2, got %v", got)
+	}
+
+	m.RemoveFromQueue("peer1", "game1")
+	active = m.ActiveRequests("peer1")
+	if len(active) != 1 || active[0] != "game3" {
+		t.Errorf("expected [game3], got %v", active)
+	}
+
+	m.RemoveFromAllQueues("peer1")
+	if got := m.ActiveRequests("peer1"); len(got) != 0 {
+		t.Errorf("expected no active requests after RemoveFromAllQueues, got %v", got)
+	}
+}
+
+func TestMatchmakerDrain(t *testing.T) {
+	nsMgr := namespace.NewManager(1000)
+	m := New(nsMgr)
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+
+	m.RequestMatch(p1, "game1", nil, 2)
+	m.RequestMatch(p1, "game2", nil, 3)
+	m.RequestMatch(p2, "game2", nil, 2)
+
+	notified := make(map[string]int)
+	m.Drain(func(p *peer.Peer, ns string) {
+		notified[p.Fingerprint+"/"+ns]++
+	})
+
+	if len(notified) != 3 || notified["peer1/game1"] != 1 || notified["peer1/game2"] != 1 || notified["peer2/game2"] != 1 {
+		t.Errorf("expected one notification per request, got %v", notified)
+	}
+	if m.QueueSize("game1") != 0 || m.QueueSize("game2") != 0 {
+		t.Error("expected queues to be empty after drain")
+	}
+	if got := m.ActiveRequests("peer1"); len(got) != 0 {
+		t.Errorf("expected no active requests after drain, got %v", got)
+	}
+}
+
+func TestMatchmakerSharedQueue(t *testing.T) {
+	q := broker.NewLocal()
+	defer q.Close()
+	mA := New(namespace.NewManager(1000))
+	mA.SetShared(q, "node-a")
+	mB := New(namespace.NewManager(1000))
+	mB.SetShared(q, "node-b")
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+	p3, c3 := makePeer(t, "peer3")
+	defer c3()
+
+	if result := mA.RequestMatch(p1, "game", nil, 2); result != nil {
+		t.Fatal("expected peer1 to wait")
+	}
+	// cancelling takes the request out of the shared queue too
+	mA.RemoveFromQueue("peer1", "game")
+	if result := mB.RequestMatch(p2, "game", nil, 2); result != nil {
+		t.Fatal("expected peer2 to wait after peer1 cancelled")
+	}
+
+	result := mA.RequestMatch(p3, "game", nil, 2)
+	if result == nil || len(result.Peers) != 2 {
+		t.Fatalf("expected peer3 to match peer2 across nodes, got %+v", result)
+	}
+	if result.Peers[0].Fingerprint != "peer2" || result.Peers[1].Fingerprint != "peer3" {
+		t.Errorf("expected [peer2 peer3], got %+v", result.Peers)
+	}
+	if got := mB.ActiveRequests("peer2"); len(got) != 1 {
+		t.Fatalf("expected peer2 still waiting on node B before it adopts, got %v", got)
+	}
+	mB.AdoptMatch(result)
+	if got := mB.ActiveRequests("peer2"); len(got) != 0 {
+		t.Errorf("expected peer2 no longer waiting after adopt, got %v", got)
+	}
+
+	// draining cancels shared requests and removes them from the queue
+	mA.RequestMatch(p1, "game", nil, 2)
+	var drained []string
+	mA.Drain(func(p *peer.Peer, ns string) {
+		drained = append(drained, p.Fingerprint+"/"+ns)
+	})
+	if len(drained) != 1 || drained[0] != "peer1/game" {
+		t.Errorf("expected peer1/game drained, got %v", drained)
+	}
+	if result := mB.RequestMatch(p2, "game", nil, 2); result != nil {
+		t.Errorf("expected peer2 to wait after drain, got %+v", result)
+	}
+}
+
+func TestMatchmakerIDFunc(t *testing.T) {
+	m := New(namespace.NewManager(1000))
+	defer m.Close()
+	seq := 0
+	m.SetIDFunc(func() string {
+		seq++
+		return fmt.Sprintf("session-%d", seq)
+	})
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+
+	for _, want := range []string{"session-1", "session-2"} {
+		m.RequestMatch(p1, "game", nil, 2)
+		result := m.RequestMatch(p2, "game", nil, 2)
+		if result == nil || result.SessionID != want {
+			t.Fatalf("expected session %s, got %+v", want, result)
+		}
+	}
+	if result, found, _ := m.LookupSession("session-2", "peer1"); !found || result == nil {
+		t.Error("expected the fixed session id to be looked up")
+	}
+}
+
+func TestMatchmakerCorrelation(t *testing.T) {
+	m := New(namespace.NewManager(1000))
+	defer m.Close()
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+	p3, c3 := makePeer(t, "peer3")
+	defer c3()
+
+	m.RequestCorrelatedMatch(p1, "game", nil, 3, "party-1")
+	m.RequestMatch(p2, "game", nil, 3)
+	result := m.RequestCorrelatedMatch(p3, "game", nil, 3, "party-1")
+	if result == nil {
+		t.Fatal("expected a match")
+	}
+	want := map[string]string{"peer1": "party-1", "peer2": "", "peer3": "party-1"}
+	for _, pi := range result.Peers {
+		if pi.Correlation != want[pi.Fingerprint] {
+			t.Errorf("%s: expected correlation %q, got %q", pi.Fingerprint, want[pi.Fingerprint], pi.Correlation)
+		}
+	}
+}
+
+func TestMatchmakerInspect(t *testing.T) {
+	m := New(namespace.NewManager(1000))
+	defer m.Close()
+
+	if got := m.Inspect(); len(got) != 0 {
+		t.Fatalf("expected no buckets, got %+v", got)
+	}
+
+	var cleanups []func()
+	defer func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}()
+	request := func(fp, ns string, criteria map[string]interface{}, groupSize int) {
+		p, c := makePeer(t, fp)
+		cleanups = append(cleanups, c)
+		if result := m.RequestMatch(p, ns, criteria, groupSize); result != nil {
+			t.Fatalf("%s: unexpected match", fp)
+		}
+	}
+	request("peer1", "game", map[string]interface{}{"mode": "ranked"}, 3)
+	time.Sleep(20 * time.Millisecond)
+	request("peer2", "game", map[string]interface{}{"mode": "ranked"}, 3)
+	request("peer3", "game", map[string]interface{}{"mode": "casual"}, 3)
+	request("peer4", "chess", nil, 2)
+
+	got := m.Inspect()
+	want := []Bucket{
+		{Namespace: "chess", CriteriaKey: "2:", Waiting: 1},
+		{Namespace: "game", CriteriaKey: "3:mode=casual", Waiting: 1},
+		{Namespace: "game", CriteriaKey: "3:mode=ranked", Waiting: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d buckets, got %+v", len(want), got)
+	}
+	for i, b := range got {
+		if b.Namespace != want[i].Namespace || b.CriteriaKey != want[i].CriteriaKey || b.Waiting != want[i].Waiting {
+			t.Errorf("bucket %d: expected %+v, got %+v", i, want[i], b)
+		}
+	}
+	if got[2].OldestWaitMs < 20 {
+		t.Errorf("expected the ranked bucket's oldest wait to be peer1's, got %dms", got[2].OldestWaitMs)
+	}
+	if got[1].OldestWaitMs >= got[2].OldestWaitMs {
+		t.Errorf("expected casual to have waited less than ranked, got %d and %d", got[1].OldestWaitMs, got[2].OldestWaitMs)
+	}
+
+	m.RemoveFromQueue("peer4", "chess")
+	if got := m.Inspect(); len(got) != 2 {
+		t.Errorf("expected the emptied bucket dropped, got %+v", got)
+	}
+}
+
+func TestLookupSession(t *testing.T) {
+	nsMgr := namespace.NewManager(1000)
+	m := New(nsMgr)
+	defer m.Close()
+	m.SetSessionTTL(50 * time.Millisecond)
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+	p2, c2 := makePeer(t, "peer2")
+	defer c2()
+
+	m.RequestMatch(p1, "game", nil, 2)
+	result := m.RequestMatch(p2, "game", nil, 2)
+	if result == nil {
+		t.Fatal("expected match")
+	}
+
+	got, found, participant := m.LookupSession(result.SessionID, "peer1")
+	if !found || !participant || got.SessionID != result.SessionID || len(got.Peers) != 2 {
+		t.Errorf("expected participant lookup to succeed, got %v %v %+v", found, participant, got)
+	}
+
+	got, found, participant = m.LookupSession(result.SessionID, "stranger")
+	if !found || participant || got != nil {
+		t.Errorf("expected non-participant to be denied, got %v %v %+v", found, participant, got)
+	}
+
+	if _, found, _ := m.LookupSession("unknown", "peer1"); found {
+		t.Error("expected unknown session not to be found")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if _, found, _ := m.LookupSession(result.SessionID, "peer1"); found {
+		t.Error("expected session to expire after TTL")
+	}
+}
+
+func TestMatchmakerClose(t *testing.T) {
+	nsMgr := namespace.NewManager(1000)
+	m := New(nsMgr)
+
+	p1, c1 := makePeer(t, "peer1")
+	defer c1()
+
+	m.RequestMatch(p1, "game", nil, 2)
+	m.Close()
+
+	if m.QueueSize("game") != 0 {
+		t.Errorf("expected queue size 0 after close, got %d", m.QueueSize("game"))
+	}
+
+	// second close should not panic
+	m.Close()
+}
+
 func TestRemoveNonExistentFromQueue(t *testing.T) {
 	nsMgr := namespace.NewManager(1000)
 	m := New(nsMgr)
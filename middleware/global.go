@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// GlobalLimiter is a single token bucket shared by every client, kept as one
+// atomic theoretical arrival time (GCRA) so the hot path never locks.
+type GlobalLimiter struct {
+	tat      atomic.Int64 // unix nanos the bucket is full again
+	interval int64        // nanos per token
+	burst    int64        // nanos of tokens the bucket holds
+}
+
+// NewGlobalLimiter allows ratePerSec (> 0) messages a second across all
+// callers, bursting up to burst. A non-positive burst defaults to ratePerSec.
+func NewGlobalLimiter(ratePerSec, burst int) *GlobalLimiter {
+	if burst <= 0 {
+		burst = ratePerSec
+	}
+	interval := int64(time.Second) / int64(ratePerSec)
+	return &GlobalLimiter{
+		interval: interval,
+		burst:    interval * int64(burst),
+	}
+}
+
+// AllowWithRetry takes a token, or reports how long until one is free.
+func (gl *GlobalLimiter) AllowWithRetry() (bool, time.Duration) {
+	now := time.Now().UnixNano()
+	for {
+		tat := gl.tat.Load()
+		next := tat
+		if next < now {
+			next = now
+		}
+		next += gl.interval
+		if over := next - now - gl.burst; over > 0 {
+			return false, time.Duration(over)
+		}
+		if gl.tat.CompareAndSwap(tat, next) {
+			return true, 0
+		}
+	}
+}
+
+func (gl *GlobalLimiter) Allow() bool {
+	ok, _ := gl.AllowWithRetry()
+	return ok
+}
@@ -56,6 +56,20 @@ func (rl *RateLimiter) shardFor(id string) *rateShard {
 }
 
 func (rl *RateLimiter) Allow(id string) bool {
+	ok, _ := rl.AllowWithRetry(id)
+	return ok
+}
+
+// AllowWithRetry is Allow that, when the request is denied, also returns how
+// long until the bucket has a token again.
+func (rl *RateLimiter) AllowWithRetry(id string) (bool, time.Duration) {
+	return rl.AllowTier(id, rl.rate, rl.burst)
+}
+
+// AllowTier is AllowWithRetry for a client with its own rate and burst
+// instead of the limiter's. A bucket made under other limits is switched
+// to these, keeping the tokens it has up to the new burst.
+func (rl *RateLimiter) AllowTier(id string, ratePerSec, burst int) (bool, time.Duration) {
 	shard := rl.shardFor(id)
 
 	shard.mu.RLock()
@@ -67,9 +81,9 @@ func (rl *RateLimiter) Allow(id string) bool {
 		b, ok = shard.clients[id]
 		if !ok {
 			b = &bucket{
-				tokens:    float64(rl.burst),
-				maxTokens: float64(rl.burst),
-				rate:      float64(rl.rate),
+				tokens:    float64(burst),
+				maxTokens: float64(burst),
+				rate:      float64(ratePerSec),
 				lastTime:  time.Now(),
 			}
 			shard.clients[id] = b
@@ -80,6 +94,9 @@ func (rl *RateLimiter) Allow(id string) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	b.maxTokens = float64(burst)
+	b.rate = float64(ratePerSec)
+
 	now := time.Now()
 	elapsed := now.Sub(b.lastTime).Seconds()
 	b.tokens += elapsed * b.rate
@@ -89,10 +106,13 @@ func (rl *RateLimiter) Allow(id string) bool {
 	b.lastTime = now
 
 	if b.tokens < 1 {
-		return false
+		if b.rate <= 0 {
+			return false, time.Second
+		}
+		return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
 	}
 	b.tokens--
-	return true
+	return true, 0
 }
 
 func (rl *RateLimiter) Remove(id string) {
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,6 +43,60 @@ func TestRateLimiterRefill(t *testing.T) {
 	}
 }
 
+func TestRateLimiterAllowWithRetry(t *testing.T) {
+	rl := NewRateLimiter(10, 1, 4)
+	defer rl.Close()
+
+	if ok, retry := rl.AllowWithRetry("client1"); !ok || retry != 0 {
+		t.Errorf("first request should be allowed without retry hint, got %v %v", ok, retry)
+	}
+
+	// one token every 100ms, the bucket was just emptied
+	ok, retry := rl.AllowWithRetry("client1")
+	if ok {
+		t.Fatal("second request should be denied (burst=1)")
+	}
+	if retry <= 0 || retry > 100*time.Millisecond {
+		t.Errorf("expected retry hint in (0, 100ms], got %v", retry)
+	}
+
+	time.Sleep(retry + 5*time.Millisecond)
+	if ok, _ := rl.AllowWithRetry("client1"); !ok {
+		t.Error("request after the retry hint should be allowed")
+	}
+}
+
+func TestRateLimiterAllowTier(t *testing.T) {
+	rl := NewRateLimiter(1, 2, 4)
+	defer rl.Close()
+
+	count := func(id string, rate, burst int) int {
+		n := 0
+		for i := 0; i < 20; i++ {
+			if ok, _ := rl.AllowTier(id, rate, burst); ok {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count("free", 1, 3); n != 3 {
+		t.Errorf("expected the free tier's burst of 3, got %d", n)
+	}
+	if n := count("premium", 1, 10); n != 10 {
+		t.Errorf("expected the premium tier's burst of 10, got %d", n)
+	}
+	// plain Allow still gets the limiter's own burst
+	n := 0
+	for i := 0; i < 20; i++ {
+		if rl.Allow("default") {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected the default burst of 2, got %d", n)
+	}
+}
+
 func TestRateLimiterDifferentClients(t *testing.T) {
 	rl := NewRateLimiter(10, 5, 4)
 	defer rl.Close()
@@ -139,3 +194,47 @@ func BenchmarkRateLimiterAllow(b *testing.B) {
 		}
 	})
 }
+
+func TestGlobalLimiter(t *testing.T) {
+	gl := NewGlobalLimiter(10, 5)
+
+	for i := 0; i < 5; i++ {
+		if !gl.Allow() {
+			t.Errorf("request %d should be allowed within burst", i)
+		}
+	}
+	ok, retry := gl.AllowWithRetry()
+	if ok {
+		t.Fatal("request after burst should be denied")
+	}
+	if retry <= 0 || retry > 100*time.Millisecond {
+		t.Errorf("expected retry hint in (0, 100ms], got %v", retry)
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	if !gl.Allow() {
+		t.Error("request after refill should be allowed")
+	}
+}
+
+func TestGlobalLimiterConcurrent(t *testing.T) {
+	gl := NewGlobalLimiter(1, 100)
+
+	var wg sync.WaitGroup
+	var count atomic.Int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if gl.Allow() {
+					count.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := count.Load(); n != 100 {
+		t.Errorf("expected exactly the burst of 100 allowed, got %d", n)
+	}
+}
@@ -1,19 +1,35 @@
 package namespace
 
 import (
+	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"peerserver/peer"
 	"peerserver/protocol"
 )
 
 type Namespace struct {
-	Name    string
-	Owner   string
-	IsRoom  bool
-	peers   map[string]*peer.Peer
-	mu      sync.RWMutex
-	maxSize int
+	Name         string
+	Owner        string
+	IsRoom       bool
+	peers        map[string]*peer.Peer
+	watchers     map[string]*peer.Peer
+	aliases      map[string]string // alias to fingerprint, nil unless indexed
+	observers    int
+	mu           sync.RWMutex
+	maxSize      int
+	idleTTL      atomic.Int64
+	lastActivity atomic.Int64
+	approval     atomic.Bool
+	holdUntil    atomic.Int64
+	motd         atomic.Pointer[string]
+
+	// one-shot rooms: who may join, nil for anyone, and when the room
+	// closes regardless of use (unix ns, 0 for never)
+	reserved  map[string]struct{}
+	expiresAt atomic.Int64
 }
 
 func New(name string, maxSize int) *Namespace {
@@ -34,13 +50,111 @@ func NewRoom(name string, maxSize int, owner string) *Namespace {
 	if maxSize > 30 {
 		maxSize = 30
 	}
-	return &Namespace{
+	ns := &Namespace{
 		Name:    name,
 		Owner:   owner,
 		IsRoom:  true,
 		peers:   make(map[string]*peer.Peer),
 		maxSize: maxSize,
 	}
+	ns.Touch()
+	return ns
+}
+
+// SetMotd sets the message sent to peers right after they join, "" for
+// none.
+func (ns *Namespace) SetMotd(motd string) {
+	ns.motd.Store(&motd)
+}
+
+func (ns *Namespace) Motd() string {
+	if m := ns.motd.Load(); m != nil {
+		return *m
+	}
+	return ""
+}
+
+// Touch records activity in the namespace for idle tracking.
+func (ns *Namespace) Touch() {
+	ns.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (ns *Namespace) LastActivity() time.Time {
+	return time.Unix(0, ns.lastActivity.Load())
+}
+
+// SetIdleTTL sets how long the namespace may go without activity before it
+// is considered idle, 0 disables.
+func (ns *Namespace) SetIdleTTL(ttl time.Duration) {
+	ns.idleTTL.Store(int64(ttl))
+}
+
+func (ns *Namespace) IdleTTL() time.Duration {
+	return time.Duration(ns.idleTTL.Load())
+}
+
+// SetApprovalRequired makes joins wait for the owner's approval.
+func (ns *Namespace) SetApprovalRequired(required bool) {
+	ns.approval.Store(required)
+}
+
+func (ns *Namespace) ApprovalRequired() bool {
+	return ns.approval.Load()
+}
+
+// IdleExpired reports whether the namespace has an idle TTL and has been
+// silent for longer than it.
+func (ns *Namespace) IdleExpired(now time.Time) bool {
+	ttl := ns.IdleTTL()
+	if ttl <= 0 {
+		return false
+	}
+	return now.Sub(ns.LastActivity()) > ttl
+}
+
+// Hold keeps the namespace from being cleaned up while empty until the given
+// time, e.g. so restored rooms wait for their members to reconnect.
+func (ns *Namespace) Hold(until time.Time) {
+	ns.holdUntil.Store(until.UnixNano())
+}
+
+func (ns *Namespace) Held(now time.Time) bool {
+	return now.UnixNano() < ns.holdUntil.Load()
+}
+
+// Reserve limits who may join the namespace to fingerprints.
+func (ns *Namespace) Reserve(fingerprints []string) {
+	reserved := make(map[string]struct{}, len(fingerprints))
+	for _, fp := range fingerprints {
+		reserved[fp] = struct{}{}
+	}
+	ns.mu.Lock()
+	ns.reserved = reserved
+	ns.mu.Unlock()
+}
+
+// Admits reports whether fingerprint may join, true unless the namespace is
+// reserved for others.
+func (ns *Namespace) Admits(fingerprint string) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	if ns.reserved == nil {
+		return true
+	}
+	_, ok := ns.reserved[fingerprint]
+	return ok
+}
+
+// ExpireAt sets when the namespace's lifetime ends, however busy it is.
+func (ns *Namespace) ExpireAt(t time.Time) {
+	ns.expiresAt.Store(t.UnixNano())
+}
+
+// LifetimeExpired reports whether the namespace has a lifetime and it ended
+// before now.
+func (ns *Namespace) LifetimeExpired(now time.Time) bool {
+	at := ns.expiresAt.Load()
+	return at > 0 && now.UnixNano() > at
 }
 
 func (ns *Namespace) Add(p *peer.Peer) bool {
@@ -49,16 +163,112 @@ func (ns *Namespace) Add(p *peer.Peer) bool {
 	if len(ns.peers) >= ns.maxSize {
 		return false
 	}
+	if old, ok := ns.peers[p.Fingerprint]; ok {
+		if old.Observer {
+			ns.observers--
+		}
+		// a reconnect under the same alias keeps holding it
+		if old.Alias != p.Alias {
+			ns.dropAliasLocked(old)
+		}
+	}
 	ns.peers[p.Fingerprint] = p
+	if p.Observer {
+		ns.observers++
+	}
+	if ns.aliases != nil && p.Alias != "" {
+		// the first member to join with an alias holds it
+		if _, taken := ns.aliases[p.Alias]; !taken {
+			ns.aliases[p.Alias] = p.Fingerprint
+		}
+	}
 	return true
 }
 
 func (ns *Namespace) Remove(fingerprint string) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
+	if p, ok := ns.peers[fingerprint]; ok {
+		if p.Observer {
+			ns.observers--
+		}
+		ns.dropAliasLocked(p)
+	}
 	delete(ns.peers, fingerprint)
 }
 
+// dropAliasLocked frees p's alias if p holds it, handing it to another
+// member that joined with the same alias. Must be called with ns.mu held.
+func (ns *Namespace) dropAliasLocked(p *peer.Peer) {
+	if ns.aliases == nil || ns.aliases[p.Alias] != p.Fingerprint {
+		return
+	}
+	delete(ns.aliases, p.Alias)
+	for fp, other := range ns.peers {
+		if fp != p.Fingerprint && other.Alias == p.Alias {
+			ns.aliases[p.Alias] = fp
+			return
+		}
+	}
+}
+
+// ResolveAlias returns the fingerprint of the member holding alias. Always
+// false unless the manager indexes aliases per namespace.
+func (ns *Namespace) ResolveAlias(alias string) (string, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	fp, ok := ns.aliases[alias]
+	return fp, ok
+}
+
+// RemovePeer removes p only if it is the member stored under its
+// fingerprint, and reports whether it did.
+func (ns *Namespace) RemovePeer(p *peer.Peer) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.peers[p.Fingerprint] != p {
+		return false
+	}
+	if p.Observer {
+		ns.observers--
+	}
+	ns.dropAliasLocked(p)
+	delete(ns.peers, p.Fingerprint)
+	return true
+}
+
+// Watch subscribes p to roster events without making it a member.
+func (ns *Namespace) Watch(p *peer.Peer) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.watchers == nil {
+		ns.watchers = make(map[string]*peer.Peer)
+	}
+	ns.watchers[p.Fingerprint] = p
+}
+
+// Unwatch removes p if it is the watcher stored under its fingerprint.
+func (ns *Namespace) Unwatch(p *peer.Peer) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.watchers[p.Fingerprint] == p {
+		delete(ns.watchers, p.Fingerprint)
+	}
+}
+
+// Watchers returns the non-closed watchers.
+func (ns *Namespace) Watchers() []*peer.Peer {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	watchers := make([]*peer.Peer, 0, len(ns.watchers))
+	for _, p := range ns.watchers {
+		if !p.IsClosed() {
+			watchers = append(watchers, p)
+		}
+	}
+	return watchers
+}
+
 func (ns *Namespace) Get(fingerprint string) (*peer.Peer, bool) {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
@@ -79,26 +289,54 @@ func (ns *Namespace) Count() int {
 	return len(ns.peers)
 }
 
+// VisibleCount is Count without observers.
+func (ns *Namespace) VisibleCount() int {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return len(ns.peers) - ns.observers
+}
+
 func (ns *Namespace) MaxSize() int {
 	return ns.maxSize
 }
 
+// List returns up to limit visible members; observers are never listed.
 func (ns *Namespace) List(limit int) []protocol.PeerInfo {
+	peers, _ := ns.ListFiltered(limit, nil)
+	return peers
+}
+
+// ListFiltered is List restricted to members matching pred (nil matches
+// all). It also returns how many visible members match in total, which may
+// exceed the number listed.
+func (ns *Namespace) ListFiltered(limit int, pred func(protocol.PeerInfo) bool) ([]protocol.PeerInfo, int) {
+	return ns.ListFields(limit, pred, nil)
+}
+
+// ListFields is ListFiltered with each entry trimmed to fields (see
+// PeerInfo.Select); pred still sees the full entry.
+func (ns *Namespace) ListFields(limit int, pred func(protocol.PeerInfo) bool, fields []string) ([]protocol.PeerInfo, int) {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
 	if limit <= 0 || limit > len(ns.peers) {
 		limit = len(ns.peers)
 	}
 	peers := make([]protocol.PeerInfo, 0, limit)
-	i := 0
+	total := 0
 	for _, p := range ns.peers {
-		if i >= limit {
-			break
+		if p.Observer {
+			continue
+		}
+		info := p.InfoForNamespace(ns.Name)
+		if pred != nil && !pred(info) {
+			continue
+		}
+		total++
+		if len(peers) < limit {
+			peers = append(peers, info.Select(fields))
 		}
-		peers = append(peers, p.InfoForNamespace(ns.Name))
-		i++
 	}
-	return peers
+	return peers, total
 }
 
 // Snapshot returns a copy of non-closed peer pointers under the lock
@@ -125,6 +363,73 @@ func (ns *Namespace) BroadcastRaw(data []byte, exclude string) {
 	}
 }
 
+// BroadcastBatch sends each member the messages in msgs it didn't send
+// itself, from[i] being the sender of msgs[i]: a lone message as is, more
+// as one batch message.
+func (ns *Namespace) BroadcastBatch(msgs [][]byte, from []string) {
+	senders := make(map[string]struct{}, len(from))
+	for _, fp := range from {
+		senders[fp] = struct{}{}
+	}
+	var all []byte
+	for _, p := range ns.Snapshot() {
+		if _, sent := senders[p.Fingerprint]; !sent {
+			if all == nil {
+				all = ns.batchFrame(msgs)
+			}
+			p.SendRaw(all)
+			continue
+		}
+		others := make([][]byte, 0, len(msgs))
+		for i, m := range msgs {
+			if from[i] != p.Fingerprint {
+				others = append(others, m)
+			}
+		}
+		if len(others) > 0 {
+			p.SendRaw(ns.batchFrame(others))
+		}
+	}
+}
+
+func (ns *Namespace) batchFrame(msgs [][]byte) []byte {
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	return protocol.EncodeBatch(ns.Name, msgs)
+}
+
+// BroadcastDual sends binary, as a binary frame, to binary-mode peers and
+// text to the rest, skipping exclude.
+func (ns *Namespace) BroadcastDual(text, binary []byte, exclude string) {
+	peers := ns.Snapshot()
+	for _, p := range peers {
+		if p.Fingerprint == exclude {
+			continue
+		}
+		if p.Binary {
+			p.SendBinary(binary)
+		} else {
+			p.SendRaw(text)
+		}
+	}
+}
+
+// BroadcastGzip sends gzipped to peers registered with gzip and plain, the
+// same broadcast inflated, to the rest, skipping exclude.
+func (ns *Namespace) BroadcastGzip(gzipped, plain []byte, exclude string) {
+	for _, p := range ns.Snapshot() {
+		if p.Fingerprint == exclude {
+			continue
+		}
+		if p.Gzip {
+			p.SendRaw(gzipped)
+		} else {
+			p.SendRaw(plain)
+		}
+	}
+}
+
 func (ns *Namespace) Broadcast(msg *protocol.Message, exclude string) {
 	data, err := protocol.Encode(msg)
 	if err != nil {
@@ -139,30 +444,106 @@ func (ns *Namespace) IsEmpty() bool {
 	return len(ns.peers) == 0
 }
 
+// RandomPeer picks a non-observer peer other than exclude uniformly at
+// random, nil if there is none.
 func (ns *Namespace) RandomPeer(exclude string) *peer.Peer {
 	ns.mu.RLock()
 	defer ns.mu.RUnlock()
+	var chosen *peer.Peer
+	n := 0
 	for fp, p := range ns.peers {
-		if fp != exclude {
-			return p
+		if fp == exclude || p.Observer {
+			continue
+		}
+		// reservoir sampling: the i-th candidate replaces the pick with
+		// probability 1/i
+		n++
+		if rand.Intn(n) == 0 {
+			chosen = p
+		}
+	}
+	return chosen
+}
+
+// RandomPeerWeighted is RandomPeer biased toward less loaded peers: each
+// candidate's chance is proportional to 1/(1+queued), where queued is how
+// many messages wait in its send buffer.
+func (ns *Namespace) RandomPeerWeighted(exclude string) *peer.Peer {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	var chosen *peer.Peer
+	total := 0.0
+	for fp, p := range ns.peers {
+		if fp == exclude || p.Observer || p.IsClosed() {
+			continue
+		}
+		// weighted reservoir sampling, one pass
+		w := 1 / float64(1+len(p.Send))
+		total += w
+		if rand.Float64()*total < w {
+			chosen = p
 		}
 	}
-	return nil
+	return chosen
 }
 
 type Manager struct {
 	namespaces map[string]*Namespace
+	owned      map[string]map[string]*Namespace
 	mu         sync.RWMutex
 	maxSize    int
+	maxCount   int
+	aliasIndex bool
 }
 
 func NewManager(maxNsSize int) *Manager {
 	return &Manager{
 		namespaces: make(map[string]*Namespace),
+		owned:      make(map[string]map[string]*Namespace),
 		maxSize:    maxNsSize,
 	}
 }
 
+// deleteLocked removes ns from the namespace map and the owned-room index.
+// Must be called with m.mu held.
+func (m *Manager) deleteLocked(ns *Namespace) {
+	delete(m.namespaces, ns.Name)
+	if rooms, ok := m.owned[ns.Owner]; ok && rooms[ns.Name] == ns {
+		delete(rooms, ns.Name)
+		if len(rooms) == 0 {
+			delete(m.owned, ns.Owner)
+		}
+	}
+}
+
+// SetMaxNamespaces caps how many namespaces, rooms included, may exist at
+// once. 0 means no cap.
+func (m *Manager) SetMaxNamespaces(n int) {
+	m.mu.Lock()
+	m.maxCount = n
+	m.mu.Unlock()
+}
+
+// SetAliasIndex makes namespaces created from now on keep their own alias
+// index, so aliases are unique per namespace and resolved with
+// Namespace.ResolveAlias.
+func (m *Manager) SetAliasIndex(on bool) {
+	m.mu.Lock()
+	m.aliasIndex = on
+	m.mu.Unlock()
+}
+
+// newLocked applies the manager's settings to a new namespace. Must be called
+// with m.mu held.
+func (m *Manager) newLocked(ns *Namespace) *Namespace {
+	if m.aliasIndex {
+		ns.aliases = make(map[string]string)
+	}
+	return ns
+}
+
+// GetOrCreate returns the namespace called name, creating it if needed. It
+// returns nil when name is new and the namespace cap is reached.
 func (m *Manager) GetOrCreate(name string) *Namespace {
 	m.mu.RLock()
 	ns, ok := m.namespaces[name]
@@ -175,22 +556,80 @@ func (m *Manager) GetOrCreate(name string) *Namespace {
 	if ns, ok = m.namespaces[name]; ok {
 		return ns
 	}
-	ns = New(name, m.maxSize)
+	if m.maxCount > 0 && len(m.namespaces) >= m.maxCount {
+		return nil
+	}
+	ns = m.newLocked(New(name, m.maxSize))
 	m.namespaces[name] = ns
 	return ns
 }
 
+// CreateRoom creates a room called name. It returns nil, false if name is
+// taken or the namespace cap is reached.
 func (m *Manager) CreateRoom(name string, maxSize int, owner string) (*Namespace, bool) {
+	return m.CreateRoomFunc(name, maxSize, owner, nil)
+}
+
+// CreateRoomFunc is CreateRoom with setup run on the new room before any
+// other goroutine can see it, so settings and the owner's membership are in
+// place before anyone can join or clean it up.
+func (m *Manager) CreateRoomFunc(name string, maxSize int, owner string, setup func(ns *Namespace)) (*Namespace, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, ok := m.namespaces[name]; ok {
 		return nil, false
 	}
-	ns := NewRoom(name, maxSize, owner)
+	if m.maxCount > 0 && len(m.namespaces) >= m.maxCount {
+		return nil, false
+	}
+	ns := m.newLocked(NewRoom(name, maxSize, owner))
+	if setup != nil {
+		setup(ns)
+	}
 	m.namespaces[name] = ns
+	if m.owned[owner] == nil {
+		m.owned[owner] = make(map[string]*Namespace)
+	}
+	m.owned[owner][name] = ns
 	return ns, true
 }
 
+// RoomsOwnedBy returns the rooms whose owner is fingerprint.
+func (m *Manager) RoomsOwnedBy(fingerprint string) []*Namespace {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rooms := make([]*Namespace, 0, len(m.owned[fingerprint]))
+	for _, ns := range m.owned[fingerprint] {
+		rooms = append(rooms, ns)
+	}
+	return rooms
+}
+
+// Rooms returns a snapshot of all room namespaces.
+func (m *Manager) Rooms() []*Namespace {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rooms := make([]*Namespace, 0)
+	for _, ns := range m.namespaces {
+		if ns.IsRoom {
+			rooms = append(rooms, ns)
+		}
+	}
+	return rooms
+}
+
+// RemoveNamespace removes ns only if it is still the namespace registered
+// under its name.
+func (m *Manager) RemoveNamespace(ns *Namespace) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.namespaces[ns.Name]; ok && cur == ns {
+		m.deleteLocked(ns)
+		return true
+	}
+	return false
+}
+
 func (m *Manager) Get(name string) (*Namespace, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -201,7 +640,9 @@ func (m *Manager) Get(name string) (*Namespace, bool) {
 func (m *Manager) Remove(name string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.namespaces, name)
+	if ns, ok := m.namespaces[name]; ok {
+		m.deleteLocked(ns)
+	}
 }
 
 func (m *Manager) RemoveIfEmpty(name string) bool {
@@ -215,23 +656,34 @@ func (m *Manager) RemoveIfEmpty(name string) bool {
 	empty := len(ns.peers) == 0
 	ns.mu.RUnlock()
 	if empty {
-		delete(m.namespaces, name)
+		m.deleteLocked(ns)
 		return true
 	}
 	return false
 }
 
 func (m *Manager) Cleanup() {
+	m.CleanupReport()
+}
+
+// CleanupReport is Cleanup, returning how many namespaces it removed.
+func (m *Manager) CleanupReport() (removed int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	for name, ns := range m.namespaces {
+	now := time.Now()
+	for _, ns := range m.namespaces {
+		if ns.Held(now) {
+			continue
+		}
 		ns.mu.RLock()
-		empty := len(ns.peers) == 0
+		empty := len(ns.peers) == 0 && len(ns.watchers) == 0
 		ns.mu.RUnlock()
 		if empty {
-			delete(m.namespaces, name)
+			m.deleteLocked(ns)
+			removed++
 		}
 	}
+	return removed
 }
 
 func (m *Manager) Stats() map[string]int {
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"peerserver/peer"
 	"peerserver/protocol"
@@ -275,6 +276,50 @@ func TestNamespaceRandomPeer(t *testing.T) {
 	}
 }
 
+func TestNamespaceRandomPeerWeighted(t *testing.T) {
+	ns := New("test", 100)
+
+	idle1, c1 := makePeer(t, "idle1")
+	defer c1()
+	idle2, c2 := makePeer(t, "idle2")
+	defer c2()
+	busy, c3 := makePeer(t, "busy")
+	defer c3()
+	self, c4 := makePeer(t, "self")
+	defer c4()
+	ns.Add(idle1)
+	ns.Add(idle2)
+	ns.Add(busy)
+	ns.Add(self)
+
+	// leave one slot free so the busy peer is loaded but still open
+	for i := 0; i < cap(busy.Send)-1; i++ {
+		busy.Send <- []byte("queued")
+	}
+
+	counts := map[string]int{}
+	const iterations = 3000
+	for i := 0; i < iterations; i++ {
+		p := ns.RandomPeerWeighted("self")
+		if p == nil {
+			t.Fatal("should return a peer")
+		}
+		counts[p.Fingerprint]++
+	}
+
+	if counts["self"] != 0 {
+		t.Errorf("excluded peer picked %d times", counts["self"])
+	}
+	for _, fp := range []string{"idle1", "idle2"} {
+		if counts[fp] < iterations/4 {
+			t.Errorf("%s picked only %d/%d times, want roughly half", fp, counts[fp], iterations)
+		}
+	}
+	if counts["busy"] > iterations/10 {
+		t.Errorf("most loaded peer picked %d/%d times", counts["busy"], iterations)
+	}
+}
+
 func TestNewRoom(t *testing.T) {
 	room := NewRoom("room1", 10, "owner-fp")
 	if !room.IsRoom {
@@ -300,6 +345,68 @@ func TestNewRoomMaxSizeCap(t *testing.T) {
 	}
 }
 
+func TestNamespaceIdleExpired(t *testing.T) {
+	ns := NewRoom("room", 10, "owner")
+	now := time.Now()
+	if ns.IdleExpired(now.Add(time.Hour)) {
+		t.Error("namespace without idle ttl should never expire")
+	}
+
+	ns.SetIdleTTL(time.Minute)
+	if ns.IdleExpired(now) {
+		t.Error("fresh namespace should not be idle")
+	}
+	if !ns.IdleExpired(now.Add(2 * time.Minute)) {
+		t.Error("namespace should be idle after ttl")
+	}
+}
+
+func TestManagerRooms(t *testing.T) {
+	m := NewManager(100)
+	m.GetOrCreate("plain")
+	m.CreateRoom("room1", 10, "owner")
+	m.CreateRoom("room2", 10, "owner")
+
+	if n := len(m.Rooms()); n != 2 {
+		t.Errorf("expected 2 rooms, got %d", n)
+	}
+}
+
+func TestManagerRoomsOwnedBy(t *testing.T) {
+	m := NewManager(100)
+	m.GetOrCreate("plain")
+	m.CreateRoom("room1", 10, "owner")
+	room2, _ := m.CreateRoom("room2", 10, "owner")
+	m.CreateRoom("room3", 10, "someone-else")
+
+	if n := len(m.RoomsOwnedBy("owner")); n != 2 {
+		t.Errorf("expected 2 owned rooms, got %d", n)
+	}
+
+	m.RemoveNamespace(room2)
+	m.Remove("room1")
+	if n := len(m.RoomsOwnedBy("owner")); n != 0 {
+		t.Errorf("expected removed rooms to leave the index, got %d", n)
+	}
+	if n := len(m.RoomsOwnedBy("someone-else")); n != 1 {
+		t.Errorf("expected 1 room for someone-else, got %d", n)
+	}
+}
+
+func TestManagerRemoveNamespaceIdentity(t *testing.T) {
+	m := NewManager(100)
+	old, _ := m.CreateRoom("room", 10, "owner")
+	m.Remove("room")
+	m.CreateRoom("room", 10, "other")
+
+	if m.RemoveNamespace(old) {
+		t.Error("should not remove a namespace replaced under the same name")
+	}
+	if _, ok := m.Get("room"); !ok {
+		t.Error("replacement room should still exist")
+	}
+}
+
 func TestManagerGetOrCreate(t *testing.T) {
 	mgr := NewManager(1000)
 
@@ -314,6 +421,105 @@ func TestManagerGetOrCreate(t *testing.T) {
 	}
 }
 
+func TestManagerAliasIndex(t *testing.T) {
+	mgr := NewManager(1000)
+	plain := mgr.GetOrCreate("plain")
+	mgr.SetAliasIndex(true)
+	ns := mgr.GetOrCreate("indexed")
+	room, _ := mgr.CreateRoom("room", 5, "owner")
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p1.Alias = "brave-fox-42"
+	p2.Alias = "brave-fox-42"
+
+	plain.Add(p1)
+	if _, ok := plain.ResolveAlias("brave-fox-42"); ok {
+		t.Error("namespace created before SetAliasIndex should not index aliases")
+	}
+
+	ns.Add(p1)
+	ns.Add(p2)
+	room.Add(p2)
+	if fp, ok := ns.ResolveAlias("brave-fox-42"); !ok || fp != "fp1" {
+		t.Errorf("first member should hold the alias, got %q %v", fp, ok)
+	}
+	if fp, ok := room.ResolveAlias("brave-fox-42"); !ok || fp != "fp2" {
+		t.Errorf("alias should be unique per namespace only, got %q %v", fp, ok)
+	}
+
+	// a member that doesn't hold the alias leaving keeps it in place
+	ns.Remove("fp2")
+	if fp, _ := ns.ResolveAlias("brave-fox-42"); fp != "fp1" {
+		t.Errorf("alias holder should be unaffected, got %q", fp)
+	}
+	ns.RemovePeer(p1)
+	if _, ok := ns.ResolveAlias("brave-fox-42"); ok {
+		t.Error("alias should be freed when its holder leaves")
+	}
+}
+
+func TestNamespaceAliasHandover(t *testing.T) {
+	mgr := NewManager(1000)
+	mgr.SetAliasIndex(true)
+	ns := mgr.GetOrCreate("indexed")
+
+	p1, c1 := makePeer(t, "fp1")
+	defer c1()
+	p2, c2 := makePeer(t, "fp2")
+	defer c2()
+	p1.Alias = "brave-fox-42"
+	p2.Alias = "brave-fox-42"
+	ns.Add(p1)
+	ns.Add(p2)
+
+	// the holder reconnecting under the same alias keeps it
+	again, c3 := makePeer(t, "fp1")
+	defer c3()
+	again.Alias = "brave-fox-42"
+	ns.Add(again)
+	if fp, _ := ns.ResolveAlias("brave-fox-42"); fp != "fp1" {
+		t.Errorf("reconnected holder should keep the alias, got %q", fp)
+	}
+
+	// when the holder leaves, the other member with the alias takes it
+	ns.RemovePeer(again)
+	if fp, ok := ns.ResolveAlias("brave-fox-42"); !ok || fp != "fp2" {
+		t.Errorf("alias should pass to fp2, got %q %v", fp, ok)
+	}
+	ns.Remove("fp2")
+	if _, ok := ns.ResolveAlias("brave-fox-42"); ok {
+		t.Error("alias should be freed with no member left to take it")
+	}
+}
+
+func TestManagerMaxNamespaces(t *testing.T) {
+	mgr := NewManager(1000)
+	mgr.SetMaxNamespaces(2)
+
+	a := mgr.GetOrCreate("a")
+	if a == nil || mgr.GetOrCreate("b") == nil {
+		t.Fatal("should create namespaces up to the cap")
+	}
+	if mgr.GetOrCreate("c") != nil {
+		t.Error("should refuse a new namespace at the cap")
+	}
+	if mgr.GetOrCreate("a") != a {
+		t.Error("existing namespace should still be returned at the cap")
+	}
+
+	if room, created := mgr.CreateRoom("room", 10, "owner"); created || room != nil {
+		t.Error("should refuse a new room at the cap")
+	}
+
+	mgr.Remove("b")
+	if mgr.GetOrCreate("c") == nil {
+		t.Error("should create again once below the cap")
+	}
+}
+
 func TestManagerCreateRoom(t *testing.T) {
 	mgr := NewManager(1000)
 
@@ -400,6 +606,41 @@ func TestManagerCleanup(t *testing.T) {
 	}
 }
 
+func TestManagerCleanupReport(t *testing.T) {
+	mgr := NewManager(1000)
+	mgr.GetOrCreate("empty1")
+	mgr.GetOrCreate("empty2")
+	ns := mgr.GetOrCreate("has-peer")
+
+	p, c := makePeer(t, "fp1")
+	defer c()
+	ns.Add(p)
+
+	if removed := mgr.CleanupReport(); removed != 2 {
+		t.Errorf("expected 2 removed, got %d", removed)
+	}
+	if removed := mgr.CleanupReport(); removed != 0 {
+		t.Errorf("expected nothing left to remove, got %d", removed)
+	}
+}
+
+func TestManagerCleanupSkipsHeld(t *testing.T) {
+	mgr := NewManager(1000)
+	ns, _ := mgr.CreateRoom("restored", 10, "owner")
+	ns.Hold(time.Now().Add(time.Minute))
+	expired, _ := mgr.CreateRoom("expired-hold", 10, "owner")
+	expired.Hold(time.Now().Add(-time.Second))
+
+	mgr.Cleanup()
+
+	if _, ok := mgr.Get("restored"); !ok {
+		t.Error("held room should survive cleanup")
+	}
+	if _, ok := mgr.Get("expired-hold"); ok {
+		t.Error("room whose hold passed should be cleaned up")
+	}
+}
+
 func TestManagerStats(t *testing.T) {
 	mgr := NewManager(1000)
 	ns1 := mgr.GetOrCreate("ns1")
@@ -444,3 +685,26 @@ func TestManagerConcurrent(t *testing.T) {
 		t.Errorf("expected 10 namespaces, got %d", len(stats))
 	}
 }
+
+func TestNamespaceListFiltered(t *testing.T) {
+	ns := New("test", 100)
+	for _, fp := range []string{"a1", "a2", "b1"} {
+		p, c := makePeer(t, fp)
+		defer c()
+		ns.Add(p)
+	}
+
+	peers, total := ns.ListFiltered(1, func(info protocol.PeerInfo) bool {
+		return strings.HasPrefix(info.Fingerprint, "a")
+	})
+	if total != 2 {
+		t.Errorf("expected 2 matching, got %d", total)
+	}
+	if len(peers) != 1 {
+		t.Errorf("expected 1 listed, got %d", len(peers))
+	}
+
+	if _, total := ns.ListFiltered(0, nil); total != 3 {
+		t.Errorf("nil filter should match all, got %d", total)
+	}
+}
@@ -10,26 +10,71 @@ import (
 	"peerserver/protocol"
 
 	"github.com/coder/websocket"
+	jsoniter "github.com/json-iterator/go"
 )
 
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
 var (
 	ErrClosed     = errors.New("connection closed")
 	ErrBufferFull = errors.New("send buffer full")
 )
 
+// bufferFullDrops counts messages SendRaw dropped because a peer's send
+// buffer was full, across all peers.
+var bufferFullDrops atomic.Int64
+
+// BufferFullDrops returns how many messages were dropped on a full send
+// buffer since the process started.
+func BufferFullDrops() int64 {
+	return bufferFullDrops.Load()
+}
+
+// maxRecentErrors bounds the error ring kept per peer for diagnostics.
+const maxRecentErrors = 8
+
+// ErrorRecord is one error the server sent a peer.
+type ErrorRecord struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// BinaryMarker prefixes frames queued on Send that go out as binary
+// websocket frames. Encoded messages always start with '{', so the two
+// can't be confused.
+const BinaryMarker = 0x00
+
 type Peer struct {
-	Fingerprint string
-	Alias       string
-	Conn        *websocket.Conn
-	Send        chan []byte
-	Namespaces  map[string]*NamespaceInfo
-	Meta        map[string]interface{}
-	ConnectedAt time.Time
-	LastPing    time.Time
-	mu          sync.RWMutex
-	closed      atomic.Bool
-	msgCount    atomic.Int64
-	cancel      context.CancelFunc
+	Fingerprint  string
+	Alias        string
+	Observer     bool
+	Binary       bool
+	Gzip         bool
+	Compressed   bool   // permessage-deflate was negotiated
+	Identity     string // shared by one user's devices, empty if none
+	Region       string
+	PingInterval time.Duration
+	Conn         *websocket.Conn
+	Send         chan []byte
+	Namespaces   map[string]*NamespaceInfo
+	watching     map[string]struct{}
+	Meta         map[string]interface{}
+	ConnectedAt  time.Time
+	LastPing     time.Time
+	mu           sync.RWMutex
+	sendMu       sync.RWMutex // held to write while Send is closed, read while sending
+	closed       atomic.Bool
+	msgCount     atomic.Int64
+	cancel       context.CancelFunc
+	errMu        sync.Mutex
+	errRing      [maxRecentErrors]ErrorRecord
+	errTotal     int
+
+	// fingerprints this peer wants presence events for, and whether others
+	// may watch it; set at registration
+	WatchPresence []string
+	SharePresence bool
 }
 
 type NamespaceInfo struct {
@@ -38,6 +83,7 @@ type NamespaceInfo struct {
 	Version string
 	Meta    map[string]interface{}
 	Joined  time.Time
+	Ready   bool
 }
 
 func New(conn *websocket.Conn, sendBufSize int, cancel context.CancelFunc) *Peer {
@@ -48,6 +94,7 @@ func New(conn *websocket.Conn, sendBufSize int, cancel context.CancelFunc) *Peer
 		Conn:        conn,
 		Send:        make(chan []byte, sendBufSize),
 		Namespaces:  make(map[string]*NamespaceInfo),
+		watching:    make(map[string]struct{}),
 		Meta:        make(map[string]interface{}),
 		ConnectedAt: time.Now(),
 		LastPing:    time.Now(),
@@ -67,6 +114,48 @@ func (p *Peer) JoinNamespace(ns string, appType, version string, meta map[string
 	}
 }
 
+// UpdateNamespace changes the app type, version and meta p advertises in ns,
+// nil values are left as they are. False if p is not in ns.
+func (p *Peer) UpdateNamespace(ns string, appType, version *string, meta map[string]interface{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.Namespaces[ns]
+	if !ok {
+		return false
+	}
+	if appType != nil {
+		info.AppType = *appType
+	}
+	if version != nil {
+		info.Version = *version
+	}
+	if meta != nil {
+		info.Meta = meta
+	}
+	return true
+}
+
+// SetReady sets p's ready flag in ns and reports whether it changed. ok is
+// false if p is not in ns.
+func (p *Peer) SetReady(ns string, ready bool) (changed, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.Namespaces[ns]
+	if !ok {
+		return false, false
+	}
+	changed = info.Ready != ready
+	info.Ready = ready
+	return changed, true
+}
+
+func (p *Peer) IsReady(ns string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	info, ok := p.Namespaces[ns]
+	return ok && info.Ready
+}
+
 func (p *Peer) LeaveNamespace(ns string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -80,6 +169,29 @@ func (p *Peer) InNamespace(ns string) bool {
 	return ok
 }
 
+// Watch records that the peer watches ns's roster without being a member.
+func (p *Peer) Watch(ns string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watching[ns] = struct{}{}
+}
+
+func (p *Peer) Unwatch(ns string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.watching, ns)
+}
+
+func (p *Peer) Watching() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ns := make([]string, 0, len(p.watching))
+	for k := range p.watching {
+		ns = append(ns, k)
+	}
+	return ns
+}
+
 func (p *Peer) GetNamespaces() []string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -109,6 +221,7 @@ func (p *Peer) Info() protocol.PeerInfo {
 	return protocol.PeerInfo{
 		Fingerprint: p.Fingerprint,
 		Alias:       p.Alias,
+		Region:      p.Region,
 		Meta:        p.Meta,
 	}
 }
@@ -119,10 +232,23 @@ func (p *Peer) InfoForNamespace(ns string) protocol.PeerInfo {
 	info := protocol.PeerInfo{
 		Fingerprint: p.Fingerprint,
 		Alias:       p.Alias,
+		Region:      p.Region,
 		Meta:        p.Meta,
 	}
 	if nsInfo, ok := p.Namespaces[ns]; ok {
 		info.AppType = nsInfo.AppType
+		info.Version = nsInfo.Version
+		if len(nsInfo.Meta) > 0 {
+			// the namespace's meta wins over the peer's global meta
+			meta := make(map[string]interface{}, len(p.Meta)+len(nsInfo.Meta))
+			for k, v := range p.Meta {
+				meta[k] = v
+			}
+			for k, v := range nsInfo.Meta {
+				meta[k] = v
+			}
+			info.Meta = meta
+		}
 	}
 	return info
 }
@@ -131,6 +257,11 @@ func (p *Peer) SendMessage(msg *protocol.Message) error {
 	if p.closed.Load() {
 		return ErrClosed
 	}
+	if msg.Type == protocol.TypeError {
+		var ep protocol.ErrorPayload
+		json.Unmarshal(msg.Payload, &ep)
+		p.RecordError(ep.Code, ep.Message)
+	}
 	data, err := protocol.Encode(msg)
 	if err != nil {
 		return err
@@ -138,32 +269,97 @@ func (p *Peer) SendMessage(msg *protocol.Message) error {
 	return p.SendRaw(data)
 }
 
-func (p *Peer) SendRaw(data []byte) (err error) {
+// RecordError adds an error sent to p to its ring of recent errors. Errors
+// sent through SendMessage are recorded already; this is for pre-encoded
+// ones sent with SendRaw.
+func (p *Peer) RecordError(code int, message string) {
+	p.errMu.Lock()
+	p.errRing[p.errTotal%maxRecentErrors] = ErrorRecord{Code: code, Message: message, At: time.Now()}
+	p.errTotal++
+	p.errMu.Unlock()
+}
+
+// RecentErrors returns the last errors sent to p, oldest first.
+func (p *Peer) RecentErrors() []ErrorRecord {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	n := p.errTotal
+	if n > maxRecentErrors {
+		n = maxRecentErrors
+	}
+	out := make([]ErrorRecord, 0, n)
+	for i := p.errTotal - n; i < p.errTotal; i++ {
+		out = append(out, p.errRing[i%maxRecentErrors])
+	}
+	return out
+}
+
+func (p *Peer) SendRaw(data []byte) error {
+	// the read lock keeps Close from closing Send under a sender that already
+	// passed the closed check; the send never blocks so Close waits briefly
+	p.sendMu.RLock()
+	defer p.sendMu.RUnlock()
 	if p.closed.Load() {
 		return ErrClosed
 	}
 
-	// protect against send on closed channel race
-	defer func() {
-		if r := recover(); r != nil {
-			err = ErrClosed
-		}
-	}()
-
 	select {
 	case p.Send <- data:
 		return nil
 	default:
+		bufferFullDrops.Add(1)
 		return ErrBufferFull
 	}
 }
 
+// SendBinary queues frame to go out as a binary websocket frame.
+func (p *Peer) SendBinary(frame []byte) error {
+	data := make([]byte, 0, 1+len(frame))
+	data = append(data, BinaryMarker)
+	return p.SendRaw(append(data, frame...))
+}
+
+// Frame returns the websocket message type and payload for data taken from
+// Send.
+func Frame(data []byte) (websocket.MessageType, []byte) {
+	if len(data) > 0 && data[0] == BinaryMarker {
+		return websocket.MessageBinary, data[1:]
+	}
+	return websocket.MessageText, data
+}
+
 func (p *Peer) Close() {
-	if p.closed.CompareAndSwap(false, true) {
-		close(p.Send)
-		p.cancel()
-		p.Conn.CloseNow()
+	p.sendMu.Lock()
+	if !p.closed.CompareAndSwap(false, true) {
+		p.sendMu.Unlock()
+		return
+	}
+	close(p.Send)
+	p.sendMu.Unlock()
+	p.cancel()
+	p.Conn.CloseNow()
+}
+
+// CloseWithMessage writes data straight to the connection, bypassing the
+// send buffer, then closes. Used for notices that must reach the client
+// before the disconnect; the write is best-effort within timeout.
+func (p *Peer) CloseWithMessage(data []byte, timeout time.Duration) {
+	if p.closed.Load() {
+		return
+	}
+	p.WriteNow(data, timeout)
+	p.Close()
+}
+
+// WriteNow writes data straight to the connection, bypassing the send
+// buffer, for notices that must go out before the peer is closed.
+func (p *Peer) WriteNow(data []byte, timeout time.Duration) error {
+	if p.closed.Load() {
+		return ErrClosed
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.Conn.Write(ctx, websocket.MessageText, data)
 }
 
 func (p *Peer) IsClosed() bool {
@@ -174,6 +370,11 @@ func (p *Peer) IncrementMsgCount() int64 {
 	return p.msgCount.Add(1)
 }
 
+// MsgCount returns how many messages p has sent so far.
+func (p *Peer) MsgCount() int64 {
+	return p.msgCount.Load()
+}
+
 func (p *Peer) UpdateMeta(meta map[string]interface{}) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
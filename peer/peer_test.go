@@ -72,6 +72,58 @@ func TestPeerNew(t *testing.T) {
 	}
 }
 
+func TestPeerUpdateNamespace(t *testing.T) {
+	p, _, cleanup := setupTestPeer(t)
+	defer cleanup()
+
+	version := "1.1"
+	if p.UpdateNamespace("game-lobby", nil, &version, nil) {
+		t.Error("should not update a namespace the peer is not in")
+	}
+
+	p.JoinNamespace("game-lobby", "game", "1.0", nil)
+	if !p.UpdateNamespace("game-lobby", nil, &version, nil) {
+		t.Fatal("should update a joined namespace")
+	}
+	info := p.InfoForNamespace("game-lobby")
+	if info.AppType != "game" || info.Version != "1.1" {
+		t.Errorf("expected app type kept and version updated, got %q %q", info.AppType, info.Version)
+	}
+
+	// namespace meta is laid over the global meta
+	p.UpdateMeta(map[string]interface{}{"name": "fox", "skill": 1})
+	p.UpdateNamespace("game-lobby", nil, nil, map[string]interface{}{"skill": 7})
+	info = p.InfoForNamespace("game-lobby")
+	if info.Meta["name"] != "fox" || info.Meta["skill"] != 7 {
+		t.Errorf("expected merged meta, got %v", info.Meta)
+	}
+	if p.Info().Meta["skill"] != 1 {
+		t.Errorf("global meta should be unchanged, got %v", p.Info().Meta)
+	}
+}
+
+func TestPeerSetReady(t *testing.T) {
+	p, _, cleanup := setupTestPeer(t)
+	defer cleanup()
+
+	if _, ok := p.SetReady("lobby", true); ok {
+		t.Error("should not set ready in a namespace the peer is not in")
+	}
+	p.JoinNamespace("lobby", "", "", nil)
+	if changed, ok := p.SetReady("lobby", true); !changed || !ok || !p.IsReady("lobby") {
+		t.Fatal("expected the ready flag set")
+	}
+	if changed, _ := p.SetReady("lobby", true); changed {
+		t.Error("setting the same value should not report a change")
+	}
+
+	p.LeaveNamespace("lobby")
+	p.JoinNamespace("lobby", "", "", nil)
+	if p.IsReady("lobby") {
+		t.Error("ready should reset on rejoin")
+	}
+}
+
 func TestPeerJoinLeaveNamespace(t *testing.T) {
 	p, _, cleanup := setupTestPeer(t)
 	defer cleanup()
@@ -241,10 +293,37 @@ func TestPeerSendRawBufferFull(t *testing.T) {
 	// fill the buffer
 	p.Send <- []byte("first")
 
+	before := BufferFullDrops()
 	err := p.SendRaw([]byte("second"))
 	if err != ErrBufferFull {
 		t.Errorf("expected ErrBufferFull, got %v", err)
 	}
+	if got := BufferFullDrops() - before; got != 1 {
+		t.Errorf("expected 1 buffer-full drop, got %d", got)
+	}
+}
+
+func TestPeerRecentErrors(t *testing.T) {
+	p := &Peer{Send: make(chan []byte, 64)}
+
+	p.SendMessage(protocol.NewError(400, "bad"))
+	p.SendMessage(&protocol.Message{Type: protocol.TypePong})
+	if got := p.RecentErrors(); len(got) != 1 || got[0].Code != 400 || got[0].Message != "bad" {
+		t.Fatalf("expected one 400 error, got %+v", got)
+	}
+
+	for i := 0; i < maxRecentErrors+3; i++ {
+		p.RecordError(429, "rate limited")
+	}
+	got := p.RecentErrors()
+	if len(got) != maxRecentErrors {
+		t.Fatalf("expected ring bounded to %d, got %d", maxRecentErrors, len(got))
+	}
+	for _, e := range got {
+		if e.Code != 429 {
+			t.Errorf("oldest errors should be evicted first, got %+v", e)
+		}
+	}
 }
 
 func TestPeerClose(t *testing.T) {
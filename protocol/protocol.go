@@ -1,6 +1,11 @@
 package protocol
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strconv"
 	"sync"
 
 	jsoniter "github.com/json-iterator/go"
@@ -23,6 +28,15 @@ func AcquireMessage() *Message {
 	msg.Payload = nil
 	msg.Timestamp = 0
 	msg.NodeID = ""
+	msg.RequireTarget = false
+	msg.ClaimID = ""
+	msg.ExpiresAt = 0
+	msg.RequestID = ""
+	msg.Encoding = ""
+	msg.Reliable = false
+	msg.Seq = 0
+	msg.ToIdentity = false
+	msg.FromNamespaces = nil
 	return msg
 }
 
@@ -37,6 +51,15 @@ func ReleaseMessage(msg *Message) {
 	msg.Payload = nil
 	msg.Timestamp = 0
 	msg.NodeID = ""
+	msg.RequireTarget = false
+	msg.ClaimID = ""
+	msg.ExpiresAt = 0
+	msg.RequestID = ""
+	msg.Encoding = ""
+	msg.Reliable = false
+	msg.Seq = 0
+	msg.ToIdentity = false
+	msg.FromNamespaces = nil
 	messagePool.Put(msg)
 }
 
@@ -65,16 +88,20 @@ const (
 	TypeJoin        = "join"
 	TypeLeave       = "leave"
 	TypeSignal      = "signal"
+	TypeSignalAll   = "signal_all"
 	TypeDiscover    = "discover"
 	TypePeerList    = "peer_list"
 	TypeMatch       = "match"
 	TypeMatched     = "matched"
+	TypeMatchCancel = "match_cancelled"
+	TypeMatchLookup = "match_lookup"
 	TypeRelay       = "relay"
 	TypePing        = "ping"
 	TypePong        = "pong"
 	TypeError       = "error"
 	TypePeerJoined  = "peer_joined"
 	TypePeerLeft    = "peer_left"
+	TypeReplaced    = "peer_replaced"
 	TypeKick        = "kick"
 	TypeBroadcast   = "broadcast"
 	TypeMetadata    = "metadata"
@@ -83,6 +110,107 @@ const (
 	TypeJoinRoom    = "join_room"
 	TypeRoomInfo    = "room_info"
 	TypeRoomClosed  = "room_closed"
+	TypeJoinRequest = "join_request"
+	TypeApproveJoin = "approve_join"
+	TypeDenyJoin    = "deny_join"
+	TypeWatch       = "watch"
+	TypeUnwatch     = "unwatch"
+	TypeNsCount     = "namespace_count"
+	TypeMyRooms     = "my_rooms"
+	TypeRoomRelay   = "room_relay"
+	TypeSetRoomMeta = "set_room_meta"
+	TypeWelcome     = "welcome"
+	TypeUpdateInfo  = "update_namespace_info"
+	TypePeerUpdated = "peer_updated"
+	TypeRelayAck    = "relay_ack"
+	TypeRelayFailed = "relay_failed"
+	TypePresence    = "presence"
+	TypeBatch       = "batch"
+	TypeReconnect   = "reconnect"
+
+	// lobby ready state
+	TypeSetReady     = "set_ready"
+	TypeReadyChanged = "ready_changed"
+	TypeLobbyStatus  = "lobby_status"
+
+	// broker-only, never sent to clients
+	TypeTargetClaim  = "target_claim"
+	TypeNodeAnnounce = "node_announce"
+)
+
+var coreTypes = map[string]struct{}{
+	TypeRegister:     {},
+	TypeRegistered:   {},
+	TypeJoin:         {},
+	TypeLeave:        {},
+	TypeSignal:       {},
+	TypeSignalAll:    {},
+	TypeDiscover:     {},
+	TypePeerList:     {},
+	TypeMatch:        {},
+	TypeMatched:      {},
+	TypeMatchCancel:  {},
+	TypeMatchLookup:  {},
+	TypeRelay:        {},
+	TypePing:         {},
+	TypePong:         {},
+	TypeError:        {},
+	TypePeerJoined:   {},
+	TypePeerLeft:     {},
+	TypeReplaced:     {},
+	TypeKick:         {},
+	TypeBroadcast:    {},
+	TypeMetadata:     {},
+	TypeCreateRoom:   {},
+	TypeRoomCreated:  {},
+	TypeJoinRoom:     {},
+	TypeRoomInfo:     {},
+	TypeRoomClosed:   {},
+	TypeJoinRequest:  {},
+	TypeApproveJoin:  {},
+	TypeDenyJoin:     {},
+	TypeWatch:        {},
+	TypeUnwatch:      {},
+	TypeNsCount:      {},
+	TypeMyRooms:      {},
+	TypeRoomRelay:    {},
+	TypeSetRoomMeta:  {},
+	TypeWelcome:      {},
+	TypeUpdateInfo:   {},
+	TypePeerUpdated:  {},
+	TypeRelayAck:     {},
+	TypeRelayFailed:  {},
+	TypePresence:     {},
+	TypeBatch:        {},
+	TypeReconnect:    {},
+	TypeSetReady:     {},
+	TypeReadyChanged: {},
+	TypeLobbyStatus:  {},
+	TypeTargetClaim:  {},
+	TypeNodeAnnounce: {},
+}
+
+// IsCoreType reports whether typ is one of the message types above.
+func IsCoreType(typ string) bool {
+	_, ok := coreTypes[typ]
+	return ok
+}
+
+// WebSocket close codes (private 4000-4999 range) the server uses when it
+// rejects or drops a connection, so clients can tell causes apart without
+// parsing the reason text.
+const (
+	CloseRegistrationTimeout = 4000 // no register message within pong_wait
+	CloseInvalidRegistration = 4001 // first message wasn't a valid register
+	CloseMissingPublicKey    = 4002 // register without public_key
+	CloseServerFull          = 4003 // max_peers reached, retry later
+	CloseQuotaExceeded       = 4004 // max_messages_per_connection reached
+	CloseReconnect           = 4005 // asked to reconnect and didn't within the grace
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
 )
 
 const (
@@ -92,24 +220,57 @@ const (
 )
 
 type Message struct {
-	Type      string              `json:"type"`
-	From      string              `json:"from,omitempty"`
-	To        string              `json:"to,omitempty"`
-	Namespace string              `json:"namespace,omitempty"`
-	Payload   jsoniter.RawMessage `json:"payload,omitempty"`
-	Timestamp int64               `json:"ts,omitempty"`
-	NodeID    string              `json:"node_id,omitempty"`
+	Type          string              `json:"type"`
+	From          string              `json:"from,omitempty"`
+	To            string              `json:"to,omitempty"`
+	Namespace     string              `json:"namespace,omitempty"`
+	Payload       jsoniter.RawMessage `json:"payload,omitempty"`
+	Timestamp     int64               `json:"ts,omitempty"`
+	NodeID        string              `json:"node_id,omitempty"`
+	RequireTarget bool                `json:"require_target,omitempty"`
+	ClaimID       string              `json:"claim_id,omitempty"`
+	ExpiresAt     int64               `json:"expires_at,omitempty"`
+	RequestID     string              `json:"request_id,omitempty"`
+	// Encoding is EncodingGzip on a relay whose payload is gzipped.
+	Encoding string `json:"encoding,omitempty"`
+	// Reliable asks for a relay to be re-sent until the target answers
+	// with a relay_ack carrying the same Seq.
+	Reliable bool   `json:"reliable,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	// ToIdentity makes a relay's To an identity, delivered to each of its
+	// devices, rather than a single peer.
+	ToIdentity bool `json:"to_identity,omitempty"`
+	// FromNamespaces are the sender's namespaces, stamped on signals and
+	// relays that cross the broker so the delivering node can check the
+	// target shares one. Never sent to clients.
+	FromNamespaces []string `json:"from_namespaces,omitempty"`
 }
 
 type RegisterPayload struct {
-	PublicKey string                 `json:"public_key"`
-	Alias     string                 `json:"alias,omitempty"`
-	Meta      map[string]interface{} `json:"meta,omitempty"`
+	PublicKey      string                 `json:"public_key"`
+	Alias          string                 `json:"alias,omitempty"`
+	Meta           map[string]interface{} `json:"meta,omitempty"`
+	Observer       bool                   `json:"observer,omitempty"`
+	Region         string                 `json:"region,omitempty"`
+	PingIntervalMs int64                  `json:"ping_interval_ms,omitempty"`
+	Binary         bool                   `json:"binary,omitempty"`
+	Gzip           bool                   `json:"gzip,omitempty"`
+	// WatchPresence lists fingerprints to get presence events for;
+	// SharePresence lets others watch this peer.
+	WatchPresence []string `json:"watch_presence,omitempty"`
+	SharePresence bool     `json:"share_presence,omitempty"`
+	// IdentityKey is a secret shared by one user's devices, each with its
+	// own public key; its hash is the identity relays can be addressed to.
+	IdentityKey string `json:"identity_key,omitempty"`
+	// TierToken selects the rate limit tier whose token it is.
+	TierToken string `json:"tier_token,omitempty"`
 }
 
 type RegisteredPayload struct {
 	Fingerprint string `json:"fingerprint"`
 	Alias       string `json:"alias"`
+	Identity    string `json:"identity,omitempty"`
+	Tier        string `json:"tier,omitempty"`
 }
 
 type JoinPayload struct {
@@ -117,6 +278,17 @@ type JoinPayload struct {
 	AppType   string                 `json:"app_type"`
 	Version   string                 `json:"version,omitempty"`
 	Meta      map[string]interface{} `json:"meta,omitempty"`
+	Fields    []string               `json:"fields,omitempty"`
+}
+
+type LeavePayload struct {
+	Namespace string `json:"namespace"`
+	Message   string `json:"message,omitempty"`
+}
+
+// PeerLeftPayload carries the leaving peer's farewell message, if it sent one.
+type PeerLeftPayload struct {
+	Message string `json:"message"`
 }
 
 type SignalPayload struct {
@@ -126,44 +298,185 @@ type SignalPayload struct {
 }
 
 type DiscoverPayload struct {
-	Namespace string `json:"namespace"`
-	Limit     int    `json:"limit,omitempty"`
+	Namespace       string   `json:"namespace"`
+	Limit           int      `json:"limit,omitempty"`
+	Region          string   `json:"region,omitempty"`
+	IncludeNoRegion bool     `json:"include_no_region,omitempty"`
+	Fields          []string `json:"fields,omitempty"`
 }
 
 type PeerInfo struct {
 	Fingerprint string                 `json:"fingerprint"`
 	Alias       string                 `json:"alias,omitempty"`
 	AppType     string                 `json:"app_type,omitempty"`
+	Version     string                 `json:"version,omitempty"`
+	Region      string                 `json:"region,omitempty"`
 	Meta        map[string]interface{} `json:"meta,omitempty"`
+	// Correlation is the token the peer sent with its match request, only
+	// set in matched.
+	Correlation string `json:"correlation,omitempty"`
+}
+
+// Select returns info with only the named fields kept, fingerprint is always
+// kept. No fields keeps everything.
+func (pi PeerInfo) Select(fields []string) PeerInfo {
+	if len(fields) == 0 {
+		return pi
+	}
+	out := PeerInfo{Fingerprint: pi.Fingerprint}
+	for _, f := range fields {
+		switch f {
+		case "alias":
+			out.Alias = pi.Alias
+		case "app_type":
+			out.AppType = pi.AppType
+		case "version":
+			out.Version = pi.Version
+		case "region":
+			out.Region = pi.Region
+		case "meta":
+			out.Meta = pi.Meta
+		}
+	}
+	return out
 }
 
 type PeerListPayload struct {
 	Namespace string     `json:"namespace"`
 	Peers     []PeerInfo `json:"peers"`
 	Total     int        `json:"total"`
+	// Chunk numbers the parts, from 1, of a list too big for one message;
+	// Last marks the final part. Both are unset on a list sent whole.
+	Chunk int  `json:"chunk,omitempty"`
+	Last  bool `json:"last,omitempty"`
 }
 
 type MatchPayload struct {
 	Namespace string                 `json:"namespace"`
 	Criteria  map[string]interface{} `json:"criteria,omitempty"`
 	GroupSize int                    `json:"group_size,omitempty"`
+	// Correlation is echoed back on this peer's entry in matched, e.g. a
+	// party id, and takes no part in matching.
+	Correlation string `json:"correlation,omitempty"`
 }
 
 type MatchedPayload struct {
 	Namespace string     `json:"namespace"`
 	Peers     []PeerInfo `json:"peers"`
 	SessionID string     `json:"session_id"`
+	RoomID    string     `json:"room_id,omitempty"`
+	// RoomError says why no room was made when one should have been
+	RoomError string `json:"room_error,omitempty"`
+}
+
+type MatchLookupPayload struct {
+	SessionID string `json:"session_id"`
+}
+
+type PresencePayload struct {
+	Fingerprint string `json:"fingerprint"`
+	Alias       string `json:"alias,omitempty"`
+	Status      string `json:"status"`
+}
+
+// NodeAnnouncePayload is what a hub announces on the control channel at
+// startup. Instance tells apart two hubs that ended up with the same node ID.
+type NodeAnnouncePayload struct {
+	Instance string `json:"instance"`
+	Reply    bool   `json:"reply,omitempty"`
+}
+
+type MatchCancelledPayload struct {
+	Namespace string `json:"namespace"`
+	Reason    string `json:"reason"`
+}
+
+// ReconnectPayload asks a client to reconnect after DelayMs, staggered per
+// peer so a fleet doesn't come back at once.
+type ReconnectPayload struct {
+	DelayMs int64  `json:"delay_ms"`
+	Reason  string `json:"reason,omitempty"`
 }
 
 type ErrorPayload struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code         int    `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
 }
 
 type BroadcastPayload struct {
 	Namespace string              `json:"namespace"`
 	Data      jsoniter.RawMessage `json:"data"`
 	Exclude   []string            `json:"exclude,omitempty"`
+	// Encoding is "base64" when Data is a JSON string holding a binary
+	// broadcast, for peers not in binary mode, or EncodingGzip when the
+	// sender gzipped it.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+var ErrInvalidBinaryFrame = errors.New("invalid binary frame")
+
+// EncodingGzip marks a relay payload or broadcast data the client gzipped
+// itself: a JSON string holding the base64 of the gzipped JSON value. It is
+// passed on as is to peers registered with gzip and inflated for the rest.
+const EncodingGzip = "gzip"
+
+var ErrInvalidGzip = errors.New("invalid gzip payload")
+
+// Gzip makes EncodingGzip data from a JSON value, the inverse of Gunzip.
+func Gzip(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(buf.Bytes())
+}
+
+// Gunzip turns EncodingGzip data back into the JSON value it was made from.
+// Output over limit bytes, or that isn't valid JSON, is ErrInvalidGzip.
+func Gunzip(data []byte, limit int) ([]byte, error) {
+	var compressed []byte
+	if err := json.Unmarshal(data, &compressed); err != nil {
+		return nil, ErrInvalidGzip
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, ErrInvalidGzip
+	}
+	plain, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil || len(plain) > limit || !json.Valid(plain) {
+		return nil, ErrInvalidGzip
+	}
+	return plain, nil
+}
+
+// DecodeBinaryBroadcast splits a binary broadcast frame sent by a client:
+// one length byte, the namespace, then the data verbatim.
+func DecodeBinaryBroadcast(frame []byte) (namespace string, data []byte, err error) {
+	if len(frame) < 1 {
+		return "", nil, ErrInvalidBinaryFrame
+	}
+	n := int(frame[0])
+	if n == 0 || len(frame) < 1+n {
+		return "", nil, ErrInvalidBinaryFrame
+	}
+	return string(frame[1 : 1+n]), frame[1+n:], nil
+}
+
+// EncodeBinaryBroadcast builds the frame binary-mode peers receive: the
+// namespace and the sender's fingerprint, each behind a length byte, then
+// the data verbatim.
+func EncodeBinaryBroadcast(namespace, from string, data []byte) []byte {
+	frame := make([]byte, 0, 2+len(namespace)+len(from)+len(data))
+	frame = append(frame, byte(len(namespace)))
+	frame = append(frame, namespace...)
+	frame = append(frame, byte(len(from)))
+	frame = append(frame, from...)
+	return append(frame, data...)
 }
 
 type MetadataPayload struct {
@@ -171,20 +484,34 @@ type MetadataPayload struct {
 }
 
 type CreateRoomPayload struct {
-	RoomID  string `json:"room_id"`
-	MaxSize int    `json:"max_size,omitempty"`
+	RoomID           string `json:"room_id"`
+	MaxSize          int    `json:"max_size,omitempty"`
+	IdleTTLMs        int64  `json:"idle_ttl_ms,omitempty"`
+	ApprovalRequired bool   `json:"approval_required,omitempty"`
+	IdempotencyKey   string `json:"idempotency_key,omitempty"`
 }
 
 type RoomCreatedPayload struct {
-	RoomID  string `json:"room_id"`
-	MaxSize int    `json:"max_size"`
-	Owner   string `json:"owner"`
+	RoomID    string `json:"room_id"`
+	MaxSize   int    `json:"max_size"`
+	Owner     string `json:"owner"`
+	IdleTTLMs int64  `json:"idle_ttl_ms,omitempty"`
 }
 
 type JoinRoomPayload struct {
 	RoomID string `json:"room_id"`
 }
 
+type JoinRequestPayload struct {
+	RoomID string   `json:"room_id"`
+	Peer   PeerInfo `json:"peer"`
+}
+
+type JoinDecisionPayload struct {
+	RoomID      string `json:"room_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
 type RoomInfoPayload struct {
 	RoomID    string `json:"room_id"`
 	PeerCount int    `json:"peer_count"`
@@ -192,20 +519,210 @@ type RoomInfoPayload struct {
 	Owner     string `json:"owner"`
 }
 
+type MyRoomsPayload struct {
+	Rooms []RoomInfoPayload `json:"rooms"`
+}
+
 type RoomClosedPayload struct {
 	RoomID string `json:"room_id"`
 	Reason string `json:"reason"`
 }
 
+type WatchPayload struct {
+	Namespace string `json:"namespace"`
+}
+
+type NamespaceCountPayload struct {
+	Namespace string `json:"namespace"`
+	Count     int    `json:"count"`
+}
+
+type RoomRelayPayload struct {
+	RoomID string              `json:"room_id"`
+	Data   jsoniter.RawMessage `json:"data"`
+}
+
+type SetRoomMetaPayload struct {
+	RoomID string   `json:"room_id"`
+	Meta   RoomMeta `json:"meta"`
+}
+
+// RoomMeta holds the room settings an owner can change; nil fields are left
+// as they are.
+type RoomMeta struct {
+	Motd *string `json:"motd,omitempty"`
+}
+
+// UpdateNamespaceInfoPayload changes what a peer advertises in a namespace it
+// is in; nil fields are left as they are.
+type UpdateNamespaceInfoPayload struct {
+	Namespace string                 `json:"namespace"`
+	AppType   *string                `json:"app_type,omitempty"`
+	Version   *string                `json:"version,omitempty"`
+	Meta      map[string]interface{} `json:"meta,omitempty"`
+}
+
+type SetReadyPayload struct {
+	Namespace string `json:"namespace"`
+	Ready     bool   `json:"ready"`
+}
+
+type ReadyChangedPayload struct {
+	Namespace   string `json:"namespace"`
+	Fingerprint string `json:"fingerprint"`
+	Ready       bool   `json:"ready"`
+}
+
+// LobbyStatusPayload is sent with just Namespace to ask, and comes back with
+// how many of the namespace's visible members are ready.
+type LobbyStatusPayload struct {
+	Namespace string `json:"namespace"`
+	Ready     int    `json:"ready"`
+	Total     int    `json:"total"`
+}
+
+type WelcomePayload struct {
+	Namespace string `json:"namespace"`
+	Message   string `json:"message"`
+}
+
 type KickPayload struct {
 	RoomID      string `json:"room_id"`
 	Fingerprint string `json:"fingerprint"`
 }
 
+// Expired reports whether the message carries an expires_at (unix ms) that is
+// before now.
+func (m *Message) Expired(nowMs int64) bool {
+	return m.ExpiresAt > 0 && nowMs > m.ExpiresAt
+}
+
 func Encode(msg *Message) ([]byte, error) {
+	if data, ok := encodeFast(msg); ok {
+		return data, nil
+	}
 	return json.Marshal(msg)
 }
 
+// encodeFast writes the hottest outbound messages (peer_joined, peer_left,
+// signal, relay) without reflection. Output is byte-identical to json.Marshal; any
+// string that would need escaping falls back to jsoniter.
+func encodeFast(msg *Message) ([]byte, bool) {
+	switch msg.Type {
+	case TypePeerJoined, TypePeerLeft, TypeSignal, TypeRelay:
+	default:
+		return nil, false
+	}
+	if !plainString(msg.From) || !plainString(msg.To) || !plainString(msg.Namespace) ||
+		!plainString(msg.NodeID) || !plainString(msg.ClaimID) || !plainString(msg.RequestID) ||
+		!plainString(msg.Encoding) {
+		return nil, false
+	}
+	namespacesLen := 0
+	for _, ns := range msg.FromNamespaces {
+		if !plainString(ns) {
+			return nil, false
+		}
+		namespacesLen += len(ns) + 3
+	}
+
+	// sized so the buffer never grows: every key and quote plus three
+	// integers come to under 256 bytes
+	buf := make([]byte, 0, 256+len(msg.Type)+len(msg.From)+len(msg.To)+len(msg.Namespace)+
+		len(msg.Payload)+len(msg.NodeID)+len(msg.ClaimID)+len(msg.RequestID)+len(msg.Encoding)+namespacesLen)
+	buf = append(buf, `{"type":"`...)
+	buf = append(buf, msg.Type...)
+	buf = append(buf, '"')
+	buf = appendStringField(buf, `,"from":"`, msg.From)
+	buf = appendStringField(buf, `,"to":"`, msg.To)
+	buf = appendStringField(buf, `,"namespace":"`, msg.Namespace)
+	if len(msg.Payload) > 0 {
+		buf = append(buf, `,"payload":`...)
+		buf = append(buf, msg.Payload...)
+	}
+	if msg.Timestamp != 0 {
+		buf = append(buf, `,"ts":`...)
+		buf = strconv.AppendInt(buf, msg.Timestamp, 10)
+	}
+	buf = appendStringField(buf, `,"node_id":"`, msg.NodeID)
+	if msg.RequireTarget {
+		buf = append(buf, `,"require_target":true`...)
+	}
+	buf = appendStringField(buf, `,"claim_id":"`, msg.ClaimID)
+	if msg.ExpiresAt != 0 {
+		buf = append(buf, `,"expires_at":`...)
+		buf = strconv.AppendInt(buf, msg.ExpiresAt, 10)
+	}
+	buf = appendStringField(buf, `,"request_id":"`, msg.RequestID)
+	buf = appendStringField(buf, `,"encoding":"`, msg.Encoding)
+	if msg.Reliable {
+		buf = append(buf, `,"reliable":true`...)
+	}
+	if msg.Seq != 0 {
+		buf = append(buf, `,"seq":`...)
+		buf = strconv.AppendUint(buf, msg.Seq, 10)
+	}
+	if msg.ToIdentity {
+		buf = append(buf, `,"to_identity":true`...)
+	}
+	if len(msg.FromNamespaces) > 0 {
+		buf = append(buf, `,"from_namespaces":[`...)
+		for i, ns := range msg.FromNamespaces {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, '"')
+			buf = append(buf, ns...)
+			buf = append(buf, '"')
+		}
+		buf = append(buf, ']')
+	}
+	buf = append(buf, '}')
+	return buf, true
+}
+
+// EncodeBatch wraps already encoded messages into one batch message, whose
+// payload is the array of them. namespace must be plain, as namespace names
+// are.
+func EncodeBatch(namespace string, msgs [][]byte) []byte {
+	size := 48 + len(namespace)
+	for _, m := range msgs {
+		size += len(m) + 1
+	}
+	buf := make([]byte, 0, size)
+	buf = append(buf, `{"type":"batch"`...)
+	buf = appendStringField(buf, `,"namespace":"`, namespace)
+	buf = append(buf, `,"payload":[`...)
+	for i, m := range msgs {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, m...)
+	}
+	return append(buf, "]}"...)
+}
+
+func appendStringField(buf []byte, key, val string) []byte {
+	if val == "" {
+		return buf
+	}
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+	return append(buf, '"')
+}
+
+// plainString reports whether s encodes to JSON verbatim: printable ASCII
+// with nothing the standard library would escape.
+func plainString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
 func Decode(data []byte) (*Message, error) {
 	msg := AcquireMessage()
 	err := json.Unmarshal(data, msg)
@@ -217,6 +734,23 @@ func NewError(code int, message string) *Message {
 	return &Message{Type: TypeError, Payload: payload}
 }
 
+// NewErrorFor is NewError carrying req's request_id, so the client can tell
+// which of its messages failed. req may be nil.
+func NewErrorFor(req *Message, code int, message string) *Message {
+	msg := NewError(code, message)
+	if req != nil {
+		msg.RequestID = req.RequestID
+	}
+	return msg
+}
+
+// NewErrorRetry is NewError with a hint for how long the client should wait
+// before retrying.
+func NewErrorRetry(code int, message string, retryAfterMs int64) *Message {
+	payload, _ := json.Marshal(ErrorPayload{Code: code, Message: message, RetryAfterMs: retryAfterMs})
+	return &Message{Type: TypeError, Payload: payload}
+}
+
 func NewMessage(typ string, from string, payload interface{}) *Message {
 	data, _ := json.Marshal(payload)
 	return &Message{Type: typ, From: from, Payload: data}
@@ -226,9 +760,11 @@ func NewMessage(typ string, from string, payload interface{}) *Message {
 var (
 	PongBytes      []byte
 	RateLimitBytes []byte
+	ReplacedBytes  []byte
 )
 
 func init() {
 	PongBytes, _ = json.Marshal(&Message{Type: TypePong})
 	RateLimitBytes, _ = json.Marshal(NewError(429, "rate limited"))
+	ReplacedBytes, _ = json.Marshal(NewMessage(TypeReplaced, "", map[string]string{"message": "session replaced elsewhere"}))
 }
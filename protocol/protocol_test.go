@@ -2,6 +2,7 @@
 package protocol
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -214,11 +215,162 @@ func TestEncodeAllPayloadTypes(t *testing.T) {
 	}
 }
 
+func TestEncodeBatch(t *testing.T) {
+	one, _ := Encode(&Message{Type: TypeBroadcast, From: "fp1", Payload: []byte(`{"data":1}`)})
+	two, _ := Encode(&Message{Type: TypeBroadcast, From: "fp2", Payload: []byte(`{"data":2}`)})
+	batch := EncodeBatch("chat", [][]byte{one, two})
+
+	var decoded struct {
+		Type      string    `json:"type"`
+		Namespace string    `json:"namespace"`
+		Payload   []Message `json:"payload"`
+	}
+	if err := json.Unmarshal(batch, &decoded); err != nil {
+		t.Fatalf("batch is not valid JSON: %v: %s", err, batch)
+	}
+	if decoded.Type != TypeBatch || decoded.Namespace != "chat" || len(decoded.Payload) != 2 ||
+		decoded.Payload[0].From != "fp1" || decoded.Payload[1].From != "fp2" {
+		t.Errorf("unexpected batch %s", batch)
+	}
+}
+
+func TestEncodeFastMatchesJSON(t *testing.T) {
+	signal, _ := json.Marshal(SignalPayload{
+		SignalType: SignalOffer,
+		SDP:        "v=0\r\no=- 123 456 IN IP4 127.0.0.1\r\n",
+	})
+	joined, _ := json.Marshal(PeerInfo{Fingerprint: "fp1", Alias: "cool-fox-01", AppType: "game"})
+
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"peer_joined", &Message{Type: TypePeerJoined, From: "fp1", Namespace: "lobby", Payload: joined}},
+		{"peer_left", NewMessage(TypePeerLeft, "fp1", nil)},
+		{"peer_left_ns", &Message{Type: TypePeerLeft, From: "fp1", Namespace: "lobby", Payload: []byte("null")}},
+		{"signal", &Message{Type: TypeSignal, From: "fp1", To: "fp2", Payload: signal, Timestamp: 1700000000000}},
+		{"signal_broker", &Message{Type: TypeSignal, From: "fp1", To: "fp2", Payload: signal,
+			NodeID: "node-a", RequireTarget: true, ClaimID: "abcd", ExpiresAt: 1700000005000}},
+		{"signal_request_id", &Message{Type: TypeSignal, From: "fp1", To: "fp2", Payload: signal, RequestID: "req-1"}},
+		{"signal_empty_payload", &Message{Type: TypeSignal, From: "fp1", To: "fp2", Payload: []byte{}}},
+		{"relay", &Message{Type: TypeRelay, From: "fp1", To: "fp2", Payload: []byte(`{"data":"x","n":[1,2]}`), Timestamp: 1700000000000}},
+		{"relay_broker", &Message{Type: TypeRelay, From: "fp1", To: "fp2", Payload: []byte(`{"a":1}`),
+			NodeID: "node-a", RequireTarget: true, ClaimID: "abcd", RequestID: "req-1"}},
+		{"relay_reliable", &Message{Type: TypeRelay, From: "fp1", To: "fp2", Payload: []byte(`{"a":1}`),
+			RequestID: "req-1", Encoding: EncodingGzip, Reliable: true, Seq: 18446744073709551615}},
+		{"relay_identity", &Message{Type: TypeRelay, From: "fp1", To: "id1", Payload: []byte(`{"a":1}`), ToIdentity: true}},
+		{"signal_from_namespaces", &Message{Type: TypeSignal, From: "fp1", To: "fp2", NodeID: "n1", FromNamespaces: []string{"lobby", "room-1"}}},
+		{"signal_escaped_namespace", &Message{Type: TypeSignal, From: "fp1", To: "fp2", FromNamespaces: []string{"a\"b"}}},
+		{"relay_gzip", &Message{Type: TypeRelay, From: "fp1", To: "fp2", Payload: []byte(`"H4sI"`), Encoding: EncodingGzip}},
+		{"escaped_from", &Message{Type: TypeSignal, From: "a<b&\"c\"", To: "fp2", Payload: signal}},
+		{"unicode_namespace", &Message{Type: TypePeerLeft, From: "fp1", Namespace: "salle-é\u2028"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("marshal error: %v", err)
+			}
+			got, err := Encode(tt.msg)
+			if err != nil {
+				t.Fatalf("encode error: %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("encode mismatch:\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestBinaryBroadcastFrames(t *testing.T) {
+	data := []byte{0x00, 0xff, 0x10, '{'}
+	ns, got, err := DecodeBinaryBroadcast(append([]byte{5}, append([]byte("lobby"), data...)...))
+	if err != nil || ns != "lobby" || string(got) != string(data) {
+		t.Fatalf("decode: ns=%q data=%v err=%v", ns, got, err)
+	}
+	for _, bad := range [][]byte{nil, {0}, {9, 'a', 'b'}} {
+		if _, _, err := DecodeBinaryBroadcast(bad); err != ErrInvalidBinaryFrame {
+			t.Errorf("expected ErrInvalidBinaryFrame for %v, got %v", bad, err)
+		}
+	}
+
+	frame := EncodeBinaryBroadcast("lobby", "fp1", data)
+	want := append([]byte{5}, "lobby"...)
+	want = append(want, 3)
+	want = append(want, "fp1"...)
+	want = append(want, data...)
+	if string(frame) != string(want) {
+		t.Errorf("encode mismatch: got %v want %v", frame, want)
+	}
+}
+
+func TestGunzip(t *testing.T) {
+	zipped, err := Gzip([]byte(`{"x":1}`))
+	if err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	plain, err := Gunzip(zipped, 1024)
+	if err != nil || string(plain) != `{"x":1}` {
+		t.Fatalf("expected round trip, got %s %v", plain, err)
+	}
+
+	notJSON, _ := Gzip([]byte("hello"))
+	tooLarge, _ := Gzip([]byte(`"` + strings.Repeat("a", 2000) + `"`))
+	for name, data := range map[string][]byte{
+		"not a string":   []byte(`{"x":1}`),
+		"not gzip":       []byte(`"aGVsbG8="`),
+		"not json":       notJSON,
+		"over the limit": tooLarge,
+	} {
+		if _, err := Gunzip(data, 1024); err != ErrInvalidGzip {
+			t.Errorf("%s: expected ErrInvalidGzip, got %v", name, err)
+		}
+	}
+}
+
+func TestPeerInfoSelect(t *testing.T) {
+	info := PeerInfo{
+		Fingerprint: "fp1",
+		Alias:       "cool-fox-01",
+		AppType:     "game",
+		Region:      "eu-west",
+		Meta:        map[string]interface{}{"skill": 5},
+	}
+
+	if got := info.Select(nil); got.Alias != info.Alias || got.Meta == nil {
+		t.Errorf("expected no fields to keep everything, got %+v", got)
+	}
+
+	lean := info.Select([]string{"alias", "unknown"})
+	if lean.Fingerprint != "fp1" || lean.Alias != "cool-fox-01" {
+		t.Errorf("expected fingerprint and alias kept, got %+v", lean)
+	}
+	if lean.AppType != "" || lean.Region != "" || lean.Meta != nil {
+		t.Errorf("expected other fields dropped, got %+v", lean)
+	}
+}
+
+func BenchmarkEncodeReflect(b *testing.B) {
+	msg := NewMessage(TypeSignal, "sender123", SignalPayload{
+		SignalType: SignalOffer,
+		SDP:        "v=0\r\no=- 123 456 IN IP4 127.0.0.1\r\n",
+	})
+	msg.To = "target456"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(msg)
+	}
+}
+
 func BenchmarkEncode(b *testing.B) {
 	msg := NewMessage(TypeSignal, "sender123", SignalPayload{
 		SignalType: SignalOffer,
 		SDP:        "v=0\r\no=- 123 456 IN IP4 127.0.0.1\r\n",
 	})
+	msg.To = "target456"
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		Encode(msg)
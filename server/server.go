@@ -3,18 +3,27 @@ package server
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"peerserver/config"
 	"peerserver/hub"
+	"peerserver/matchmaker"
 	"peerserver/middleware"
 	"peerserver/peer"
 
@@ -30,39 +39,202 @@ type Server struct {
 	cfg     *config.Config
 	hub     *hub.Hub
 	limiter *middleware.RateLimiter
+	global  *middleware.GlobalLimiter // nil when unlimited
+
+	httpMu      sync.Mutex
+	httpServers []*http.Server
+
+	// open /echo connections, closed by Shutdown, and how many slots of
+	// max_echo_connections are taken, counting handshakes in progress
+	echoMu    sync.Mutex
+	echoConns map[*websocket.Conn]struct{}
+	echoSlots int
 }
 
 func New(cfg *config.Config, h *hub.Hub) *Server {
-	return &Server{
+	s := &Server{
 		cfg:     cfg,
 		hub:     h,
 		limiter: middleware.NewRateLimiter(cfg.RateLimitPerSec, cfg.RateLimitBurst, cfg.RateLimitShards),
+
+		echoConns: make(map[*websocket.Conn]struct{}),
+	}
+	if cfg.GlobalRateLimitPerSec > 0 {
+		s.global = middleware.NewGlobalLimiter(cfg.GlobalRateLimitPerSec, 0)
 	}
+	return s
 }
 
-func (s *Server) Start() error {
+func (s *Server) routes() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", s.handleWebSocket)
 	mux.HandleFunc("/health", s.handleHealth)
 	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/ping", handlePing)
+	if s.cfg.EchoEnabled {
+		mux.HandleFunc("/echo", s.handleEcho)
+	}
+	if s.cfg.AdminToken != "" {
+		// per-peer details are only served behind the admin token
+		mux.Handle("GET /admin/peer/{fingerprint}", s.requireAdmin(http.HandlerFunc(s.handleAdminPeer)))
+		mux.Handle("POST /admin/cleanup", s.requireAdmin(http.HandlerFunc(s.handleAdminCleanup)))
+		mux.Handle("GET /admin/matchmaker", s.requireAdmin(http.HandlerFunc(s.handleAdminMatchmaker)))
+		mux.Handle("POST /admin/reconnect-all", s.requireAdmin(http.HandlerFunc(s.handleAdminReconnectAll)))
+	}
+	return mux
+}
+
+func (s *Server) Start() error {
+	mux := s.routes()
 
 	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
-	log.Printf("peer server starting on %s", addr)
+	if _, ok := compressionModes[s.cfg.CompressionMode]; s.cfg.CompressionMode != "" && !ok {
+		log.Printf("WARNING: unknown compression_mode %q, using compression_enabled", s.cfg.CompressionMode)
+	}
+	if scope := s.cfg.AliasScope; scope != "" && scope != hub.AliasScopeGlobal && scope != hub.AliasScopeNamespace {
+		log.Printf("WARNING: unknown alias_scope %q, using global", scope)
+	}
 
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  s.cfg.ReadTimeout.Duration,
-		WriteTimeout: s.cfg.WriteTimeout.Duration,
+	var listeners []listener
+	hasTLS := s.cfg.TLSCert != "" && s.cfg.TLSKey != ""
+	switch {
+	case hasTLS && s.cfg.TLSPort > 0:
+		// plain and TLS side by side, sharing the mux and hub
+		tlsAddr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.TLSPort)
+		log.Printf("peer server starting on %s (plain) and %s (tls)", addr, tlsAddr)
+		listeners = append(listeners, s.httpServer(addr, mux, false), s.httpServer(tlsAddr, mux, true))
+	case hasTLS:
+		log.Printf("peer server starting on %s (tls)", addr)
+		listeners = append(listeners, s.httpServer(addr, mux, true))
+	default:
+		log.Printf("peer server starting on %s", addr)
+		listeners = append(listeners, s.httpServer(addr, mux, false))
 	}
 
-	if s.cfg.TLSCert != "" && s.cfg.TLSKey != "" {
-		return srv.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+	if debug := s.debugHandler(); debug != nil {
+		debugAddr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.MetricsPort)
+		log.Printf("debug endpoints on %s", debugAddr)
+		s.serveDebug(s.httpServer(debugAddr, debug, false))
 	}
-	return srv.ListenAndServe()
+	return s.serve(listeners...)
+}
+
+// serveDebug runs the metrics and pprof listener with the same timeouts as
+// the rest and closes it on Shutdown, but on its own: if it fails the error
+// is logged and signaling keeps running.
+func (s *Server) serveDebug(l listener) {
+	s.httpMu.Lock()
+	s.httpServers = append(s.httpServers, l.srv)
+	s.httpMu.Unlock()
+
+	go func() {
+		ln, err := s.listen(l.srv.Addr)
+		if err == nil {
+			err = l.srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("debug server error: %v", err)
+		}
+	}()
+}
+
+type listener struct {
+	srv *http.Server
+	tls bool
+}
+
+func (s *Server) httpServer(addr string, handler http.Handler, tls bool) listener {
+	return listener{
+		srv: &http.Server{
+			Addr:         addr,
+			Handler:      handler,
+			ReadTimeout:  s.cfg.ReadTimeout.Duration,
+			WriteTimeout: s.cfg.WriteTimeout.Duration,
+		},
+		tls: tls,
+	}
+}
+
+// serve runs the listeners until Shutdown or until one fails, in which case
+// the others are closed and its error returned.
+func (s *Server) serve(listeners ...listener) error {
+	s.httpMu.Lock()
+	for _, l := range listeners {
+		s.httpServers = append(s.httpServers, l.srv)
+	}
+	s.httpMu.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l listener) {
+			ln, err := s.listen(l.srv.Addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if l.tls {
+				errs <- l.srv.ServeTLS(ln, s.cfg.TLSCert, s.cfg.TLSKey)
+			} else {
+				errs <- l.srv.Serve(ln)
+			}
+		}(l)
+	}
+
+	var first error
+	for range listeners {
+		err := <-errs
+		if first == nil && !errors.Is(err, http.ErrServerClosed) {
+			first = err
+			for _, l := range listeners {
+				l.srv.Close()
+			}
+		}
+	}
+	return first
+}
+
+// listen opens addr with the configured TCP keepalive period, which the
+// kernel uses to notice half-open connections well before a missed pong
+// would: 0 is Go's default of 15s, negative turns keepalive off.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: s.cfg.TCPKeepAlive.Duration}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tunedListener{Listener: ln, noDelay: s.cfg.TCPNoDelay}, nil
+}
+
+// tunedListener applies the TCP options ListenConfig has no field for to
+// each accepted connection.
+type tunedListener struct {
+	net.Listener
+	noDelay bool
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetNoDelay(l.noDelay)
+	}
+	return conn, nil
+}
+
+// compressionModes maps compression_mode config values to websocket modes.
+var compressionModes = map[string]websocket.CompressionMode{
+	"disabled":            websocket.CompressionDisabled,
+	"no_context_takeover": websocket.CompressionNoContextTakeover,
+	"context_takeover":    websocket.CompressionContextTakeover,
 }
 
 func (s *Server) compressionMode() websocket.CompressionMode {
+	// compression_mode wins; unset or unknown falls back to compression_enabled
+	if mode, ok := compressionModes[s.cfg.CompressionMode]; ok {
+		return mode
+	}
 	if s.cfg.CompressionEnabled {
 		return websocket.CompressionContextTakeover
 	}
@@ -70,9 +242,13 @@ func (s *Server) compressionMode() websocket.CompressionMode {
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !s.checkUpgrade(w, r) {
+		return
+	}
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-		CompressionMode:    s.compressionMode(),
+		InsecureSkipVerify:   true,
+		CompressionMode:      s.compressionMode(),
+		CompressionThreshold: s.cfg.CompressionThreshold,
 	})
 	if err != nil {
 		log.Printf("accept error: %v", err)
@@ -82,12 +258,22 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	ctx, cancel := context.WithCancel(r.Context())
 	p := peer.New(conn, s.cfg.SendBufferSize, cancel)
+	// Accept answers with the extension only when the client offered it
+	p.Compressed = strings.Contains(w.Header().Get("Sec-WebSocket-Extensions"), "permessage-deflate")
 
-	readCtx, readCancel := context.WithTimeout(ctx, s.cfg.PongWait.Duration)
-	_, regData, err := conn.Read(readCtx)
-	readCancel()
+	// a timed out read context would tear the connection down before the
+	// close code could be sent, so the timeout closes it instead
+	regTimer := time.AfterFunc(s.cfg.PongWait.Duration, func() {
+		conn.Close(protocol.CloseRegistrationTimeout, "registration timeout")
+	})
+	_, regData, err := conn.Read(ctx)
+	if !regTimer.Stop() {
+		// the timer owns the close
+		cancel()
+		return
+	}
 	if err != nil {
-		conn.Close(websocket.StatusPolicyViolation, "registration timeout")
+		conn.CloseNow()
 		cancel()
 		return
 	}
@@ -96,7 +282,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if err != nil || msg.Type != protocol.TypeRegister {
 		errMsg, _ := protocol.Encode(protocol.NewError(400, "first message must be register"))
 		conn.Write(ctx, websocket.MessageText, errMsg)
-		conn.Close(websocket.StatusPolicyViolation, "invalid registration")
+		conn.Close(protocol.CloseInvalidRegistration, "invalid registration")
 		cancel()
 		protocol.ReleaseMessage(msg)
 		return
@@ -106,29 +292,74 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	if err := json.Unmarshal(msg.Payload, &regPayload); err != nil || regPayload.PublicKey == "" {
 		errMsg, _ := protocol.Encode(protocol.NewError(400, "public_key required"))
 		conn.Write(ctx, websocket.MessageText, errMsg)
-		conn.Close(websocket.StatusPolicyViolation, "missing public key")
+		conn.Close(protocol.CloseMissingPublicKey, "missing public key")
 		cancel()
 		protocol.ReleaseMessage(msg)
 		return
 	}
 	protocol.ReleaseMessage(msg)
 
-	fingerprint := generateFingerprint(regPayload.PublicKey)
+	if max := s.cfg.MaxAliasLength; max > 0 && len(regPayload.Alias) > max {
+		errMsg, _ := protocol.Encode(protocol.NewError(400, "alias too long"))
+		conn.Write(ctx, websocket.MessageText, errMsg)
+		conn.Close(protocol.CloseInvalidRegistration, "alias too long")
+		cancel()
+		return
+	}
+
+	if max := s.cfg.MaxPresenceWatch; max > 0 && len(regPayload.WatchPresence) > max {
+		errMsg, _ := protocol.Encode(protocol.NewError(400, "too many presence watches"))
+		conn.Write(ctx, websocket.MessageText, errMsg)
+		conn.Close(protocol.CloseInvalidRegistration, "too many presence watches")
+		cancel()
+		return
+	}
+
+	tier, ok := s.rateTier(regPayload.TierToken)
+	if !ok {
+		errMsg, _ := protocol.Encode(protocol.NewError(400, "unknown tier token"))
+		conn.Write(ctx, websocket.MessageText, errMsg)
+		conn.Close(protocol.CloseInvalidRegistration, "unknown tier token")
+		cancel()
+		return
+	}
+
+	fingerprint := generateFingerprint(s.cfg.FingerprintSalt, regPayload.PublicKey)
 	alias := regPayload.Alias
-	if alias == "" {
+	if s.cfg.DisableAliases {
+		alias = ""
+	} else if alias == "" {
 		alias = generateAlias(fingerprint)
 	}
 
 	p.Fingerprint = fingerprint
 	p.Alias = alias
+	if regPayload.IdentityKey != "" {
+		// prefixed so an identity never equals a fingerprint
+		p.Identity = generateFingerprint(s.cfg.FingerprintSalt, "identity:"+regPayload.IdentityKey)
+	}
+	p.Observer = regPayload.Observer
+	p.Binary = regPayload.Binary
+	p.Gzip = regPayload.Gzip
+	p.WatchPresence = regPayload.WatchPresence
+	p.SharePresence = regPayload.SharePresence
+	p.Region = regPayload.Region
+	if regPayload.PingIntervalMs > 0 {
+		p.PingInterval = s.clampPingInterval(time.Duration(regPayload.PingIntervalMs) * time.Millisecond)
+	}
 	if regPayload.Meta != nil {
 		p.UpdateMeta(regPayload.Meta)
 	}
 
 	if !s.hub.Register(p) {
-		errMsg, _ := protocol.Encode(protocol.NewError(503, "server full"))
+		fullMsg := s.cfg.ServerFullMessage
+		if fullMsg == "" {
+			fullMsg = "server full"
+		}
+		retryAfter := s.cfg.ServerFullRetryAfter.Duration
+		errMsg, _ := protocol.Encode(protocol.NewErrorRetry(503, fullMsg, retryAfter.Milliseconds()))
 		conn.Write(ctx, websocket.MessageText, errMsg)
-		conn.Close(websocket.StatusTryAgainLater, "server full")
+		conn.Close(protocol.CloseServerFull, serverFullReason(fullMsg, retryAfter))
 		cancel()
 		return
 	}
@@ -136,12 +367,174 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	regResp := protocol.NewMessage(protocol.TypeRegistered, fingerprint, protocol.RegisteredPayload{
 		Fingerprint: fingerprint,
 		Alias:       alias,
+		Identity:    p.Identity,
+		Tier:        tier.name,
 	})
 	data, _ := protocol.Encode(regResp)
 	conn.Write(ctx, websocket.MessageText, data)
 
+	// readPump's defer normally unregisters, this frees the slot promptly if
+	// it is held up
+	stop := s.hub.UnregisterOnDone(ctx, p)
+	defer stop()
+
 	go s.writePump(ctx, p)
-	s.readPump(ctx, p)
+	s.readPump(ctx, p, tier)
+}
+
+// rateLimit is the message rate and burst a peer is held to, from the
+// rate_limit_tiers entry named name or, when name is empty, the defaults.
+type rateLimit struct {
+	name        string
+	rate, burst int
+}
+
+// rateTier returns the limits for the tier whose token is token, the
+// defaults for no token, and false for a token no tier has.
+func (s *Server) rateTier(token string) (rateLimit, bool) {
+	if token == "" {
+		return rateLimit{rate: s.cfg.RateLimitPerSec, burst: s.cfg.RateLimitBurst}, true
+	}
+	for name, tier := range s.cfg.RateLimitTiers {
+		if tier.Token != "" && subtle.ConstantTimeCompare([]byte(tier.Token), []byte(token)) == 1 {
+			return rateLimit{name: name, rate: tier.RatePerSec, burst: tier.Burst}, true
+		}
+	}
+	return rateLimit{}, false
+}
+
+// clampPingInterval bounds a client-requested ping interval by the
+// configured min and max; a zero bound is not enforced.
+func (s *Server) clampPingInterval(d time.Duration) time.Duration {
+	if min := s.cfg.MinPingInterval.Duration; min > 0 && d < min {
+		d = min
+	}
+	if max := s.cfg.MaxPingInterval.Duration; max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// debugHandler serves /debug/pprof on the metrics port when pprof is
+// enabled, nil otherwise. It is never mounted on the main port.
+func (s *Server) debugHandler() http.Handler {
+	if !s.cfg.PprofEnabled && !s.cfg.MetricsEnabled {
+		return nil
+	}
+	mux := http.NewServeMux()
+	if s.cfg.MetricsEnabled {
+		mux.HandleFunc("/metrics", s.handleMetrics)
+	}
+	if s.cfg.PprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return s.requireAdmin(mux)
+}
+
+// otherNamespaces is the namespace label that metrics for namespaces
+// outside metrics_namespace_allowlist are summed under. It is reserved: a
+// namespace with this name is summed there too, even if allowlisted, so its
+// series can't be mistaken for the bucket's.
+const otherNamespaces = "other"
+
+// handleMetrics serves the hub's gauges in the Prometheus text format.
+// Only namespaces matching metrics_namespace_allowlist get series of their
+// own, so millions of short-lived namespaces can't explode cardinality.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	waiting := make(map[string]int)
+	for _, b := range s.hub.MatchBuckets() {
+		waiting[b.Namespace] += b.Waiting
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP peer_server_peers Connected peers.\n# TYPE peer_server_peers gauge\npeer_server_peers %d\n", s.hub.PeerCount())
+	writeLabelled(w, "peer_server_namespace_members", "gauge", "Members per namespace.", "namespace", s.foldNamespaces(s.hub.NamespaceStats()))
+	writeLabelled(w, "peer_server_match_waiting", "gauge", "Peers waiting for a match per namespace.", "namespace", s.foldNamespaces(waiting))
+	drops := make(map[string]int)
+	for cause, n := range s.hub.DropStats() {
+		drops[cause] = int(n)
+	}
+	writeLabelled(w, "peer_server_dropped_total", "counter", "Messages dropped, by cause.", "cause", drops)
+}
+
+// foldNamespaces keeps the allowlisted namespaces in counts and sums the
+// rest under otherNamespaces.
+func (s *Server) foldNamespaces(counts map[string]int) map[string]int {
+	folded := make(map[string]int)
+	for ns, n := range counts {
+		if s.metricsAllowed(ns) {
+			folded[ns] += n
+		} else {
+			folded[otherNamespaces] += n
+		}
+	}
+	return folded
+}
+
+// metricsAllowed reports whether ns matches an entry of
+// metrics_namespace_allowlist, an exact name or a path.Match glob.
+func (s *Server) metricsAllowed(ns string) bool {
+	if ns == otherNamespaces {
+		return false
+	}
+	for _, pattern := range s.cfg.MetricsNamespaceAllowlist {
+		if ok, _ := path.Match(pattern, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeLabelled writes one metric family with a series per key of values,
+// in key order.
+func writeLabelled(w io.Writer, name, kind, help, label string, values map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(k), values[k])
+	}
+}
+
+// requireAdmin rejects requests without "Authorization: Bearer <admin_token>"
+// when an admin token is configured.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	token := s.cfg.AdminToken
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serverFullReason builds the close reason for a rejected connection, with a
+// Retry-After style hint in seconds when one is configured.
+func serverFullReason(message string, retryAfter time.Duration) string {
+	suffix := ""
+	if retryAfter > 0 {
+		secs := int64((retryAfter + time.Second - 1) / time.Second)
+		suffix = fmt.Sprintf("; retry-after=%d", secs)
+	}
+	// close reasons are limited to 123 bytes
+	if max := 123 - len(suffix); len(message) > max {
+		message = message[:max]
+	}
+	return message + suffix
 }
 
 func isExpectedCloseError(err error) bool {
@@ -173,14 +566,14 @@ func isExpectedCloseError(err error) bool {
 	return false
 }
 
-func (s *Server) readPump(ctx context.Context, p *peer.Peer) {
+func (s *Server) readPump(ctx context.Context, p *peer.Peer, limit rateLimit) {
 	defer func() {
 		s.limiter.Remove(p.Fingerprint)
-		s.hub.Unregister(p.Fingerprint)
+		s.hub.UnregisterPeer(p)
 	}()
 
 	for {
-		_, data, err := p.Conn.Read(ctx)
+		typ, data, err := p.Conn.Read(ctx)
 		if err != nil {
 			if !isExpectedCloseError(err) && ctx.Err() == nil {
 				log.Printf("read error [%s]: %v", p.Fingerprint[:8], err)
@@ -188,18 +581,53 @@ func (s *Server) readPump(ctx context.Context, p *peer.Peer) {
 			return
 		}
 
-		if !s.limiter.Allow(p.Fingerprint) {
-			p.SendRaw(protocol.RateLimitBytes)
+		// the server-wide budget sheds load first, whoever the sender
+		if s.global != nil {
+			if ok, retry := s.global.AllowWithRetry(); !ok {
+				p.SendMessage(protocol.NewErrorRetry(429, "server busy", retryMillis(retry)))
+				continue
+			}
+		}
+		if ok, retry := s.limiter.AllowTier(p.Fingerprint, limit.rate, limit.burst); !ok {
+			p.SendMessage(protocol.NewErrorRetry(429, "rate limited", retryMillis(retry)))
 			continue
 		}
 
-		p.IncrementMsgCount()
-		s.hub.HandleMessage(p, data)
+		if n := p.IncrementMsgCount(); s.cfg.MaxMessagesPerConnection > 0 && n > s.cfg.MaxMessagesPerConnection {
+			errMsg, _ := protocol.Encode(protocol.NewError(429, "connection quota exceeded"))
+			p.Conn.Write(ctx, websocket.MessageText, errMsg)
+			p.Conn.Close(protocol.CloseQuotaExceeded, "connection quota exceeded")
+			return
+		}
+		if typ == websocket.MessageBinary {
+			// marked so it keeps its place among the peer's text messages
+			data = append([]byte{peer.BinaryMarker}, data...)
+		}
+		s.hub.Dispatch(p, data)
+	}
+}
+
+// retryMillis is a retry_after_ms hint for retry, rounded up so clients never
+// get a 0ms hint.
+func retryMillis(retry time.Duration) int64 {
+	return (retry + time.Millisecond - 1).Milliseconds()
+}
+
+// writeBatchMax is how many queued messages writePump writes after the one
+// that woke it before going back to its select.
+func (s *Server) writeBatchMax() int {
+	if s.cfg.WriteBatchMax > 0 {
+		return s.cfg.WriteBatchMax
 	}
+	return 64
 }
 
 func (s *Server) writePump(ctx context.Context, p *peer.Peer) {
-	ticker := time.NewTicker(s.cfg.PingInterval.Duration)
+	interval := s.cfg.PingInterval.Duration
+	if p.PingInterval > 0 {
+		interval = p.PingInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer func() {
 		ticker.Stop()
 		p.Conn.CloseNow()
@@ -212,23 +640,28 @@ func (s *Server) writePump(ctx context.Context, p *peer.Peer) {
 				p.Conn.Close(websocket.StatusNormalClosure, "")
 				return
 			}
+			typ, frame := peer.Frame(data)
 			writeCtx, writeCancel := context.WithTimeout(ctx, s.cfg.WriteTimeout.Duration)
-			err := p.Conn.Write(writeCtx, websocket.MessageText, data)
+			err := p.Conn.Write(writeCtx, typ, frame)
 			writeCancel()
 			if err != nil {
 				return
 			}
 
-			// batch drain
+			// batch drain, capped so pings and shutdown get a turn
 			n := len(p.Send)
+			if n > s.writeBatchMax() {
+				n = s.writeBatchMax()
+			}
 			for i := 0; i < n; i++ {
 				extra, ok := <-p.Send
 				if !ok {
 					p.Conn.Close(websocket.StatusNormalClosure, "")
 					return
 				}
+				typ, frame := peer.Frame(extra)
 				writeCtx, writeCancel := context.WithTimeout(ctx, s.cfg.WriteTimeout.Duration)
-				err := p.Conn.Write(writeCtx, websocket.MessageText, extra)
+				err := p.Conn.Write(writeCtx, typ, frame)
 				writeCancel()
 				if err != nil {
 					return
@@ -247,32 +680,314 @@ func (s *Server) writePump(ctx context.Context, p *peer.Peer) {
 	}
 }
 
+// Health is the /health response.
+type Health struct {
+	Status    string `json:"status"`
+	Peers     int64  `json:"peers"`
+	MaxPeers  int    `json:"max_peers"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Stats is the /stats response: the hub's stats plus server settings.
+// ShardCounts is only filled with ?verbose=1.
+type Stats struct {
+	hub.HubStats
+	MaxPeers    int   `json:"max_peers"`
+	Shards      int   `json:"shards"`
+	ShardCounts []int `json:"shard_counts,omitempty"`
+}
+
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    "ok",
-		"peers":     s.hub.PeerCount(),
-		"max_peers": s.cfg.MaxPeers,
-		"timestamp": time.Now().Unix(),
+	json.NewEncoder(w).Encode(Health{
+		Status:    "ok",
+		Peers:     s.hub.PeerCount(),
+		MaxPeers:  s.cfg.MaxPeers,
+		Timestamp: time.Now().Unix(),
 	})
 }
 
-func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+// checkUpgrade answers /ws requests that can't become a websocket before
+// Accept gets them, with a JSON error a plain HTTP client can read: 426 for
+// requests that aren't websocket upgrades, 403 for browsers on an origin
+// outside allowed_origins.
+func (s *Server) checkUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		writeJSONError(w, http.StatusUpgradeRequired, r.URL.Path+" expects a WebSocket upgrade")
+		return false
+	}
+	if !s.originAllowed(r) {
+		writeJSONError(w, http.StatusForbidden, "origin not allowed")
+		return false
+	}
+	return true
+}
+
+// originAllowed reports whether r's Origin is acceptable: no Origin (not a
+// browser), the server's own host, any origin when allowed_origins is empty,
+// or a host matching one of its entries, exact or a path.Match glob.
+func (s *Server) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.cfg.AllowedOrigins) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(r.Host) {
+		return true
+	}
+	for _, pattern := range s.cfg.AllowedOrigins {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHasToken reports whether the comma separated header name contains
+// token, case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_peers": s.hub.PeerCount(),
-		"max_peers":   s.cfg.MaxPeers,
-		"namespaces":  s.hub.NamespaceStats(),
-		"shards":      s.cfg.ShardCount,
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+var pongBody = []byte("pong")
+
+// handlePing is a cheap liveness probe for load balancers, unlike /health it
+// touches no hub state and encodes nothing.
+func handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(pongBody)
+}
+
+// handleEcho writes every websocket message back to its sender, for checking
+// that upgrades and frames make it through proxies. No registration, no hub,
+// but the same upgrade and origin checks as /ws, at most
+// max_echo_connections at once, the per-peer rate limit, and a connection
+// idle for pong_wait is closed.
+func (s *Server) handleEcho(w http.ResponseWriter, r *http.Request) {
+	if !s.checkUpgrade(w, r) {
+		return
+	}
+	// the slot is reserved before the handshake, which runs unlocked so a
+	// stalled one doesn't hold up the others
+	s.echoMu.Lock()
+	if max := s.cfg.MaxEchoConnections; max > 0 && s.echoSlots >= max {
+		s.echoMu.Unlock()
+		writeJSONError(w, http.StatusServiceUnavailable, "too many echo connections")
+		return
+	}
+	s.echoSlots++
+	s.echoMu.Unlock()
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
 	})
+	if err != nil {
+		s.echoMu.Lock()
+		s.echoSlots--
+		s.echoMu.Unlock()
+		return
+	}
+	s.echoMu.Lock()
+	s.echoConns[conn] = struct{}{}
+	s.echoMu.Unlock()
+
+	// rate limited like a peer, under a key no fingerprint can have
+	limitKey := fmt.Sprintf("echo:%p", conn)
+	defer func() {
+		s.echoMu.Lock()
+		delete(s.echoConns, conn)
+		s.echoSlots--
+		s.echoMu.Unlock()
+		s.limiter.Remove(limitKey)
+		conn.CloseNow()
+	}()
+	conn.SetReadLimit(s.cfg.MaxMessageSize)
+
+	ctx := r.Context()
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, s.cfg.PongWait.Duration)
+		typ, data, err := conn.Read(readCtx)
+		cancel()
+		if err != nil {
+			return
+		}
+		if ok, _ := s.limiter.AllowTier(limitKey, s.cfg.RateLimitPerSec, s.cfg.RateLimitBurst); !ok {
+			continue
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, s.cfg.WriteTimeout.Duration)
+		err = conn.Write(writeCtx, typ, data)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		HubStats: s.hub.Stats(),
+		MaxPeers: s.cfg.MaxPeers,
+		Shards:   s.cfg.ShardCount,
+	}
+	query := r.URL.Query()
+	if v := query.Get("verbose"); v == "1" || v == "true" {
+		stats.ShardCounts = s.hub.ShardCounts()
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	stats.Namespaces = filterNamespaces(stats.Namespaces, query.Get("prefix"), limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// filterNamespaces keeps the namespaces whose name starts with prefix and,
+// when limit is positive, only the limit largest of those.
+func filterNamespaces(counts map[string]int, prefix string, limit int) map[string]int {
+	if prefix == "" && (limit <= 0 || len(counts) <= limit) {
+		return counts
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	if limit > 0 && len(names) > limit {
+		sort.Slice(names, func(i, j int) bool {
+			if counts[names[i]] != counts[names[j]] {
+				return counts[names[i]] > counts[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		names = names[:limit]
+	}
+	filtered := make(map[string]int, len(names))
+	for _, name := range names {
+		filtered[name] = counts[name]
+	}
+	return filtered
+}
+
+// handleAdminPeer reports one connected peer's state and the last errors it
+// was sent, for debugging a misbehaving client. Aliases are accepted too,
+// with ?namespace= when aliases are scoped per namespace.
+func (s *Server) handleAdminPeer(w http.ResponseWriter, r *http.Request) {
+	fingerprint := r.PathValue("fingerprint")
+	if fp, ok := s.hub.ResolveAlias(r.URL.Query().Get("namespace"), fingerprint); ok {
+		fingerprint = fp
+	}
+	p, ok := s.hub.GetPeer(fingerprint)
+	if !ok {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		return
+	}
+	detail := map[string]interface{}{
+		"fingerprint":   p.Fingerprint,
+		"alias":         p.Alias,
+		"observer":      p.Observer,
+		"region":        p.Region,
+		"connected_at":  p.ConnectedAt,
+		"namespaces":    p.GetNamespaces(),
+		"message_count": p.MsgCount(),
+		"send_queue":    len(p.Send),
+		"recent_errors": p.RecentErrors(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+func (s *Server) handleAdminCleanup(w http.ResponseWriter, r *http.Request) {
+	removed := s.hub.CleanupNamespaces()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
+
+// handleAdminMatchmaker lists the match buckets peers are waiting in, for
+// seeing why matches don't form.
+func (s *Server) handleAdminMatchmaker(w http.ResponseWriter, r *http.Request) {
+	buckets := s.hub.MatchBuckets()
+	if buckets == nil {
+		buckets = []matchmaker.Bucket{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"buckets": buckets})
+}
+
+// handleAdminReconnectAll asks every peer to reconnect, staggered over
+// ?jitter= and closed after ?grace= if it hasn't, both durations like "30s".
+func (s *Server) handleAdminReconnectAll(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var jitter, grace time.Duration
+	for name, d := range map[string]*time.Duration{"jitter": &jitter, "grace": &grace} {
+		v := query.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid "+name, http.StatusBadRequest)
+			return
+		}
+		*d = parsed
+	}
+	n := s.hub.ReconnectAll(jitter, grace, query.Get("reason"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"peers": n})
 }
 
 func (s *Server) Shutdown() {
 	s.limiter.Close()
 	s.hub.Shutdown()
+
+	s.echoMu.Lock()
+	echoes := make([]*websocket.Conn, 0, len(s.echoConns))
+	for conn := range s.echoConns {
+		echoes = append(echoes, conn)
+	}
+	s.echoMu.Unlock()
+	for _, conn := range echoes {
+		conn.Close(websocket.StatusGoingAway, "server shutting down")
+	}
+
+	s.httpMu.Lock()
+	defer s.httpMu.Unlock()
+	for _, srv := range s.httpServers {
+		srv.Close()
+	}
 }
 
-func generateFingerprint(publicKey string) string {
+// generateFingerprint hashes publicKey, prefixed with "salt:" when a salt is
+// set so the same key gets a different fingerprint on each deployment.
+func generateFingerprint(salt, publicKey string) string {
+	if salt != "" {
+		publicKey = salt + ":" + publicKey
+	}
 	hash := sha256.Sum256([]byte(publicKey))
 	return hex.EncodeToString(hash[:])
 }
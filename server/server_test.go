@@ -1,12 +1,26 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -27,39 +41,21 @@ func newTestServerSimple() (*Server, *httptest.Server) {
 	cfg.RateLimitBurst = 2000
 	cfg.SendBufferSize = 32
 	cfg.CompressionEnabled = false
+	return newTestServerWithConfig(cfg)
+}
 
+func newTestServerWithConfig(cfg *config.Config) (*Server, *httptest.Server) {
 	b := broker.NewLocal()
 	h := hub.New(cfg.ShardCount, cfg.MaxPeers, b)
 	srv := New(cfg, h)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", srv.handleWebSocket)
-	mux.HandleFunc("/health", srv.handleHealth)
-	mux.HandleFunc("/stats", srv.handleStats)
-
-	ts := httptest.NewServer(mux)
+	ts := httptest.NewServer(srv.routes())
 	return srv, ts
 }
 
 func connectAndRegister(t *testing.T, tsURL, publicKey string) (*websocket.Conn, string) {
 	t.Helper()
-
-	url := "ws" + strings.TrimPrefix(tsURL, "http") + "/ws"
-	ctx := context.Background()
-	conn, _, err := websocket.Dial(ctx, url, nil)
-	if err != nil {
-		t.Fatalf("dial error: %v", err)
-	}
-
-	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: publicKey})
-	regMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
-	conn.Write(ctx, websocket.MessageText, regMsg)
-
-	_, data, err := conn.Read(ctx)
-	if err != nil {
-		t.Fatalf("read registered response error: %v", err)
-	}
-	msg, _ := protocol.Decode(data)
+	conn, msg := connectAndRegisterWith(t, tsURL, protocol.RegisterPayload{PublicKey: publicKey}, nil)
 	if msg.Type != protocol.TypeRegistered {
 		t.Fatalf("expected registered, got %s", msg.Type)
 	}
@@ -69,6 +65,23 @@ func connectAndRegister(t *testing.T, tsURL, publicKey string) (*websocket.Conn,
 	return conn, rp.Fingerprint
 }
 
+// connectAndRegisterWith dials tsURL's /ws with dialOpts, registers with
+// payload and returns the connection and the server's reply, which may be
+// an error rather than registered.
+func connectAndRegisterWith(t *testing.T, tsURL string, payload protocol.RegisterPayload, dialOpts *websocket.DialOptions) (*websocket.Conn, *protocol.Message) {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(tsURL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), url, dialOpts)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+
+	regPayload, _ := json.Marshal(payload)
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+	return conn, readMessage(t, conn, 5*time.Second)
+}
+
 func readMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration) *protocol.Message {
 	t.Helper()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -129,184 +142,1342 @@ func TestServerStatsEndpoint(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		t.Errorf("expected 200, got %d", resp.StatusCode)
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body["total_peers"] == nil {
+		t.Error("expected total_peers in stats")
+	}
+}
+
+func TestServerStatsTyped(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxPeers = 50
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	conn, _ := connectAndRegister(t, ts.URL, "typed-key")
+	defer conn.CloseNow()
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "typed-ns", AppType: "game"})
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	readMessage(t, conn, time.Second) // peer_list
+
+	resp, err := http.Get(ts.URL + "/stats?verbose=1")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	var stats Stats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if stats.TotalPeers != 1 || stats.MaxPeers != 50 || stats.Shards != cfg.ShardCount {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if stats.Namespaces["typed-ns"] != 1 {
+		t.Errorf("expected typed-ns with 1 peer, got %v", stats.Namespaces)
+	}
+	if len(stats.ShardCounts) != cfg.ShardCount {
+		t.Errorf("expected %d shard counts, got %d", cfg.ShardCount, len(stats.ShardCounts))
+	}
+	if _, ok := stats.Dropped["send_buffer_full"]; !ok {
+		t.Errorf("expected dropped counters, got %v", stats.Dropped)
+	}
+
+	resp, err = http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("health request error: %v", err)
+	}
+	defer resp.Body.Close()
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatalf("decode health: %v", err)
+	}
+	if health.Status != "ok" || health.Peers != 1 || health.MaxPeers != 50 || health.Timestamp == 0 {
+		t.Errorf("unexpected health %+v", health)
+	}
+}
+
+func TestServerPingEndpoint(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ping")
+	if err != nil {
+		t.Fatalf("ping request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "pong" {
+		t.Errorf("expected 200 pong, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestServerEchoEndpoint(t *testing.T) {
+	_, ts := newTestServerSimple()
+	resp, err := http.Get(ts.URL + "/echo")
+	if err != nil {
+		t.Fatalf("echo request error: %v", err)
+	}
+	resp.Body.Close()
+	ts.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("echo should not be served by default, got %d", resp.StatusCode)
+	}
+
+	cfg := config.Default()
+	cfg.EchoEnabled = true
+	_, ts = newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/echo", nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	for _, want := range []struct {
+		typ  websocket.MessageType
+		data string
+	}{
+		{websocket.MessageText, "hello"},
+		{websocket.MessageBinary, "\x00\x01\x02"},
+	} {
+		conn.Write(ctx, want.typ, []byte(want.data))
+		typ, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if typ != want.typ || string(data) != want.data {
+			t.Errorf("expected %v %q echoed, got %v %q", want.typ, want.data, typ, data)
+		}
+	}
+}
+
+func TestServerEchoGuards(t *testing.T) {
+	cfg := config.Default()
+	cfg.EchoEnabled = true
+	cfg.MaxEchoConnections = 1
+	cfg.PongWait = config.Duration{Duration: 200 * time.Millisecond}
+	srv, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+	echoURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/echo"
+
+	resp, err := http.Get(ts.URL + "/echo")
+	if err != nil {
+		t.Fatalf("echo request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("expected 426 for a plain GET, got %d", resp.StatusCode)
+	}
+
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, echoURL, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+	if _, resp, err := websocket.Dial(ctx, echoURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 over max_echo_connections, got %v", err)
+	}
+
+	// an idle connection is closed after pong_wait and frees its slot
+	readCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(readCtx); err == nil || readCtx.Err() != nil {
+		t.Fatalf("expected the idle echo connection closed, got %v", err)
+	}
+	var again *websocket.Conn
+	for deadline := time.Now().Add(time.Second); ; {
+		if again, _, err = websocket.Dial(ctx, echoURL, nil); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the slot freed, got %v", err)
+	}
+	defer again.CloseNow()
+
+	srv.Shutdown()
+	readCtx, cancel = context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if _, _, err := again.Read(readCtx); websocket.CloseStatus(err) != websocket.StatusGoingAway {
+		t.Errorf("expected shutdown to close the echo connection, got %v", err)
+	}
+}
+
+func TestServerStatsVerboseShardCounts(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn, _ := connectAndRegister(t, ts.URL, "shard-key")
+	defer conn.CloseNow()
+
+	resp, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if _, ok := body["shard_counts"]; ok {
+		t.Error("shard_counts should only be present in verbose mode")
+	}
+
+	resp, err = http.Get(ts.URL + "/stats?verbose=1")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	defer resp.Body.Close()
+	var verbose struct {
+		TotalPeers  int64 `json:"total_peers"`
+		ShardCounts []int `json:"shard_counts"`
+	}
+	json.NewDecoder(resp.Body).Decode(&verbose)
+	total := 0
+	for _, n := range verbose.ShardCounts {
+		total += n
+	}
+	if int64(total) != verbose.TotalPeers {
+		t.Errorf("shard counts sum %d != total_peers %d", total, verbose.TotalPeers)
+	}
+	if total != 1 {
+		t.Errorf("expected 1 peer across shards, got %d", total)
+	}
+}
+
+func TestServerStatsNamespaceFilter(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	join := func(key string, namespaces ...string) {
+		conn, _ := connectAndRegister(t, ts.URL, key)
+		t.Cleanup(func() { conn.CloseNow() })
+		for _, ns := range namespaces {
+			sendMessage(t, conn, &protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"` + ns + `"}`)})
+			readMessage(t, conn, time.Second) // peer_list
+		}
+	}
+	join("filter-a", "game:1", "game:2", "chat:1")
+	join("filter-b", "game:2")
+	join("filter-c", "game:2", "game:3")
+
+	get := func(query string) map[string]int {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/stats" + query)
+		if err != nil {
+			t.Fatalf("stats request error: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Namespaces map[string]int `json:"namespaces"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Namespaces
+	}
+
+	got := get("?prefix=game:")
+	if len(got) != 3 || got["game:1"] != 1 || got["game:2"] != 3 || got["game:3"] != 1 {
+		t.Errorf("expected only game: namespaces, got %v", got)
+	}
+	if _, ok := got["chat:1"]; ok {
+		t.Error("chat:1 should be filtered out")
+	}
+	if got := get("?prefix=game:&limit=1"); len(got) != 1 || got["game:2"] != 3 {
+		t.Errorf("expected only the largest game namespace, got %v", got)
+	}
+	if got := get(""); len(got) != 4 {
+		t.Errorf("expected all namespaces without a filter, got %v", got)
+	}
+
+	resp, err := http.Get(ts.URL + "/stats?limit=x")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid limit, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerStatsSendQueue(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn, _ := connectAndRegister(t, ts.URL, "queue-key")
+	defer conn.CloseNow()
+
+	resp, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	for _, key := range []string{"send_queue_max", "send_queue_p95"} {
+		if _, ok := body[key]; !ok {
+			t.Errorf("stats missing %s", key)
+		}
+	}
+	dropped, _ := body["dropped"].(map[string]interface{})
+	for _, key := range []string{"send_buffer_full", "broker_publish_error", "target_not_found", "broadcast_rejected"} {
+		if _, ok := dropped[key]; !ok {
+			t.Errorf("stats dropped missing %s", key)
+		}
+	}
+}
+
+func TestServerDisableAliases(t *testing.T) {
+	cfg := config.Default()
+	cfg.DisableAliases = true
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: "private-key", Alias: "wanted-alias"})
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+
+	msg := readMessage(t, conn, time.Second)
+	if msg.Type != protocol.TypeRegistered {
+		t.Fatalf("expected registered, got %s", msg.Type)
+	}
+	var rp protocol.RegisteredPayload
+	json.Unmarshal(msg.Payload, &rp)
+	if rp.Alias != "" {
+		t.Errorf("expected no alias, got %q", rp.Alias)
+	}
+}
+
+func TestServerPprofToggle(t *testing.T) {
+	b := broker.NewLocal()
+	h := hub.New(64, 100, b)
+	defer h.Shutdown()
+
+	cfg := config.Default()
+	if New(cfg, h).debugHandler() != nil {
+		t.Fatal("debug handler should not exist when pprof and metrics are disabled")
+	}
+
+	cfg.PprofEnabled = true
+	ts := httptest.NewServer(New(cfg, h).debugHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("pprof request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 from pprof index, got %d", resp.StatusCode)
+	}
+
+	// the main mux never serves pprof
+	_, mainTS := newTestServerWithConfig(cfg)
+	defer mainTS.Close()
+	resp, err = http.Get(mainTS.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 on main port, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerMetricsNamespaceAllowlist(t *testing.T) {
+	cfg := config.Default()
+	cfg.MetricsEnabled = true
+	cfg.MetricsNamespaceAllowlist = []string{"lobby-*", "main", "other"}
+	srv, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+	defer srv.hub.Shutdown()
+
+	// "other" is reserved for the sum, so a namespace of that name is
+	// counted in it rather than getting a second series with the label
+	for i, ns := range []string{"lobby-eu", "lobby-eu", "room-1", "room-2", "other"} {
+		conn, _ := connectAndRegister(t, ts.URL, fmt.Sprintf("metrics-key-%d", i))
+		defer conn.CloseNow()
+		sendMessage(t, conn, &protocol.Message{Type: protocol.TypeJoin, Payload: []byte(`{"namespace":"` + ns + `"}`)})
+		readMessage(t, conn, time.Second) // peer_list
+	}
+
+	metricsTS := httptest.NewServer(srv.debugHandler())
+	defer metricsTS.Close()
+	resp, err := http.Get(metricsTS.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("metrics request error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	out := string(body)
+
+	for _, want := range []string{
+		"peer_server_peers 5\n",
+		`peer_server_namespace_members{namespace="lobby-eu"} 2` + "\n",
+		`peer_server_namespace_members{namespace="other"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in metrics:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, `peer_server_namespace_members{namespace="other"}`); n != 1 {
+		t.Errorf("expected one other series, got %d:\n%s", n, out)
+	}
+	if strings.Contains(out, "room-1") || strings.Contains(out, "room-2") {
+		t.Errorf("namespaces outside the allowlist should not get their own series:\n%s", out)
+	}
+}
+
+func TestServerPprofAdminToken(t *testing.T) {
+	b := broker.NewLocal()
+	h := hub.New(64, 100, b)
+	defer h.Shutdown()
+
+	cfg := config.Default()
+	cfg.PprofEnabled = true
+	cfg.AdminToken = "s3cret"
+	ts := httptest.NewServer(New(cfg, h).debugHandler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 with token, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerReplacedConnectionNotified(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	oldConn, _ := connectAndRegister(t, ts.URL, "same-key")
+	defer oldConn.CloseNow()
+	newConn, _ := connectAndRegister(t, ts.URL, "same-key")
+	defer newConn.CloseNow()
+
+	msg := readMessage(t, oldConn, time.Second)
+	if msg.Type != protocol.TypeReplaced {
+		t.Fatalf("expected peer_replaced, got %s", msg.Type)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := oldConn.Read(ctx); err == nil {
+		t.Error("replaced connection should be closed after the notice")
+	}
+}
+
+func TestClampPingInterval(t *testing.T) {
+	cfg := config.Default()
+	cfg.MinPingInterval = config.Duration{Duration: 5 * time.Second}
+	cfg.MaxPingInterval = config.Duration{Duration: time.Minute}
+	srv := &Server{cfg: cfg}
+
+	tests := []struct {
+		in, want time.Duration
+	}{
+		{time.Second, 5 * time.Second},
+		{20 * time.Second, 20 * time.Second},
+		{time.Hour, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := srv.clampPingInterval(tt.in); got != tt.want {
+			t.Errorf("clamp(%v): expected %v, got %v", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestServerPerPeerPingInterval(t *testing.T) {
+	cfg := config.Default()
+	cfg.PingInterval = config.Duration{Duration: time.Minute}
+	cfg.MinPingInterval = config.Duration{Duration: 10 * time.Millisecond}
+	cfg.WriteTimeout = config.Duration{Duration: 100 * time.Millisecond}
+	srv, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	dial := func(key string, pingMs int64) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+		conn, _, err := websocket.Dial(context.Background(), url, nil)
+		if err != nil {
+			t.Fatalf("dial error: %v", err)
+		}
+		regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: key, PingIntervalMs: pingMs})
+		sendMessage(t, conn, &protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+		readMessage(t, conn, time.Second)
+		return conn
+	}
+
+	// neither client reads, so pings go unanswered. Only the peer that asked
+	// for a fast interval is pinged, times out and is dropped.
+	fast := dial("fast-key", 20)
+	defer fast.CloseNow()
+	slow := dial("slow-key", 0)
+	defer slow.CloseNow()
+
+	fastFP := generateFingerprint("", "fast-key")
+	deadline := time.After(2 * time.Second)
+	for {
+		if _, ok := srv.hub.GetPeer(fastFP); !ok {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("fast-ping peer should have been pinged and dropped")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	if _, ok := srv.hub.GetPeer(generateFingerprint("", "slow-key")); !ok {
+		t.Error("default-interval peer should not have been pinged yet")
+	}
+}
+
+func TestServerFullCustomMessage(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxPeers = 1
+	cfg.ServerFullMessage = "full, try eu-2.example.com"
+	cfg.ServerFullRetryAfter = config.Duration{Duration: 5 * time.Second}
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	conn1, _ := connectAndRegister(t, ts.URL, "full-key-1")
+	defer conn1.CloseNow()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn2, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn2.CloseNow()
+
+	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: "full-key-2"})
+	sendMessage(t, conn2, &protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+
+	msg := readMessage(t, conn2, 2*time.Second)
+	if msg.Type != protocol.TypeError {
+		t.Fatalf("expected error, got %s", msg.Type)
+	}
+	var ep protocol.ErrorPayload
+	json.Unmarshal(msg.Payload, &ep)
+	if ep.Code != 503 {
+		t.Errorf("expected code 503, got %d", ep.Code)
+	}
+	if ep.Message != "full, try eu-2.example.com" {
+		t.Errorf("expected custom message, got %q", ep.Message)
+	}
+	if ep.RetryAfterMs != 5000 {
+		t.Errorf("expected retry_after_ms 5000, got %d", ep.RetryAfterMs)
+	}
+
+	_, _, err = conn2.Read(context.Background())
+	var ce websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected close error, got %v", err)
+	}
+	if ce.Code != protocol.CloseServerFull {
+		t.Errorf("expected CloseServerFull, got %v", ce.Code)
+	}
+	if ce.Reason != "full, try eu-2.example.com; retry-after=5" {
+		t.Errorf("unexpected close reason %q", ce.Reason)
+	}
+}
+
+func TestServerFullReasonTruncated(t *testing.T) {
+	reason := serverFullReason(strings.Repeat("x", 200), 1500*time.Millisecond)
+	if len(reason) > 123 {
+		t.Errorf("close reason too long: %d bytes", len(reason))
+	}
+	if !strings.HasSuffix(reason, "; retry-after=2") {
+		t.Errorf("expected rounded-up retry hint, got %q", reason)
+	}
+	if got := serverFullReason("server full", 0); got != "server full" {
+		t.Errorf("expected no hint without retry-after, got %q", got)
+	}
+}
+
+func TestServerWebSocketRegister(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn, fp := connectAndRegister(t, ts.URL, "test-public-key-1")
+	defer conn.CloseNow()
+
+	expectedFP := sha256Hex("test-public-key-1")
+	if fp != expectedFP {
+		t.Errorf("expected fingerprint %s, got %s", expectedFP, fp)
+	}
+}
+
+func TestServerRegisterMissingPublicKey(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: ""})
+	regMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+	conn.Write(context.Background(), websocket.MessageText, regMsg)
+
+	_, data, err := conn.Read(context.Background())
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	msg, _ := protocol.Decode(data)
+	if msg.Type != protocol.TypeError {
+		t.Errorf("expected error, got %s", msg.Type)
+	}
+	expectCloseCode(t, conn, protocol.CloseMissingPublicKey)
+}
+
+func TestServerRegisterInvalidFirstMessage(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "test"})
+	joinMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
+	conn.Write(context.Background(), websocket.MessageText, joinMsg)
+
+	_, data, err := conn.Read(context.Background())
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	msg, _ := protocol.Decode(data)
+	if msg.Type != protocol.TypeError {
+		t.Errorf("expected error, got %s", msg.Type)
+	}
+	expectCloseCode(t, conn, protocol.CloseInvalidRegistration)
+}
+
+func TestServerRegisterAliasTooLong(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxAliasLength = 8
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	conn, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "long-alias-key", Alias: "much-too-long"}, nil)
+	defer conn.CloseNow()
+
+	var ep protocol.ErrorPayload
+	json.Unmarshal(msg.Payload, &ep)
+	if msg.Type != protocol.TypeError || ep.Code != 400 {
+		t.Errorf("expected 400 error, got %s %d", msg.Type, ep.Code)
+	}
+	expectCloseCode(t, conn, protocol.CloseInvalidRegistration)
+}
+
+func TestServerRegisterTimeout(t *testing.T) {
+	cfg := config.Default()
+	cfg.PongWait = config.Duration{Duration: 50 * time.Millisecond}
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.CloseNow()
+
+	// never register
+	expectCloseCode(t, conn, protocol.CloseRegistrationTimeout)
+}
+
+// expectCloseCode reads until the connection closes and checks the close
+// code, skipping any messages sent before the close.
+func expectCloseCode(t *testing.T, conn *websocket.Conn, code websocket.StatusCode) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for {
+		_, _, err := conn.Read(ctx)
+		if err == nil {
+			continue
+		}
+		if got := websocket.CloseStatus(err); got != code {
+			t.Errorf("expected close code %d, got %d (%v)", code, got, err)
+		}
+		return
+	}
+}
+
+func TestServerFullFlow(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn1, _ := connectAndRegister(t, ts.URL, "key1")
+	defer conn1.CloseNow()
+	conn2, _ := connectAndRegister(t, ts.URL, "key2")
+	defer conn2.CloseNow()
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby", AppType: "game"})
+	joinMsg := &protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}
+
+	sendMessage(t, conn1, joinMsg)
+	msg1 := readMessage(t, conn1, 2*time.Second)
+	if msg1.Type != protocol.TypePeerList {
+		t.Errorf("expected peer_list, got %s", msg1.Type)
+	}
+
+	sendMessage(t, conn2, joinMsg)
+	msg2 := readMessage(t, conn2, 2*time.Second)
+	if msg2.Type != protocol.TypePeerList {
+		t.Errorf("expected peer_list, got %s", msg2.Type)
+	}
+
+	msg3 := readMessage(t, conn1, 2*time.Second)
+	if msg3.Type != protocol.TypePeerJoined {
+		t.Errorf("expected peer_joined, got %s", msg3.Type)
+	}
+}
+
+func TestServerSignalFlow(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn1, fp1 := connectAndRegister(t, ts.URL, "signal-key1")
+	defer conn1.CloseNow()
+	conn2, fp2 := connectAndRegister(t, ts.URL, "signal-key2")
+	defer conn2.CloseNow()
+
+	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "signal-ns", AppType: "game"})
+	joinMsg := &protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}
+
+	sendMessage(t, conn1, joinMsg)
+	readMessage(t, conn1, 2*time.Second)
+
+	sendMessage(t, conn2, joinMsg)
+	readMessage(t, conn2, 2*time.Second)
+	readMessage(t, conn1, 2*time.Second)
+
+	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer", SDP: "test-sdp"})
+	signalMsg := &protocol.Message{Type: protocol.TypeSignal, To: fp2, Payload: signalPayload}
+	sendMessage(t, conn1, signalMsg)
+
+	received := readMessage(t, conn2, 2*time.Second)
+	if received.Type != protocol.TypeSignal {
+		t.Errorf("expected signal, got %s", received.Type)
+	}
+	if received.From != fp1 {
+		t.Errorf("expected from %s, got %s", fp1, received.From)
+	}
+}
+
+func TestServerRoomFlow(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn1, _ := connectAndRegister(t, ts.URL, "room-owner-key")
+	defer conn1.CloseNow()
+	conn2, _ := connectAndRegister(t, ts.URL, "room-joiner-key")
+	defer conn2.CloseNow()
+
+	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "test-room", MaxSize: 10})
+	sendMessage(t, conn1, &protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
+
+	msg := readMessage(t, conn1, 2*time.Second)
+	if msg.Type != protocol.TypeRoomCreated {
+		t.Errorf("expected room_created, got %s", msg.Type)
+	}
+
+	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "test-room"})
+	sendMessage(t, conn2, &protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload})
+
+	msg = readMessage(t, conn2, 2*time.Second)
+	if msg.Type != protocol.TypePeerList {
+		t.Errorf("expected peer_list, got %s", msg.Type)
+	}
+
+	msg = readMessage(t, conn1, 2*time.Second)
+	if msg.Type != protocol.TypePeerJoined {
+		t.Errorf("expected peer_joined, got %s", msg.Type)
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	conn, _ := connectAndRegister(t, ts.URL, "ping-key")
+	defer conn.CloseNow()
+
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	msg := readMessage(t, conn, 2*time.Second)
+	if msg.Type != protocol.TypePong {
+		t.Errorf("expected pong, got %s", msg.Type)
+	}
+}
+
+func TestServerWebSocketUpgradeErrors(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowedOrigins = []string{"*.example.com"}
+	srv, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+	defer srv.hub.Shutdown()
+
+	resp, err := http.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatalf("get error: %v", err)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Upgrade") != "websocket" || body.Error == "" {
+		t.Errorf("expected 426 with an error body, got %d %q", resp.StatusCode, body.Error)
+	}
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, resp, err = websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Origin": {"https://evil.test"}},
+	})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a disallowed origin, got %v", err)
+	}
+
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Origin": {"https://app.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("allowed origin should connect: %v", err)
+	}
+	conn.CloseNow()
+}
+
+func TestServerRateLimitRetryHint(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimitPerSec = 1
+	cfg.RateLimitBurst = 1
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	conn, _ := connectAndRegister(t, ts.URL, "ratelimit-hint-key")
+	defer conn.CloseNow()
+
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	if msg := readMessage(t, conn, 2*time.Second); msg.Type != protocol.TypePong {
+		t.Fatalf("expected pong, got %s", msg.Type)
+	}
+
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	msg := readMessage(t, conn, 2*time.Second)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(msg.Payload, &ep)
+	if msg.Type != protocol.TypeError || ep.Code != 429 {
+		t.Fatalf("expected 429, got %s %d", msg.Type, ep.Code)
+	}
+	if ep.RetryAfterMs <= 0 || ep.RetryAfterMs > 1000 {
+		t.Errorf("expected retry_after_ms in (0, 1000], got %d", ep.RetryAfterMs)
+	}
+}
+
+func TestServerRateLimitTiers(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimitPerSec = 1
+	cfg.RateLimitBurst = 3
+	cfg.RateLimitTiers = map[string]config.RateLimitTier{
+		"premium": {RatePerSec: 1, Burst: 30, Token: "premium-token"},
+	}
+	srv, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+	defer srv.hub.Shutdown()
+
+	// pongs answered before the first 429, out of 20 pings sent at once
+	sustained := func(conn *websocket.Conn) int {
+		for i := 0; i < 20; i++ {
+			sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+		}
+		n := 0
+		for i := 0; i < 20; i++ {
+			if msg := readMessage(t, conn, time.Second); msg.Type == protocol.TypePong {
+				n++
+			}
+		}
+		return n
+	}
+
+	free, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "tier-free-key"}, nil)
+	defer free.CloseNow()
+	if msg.Type != protocol.TypeRegistered {
+		t.Fatalf("expected registered, got %s", msg.Type)
+	}
+	premium, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "tier-premium-key", TierToken: "premium-token"}, nil)
+	defer premium.CloseNow()
+	var rp protocol.RegisteredPayload
+	json.Unmarshal(msg.Payload, &rp)
+	if rp.Tier != "premium" {
+		t.Fatalf("expected premium tier, got %q", rp.Tier)
+	}
+
+	if f, p := sustained(free), sustained(premium); f > 4 || p < 20 {
+		t.Errorf("expected premium to sustain all 20 and free about its burst of 3, got premium %d free %d", p, f)
+	}
+
+	bad, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "tier-bad-key", TierToken: "guessed"}, nil)
+	defer bad.CloseNow()
+	var ep protocol.ErrorPayload
+	json.Unmarshal(msg.Payload, &ep)
+	if msg.Type != protocol.TypeError || ep.Code != 400 {
+		t.Errorf("expected 400 for an unknown tier token, got %s %d", msg.Type, ep.Code)
+	}
+}
+
+func TestServerGlobalRateLimit(t *testing.T) {
+	cfg := config.Default()
+	cfg.GlobalRateLimitPerSec = 5
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	// each client is far under its own limit, together they exceed the server's
+	const clients, perClient = 4, 5
+	conns := make([]*websocket.Conn, clients)
+	for i := range conns {
+		conn, _ := connectAndRegister(t, ts.URL, fmt.Sprintf("global-limit-key-%d", i))
+		defer conn.CloseNow()
+		conns[i] = conn
+	}
+	for _, conn := range conns {
+		for j := 0; j < perClient; j++ {
+			sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+		}
 	}
 
-	var body map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&body)
-	if body["total_peers"] == nil {
-		t.Error("expected total_peers in stats")
+	var pongs, busy int
+	for _, conn := range conns {
+		for j := 0; j < perClient; j++ {
+			msg := readMessage(t, conn, 2*time.Second)
+			switch msg.Type {
+			case protocol.TypePong:
+				pongs++
+			case protocol.TypeError:
+				var ep protocol.ErrorPayload
+				json.Unmarshal(msg.Payload, &ep)
+				if ep.Code != 429 || ep.Message != "server busy" || ep.RetryAfterMs <= 0 {
+					t.Errorf("unexpected error %d %q retry %d", ep.Code, ep.Message, ep.RetryAfterMs)
+				}
+				busy++
+			}
+		}
+	}
+	// the burst plus at most a token or two refilled while sending
+	if pongs < 5 || pongs > 7 || pongs+busy != clients*perClient {
+		t.Errorf("expected aggregate throughput capped near 5, got %d pongs and %d busy", pongs, busy)
 	}
 }
 
-func TestServerWebSocketRegister(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerAdminPeerRecentErrors(t *testing.T) {
+	cfg := config.Default()
+	cfg.RateLimitPerSec = 1
+	cfg.RateLimitBurst = 1
+	cfg.AdminToken = "secret"
+	_, ts := newTestServerWithConfig(cfg)
 	defer ts.Close()
 
-	conn, fp := connectAndRegister(t, ts.URL, "test-public-key-1")
+	conn, fp := connectAndRegister(t, ts.URL, "admin-detail-key")
 	defer conn.CloseNow()
 
-	expectedFP := sha256Hex("test-public-key-1")
-	if fp != expectedFP {
-		t.Errorf("expected fingerprint %s, got %s", expectedFP, fp)
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	readMessage(t, conn, 2*time.Second)
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	if msg := readMessage(t, conn, 2*time.Second); msg.Type != protocol.TypeError {
+		t.Fatalf("expected rate limit error, got %s", msg.Type)
 	}
-}
-
-func TestServerRegisterMissingPublicKey(t *testing.T) {
-	_, ts := newTestServerSimple()
-	defer ts.Close()
 
-	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
-	conn, _, err := websocket.Dial(context.Background(), url, nil)
-	if err != nil {
-		t.Fatalf("dial error: %v", err)
+	get := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/peer/"+fp, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("admin request error: %v", err)
+		}
+		return resp
 	}
-	defer conn.CloseNow()
 
-	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: ""})
-	regMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
-	conn.Write(context.Background(), websocket.MessageText, regMsg)
+	if resp := get(""); resp.StatusCode != http.StatusUnauthorized {
+		resp.Body.Close()
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
 
-	_, data, err := conn.Read(context.Background())
-	if err != nil {
-		t.Fatalf("read error: %v", err)
+	resp := get("secret")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
 	}
-	msg, _ := protocol.Decode(data)
-	if msg.Type != protocol.TypeError {
-		t.Errorf("expected error, got %s", msg.Type)
+	var detail struct {
+		Fingerprint  string `json:"fingerprint"`
+		RecentErrors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"recent_errors"`
+	}
+	json.NewDecoder(resp.Body).Decode(&detail)
+	if detail.Fingerprint != fp {
+		t.Errorf("expected fingerprint %s, got %s", fp, detail.Fingerprint)
+	}
+	if n := len(detail.RecentErrors); n == 0 || detail.RecentErrors[n-1].Code != 429 {
+		t.Errorf("expected the rate limit error in recent_errors, got %+v", detail.RecentErrors)
 	}
 }
 
-func TestServerRegisterInvalidFirstMessage(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerAdminMatchmaker(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	srv, ts := newTestServerWithConfig(cfg)
 	defer ts.Close()
+	defer srv.hub.Shutdown()
+
+	for i, mode := range []string{"ranked", "ranked", "casual"} {
+		conn, _ := connectAndRegister(t, ts.URL, fmt.Sprintf("mm-key-%d", i))
+		defer conn.CloseNow()
+		payload, _ := json.Marshal(protocol.MatchPayload{Namespace: "game", GroupSize: 3, Criteria: map[string]interface{}{"mode": mode}})
+		sendMessage(t, conn, &protocol.Message{Type: protocol.TypeMatch, Payload: payload})
+		readMessage(t, conn, time.Second) // waiting
+	}
 
-	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
-	conn, _, err := websocket.Dial(context.Background(), url, nil)
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/matchmaker", nil)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("dial error: %v", err)
+		t.Fatalf("admin request error: %v", err)
 	}
-	defer conn.CloseNow()
-
-	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "test"})
-	joinMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload})
-	conn.Write(context.Background(), websocket.MessageText, joinMsg)
-
-	_, data, err := conn.Read(context.Background())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("read error: %v", err)
+		t.Fatalf("admin request error: %v", err)
 	}
-	msg, _ := protocol.Decode(data)
-	if msg.Type != protocol.TypeError {
-		t.Errorf("expected error, got %s", msg.Type)
+	defer resp.Body.Close()
+	var body struct {
+		Buckets []struct {
+			Namespace   string `json:"namespace"`
+			CriteriaKey string `json:"criteria_key"`
+			Waiting     int    `json:"waiting"`
+		} `json:"buckets"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if len(body.Buckets) != 2 {
+		t.Fatalf("expected 2 buckets, got %+v", body.Buckets)
+	}
+	if b := body.Buckets[0]; b.Namespace != "game" || b.CriteriaKey != "3:mode=casual" || b.Waiting != 1 {
+		t.Errorf("unexpected casual bucket %+v", b)
+	}
+	if b := body.Buckets[1]; b.CriteriaKey != "3:mode=ranked" || b.Waiting != 2 {
+		t.Errorf("unexpected ranked bucket %+v", b)
 	}
 }
 
-func TestServerFullFlow(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerAdminReconnectAll(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	srv, ts := newTestServerWithConfig(cfg)
 	defer ts.Close()
+	defer srv.hub.Shutdown()
 
-	conn1, _ := connectAndRegister(t, ts.URL, "key1")
-	defer conn1.CloseNow()
-	conn2, _ := connectAndRegister(t, ts.URL, "key2")
-	defer conn2.CloseNow()
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conns[i], _ = connectAndRegister(t, ts.URL, fmt.Sprintf("reconnect-key-%d", i))
+		defer conns[i].CloseNow()
+	}
 
-	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "lobby", AppType: "game"})
-	joinMsg := &protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}
+	post := func(query string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/reconnect-all"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("admin request error: %v", err)
+		}
+		return resp
+	}
+	resp := post("?jitter=soon")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid jitter, got %d", resp.StatusCode)
+	}
 
-	sendMessage(t, conn1, joinMsg)
-	msg1 := readMessage(t, conn1, 2*time.Second)
-	if msg1.Type != protocol.TypePeerList {
-		t.Errorf("expected peer_list, got %s", msg1.Type)
+	resp = post("?jitter=50ms&grace=100ms&reason=upgrade")
+	var body struct {
+		Peers int `json:"peers"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if body.Peers != 2 {
+		t.Fatalf("expected 2 peers asked, got %d", body.Peers)
 	}
 
-	sendMessage(t, conn2, joinMsg)
-	msg2 := readMessage(t, conn2, 2*time.Second)
-	if msg2.Type != protocol.TypePeerList {
-		t.Errorf("expected peer_list, got %s", msg2.Type)
+	for _, conn := range conns {
+		msg := readMessage(t, conn, time.Second)
+		var rp protocol.ReconnectPayload
+		json.Unmarshal(msg.Payload, &rp)
+		if msg.Type != protocol.TypeReconnect || rp.Reason != "upgrade" || rp.DelayMs < 0 || rp.DelayMs >= 50 {
+			t.Fatalf("unexpected reconnect %s %+v", msg.Type, rp)
+		}
 	}
 
-	msg3 := readMessage(t, conn1, 2*time.Second)
-	if msg3.Type != protocol.TypePeerJoined {
-		t.Errorf("expected peer_joined, got %s", msg3.Type)
+	// neither reconnected, so both are closed once the grace runs out
+	for _, conn := range conns {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, _, err := conn.Read(ctx)
+		cancel()
+		if websocket.CloseStatus(err) != protocol.CloseReconnect {
+			t.Errorf("expected reconnect close, got %v", err)
+		}
 	}
 }
 
-func TestServerSignalFlow(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerAdminCleanup(t *testing.T) {
+	cfg := config.Default()
+	cfg.AdminToken = "secret"
+	h := hub.NewWithOptions(cfg.ShardCount, cfg.MaxPeers, broker.NewLocal(), hub.Options{RestoredRoomGrace: time.Millisecond})
+	ts := httptest.NewServer(New(cfg, h).routes())
 	defer ts.Close()
+	defer h.Shutdown()
+
+	h.RestoreRooms([]hub.RoomSnapshot{{ID: "room-a"}, {ID: "room-b"}, {ID: "room-c"}})
+	time.Sleep(5 * time.Millisecond)
+
+	post := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/cleanup", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("admin request error: %v", err)
+		}
+		return resp
+	}
 
-	conn1, fp1 := connectAndRegister(t, ts.URL, "signal-key1")
-	defer conn1.CloseNow()
-	conn2, fp2 := connectAndRegister(t, ts.URL, "signal-key2")
-	defer conn2.CloseNow()
-
-	joinPayload, _ := json.Marshal(protocol.JoinPayload{Namespace: "signal-ns", AppType: "game"})
-	joinMsg := &protocol.Message{Type: protocol.TypeJoin, Payload: joinPayload}
+	if resp := post(""); resp.StatusCode != http.StatusUnauthorized {
+		resp.Body.Close()
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
 
-	sendMessage(t, conn1, joinMsg)
-	readMessage(t, conn1, 2*time.Second)
+	for _, want := range []int{3, 0} {
+		resp := post("secret")
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		var body struct {
+			Removed int `json:"removed"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if body.Removed != want {
+			t.Errorf("expected %d removed, got %d", want, body.Removed)
+		}
+	}
+	if n := len(h.NamespaceStats()); n != 0 {
+		t.Errorf("expected no namespaces left, got %d", n)
+	}
+}
 
-	sendMessage(t, conn2, joinMsg)
-	readMessage(t, conn2, 2*time.Second)
-	readMessage(t, conn1, 2*time.Second)
+// rawWSDial opens a websocket by hand so a test can see control frames the
+// websocket package answers invisibly.
+func rawWSDial(t *testing.T, tsURL string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(tsURL, "http://"))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", conn.RemoteAddr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v %v", err, resp)
+	}
+	return conn, br
+}
 
-	signalPayload, _ := json.Marshal(protocol.SignalPayload{SignalType: "offer", SDP: "test-sdp"})
-	signalMsg := &protocol.Message{Type: protocol.TypeSignal, To: fp2, Payload: signalPayload}
-	sendMessage(t, conn1, signalMsg)
+// rawWSWriteText sends a masked text frame; a zero mask key leaves the
+// payload as is.
+func rawWSWriteText(conn net.Conn, payload []byte) error {
+	frame := []byte{0x81}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	_, err := conn.Write(append(frame, payload...))
+	return err
+}
 
-	received := readMessage(t, conn2, 2*time.Second)
-	if received.Type != protocol.TypeSignal {
-		t.Errorf("expected signal, got %s", received.Type)
+func rawWSReadFrame(r *bufio.Reader) (opcode byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
 	}
-	if received.From != fp1 {
-		t.Errorf("expected from %s, got %s", fp1, received.From)
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return 0, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
 	}
+	_, err = r.Discard(int(n))
+	return hdr[0] & 0x0f, err
 }
 
-func TestServerRoomFlow(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerWriteBatchMaxLetsPingThrough(t *testing.T) {
+	cfg := config.Default()
+	cfg.SendBufferSize = 4096
+	cfg.WriteBatchMax = 4
+	cfg.PingInterval = config.Duration{Duration: 50 * time.Millisecond}
+	srv, ts := newTestServerWithConfig(cfg)
 	defer ts.Close()
 
-	conn1, _ := connectAndRegister(t, ts.URL, "room-owner-key")
-	defer conn1.CloseNow()
-	conn2, _ := connectAndRegister(t, ts.URL, "room-joiner-key")
-	defer conn2.CloseNow()
-
-	createPayload, _ := json.Marshal(protocol.CreateRoomPayload{RoomID: "test-room", MaxSize: 10})
-	sendMessage(t, conn1, &protocol.Message{Type: protocol.TypeCreateRoom, Payload: createPayload})
+	conn, br := rawWSDial(t, ts.URL)
+	defer conn.Close()
+	regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: "batch-key"})
+	regMsg, _ := protocol.Encode(&protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+	if err := rawWSWriteText(conn, regMsg); err != nil {
+		t.Fatalf("write register: %v", err)
+	}
+	if op, err := rawWSReadFrame(br); err != nil || op != 0x1 {
+		t.Fatalf("expected registered text frame, got op %d err %v", op, err)
+	}
 
-	msg := readMessage(t, conn1, 2*time.Second)
-	if msg.Type != protocol.TypeRoomCreated {
-		t.Errorf("expected room_created, got %s", msg.Type)
+	p, ok := srv.hub.GetPeer(generateFingerprint("", "batch-key"))
+	if !ok {
+		t.Fatal("peer not registered")
+	}
+	// a backlog far larger than the socket buffers, so the writer is still
+	// busy with it when the ping ticker fires
+	filler := []byte(`"` + strings.Repeat("x", 16<<10) + `"`)
+	backlog := cap(p.Send) - 1
+	for i := 0; i < backlog; i++ {
+		if err := p.SendRaw(filler); err != nil {
+			t.Fatalf("queue filler %d: %v", i, err)
+		}
 	}
+	time.Sleep(3 * cfg.PingInterval.Duration)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for frames := 0; ; frames++ {
+		op, err := rawWSReadFrame(br)
+		if err != nil {
+			t.Fatalf("read error after %d frames: %v", frames, err)
+		}
+		if op == 0x9 {
+			if frames > backlog/4 {
+				t.Errorf("ping came only after %d of %d queued frames", frames, backlog)
+			}
+			return
+		}
+	}
+}
 
-	joinPayload, _ := json.Marshal(protocol.JoinRoomPayload{RoomID: "test-room"})
-	sendMessage(t, conn2, &protocol.Message{Type: protocol.TypeJoinRoom, Payload: joinPayload})
+func TestServerMaxMessagesPerConnection(t *testing.T) {
+	cfg := config.Default()
+	cfg.MaxMessagesPerConnection = 3
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
 
-	msg = readMessage(t, conn2, 2*time.Second)
-	if msg.Type != protocol.TypePeerList {
-		t.Errorf("expected peer_list, got %s", msg.Type)
+	conn, _ := connectAndRegister(t, ts.URL, "quota-key")
+	defer conn.CloseNow()
+
+	for i := 0; i < 3; i++ {
+		sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+		if msg := readMessage(t, conn, 2*time.Second); msg.Type != protocol.TypePong {
+			t.Fatalf("message %d: expected pong, got %s", i+1, msg.Type)
+		}
 	}
 
-	msg = readMessage(t, conn1, 2*time.Second)
-	if msg.Type != protocol.TypePeerJoined {
-		t.Errorf("expected peer_joined, got %s", msg.Type)
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	msg := readMessage(t, conn, 2*time.Second)
+	var ep protocol.ErrorPayload
+	json.Unmarshal(msg.Payload, &ep)
+	if msg.Type != protocol.TypeError || ep.Code != 429 {
+		t.Fatalf("expected 429 after quota, got %s %d", msg.Type, ep.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, _, err := conn.Read(ctx); websocket.CloseStatus(err) != protocol.CloseQuotaExceeded {
+		t.Errorf("expected quota exceeded close, got %v", err)
 	}
 }
 
-func TestServerPing(t *testing.T) {
-	_, ts := newTestServerSimple()
+func TestServerShutdownCancelsMatchRequests(t *testing.T) {
+	srv, ts := newTestServerSimple()
 	defer ts.Close()
 
-	conn, _ := connectAndRegister(t, ts.URL, "ping-key")
+	conn, _ := connectAndRegister(t, ts.URL, "drain-key")
 	defer conn.CloseNow()
 
-	sendMessage(t, conn, &protocol.Message{Type: protocol.TypePing})
+	matchPayload, _ := json.Marshal(protocol.MatchPayload{Namespace: "lobby", GroupSize: 2})
+	sendMessage(t, conn, &protocol.Message{Type: protocol.TypeMatch, Payload: matchPayload})
+	if msg := readMessage(t, conn, 2*time.Second); msg.Type != protocol.TypeMatch {
+		t.Fatalf("expected waiting status, got %s", msg.Type)
+	}
+
+	srv.Shutdown()
+
 	msg := readMessage(t, conn, 2*time.Second)
-	if msg.Type != protocol.TypePong {
-		t.Errorf("expected pong, got %s", msg.Type)
+	if msg.Type != protocol.TypeMatchCancel {
+		t.Fatalf("expected match_cancelled, got %s", msg.Type)
+	}
+	var mc protocol.MatchCancelledPayload
+	json.Unmarshal(msg.Payload, &mc)
+	if mc.Namespace != "lobby" || mc.Reason != "server draining" {
+		t.Errorf("unexpected cancellation payload: %+v", mc)
 	}
 }
 
@@ -394,23 +1565,78 @@ func TestServerBroadcastFlow(t *testing.T) {
 }
 
 func TestGenerateFingerprint(t *testing.T) {
-	fp := generateFingerprint("test-key")
+	fp := generateFingerprint("", "test-key")
 	expected := sha256Hex("test-key")
 	if fp != expected {
 		t.Errorf("expected %s, got %s", expected, fp)
 	}
 
-	fp2 := generateFingerprint("test-key")
+	fp2 := generateFingerprint("", "test-key")
 	if fp != fp2 {
 		t.Error("fingerprint should be deterministic")
 	}
 
-	fp3 := generateFingerprint("other-key")
+	fp3 := generateFingerprint("", "other-key")
 	if fp == fp3 {
 		t.Error("different keys should produce different fingerprints")
 	}
 }
 
+func TestGenerateFingerprintSalt(t *testing.T) {
+	salted := generateFingerprint("deploy-a", "test-key")
+	if salted != sha256Hex("deploy-a:test-key") {
+		t.Errorf("expected sha256 of salt:key, got %s", salted)
+	}
+	if salted != generateFingerprint("deploy-a", "test-key") {
+		t.Error("salted fingerprint should be stable")
+	}
+	if salted == generateFingerprint("deploy-b", "test-key") {
+		t.Error("different salts should produce different fingerprints")
+	}
+	if salted == generateFingerprint("", "test-key") {
+		t.Error("a salted fingerprint should differ from the unsalted one")
+	}
+}
+
+func TestServerRegisterIdentity(t *testing.T) {
+	_, ts := newTestServerSimple()
+	defer ts.Close()
+
+	register := func(key, identityKey string) protocol.RegisteredPayload {
+		t.Helper()
+		conn, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: key, IdentityKey: identityKey}, nil)
+		t.Cleanup(func() { conn.CloseNow() })
+		var rp protocol.RegisteredPayload
+		json.Unmarshal(msg.Payload, &rp)
+		return rp
+	}
+	phone := register("phone-key", "alice-secret")
+	laptop := register("laptop-key", "alice-secret")
+	other := register("other-key", "bob-secret")
+	if phone.Identity == "" || phone.Identity != laptop.Identity {
+		t.Errorf("expected devices with one identity key to share an identity, got %q and %q", phone.Identity, laptop.Identity)
+	}
+	if phone.Fingerprint == laptop.Fingerprint || other.Identity == phone.Identity {
+		t.Error("expected distinct fingerprints and identities")
+	}
+	if none := register("plain-key", ""); none.Identity != "" {
+		t.Errorf("expected no identity without an identity key, got %q", none.Identity)
+	}
+}
+
+func TestServerFingerprintSalt(t *testing.T) {
+	cfg := config.Default()
+	cfg.FingerprintSalt = "deploy-a"
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	conn, fp := connectAndRegister(t, ts.URL, "salted-key")
+	defer conn.CloseNow()
+	if fp != generateFingerprint("deploy-a", "salted-key") {
+		t.Errorf("expected the salted fingerprint, got %s", fp)
+	}
+}
+
 func TestGenerateAlias(t *testing.T) {
 	alias := generateAlias("some-fingerprint")
 	if alias == "" {
@@ -447,3 +1673,249 @@ func TestCompressionMode(t *testing.T) {
 		t.Error("expected CompressionContextTakeover")
 	}
 }
+
+func TestCompressionModeConfig(t *testing.T) {
+	b := broker.NewLocal()
+	h := hub.New(64, 100, b)
+	defer h.Shutdown()
+
+	tests := []struct {
+		mode    string
+		enabled bool
+		want    websocket.CompressionMode
+	}{
+		{"disabled", true, websocket.CompressionDisabled},
+		{"no_context_takeover", false, websocket.CompressionNoContextTakeover},
+		{"context_takeover", false, websocket.CompressionContextTakeover},
+		{"", true, websocket.CompressionContextTakeover},
+		{"", false, websocket.CompressionDisabled},
+		{"bogus", false, websocket.CompressionDisabled},
+	}
+	for _, tt := range tests {
+		cfg := config.Default()
+		cfg.CompressionMode = tt.mode
+		cfg.CompressionEnabled = tt.enabled
+		srv := New(cfg, h)
+		if got := srv.compressionMode(); got != tt.want {
+			t.Errorf("mode %q enabled %v: expected %v, got %v", tt.mode, tt.enabled, tt.want, got)
+		}
+	}
+}
+
+func TestServerStatsCompressedConnections(t *testing.T) {
+	cfg := config.Default()
+	cfg.CompressionEnabled = true
+	_, ts := newTestServerWithConfig(cfg)
+	defer ts.Close()
+
+	compressing, msg := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "deflate-key"}, &websocket.DialOptions{CompressionMode: websocket.CompressionContextTakeover})
+	defer compressing.CloseNow()
+	plain, msg2 := connectAndRegisterWith(t, ts.URL, protocol.RegisterPayload{PublicKey: "plain-key"}, &websocket.DialOptions{CompressionMode: websocket.CompressionDisabled})
+	defer plain.CloseNow()
+	if msg.Type != protocol.TypeRegistered || msg2.Type != protocol.TypeRegistered {
+		t.Fatalf("expected both registered, got %s and %s", msg.Type, msg2.Type)
+	}
+
+	resp, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatalf("stats request error: %v", err)
+	}
+	defer resp.Body.Close()
+	var stats Stats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	if stats.TotalPeers != 2 || stats.CompressedConnections != 1 {
+		t.Errorf("expected 1 of 2 connections compressed, got %d of %d", stats.CompressedConnections, stats.TotalPeers)
+	}
+}
+
+// writeSelfSignedCert writes a throwaway localhost certificate and key into
+// dir and returns their paths.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certPath, keyPath
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServerPlainAndTLSListeners(t *testing.T) {
+	cfg := config.Default()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.TLSPort = freePort(t)
+	cfg.TLSCert, cfg.TLSKey = writeSelfSignedCert(t, t.TempDir())
+	cfg.MetricsEnabled = true
+	cfg.MetricsPort = freePort(t)
+
+	h := hub.New(cfg.ShardCount, cfg.MaxPeers, broker.NewLocal())
+	srv := New(cfg, h)
+	started := make(chan error, 1)
+	go func() { started <- srv.Start() }()
+
+	tlsClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	endpoints := []struct {
+		url  string
+		opts *websocket.DialOptions
+	}{
+		{fmt.Sprintf("ws://127.0.0.1:%d/ws", cfg.Port), nil},
+		{fmt.Sprintf("wss://127.0.0.1:%d/ws", cfg.TLSPort), &websocket.DialOptions{HTTPClient: tlsClient}},
+	}
+
+	for i, ep := range endpoints {
+		var conn *websocket.Conn
+		var err error
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			conn, _, err = websocket.Dial(ctx, ep.url, ep.opts)
+			cancel()
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("dial %s: %v", ep.url, err)
+		}
+
+		regPayload, _ := json.Marshal(protocol.RegisterPayload{PublicKey: fmt.Sprintf("dual-listener-key-%d", i)})
+		sendMessage(t, conn, &protocol.Message{Type: protocol.TypeRegister, Payload: regPayload})
+		if msg := readMessage(t, conn, 2*time.Second); msg.Type != protocol.TypeRegistered {
+			t.Errorf("%s: expected registered, got %s", ep.url, msg.Type)
+		}
+		conn.CloseNow()
+	}
+
+	metricsURL := fmt.Sprintf("http://127.0.0.1:%d/metrics", cfg.MetricsPort)
+	resp, err := http.Get(metricsURL)
+	if err != nil {
+		t.Fatalf("metrics request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected metrics 200, got %d", resp.StatusCode)
+	}
+
+	srv.Shutdown()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("expected Start to return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Start did not return after Shutdown")
+	}
+	if resp, err := http.Get(metricsURL); err == nil {
+		resp.Body.Close()
+		t.Error("expected the metrics port to close on Shutdown")
+	}
+}
+
+func TestServerMetricsBindFailureKeepsServing(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cfg := config.Default()
+	cfg.Host = "127.0.0.1"
+	cfg.Port = freePort(t)
+	cfg.MetricsEnabled = true
+	cfg.MetricsPort = taken.Addr().(*net.TCPAddr).Port
+
+	h := hub.New(cfg.ShardCount, cfg.MaxPeers, broker.NewLocal())
+	srv := New(cfg, h)
+	started := make(chan error, 1)
+	go func() { started <- srv.Start() }()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d", cfg.Port)
+	var conn *websocket.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-started:
+			t.Fatalf("a metrics port already in use should not stop the server: %v", err)
+		default:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, _, err = websocket.Dial(ctx, "ws"+strings.TrimPrefix(url, "http")+"/ws", nil)
+		cancel()
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.CloseNow()
+
+	srv.Shutdown()
+	if err := <-started; err != nil {
+		t.Errorf("expected Start to return nil after Shutdown, got %v", err)
+	}
+}
+
+func TestServerTunedListener(t *testing.T) {
+	for _, keepAlive := range []time.Duration{30 * time.Second, -1} {
+		cfg := config.Default()
+		cfg.TCPKeepAlive = config.Duration{Duration: keepAlive}
+		cfg.TCPNoDelay = false
+		h := hub.New(cfg.ShardCount, cfg.MaxPeers, broker.NewLocal())
+		srv := New(cfg, h)
+
+		ln, err := srv.listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		if tl, ok := ln.(tunedListener); !ok || tl.noDelay {
+			t.Fatalf("expected a tuned listener with no_delay off, got %#v", ln)
+		}
+		httpSrv := &http.Server{Handler: srv.routes()}
+		go httpSrv.Serve(ln)
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/ping")
+		if err != nil {
+			t.Fatalf("keepalive %v: ping: %v", keepAlive, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "pong" {
+			t.Errorf("keepalive %v: expected pong, got %q", keepAlive, body)
+		}
+		httpSrv.Close()
+		h.Shutdown()
+	}
+}